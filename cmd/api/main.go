@@ -3,28 +3,65 @@ package main
 import (
 	"context"
 	"errors"
+	"fmt"
 	"log"
+	"net"
 	"net/http"
+	"net/mail"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
 
+	"github.com/fairhive-labs/preregister/internal/audit"
+	"github.com/fairhive-labs/preregister/internal/auth"
+	"github.com/fairhive-labs/preregister/internal/captcha"
+	"github.com/fairhive-labs/preregister/internal/clientip"
 	"github.com/fairhive-labs/preregister/internal/crypto"
 	"github.com/fairhive-labs/preregister/internal/crypto/cipher"
 	"github.com/fairhive-labs/preregister/internal/data"
+	"github.com/fairhive-labs/preregister/internal/emailcheck"
+	"github.com/fairhive-labs/preregister/internal/ipfilter"
 	"github.com/fairhive-labs/preregister/internal/limiter"
 	"github.com/fairhive-labs/preregister/internal/mailer"
+	"github.com/fairhive-labs/preregister/internal/outbox"
+	"github.com/fairhive-labs/preregister/internal/pending"
+)
+
+// emailPolicy defines how repeated emails are handled during registration and activation
+type emailPolicy string
+
+const (
+	allowDuplicateEmail  emailPolicy = "allow"
+	warnDuplicateEmail   emailPolicy = "warn"
+	rejectDuplicateEmail emailPolicy = "reject"
 )
 
 type App struct {
 	db                 data.DB
 	jwt                crypto.Token
 	mailer             mailer.Mailer
+	templates          *mailer.TemplateMailer // previews, bypassing throttling and outbox
 	wg                 sync.WaitGroup
-	rl                 *limiter.RateLimiter
+	rl                 limiter.Limiter
+	policies           ratePolicies
+	ips                *clientip.Resolver
+	ipf                *ipfilter.Filter
+	allowlist          bool // admin routes require the allow list
+	captcha            captcha.Verifier
+	pow                *crypto.PoW
+	emails             *emailcheck.Checker
+	outbox             *outbox.Outbox
+	pending            *pending.Tracker
+	lo                 *limiter.Lockout
 	secpath1, secpath2 string
+	ep                 emailPolicy
+	recipient          string
+	auth               auth.Authenticator
+	audit              audit.Sink
 }
 
 var (
@@ -32,6 +69,37 @@ var (
 	tableName          = "Waitlist"
 	ek                 string
 	secpath1, secpath2 string
+	dupPolicy          = allowDuplicateEmail
+	exportRecipient    string
+	authenticator      auth.Authenticator
+	auditSink          audit.Sink
+	lockoutFailures    = 5
+	lockoutBackoff     = time.Minute
+	lockoutMaxBackoff  = time.Hour
+	rateLimiter        limiter.Limiter
+	limiterFactory     limiter.Factory
+	ipResolver         *clientip.Resolver
+	ipFilter           *ipfilter.Filter
+	adminAllowlist     bool
+	captchaVerifier    captcha.Verifier
+	powChallenges      *crypto.PoW
+	emailChecker       *emailcheck.Checker
+	emailCooldown      = 2 * time.Minute
+	emailDailyCap      = 5
+	mailTransport      mailer.Transport
+	mailFrom           = &mail.Address{Address: mailer.DefaultFrom}
+	mailReplyTo        *mail.Address
+	mailUnsubscribe    []string
+	mailDKIM           *mailer.DKIM
+	outboxStore        outbox.Store
+	outboxWorkers      = 2
+	outboxMaxAttempts  = 8
+	outboxBackoff      = 30 * time.Second
+	outboxMaxBackoff   = time.Hour
+	outboxRetention    = 7 * 24 * time.Hour
+	pendingStore       pending.Store
+	reminderDelay      = 24 * time.Hour
+	pendingRetention   = 30 * 24 * time.Hour
 )
 
 func setup() {
@@ -49,19 +117,435 @@ func setup() {
 	}
 	log.Printf("💾 DynamoDB Table is %q\n", tableName)
 
-	ek = os.Getenv("FAIRHIVE_ENCRYPTION_KEY")
-	if ek == "" {
-		panic("encryption key is missing")
+	var kp cipher.KeyProvider
+	switch p := os.Getenv("FAIRHIVE_KEY_PROVIDER"); p {
+	case "", "env":
+		kp = cipher.StaticKeyProvider(os.Getenv("FAIRHIVE_ENCRYPTION_KEY"))
+	case "file":
+		kp = cipher.NewFileKeyProvider(os.Getenv("FAIRHIVE_ENCRYPTION_KEY_FILE"))
+	case "kms":
+		kms := cipher.NewAWSKMS(os.Getenv("FAIRHIVE_KMS_KEY_ID"))
+		kp = cipher.NewKMSKeyProvider(kms, os.Getenv("FAIRHIVE_WRAPPED_ENCRYPTION_KEY"))
+	default:
+		panic(fmt.Sprintf("unsupported key provider %q", p))
+	}
+	var err error
+	if ek, err = kp.DataKey(); err != nil {
+		panic(fmt.Sprintf("encryption key is missing: %v", err))
 	}
 	log.Println("🔑 Encryption Key: OK")
 
-	secpath1 = os.Getenv("FAIRHIVE_API_SECURE_PATH1")
-	if secpath1 == "" {
-		panic("secure path #1 must be set")
+	var as []auth.Authenticator
+	if k := os.Getenv("FAIRHIVE_ADMIN_API_KEYS"); k != "" {
+		ak, err := auth.NewAPIKeys(k)
+		if err != nil {
+			panic(err)
+		}
+		as = append(as, ak)
+	}
+	if f := os.Getenv("FAIRHIVE_OIDC_JWKS_FILE"); f != "" {
+		o, err := auth.LoadOIDC(f, os.Getenv("FAIRHIVE_OIDC_ISSUER"), os.Getenv("FAIRHIVE_OIDC_AUDIENCE"))
+		if err != nil {
+			panic(err)
+		}
+		as = append(as, o)
+	}
+	authenticator = auth.Chain(as...)
+	log.Printf("🛂 Admin Authenticators: %d\n", len(as))
+
+	switch s := os.Getenv("FAIRHIVE_AUDIT_SINK"); s {
+	case "", "file":
+		f := os.Getenv("FAIRHIVE_AUDIT_FILE")
+		if f == "" {
+			f = "audit.jsonl"
+		}
+		auditSink = audit.NewFileSink(f)
+		log.Printf("📜 Audit Log is file %q\n", f)
+	case "dynamodb":
+		tn := os.Getenv("FAIRHIVE_AUDIT_TABLE_NAME")
+		as, err := audit.NewDynamoDBSink(tn)
+		if err != nil {
+			panic(err)
+		}
+		auditSink = as
+		log.Printf("📜 Audit Log is DynamoDB Table %q\n", tn)
+	default:
+		panic(fmt.Sprintf("unsupported audit sink %q", s))
+	}
+
+	var proxies []string
+	if p := os.Getenv("FAIRHIVE_TRUSTED_PROXIES"); p != "" {
+		proxies = strings.Split(p, ",")
+	}
+	platforms := strings.Split(os.Getenv("FAIRHIVE_TRUSTED_PLATFORMS"), ",")
+	if ipResolver, err = clientip.New(proxies, platforms...); err != nil {
+		panic(fmt.Sprintf("invalid trusted proxies: %v", err))
+	}
+	log.Printf("🌐 Trusted Proxies: %d, Platforms: %q\n", len(proxies), os.Getenv("FAIRHIVE_TRUSTED_PLATFORMS"))
+
+	var geo ipfilter.CountryLookup
+	if db := os.Getenv("FAIRHIVE_GEOIP_DB"); db != "" {
+		m, err := ipfilter.OpenMaxMind(db)
+		if err != nil {
+			panic(err)
+		}
+		geo = m
+		log.Printf("🗺️ GeoIP Database is %q\n", db)
+	}
+	ipFilter = nil
+	if f := os.Getenv("FAIRHIVE_IP_FILTER_FILE"); f != "" {
+		if ipFilter, err = ipfilter.Load(f, geo); err != nil {
+			panic(err)
+		}
+		log.Printf("🧱 IP Filter is file %q\n", f)
+	}
+	adminAllowlist = os.Getenv("FAIRHIVE_ADMIN_REQUIRE_ALLOWLIST") == "true"
+	if adminAllowlist {
+		if ipFilter == nil {
+			panic("admin allow list requires an IP filter file")
+		}
+		log.Println("🧱 Admin routes require the allow list")
+	}
+
+	switch l := os.Getenv("FAIRHIVE_RATE_LIMITER"); l {
+	case "", "memory":
+		rateLimiter = limiter.New(0.1, 10)
+		limiterFactory = limiter.NewFactory()
+		log.Println("🚧 Rate Limiter is in memory")
+	case "redis":
+		limit, window := 10, 100*time.Second
+		if v := os.Getenv("FAIRHIVE_RATE_LIMIT"); v != "" {
+			if limit, err = strconv.Atoi(v); err != nil || limit < 1 {
+				panic(fmt.Sprintf("invalid rate limit %q", v))
+			}
+		}
+		if v := os.Getenv("FAIRHIVE_RATE_WINDOW"); v != "" {
+			if window, err = time.ParseDuration(v); err != nil || window < time.Millisecond {
+				panic(fmt.Sprintf("invalid rate window %q", v))
+			}
+		}
+		rl, err := limiter.NewRedisLimiter(os.Getenv("FAIRHIVE_REDIS_URL"), limit, window)
+		if err != nil {
+			panic(err)
+		}
+		rateLimiter = rl
+		limiterFactory = rl.Factory()
+		log.Printf("🚧 Rate Limiter is Redis, %d requests per %v\n", limit, window)
+	default:
+		panic(fmt.Sprintf("unsupported rate limiter %q", l))
+	}
+
+	if f := os.Getenv("FAIRHIVE_ADMIN_LOCKOUT_FAILURES"); f != "" {
+		if lockoutFailures, err = strconv.Atoi(f); err != nil || lockoutFailures < 1 {
+			panic(fmt.Sprintf("invalid admin lockout failures %q", f))
+		}
+	}
+	if b := os.Getenv("FAIRHIVE_ADMIN_LOCKOUT_BACKOFF"); b != "" {
+		if lockoutBackoff, err = time.ParseDuration(b); err != nil || lockoutBackoff <= 0 {
+			panic(fmt.Sprintf("invalid admin lockout backoff %q", b))
+		}
+	}
+	if b := os.Getenv("FAIRHIVE_ADMIN_LOCKOUT_MAX_BACKOFF"); b != "" {
+		if lockoutMaxBackoff, err = time.ParseDuration(b); err != nil || lockoutMaxBackoff < lockoutBackoff {
+			panic(fmt.Sprintf("invalid admin lockout max backoff %q", b))
+		}
+	}
+	log.Printf("🔒 Admin Lockout after %d failures, for %v up to %v\n", lockoutFailures, lockoutBackoff, lockoutMaxBackoff)
+
+	captchaVerifier = nil
+	switch p := os.Getenv("FAIRHIVE_CAPTCHA_PROVIDER"); p {
+	case "", "none":
+		log.Println("⚠️ CAPTCHA verification is disabled")
+	case "fake": // development only, the secret is the only valid token
+		captchaVerifier = captcha.Fake(os.Getenv("FAIRHIVE_CAPTCHA_SECRET"))
+		log.Println("🤖 CAPTCHA Provider is fake")
+	default:
+		v, err := captcha.New(p, os.Getenv("FAIRHIVE_CAPTCHA_SECRET"))
+		if err != nil {
+			panic(fmt.Sprintf("invalid captcha provider %q: %v", p, err))
+		}
+		if ms := os.Getenv("FAIRHIVE_CAPTCHA_MIN_SCORE"); ms != "" {
+			if v.MinScore, err = strconv.ParseFloat(ms, 64); err != nil || v.MinScore < 0 || v.MinScore > 1 {
+				panic(fmt.Sprintf("invalid captcha min score %q", ms))
+			}
+		}
+		captchaVerifier = v
+		log.Printf("🤖 CAPTCHA Provider is %q\n", p)
+	}
+
+	powChallenges = nil
+	if d := os.Getenv("FAIRHIVE_POW_DIFFICULTY"); d != "" && d != "0" {
+		bits, err := strconv.Atoi(d)
+		if err != nil || bits < 1 || bits > 64 {
+			panic(fmt.Sprintf("invalid proof of work difficulty %q", d))
+		}
+		s := os.Getenv("FAIRHIVE_POW_SECRET") // shared by all the instances
+		_, shared := rateLimiter.(*limiter.RedisLimiter)
+		switch {
+		case s == "" && shared:
+			panic("proof of work secret is missing, it must be shared by the instances")
+		case s == "":
+			s, _ = cipher.GenerateKey(32)
+			log.Println("⚠️ Proof of work secret is random: challenges are only valid on this instance until it restarts, set FAIRHIVE_POW_SECRET")
+		}
+		ttl := 5 * time.Minute
+		if t := os.Getenv("FAIRHIVE_POW_TTL"); t != "" {
+			if ttl, err = time.ParseDuration(t); err != nil || ttl <= 0 {
+				panic(fmt.Sprintf("invalid proof of work ttl %q", t))
+			}
+		}
+		powChallenges = crypto.NewPoW(s, bits, ttl)
+		if rl, ok := rateLimiter.(*limiter.RedisLimiter); ok {
+			powChallenges.ShareUsed(rl.Set("pow:"))
+			log.Println("🧮 Solved challenges are shared in Redis")
+		}
+		if th := os.Getenv("FAIRHIVE_POW_LOAD_THRESHOLD"); th != "" {
+			threshold, err := strconv.Atoi(th)
+			if err != nil || threshold < 0 {
+				panic(fmt.Sprintf("invalid proof of work load threshold %q", th))
+			}
+			maxBits := bits + 4
+			if m := os.Getenv("FAIRHIVE_POW_MAX_DIFFICULTY"); m != "" {
+				if maxBits, err = strconv.Atoi(m); err != nil || maxBits < bits || maxBits > 64 {
+					panic(fmt.Sprintf("invalid proof of work max difficulty %q", m))
+				}
+			}
+			powChallenges.AdjustUnderLoad(threshold, maxBits)
+			log.Printf("🧮 Proof of Work difficulty is %d bits, up to %d above %d challenges/min\n", bits, maxBits, threshold)
+		} else {
+			log.Printf("🧮 Proof of Work difficulty is %d bits\n", bits)
+		}
+	}
+
+	emailChecker = nil
+	switch ec := os.Getenv("FAIRHIVE_EMAIL_CHECK"); ec {
+	case "off":
+		log.Println("⚠️ Email check is disabled")
+	case "", "on", "mx":
+		var r emailcheck.MXResolver
+		if ec == "mx" {
+			r = net.DefaultResolver
+		}
+		pt := emailcheck.PlusTagDomains
+		if d, ok := os.LookupEnv("FAIRHIVE_PLUS_TAG_DOMAINS"); ok {
+			pt = strings.FieldsFunc(d, func(r rune) bool { return r == ',' })
+		}
+		emailChecker = emailcheck.New(r, pt...)
+		if f := os.Getenv("FAIRHIVE_DISPOSABLE_DOMAINS_FILE"); f != "" {
+			if err := emailChecker.Load(f); err != nil {
+				panic(fmt.Sprintf("invalid disposable domains file %q: %v", f, err))
+			}
+		}
+		log.Printf("📮 Email Check: OK, MX verification %v, plus-tags removed for %d domains\n", r != nil, len(pt))
+	default:
+		panic(fmt.Sprintf("unsupported email check %q", ec))
+	}
+
+	if cd := os.Getenv("FAIRHIVE_EMAIL_COOLDOWN"); cd != "" {
+		if emailCooldown, err = time.ParseDuration(cd); err != nil || emailCooldown < 0 {
+			panic(fmt.Sprintf("invalid email cooldown %q", cd))
+		}
+	}
+	if dc := os.Getenv("FAIRHIVE_EMAIL_DAILY_CAP"); dc != "" {
+		if emailDailyCap, err = strconv.Atoi(dc); err != nil || emailDailyCap < 0 {
+			panic(fmt.Sprintf("invalid email daily cap %q", dc))
+		}
+	}
+	log.Printf("📨 Activation Emails: 1 per %v, %d per day per recipient\n", emailCooldown, emailDailyCap)
+	if _, ok := rateLimiter.(*limiter.RedisLimiter); ok {
+		log.Println("📨 Email limits are shared in Redis")
+	} else {
+		log.Println("⚠️ Email limits are kept in memory: each instance allows the cap and a restart resets it, set FAIRHIVE_RATE_LIMITER=redis to share them")
 	}
+
+	smtpUser := "" // the SMTP servers only accept emails from the authenticated user
+	switch t := os.Getenv("FAIRHIVE_MAIL_TRANSPORT"); t {
+	case "", "smtp":
+		host, port := "smtp.gmail.com", 587
+		if h := os.Getenv("FAIRHIVE_SMTP_HOST"); h != "" {
+			host = h
+		}
+		if p := os.Getenv("FAIRHIVE_SMTP_PORT"); p != "" {
+			if port, err = strconv.Atoi(p); err != nil || port <= 0 {
+				panic(fmt.Sprintf("invalid smtp port %q", p))
+			}
+		}
+		smtpUser = os.Getenv("FAIRHIVE_GSUITE_USER")
+		mailTransport = mailer.NewSMTPTransport(smtpUser, os.Getenv("FAIRHIVE_GSUITE_PASSWORD"), host, port)
+		log.Printf("✉️ Mail Transport is SMTP %s:%d\n", host, port)
+	case "ses":
+		mailTransport = mailer.NewSESTransport(os.Getenv("FAIRHIVE_SES_REGION"))
+		log.Println("✉️ Mail Transport is AWS SES")
+	case "http":
+		u := os.Getenv("FAIRHIVE_MAIL_API_URL")
+		if u == "" {
+			u = mailer.SendGridURL
+		}
+		k := os.Getenv("FAIRHIVE_MAIL_API_KEY")
+		if k == "" {
+			panic("mail API key is missing")
+		}
+		mailTransport = mailer.NewHTTPTransport(u, k)
+		log.Printf("✉️ Mail Transport is HTTP API %q\n", u)
+	case "file": // development only
+		d := os.Getenv("FAIRHIVE_MAIL_DIR")
+		if d == "" {
+			d = "maildir"
+		}
+		if mailTransport, err = mailer.NewFileTransport(d); err != nil {
+			panic(err)
+		}
+		log.Printf("✉️ Mail Transport is maildir %q\n", d)
+	default:
+		panic(fmt.Sprintf("unsupported mail transport %q", t))
+	}
+	mailFrom, mailReplyTo, mailUnsubscribe = &mail.Address{Address: mailer.DefaultFrom}, nil, nil
+	if smtpUser != "" {
+		mailFrom.Address = smtpUser
+	}
+	if f := os.Getenv("FAIRHIVE_MAIL_FROM"); f != "" {
+		if mailFrom, err = mail.ParseAddress(f); err != nil {
+			panic(fmt.Sprintf("invalid mail sender %q: %v", f, err))
+		}
+		if smtpUser != "" && !strings.EqualFold(mailFrom.Address, smtpUser) {
+			panic(fmt.Sprintf("mail sender %q differs from the SMTP user %q", mailFrom.Address, smtpUser))
+		}
+	}
+	if r := os.Getenv("FAIRHIVE_MAIL_REPLY_TO"); r != "" {
+		if mailReplyTo, err = mail.ParseAddress(r); err != nil {
+			panic(fmt.Sprintf("invalid mail reply-to %q: %v", r, err))
+		}
+	}
+	if u := os.Getenv("FAIRHIVE_MAIL_UNSUBSCRIBE"); u != "" {
+		for _, uri := range strings.Split(u, ",") {
+			uri = strings.TrimSpace(uri)
+			if !strings.HasPrefix(uri, "mailto:") && !strings.HasPrefix(uri, "https://") {
+				panic(fmt.Sprintf("invalid unsubscribe URI %q", uri))
+			}
+			mailUnsubscribe = append(mailUnsubscribe, uri)
+		}
+	}
+	log.Printf("✉️ Emails are sent from %s\n", mailFrom)
+
+	mailDKIM = nil
+	if sel := os.Getenv("FAIRHIVE_DKIM_SELECTOR"); sel != "" {
+		d := os.Getenv("FAIRHIVE_DKIM_DOMAIN")
+		if d == "" {
+			_, d, _ = strings.Cut(mailFrom.Address, "@")
+		}
+		k := []byte(os.Getenv("FAIRHIVE_DKIM_KEY"))
+		if f := os.Getenv("FAIRHIVE_DKIM_KEY_FILE"); f != "" {
+			if k, err = os.ReadFile(f); err != nil {
+				panic(fmt.Sprintf("cannot read DKIM key: %v", err))
+			}
+		}
+		if mailDKIM, err = mailer.NewDKIM(d, sel, k); err != nil {
+			panic(err)
+		}
+		log.Printf("🔏 Emails are DKIM signed, %s must publish %q\n", mailDKIM.Name(), mailDKIM.DNSRecord())
+		if _, ok := mailTransport.(*mailer.HTTPTransport); ok {
+			log.Println("⚠️ HTTP API emails are signed by the provider, DKIM key is ignored")
+		}
+	}
+
+	outboxStore = nil
+	switch o := os.Getenv("FAIRHIVE_OUTBOX"); o {
+	case "", "off":
+		log.Println("⚠️ Outbox is disabled, emails are sent directly")
+	case "memory":
+		outboxStore = outbox.NewMemoryStore()
+	case "file":
+		d := os.Getenv("FAIRHIVE_OUTBOX_DIR")
+		if d == "" {
+			d = "outbox"
+		}
+		if outboxStore, err = outbox.NewFileStore(d); err != nil {
+			panic(err)
+		}
+	case "dynamodb":
+		if outboxStore, err = outbox.NewDynamoDBStore(os.Getenv("FAIRHIVE_OUTBOX_TABLE_NAME")); err != nil {
+			panic(err)
+		}
+	default:
+		panic(fmt.Sprintf("unsupported outbox %q", o))
+	}
+	if outboxStore != nil {
+		if w := os.Getenv("FAIRHIVE_OUTBOX_WORKERS"); w != "" {
+			if outboxWorkers, err = strconv.Atoi(w); err != nil || outboxWorkers <= 0 {
+				panic(fmt.Sprintf("invalid outbox workers %q", w))
+			}
+		}
+		if a := os.Getenv("FAIRHIVE_OUTBOX_MAX_ATTEMPTS"); a != "" {
+			if outboxMaxAttempts, err = strconv.Atoi(a); err != nil || outboxMaxAttempts <= 0 {
+				panic(fmt.Sprintf("invalid outbox max attempts %q", a))
+			}
+		}
+		if b := os.Getenv("FAIRHIVE_OUTBOX_BACKOFF"); b != "" {
+			if outboxBackoff, err = time.ParseDuration(b); err != nil || outboxBackoff <= 0 {
+				panic(fmt.Sprintf("invalid outbox backoff %q", b))
+			}
+		}
+		if b := os.Getenv("FAIRHIVE_OUTBOX_MAX_BACKOFF"); b != "" {
+			if outboxMaxBackoff, err = time.ParseDuration(b); err != nil || outboxMaxBackoff < outboxBackoff {
+				panic(fmt.Sprintf("invalid outbox max backoff %q", b))
+			}
+		}
+		if r := os.Getenv("FAIRHIVE_OUTBOX_DEAD_RETENTION"); r != "" {
+			if outboxRetention, err = time.ParseDuration(r); err != nil || outboxRetention <= 0 {
+				panic(fmt.Sprintf("invalid outbox dead letters retention %q", r))
+			}
+		}
+		log.Printf("📬 Outbox is %T, %d workers, %d attempts with a backoff from %v to %v, dead letters kept for %v\n", outboxStore, outboxWorkers, outboxMaxAttempts, outboxBackoff, outboxMaxBackoff, outboxRetention)
+	}
+
+	pendingStore = nil
+	reminderDelay, pendingRetention = 24*time.Hour, 30*24*time.Hour
+	switch p := os.Getenv("FAIRHIVE_PENDING"); p {
+	case "", "off":
+		log.Println("⚠️ Pending registrations are not tracked, no reminder is sent")
+	case "memory":
+		pendingStore = pending.NewMemoryStore()
+	case "dynamodb":
+		if pendingStore, err = pending.NewDynamoDBStore(os.Getenv("FAIRHIVE_PENDING_TABLE_NAME")); err != nil {
+			panic(err)
+		}
+	default:
+		panic(fmt.Sprintf("unsupported pending registrations store %q", p))
+	}
+	if pendingStore != nil {
+		if d := os.Getenv("FAIRHIVE_REMINDER_DELAY"); d != "" {
+			if reminderDelay, err = time.ParseDuration(d); err != nil || reminderDelay <= 0 {
+				panic(fmt.Sprintf("invalid reminder delay %q", d))
+			}
+		}
+		if r := os.Getenv("FAIRHIVE_PENDING_RETENTION"); r != "" {
+			if pendingRetention, err = time.ParseDuration(r); err != nil || pendingRetention < reminderDelay {
+				panic(fmt.Sprintf("invalid pending registrations retention %q", r))
+			}
+		}
+		log.Printf("⏰ Pending registrations are %T, reminded after %v and kept for %v\n", pendingStore, reminderDelay, pendingRetention)
+	}
+
+	// Deprecated: secure paths are only kept as a fallback, use the /admin routes
+	secpath1 = os.Getenv("FAIRHIVE_API_SECURE_PATH1")
 	secpath2 = os.Getenv("FAIRHIVE_API_SECURE_PATH2")
-	if secpath2 == "" {
-		panic("secure path #1 must be set")
+	if secpath1 != "" && secpath2 != "" {
+		log.Println("⚠️ Secure paths are deprecated, use the /admin routes")
+	}
+
+	if p := os.Getenv("FAIRHIVE_DUPLICATE_EMAIL_POLICY"); p != "" {
+		switch ep := emailPolicy(p); ep {
+		case allowDuplicateEmail, warnDuplicateEmail, rejectDuplicateEmail:
+			dupPolicy = ep
+		default:
+			panic(fmt.Sprintf("unsupported duplicate email policy %q", p))
+		}
+	}
+	log.Printf("📧 Duplicate Email Policy is %q\n", dupPolicy)
+
+	exportRecipient = os.Getenv("FAIRHIVE_EXPORT_RECIPIENT")
+	if exportRecipient != "" {
+		log.Println("📦 Export Recipient: OK")
 	}
 }
 
@@ -70,14 +554,46 @@ func newApp() *App {
 	if err != nil {
 		panic(err)
 	}
+	tm := mailer.NewTemplateMailer(mailTransport, mailFrom)
+	tm.ReplyTo, tm.ListUnsubscribe, tm.DKIM = mailReplyTo, mailUnsubscribe, mailDKIM
+	var m mailer.Mailer = tm
+	var ob *outbox.Outbox
+	if outboxStore != nil {
+		ob = outbox.New(outboxStore, m, ek, outboxMaxAttempts, outboxBackoff, outboxMaxBackoff)
+		ob.KeepDeadLetters(outboxRetention)
+		m = ob
+	}
+	var pt *pending.Tracker
+	if pendingStore != nil {
+		pt = pending.New(pendingStore, ek, reminderDelay, pendingRetention)
+	}
+	th := mailer.NewThrottled(m, emailCooldown, emailDailyCap)
+	if rl, ok := rateLimiter.(*limiter.RedisLimiter); ok {
+		th.Share(rl.Set("email:cooldown:"), rl.WithLimit(emailDailyCap, 24*time.Hour))
+	}
 	return &App{
-		db:       db,
-		jwt:      jwts["ES256"],
-		mailer:   mailer.New(os.Getenv("FAIRHIVE_GSUITE_USER"), os.Getenv("FAIRHIVE_GSUITE_PASSWORD"), "smtp.gmail.com", 587),
-		wg:       sync.WaitGroup{},
-		rl:       limiter.New(0.1, 10),
-		secpath1: secpath1,
-		secpath2: secpath2,
+		db:        db,
+		jwt:       jwts["ES256"],
+		mailer:    th,
+		templates: tm,
+		wg:        sync.WaitGroup{},
+		rl:        rateLimiter,
+		policies:  newRatePolicies(limiterFactory, emailChecker),
+		ips:       ipResolver,
+		ipf:       ipFilter,
+		allowlist: adminAllowlist,
+		captcha:   captchaVerifier,
+		pow:       powChallenges,
+		emails:    emailChecker,
+		outbox:    ob,
+		pending:   pt,
+		lo:        limiter.NewLockout(lockoutFailures, lockoutBackoff, lockoutMaxBackoff),
+		secpath1:  secpath1,
+		secpath2:  secpath2,
+		ep:        dupPolicy,
+		recipient: exportRecipient,
+		auth:      authenticator,
+		audit:     auditSink,
 	}
 }
 
@@ -123,10 +639,53 @@ func main() {
 		close(idleConnsClosed)
 	}()
 
-	go func() { // every 5 minutes, purge the rate limiters older than 10 minutes
+	if m, ok := app.db.(data.Migrator); ok && os.Getenv("FAIRHIVE_MIGRATE_EMAILS") == "true" {
+		app.wg.Add(1)
+		go func() {
+			defer app.wg.Done()
+			if _, err := m.MigrateEmails(); err != nil {
+				log.Printf("⚠️ Email migration failed: %v\n", err)
+			}
+		}()
+	}
+
+	if app.ipf != nil {
+		go app.ipf.Watch(time.Minute, nil) // reload the IP filter rules every minute
+	}
+
+	if app.outbox != nil {
+		go app.outbox.Run(outboxWorkers, 10*time.Second, nil) // unsent emails are kept in the outbox on shutdown
+	}
+
+	if app.pending != nil {
+		go func() { // every minute, remind the pending registrations which are due, and purge the oldest ones
+			for {
+				time.Sleep(time.Minute)
+				app.remind()
+				if _, err := app.pending.Purge(); err != nil {
+					log.Printf("🔥 Cannot purge pending registrations: %v\n", err)
+				}
+			}
+		}()
+	}
+
+	go func() { // every 5 minutes, purge the rate limiters and the expired lockouts older than 10 minutes, and the expired challenges
 		for {
 			time.Sleep(5 * time.Minute)
 			app.rl.Cleanup(10 * time.Minute)
+			app.policies.cleanup(10 * time.Minute)
+			app.lo.Cleanup(10 * time.Minute)
+			if app.pow != nil {
+				app.pow.Cleanup(time.Now())
+			}
+			if m, ok := app.mailer.(*mailer.Throttled); ok {
+				m.Cleanup()
+			}
+			if app.outbox != nil {
+				if _, err := app.outbox.Purge(); err != nil {
+					log.Printf("⚠️ Cannot purge outbox dead letters: %v\n", err)
+				}
+			}
 		}
 	}()
 
@@ -1,7 +1,23 @@
 package main
 
 import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"net/mail"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
+
+	"github.com/fairhive-labs/preregister/internal/captcha"
+	"github.com/fairhive-labs/preregister/internal/crypto/cipher"
+	"github.com/fairhive-labs/preregister/internal/limiter"
+	"github.com/fairhive-labs/preregister/internal/mailer"
+	"github.com/fairhive-labs/preregister/internal/outbox"
+	"github.com/fairhive-labs/preregister/internal/pending"
 )
 
 func TestSetup(t *testing.T) {
@@ -44,3 +60,674 @@ func TestNewApp(t *testing.T) {
 		t.FailNow()
 	}
 }
+
+func TestSetupDuplicateEmailPolicy(t *testing.T) {
+	t.Setenv("FAIRHIVE_PREREGISTER_TABLE_NAME", "Waitlist_UnitTest")
+	t.Setenv("FAIRHIVE_ENCRYPTION_KEY", "Sup3rSecr3tKAY")
+	t.Setenv("FAIRHIVE_API_SECURE_PATH1", "p4th1")
+	t.Setenv("FAIRHIVE_API_SECURE_PATH2", "p4th2")
+
+	t.Setenv("FAIRHIVE_DUPLICATE_EMAIL_POLICY", "reject")
+	setup()
+	if dupPolicy != rejectDuplicateEmail {
+		t.Errorf("wrong duplicate email policy, got %s, want %s", dupPolicy, rejectDuplicateEmail)
+		t.FailNow()
+	}
+
+	t.Setenv("FAIRHIVE_DUPLICATE_EMAIL_POLICY", "ignore")
+	defer func() {
+		dupPolicy = allowDuplicateEmail
+		if r := recover(); r == nil {
+			t.Errorf("setup should panic with an unsupported duplicate email policy")
+		}
+	}()
+	setup()
+}
+
+func TestSetupKeyProvider(t *testing.T) {
+	t.Setenv("FAIRHIVE_PREREGISTER_TABLE_NAME", "Waitlist_UnitTest")
+	t.Setenv("FAIRHIVE_ENCRYPTION_KEY", "")
+	t.Setenv("FAIRHIVE_API_SECURE_PATH1", "p4th1")
+	t.Setenv("FAIRHIVE_API_SECURE_PATH2", "p4th2")
+
+	k, _ := cipher.GenerateKey(32)
+	f := filepath.Join(t.TempDir(), "data.key")
+	os.WriteFile(f, []byte(k), 0600)
+	t.Setenv("FAIRHIVE_KEY_PROVIDER", "file")
+	t.Setenv("FAIRHIVE_ENCRYPTION_KEY_FILE", f)
+	setup()
+	if ek != k {
+		t.Errorf("wrong encryption key, got %s, want %s", ek, k)
+		t.FailNow()
+	}
+
+	t.Setenv("FAIRHIVE_KEY_PROVIDER", "env")
+	defer func() {
+		if r := recover(); r == nil {
+			t.Errorf("setup should panic when the encryption key is missing")
+		}
+	}()
+	setup()
+}
+
+func TestSetupAdminLockout(t *testing.T) {
+	t.Setenv("FAIRHIVE_PREREGISTER_TABLE_NAME", "Waitlist_UnitTest")
+	t.Setenv("FAIRHIVE_ENCRYPTION_KEY", "Sup3rSecr3tKAY")
+
+	t.Setenv("FAIRHIVE_ADMIN_LOCKOUT_FAILURES", "3")
+	t.Setenv("FAIRHIVE_ADMIN_LOCKOUT_BACKOFF", "30s")
+	t.Setenv("FAIRHIVE_ADMIN_LOCKOUT_MAX_BACKOFF", "15m")
+	defer func() {
+		lockoutFailures, lockoutBackoff, lockoutMaxBackoff = 5, time.Minute, time.Hour
+	}()
+	setup()
+	if lockoutFailures != 3 || lockoutBackoff != 30*time.Second || lockoutMaxBackoff != 15*time.Minute {
+		t.Errorf("wrong admin lockout, got %d %v %v, want %d %v %v", lockoutFailures, lockoutBackoff, lockoutMaxBackoff, 3, 30*time.Second, 15*time.Minute)
+		t.FailNow()
+	}
+
+	tt := []struct {
+		name, env, value string
+	}{
+		{"failures", "FAIRHIVE_ADMIN_LOCKOUT_FAILURES", "0"},
+		{"backoff", "FAIRHIVE_ADMIN_LOCKOUT_BACKOFF", "soon"},
+		{"max backoff", "FAIRHIVE_ADMIN_LOCKOUT_MAX_BACKOFF", "10s"},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Setenv(tc.env, tc.value)
+			defer func() {
+				if r := recover(); r == nil {
+					t.Errorf("setup should panic with an invalid %s", tc.name)
+				}
+			}()
+			setup()
+		})
+	}
+}
+
+func TestSetupRateLimiter(t *testing.T) {
+	t.Setenv("FAIRHIVE_PREREGISTER_TABLE_NAME", "Waitlist_UnitTest")
+	t.Setenv("FAIRHIVE_ENCRYPTION_KEY", "Sup3rSecr3tKAY")
+
+	setup()
+	if _, ok := rateLimiter.(*limiter.RateLimiter); !ok {
+		t.Errorf("wrong default rate limiter, got %T", rateLimiter)
+		t.FailNow()
+	}
+
+	t.Setenv("FAIRHIVE_RATE_LIMITER", "redis")
+	t.Setenv("FAIRHIVE_REDIS_URL", "redis://localhost:6379")
+	t.Setenv("FAIRHIVE_RATE_LIMIT", "20")
+	t.Setenv("FAIRHIVE_RATE_WINDOW", "1m")
+	setup()
+	if _, ok := rateLimiter.(*limiter.RedisLimiter); !ok {
+		t.Errorf("wrong rate limiter, got %T", rateLimiter)
+		t.FailNow()
+	}
+
+	tt := []struct {
+		name, env, value string
+	}{
+		{"limiter", "FAIRHIVE_RATE_LIMITER", "memcached"},
+		{"redis url", "FAIRHIVE_REDIS_URL", "http://localhost:6379"},
+		{"limit", "FAIRHIVE_RATE_LIMIT", "none"},
+		{"window", "FAIRHIVE_RATE_WINDOW", "0s"},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Setenv(tc.env, tc.value)
+			defer func() {
+				if r := recover(); r == nil {
+					t.Errorf("setup should panic with an invalid %s", tc.name)
+				}
+			}()
+			setup()
+		})
+	}
+}
+
+func TestSetupTrustedProxies(t *testing.T) {
+	t.Setenv("FAIRHIVE_PREREGISTER_TABLE_NAME", "Waitlist_UnitTest")
+	t.Setenv("FAIRHIVE_ENCRYPTION_KEY", "Sup3rSecr3tKAY")
+
+	t.Setenv("FAIRHIVE_TRUSTED_PROXIES", "10.0.0.0/8,192.168.0.0/16")
+	t.Setenv("FAIRHIVE_TRUSTED_PLATFORMS", "heroku,cloudflare")
+	setup()
+	if ipResolver == nil {
+		t.Errorf("client ip resolver cannot be nil")
+		t.FailNow()
+	}
+
+	tt := []struct {
+		name, env, value string
+	}{
+		{"proxies", "FAIRHIVE_TRUSTED_PROXIES", "10.0.0.0/33"},
+		{"platforms", "FAIRHIVE_TRUSTED_PLATFORMS", "fly"},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Setenv(tc.env, tc.value)
+			defer func() {
+				if r := recover(); r == nil {
+					t.Errorf("setup should panic with invalid trusted %s", tc.name)
+				}
+			}()
+			setup()
+		})
+	}
+}
+
+func TestSetupIPFilter(t *testing.T) {
+	t.Setenv("FAIRHIVE_PREREGISTER_TABLE_NAME", "Waitlist_UnitTest")
+	t.Setenv("FAIRHIVE_ENCRYPTION_KEY", "Sup3rSecr3tKAY")
+	dir := t.TempDir()
+	f := filepath.Join(dir, "ipfilter.txt")
+	os.WriteFile(f, []byte("allow 203.0.113.0/24\n"), 0600)
+	defer func() {
+		ipFilter, adminAllowlist = nil, false
+	}()
+
+	t.Setenv("FAIRHIVE_IP_FILTER_FILE", f)
+	t.Setenv("FAIRHIVE_ADMIN_REQUIRE_ALLOWLIST", "true")
+	setup()
+	if ipFilter == nil || !adminAllowlist {
+		t.Errorf("wrong IP filter, got %v (allow list required: %v)", ipFilter, adminAllowlist)
+		t.FailNow()
+	}
+
+	bad := filepath.Join(dir, "bad.txt")
+	os.WriteFile(bad, []byte("block everything\n"), 0600)
+	tt := []struct {
+		name  string
+		file  string
+		geoip string
+	}{
+		{"allow list without file", "", ""},
+		{"invalid file", bad, ""},
+		{"missing file", filepath.Join(dir, "missing.txt"), ""},
+		{"invalid geoip database", f, f},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Setenv("FAIRHIVE_IP_FILTER_FILE", tc.file)
+			t.Setenv("FAIRHIVE_GEOIP_DB", tc.geoip)
+			defer func() {
+				if r := recover(); r == nil {
+					t.Errorf("setup should panic with %s", tc.name)
+				}
+			}()
+			setup()
+		})
+	}
+}
+
+func TestSetupCaptcha(t *testing.T) {
+	t.Setenv("FAIRHIVE_PREREGISTER_TABLE_NAME", "Waitlist_UnitTest")
+	t.Setenv("FAIRHIVE_ENCRYPTION_KEY", "Sup3rSecr3tKAY")
+	defer func() {
+		captchaVerifier = nil
+	}()
+
+	setup()
+	if captchaVerifier != nil {
+		t.Errorf("captcha verification should be disabled by default, got %T", captchaVerifier)
+		t.FailNow()
+	}
+
+	t.Setenv("FAIRHIVE_CAPTCHA_SECRET", "s3cr3t")
+	t.Setenv("FAIRHIVE_CAPTCHA_PROVIDER", "fake")
+	setup()
+	if _, ok := captchaVerifier.(captcha.Fake); !ok {
+		t.Errorf("wrong captcha verifier, got %T", captchaVerifier)
+		t.FailNow()
+	}
+
+	t.Setenv("FAIRHIVE_CAPTCHA_PROVIDER", "recaptcha")
+	t.Setenv("FAIRHIVE_CAPTCHA_MIN_SCORE", "0.5")
+	setup()
+	if v, ok := captchaVerifier.(*captcha.Siteverify); !ok || v.MinScore != 0.5 {
+		t.Errorf("wrong captcha verifier, got %#v", captchaVerifier)
+		t.FailNow()
+	}
+
+	tt := []struct {
+		name, env, value string
+	}{
+		{"provider", "FAIRHIVE_CAPTCHA_PROVIDER", "friendly"},
+		{"secret", "FAIRHIVE_CAPTCHA_SECRET", ""},
+		{"min score", "FAIRHIVE_CAPTCHA_MIN_SCORE", "2"},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Setenv(tc.env, tc.value)
+			defer func() {
+				if r := recover(); r == nil {
+					t.Errorf("setup should panic with an invalid captcha %s", tc.name)
+				}
+			}()
+			setup()
+		})
+	}
+}
+
+func TestSetupProofOfWork(t *testing.T) {
+	t.Setenv("FAIRHIVE_PREREGISTER_TABLE_NAME", "Waitlist_UnitTest")
+	t.Setenv("FAIRHIVE_ENCRYPTION_KEY", "Sup3rSecr3tKAY")
+	defer func() {
+		powChallenges = nil
+	}()
+
+	setup()
+	if powChallenges != nil {
+		t.Errorf("proof of work should be disabled by default")
+		t.FailNow()
+	}
+
+	t.Setenv("FAIRHIVE_POW_DIFFICULTY", "12")
+	t.Setenv("FAIRHIVE_POW_LOAD_THRESHOLD", "100")
+	setup()
+	if powChallenges == nil {
+		t.Errorf("proof of work should be enabled")
+		t.FailNow()
+	}
+	if c, _ := powChallenges.Issue(time.Now()); c.Difficulty != 12 {
+		t.Errorf("incorrect difficulty, got %d, want %d", c.Difficulty, 12)
+		t.FailNow()
+	}
+
+	tt := []struct {
+		name, env, value string
+	}{
+		{"difficulty", "FAIRHIVE_POW_DIFFICULTY", "65"},
+		{"ttl", "FAIRHIVE_POW_TTL", "-1m"},
+		{"load threshold", "FAIRHIVE_POW_LOAD_THRESHOLD", "many"},
+		{"max difficulty", "FAIRHIVE_POW_MAX_DIFFICULTY", "8"},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Setenv(tc.env, tc.value)
+			defer func() {
+				if r := recover(); r == nil {
+					t.Errorf("setup should panic with an invalid proof of work %s", tc.name)
+				}
+			}()
+			setup()
+		})
+	}
+
+	t.Run("shared secret", func(t *testing.T) {
+		t.Setenv("FAIRHIVE_RATE_LIMITER", "redis")
+		t.Setenv("FAIRHIVE_REDIS_URL", "redis://localhost:6379")
+		t.Setenv("FAIRHIVE_POW_SECRET", "sh4r3d")
+		setup()
+		t.Setenv("FAIRHIVE_POW_SECRET", "")
+		defer func() {
+			if r := recover(); r == nil {
+				t.Errorf("setup should panic without a secret shared by the instances")
+			}
+		}()
+		setup()
+	})
+}
+
+func TestSetupEmailCheck(t *testing.T) {
+	t.Setenv("FAIRHIVE_PREREGISTER_TABLE_NAME", "Waitlist_UnitTest")
+	t.Setenv("FAIRHIVE_ENCRYPTION_KEY", "Sup3rSecr3tKAY")
+	defer func() {
+		emailChecker = nil
+	}()
+
+	setup()
+	if emailChecker == nil {
+		t.Errorf("email check should be enabled by default")
+		t.FailNow()
+	}
+	if e, _ := emailChecker.Normalize("john.doe+poln@gmail.com"); e != "john.doe@gmail.com" {
+		t.Errorf("incorrect default plus-tag domains, got %q", e)
+		t.FailNow()
+	}
+
+	t.Setenv("FAIRHIVE_PLUS_TAG_DOMAINS", "")
+	p := filepath.Join(t.TempDir(), "disposable.txt")
+	os.WriteFile(p, []byte("poln-trash.org\n"), 0600)
+	t.Setenv("FAIRHIVE_DISPOSABLE_DOMAINS_FILE", p)
+	setup()
+	if e, _ := emailChecker.Normalize("john.doe+poln@gmail.com"); e != "john.doe+poln@gmail.com" {
+		t.Errorf("plus-tags should be kept, got %q", e)
+		t.FailNow()
+	}
+	if !emailChecker.Disposable("poln-trash.org") {
+		t.Errorf("disposable domains file should be loaded")
+		t.FailNow()
+	}
+
+	t.Setenv("FAIRHIVE_EMAIL_CHECK", "off")
+	setup()
+	if emailChecker != nil {
+		t.Errorf("email check should be disabled")
+		t.FailNow()
+	}
+
+	tt := []struct {
+		name, env, value string
+	}{
+		{"mode", "FAIRHIVE_EMAIL_CHECK", "strict"},
+		{"file", "FAIRHIVE_DISPOSABLE_DOMAINS_FILE", filepath.Join(t.TempDir(), "missing")},
+	}
+	t.Setenv("FAIRHIVE_EMAIL_CHECK", "mx")
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Setenv(tc.env, tc.value)
+			defer func() {
+				if r := recover(); r == nil {
+					t.Errorf("setup should panic with an invalid email check %s", tc.name)
+				}
+			}()
+			setup()
+		})
+	}
+}
+
+func TestSetupEmailThrottling(t *testing.T) {
+	t.Setenv("FAIRHIVE_PREREGISTER_TABLE_NAME", "Waitlist_UnitTest")
+	t.Setenv("FAIRHIVE_ENCRYPTION_KEY", "Sup3rSecr3tKAY")
+	defer func() {
+		emailCooldown, emailDailyCap = 2*time.Minute, 5
+	}()
+
+	t.Setenv("FAIRHIVE_EMAIL_COOLDOWN", "10m")
+	t.Setenv("FAIRHIVE_EMAIL_DAILY_CAP", "3")
+	setup()
+	if emailCooldown != 10*time.Minute || emailDailyCap != 3 {
+		t.Errorf("incorrect email throttling, got %v and %d", emailCooldown, emailDailyCap)
+		t.FailNow()
+	}
+	if _, ok := newApp().mailer.(*mailer.Throttled); !ok {
+		t.Errorf("activation emails should be throttled")
+		t.FailNow()
+	}
+
+	tt := []struct {
+		name, env, value string
+	}{
+		{"cooldown", "FAIRHIVE_EMAIL_COOLDOWN", "-1m"},
+		{"daily cap", "FAIRHIVE_EMAIL_DAILY_CAP", "lots"},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Setenv(tc.env, tc.value)
+			defer func() {
+				if r := recover(); r == nil {
+					t.Errorf("setup should panic with an invalid email %s", tc.name)
+				}
+			}()
+			setup()
+		})
+	}
+}
+
+func TestSetupOutbox(t *testing.T) {
+	t.Setenv("FAIRHIVE_PREREGISTER_TABLE_NAME", "Waitlist_UnitTest")
+	t.Setenv("FAIRHIVE_ENCRYPTION_KEY", "Sup3rSecr3tKAY")
+	defer func() {
+		outboxStore = nil
+		outboxWorkers, outboxMaxAttempts, outboxBackoff, outboxMaxBackoff, outboxRetention = 2, 8, 30*time.Second, time.Hour, 7*24*time.Hour
+	}()
+
+	setup()
+	if outboxStore != nil || newApp().outbox != nil {
+		t.Errorf("outbox should be disabled by default")
+		t.FailNow()
+	}
+
+	d := filepath.Join(t.TempDir(), "outbox")
+	t.Setenv("FAIRHIVE_OUTBOX", "file")
+	t.Setenv("FAIRHIVE_OUTBOX_DIR", d)
+	t.Setenv("FAIRHIVE_OUTBOX_WORKERS", "4")
+	t.Setenv("FAIRHIVE_OUTBOX_MAX_ATTEMPTS", "5")
+	t.Setenv("FAIRHIVE_OUTBOX_BACKOFF", "1m")
+	t.Setenv("FAIRHIVE_OUTBOX_MAX_BACKOFF", "2h")
+	t.Setenv("FAIRHIVE_OUTBOX_DEAD_RETENTION", "72h")
+	setup()
+	if _, ok := outboxStore.(*outbox.FileStore); !ok {
+		t.Errorf("wrong outbox store, got %T", outboxStore)
+		t.FailNow()
+	}
+	if outboxWorkers != 4 || outboxMaxAttempts != 5 || outboxBackoff != time.Minute || outboxMaxBackoff != 2*time.Hour || outboxRetention != 72*time.Hour {
+		t.Errorf("incorrect outbox settings, got %d %d %v %v %v", outboxWorkers, outboxMaxAttempts, outboxBackoff, outboxMaxBackoff, outboxRetention)
+		t.FailNow()
+	}
+	if _, err := os.Stat(d); err != nil {
+		t.Errorf("outbox directory should be created: %v", err)
+		t.FailNow()
+	}
+	if newApp().outbox == nil {
+		t.Errorf("app should use the outbox")
+		t.FailNow()
+	}
+
+	t.Setenv("FAIRHIVE_OUTBOX", "dynamodb")
+	t.Setenv("FAIRHIVE_OUTBOX_TABLE_NAME", "Outbox_UnitTest")
+	setup()
+	if _, ok := outboxStore.(*outbox.DynamoDBStore); !ok {
+		t.Errorf("wrong outbox store, got %T", outboxStore)
+		t.FailNow()
+	}
+
+	tt := []struct {
+		name, env, value string
+	}{
+		{"store", "FAIRHIVE_OUTBOX", "sql"},
+		{"table name", "FAIRHIVE_OUTBOX_TABLE_NAME", ""},
+		{"workers", "FAIRHIVE_OUTBOX_WORKERS", "0"},
+		{"max attempts", "FAIRHIVE_OUTBOX_MAX_ATTEMPTS", "many"},
+		{"backoff", "FAIRHIVE_OUTBOX_BACKOFF", "0s"},
+		{"max backoff", "FAIRHIVE_OUTBOX_MAX_BACKOFF", "10s"},
+		{"dead letters retention", "FAIRHIVE_OUTBOX_DEAD_RETENTION", "forever"},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Setenv(tc.env, tc.value)
+			defer func() {
+				if r := recover(); r == nil {
+					t.Errorf("setup should panic with an invalid outbox %s", tc.name)
+				}
+			}()
+			setup()
+		})
+	}
+}
+
+func TestSetupPending(t *testing.T) {
+	t.Setenv("FAIRHIVE_PREREGISTER_TABLE_NAME", "Waitlist_UnitTest")
+	t.Setenv("FAIRHIVE_ENCRYPTION_KEY", "Sup3rSecr3tKAY")
+	defer func() {
+		pendingStore = nil
+		reminderDelay, pendingRetention = 24*time.Hour, 30*24*time.Hour
+	}()
+
+	setup()
+	if pendingStore != nil || newApp().pending != nil {
+		t.Errorf("pending registrations should not be tracked by default")
+		t.FailNow()
+	}
+
+	t.Setenv("FAIRHIVE_PENDING", "memory")
+	t.Setenv("FAIRHIVE_REMINDER_DELAY", "48h")
+	t.Setenv("FAIRHIVE_PENDING_RETENTION", "720h")
+	setup()
+	if _, ok := pendingStore.(*pending.MemoryStore); !ok {
+		t.Errorf("wrong pending registrations store, got %T", pendingStore)
+		t.FailNow()
+	}
+	if reminderDelay != 48*time.Hour || pendingRetention != 720*time.Hour {
+		t.Errorf("incorrect pending registrations settings, got %v %v", reminderDelay, pendingRetention)
+		t.FailNow()
+	}
+	if newApp().pending == nil {
+		t.Errorf("app should track pending registrations")
+		t.FailNow()
+	}
+
+	t.Setenv("FAIRHIVE_PENDING", "dynamodb")
+	t.Setenv("FAIRHIVE_PENDING_TABLE_NAME", "Pending_UnitTest")
+	setup()
+	if _, ok := pendingStore.(*pending.DynamoDBStore); !ok {
+		t.Errorf("wrong pending registrations store, got %T", pendingStore)
+		t.FailNow()
+	}
+
+	tt := []struct {
+		name, env, value string
+	}{
+		{"store", "FAIRHIVE_PENDING", "file"},
+		{"table name", "FAIRHIVE_PENDING_TABLE_NAME", ""},
+		{"delay", "FAIRHIVE_REMINDER_DELAY", "tomorrow"},
+		{"negative delay", "FAIRHIVE_REMINDER_DELAY", "-1h"},
+		{"retention", "FAIRHIVE_PENDING_RETENTION", "1h"},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Setenv(tc.env, tc.value)
+			defer func() {
+				if r := recover(); r == nil {
+					t.Errorf("setup should panic with an invalid pending registrations %s", tc.name)
+				}
+			}()
+			setup()
+		})
+	}
+}
+
+func TestSetupMailTransport(t *testing.T) {
+	t.Setenv("FAIRHIVE_PREREGISTER_TABLE_NAME", "Waitlist_UnitTest")
+	t.Setenv("FAIRHIVE_ENCRYPTION_KEY", "Sup3rSecr3tKAY")
+	defer func() {
+		mailTransport, mailFrom, mailReplyTo, mailUnsubscribe = nil, &mail.Address{Address: mailer.DefaultFrom}, nil, nil
+	}()
+
+	t.Setenv("FAIRHIVE_GSUITE_USER", "")
+	setup()
+	if _, ok := mailTransport.(*mailer.SMTPTransport); !ok || mailFrom.Address != mailer.DefaultFrom || mailReplyTo != nil || mailUnsubscribe != nil {
+		t.Errorf("wrong default mail transport, got %T from %v", mailTransport, mailFrom)
+		t.FailNow()
+	}
+	t.Run("smtp user", func(t *testing.T) {
+		t.Setenv("FAIRHIVE_GSUITE_USER", "hello@poln.org")
+		setup()
+		if mailFrom.Address != "hello@poln.org" {
+			t.Errorf("emails should be sent from the SMTP user, got %v", mailFrom)
+		}
+	})
+
+	t.Setenv("FAIRHIVE_MAIL_FROM", "poln <hello@poln.org>")
+	t.Setenv("FAIRHIVE_MAIL_REPLY_TO", "support@poln.org")
+	t.Setenv("FAIRHIVE_MAIL_UNSUBSCRIBE", "mailto:unsubscribe@poln.org, https://poln.org/unsubscribe")
+	tt := []struct {
+		transport string
+		env       map[string]string
+		want      mailer.Transport
+	}{
+		{"smtp", map[string]string{"FAIRHIVE_SMTP_HOST": "smtp.poln.org", "FAIRHIVE_SMTP_PORT": "2525"}, &mailer.SMTPTransport{}},
+		{"ses", map[string]string{"FAIRHIVE_SES_REGION": "eu-west-1"}, &mailer.SESTransport{}},
+		{"http", map[string]string{"FAIRHIVE_MAIL_API_KEY": "k3y"}, &mailer.HTTPTransport{}},
+		{"file", map[string]string{"FAIRHIVE_MAIL_DIR": filepath.Join(t.TempDir(), "maildir")}, &mailer.FileTransport{}},
+	}
+	for _, tc := range tt {
+		t.Run(tc.transport, func(t *testing.T) {
+			t.Setenv("FAIRHIVE_MAIL_TRANSPORT", tc.transport)
+			for k, v := range tc.env {
+				t.Setenv(k, v)
+			}
+			setup()
+			if fmt.Sprintf("%T", mailTransport) != fmt.Sprintf("%T", tc.want) || mailFrom.String() != `"poln" <hello@poln.org>` ||
+				mailReplyTo.Address != "support@poln.org" || len(mailUnsubscribe) != 2 || mailUnsubscribe[1] != "https://poln.org/unsubscribe" {
+				t.Errorf("wrong mail transport, got %T from %v, want %T", mailTransport, mailFrom, tc.want)
+			}
+		})
+	}
+
+	for _, tc := range []struct {
+		name, transport, env, value string
+	}{
+		{"transport", "pigeon", "", ""},
+		{"smtp port", "smtp", "FAIRHIVE_SMTP_PORT", "-25"},
+		{"api key", "http", "FAIRHIVE_MAIL_API_KEY", ""},
+		{"sender", "ses", "FAIRHIVE_MAIL_FROM", "poln <hello@"},
+		{"smtp sender", "smtp", "FAIRHIVE_GSUITE_USER", "no_reply@poln.org"},
+		{"reply-to", "ses", "FAIRHIVE_MAIL_REPLY_TO", "support"},
+		{"unsubscribe", "ses", "FAIRHIVE_MAIL_UNSUBSCRIBE", "http://poln.org/unsubscribe"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Setenv("FAIRHIVE_MAIL_TRANSPORT", tc.transport)
+			if tc.env != "" {
+				t.Setenv(tc.env, tc.value)
+			}
+			defer func() {
+				if r := recover(); r == nil {
+					t.Errorf("setup should panic with an invalid mail %s", tc.name)
+				}
+			}()
+			setup()
+		})
+	}
+}
+
+func TestSetupDKIM(t *testing.T) {
+	t.Setenv("FAIRHIVE_PREREGISTER_TABLE_NAME", "Waitlist_UnitTest")
+	t.Setenv("FAIRHIVE_ENCRYPTION_KEY", "Sup3rSecr3tKAY")
+	defer func() {
+		mailTransport, mailFrom, mailDKIM = nil, &mail.Address{Address: mailer.DefaultFrom}, nil
+	}()
+
+	setup()
+	if mailDKIM != nil {
+		t.Errorf("DKIM should be disabled by default")
+		t.FailNow()
+	}
+
+	_, pvk, _ := ed25519.GenerateKey(rand.Reader)
+	b, _ := x509.MarshalPKCS8PrivateKey(pvk)
+	k := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: b})
+	f := filepath.Join(t.TempDir(), "dkim.pem")
+	os.WriteFile(f, k, 0600)
+	t.Setenv("FAIRHIVE_DKIM_SELECTOR", "poln")
+	t.Setenv("FAIRHIVE_MAIL_FROM", "hello@poln.org")
+	for n, env := range map[string]map[string]string{
+		"key":      {"FAIRHIVE_DKIM_KEY": string(k)},
+		"key file": {"FAIRHIVE_DKIM_KEY_FILE": f, "FAIRHIVE_DKIM_DOMAIN": "mail.poln.org"},
+	} {
+		t.Run(n, func(t *testing.T) {
+			for k, v := range env {
+				t.Setenv(k, v)
+			}
+			setup()
+			want := "poln._domainkey.poln.org"
+			if env["FAIRHIVE_DKIM_DOMAIN"] != "" {
+				want = "poln._domainkey.mail.poln.org"
+			}
+			if mailDKIM == nil || mailDKIM.Name() != want {
+				t.Errorf("wrong DKIM signer, got %v, want %s", mailDKIM, want)
+			}
+		})
+	}
+
+	for n, env := range map[string]map[string]string{
+		"missing key":  {},
+		"invalid key":  {"FAIRHIVE_DKIM_KEY": "s3cr3t"},
+		"missing file": {"FAIRHIVE_DKIM_KEY_FILE": filepath.Join(t.TempDir(), "missing.pem")},
+	} {
+		t.Run(n, func(t *testing.T) {
+			for k, v := range env {
+				t.Setenv(k, v)
+			}
+			defer func() {
+				if r := recover(); r == nil {
+					t.Errorf("setup should panic with a %s", n)
+				}
+			}()
+			setup()
+		})
+	}
+}
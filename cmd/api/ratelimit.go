@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fairhive-labs/preregister/internal/data"
+	"github.com/fairhive-labs/preregister/internal/emailcheck"
+	"github.com/fairhive-labs/preregister/internal/limiter"
+	"github.com/gin-gonic/gin"
+	"golang.org/x/time/rate"
+)
+
+const (
+	rateAppliedKey = "ratelimit.applied"
+	rateBodyKey    = "ratelimit.body"
+	rateResultKey  = "ratelimit.result"
+
+	maxPeekBytes = 4 << 10 // the bodies of the limited routes are small JSON objects
+)
+
+// keyFunc returns the key of the request to limit, empty if the key is not available (yet)
+type keyFunc func(c *gin.Context) string
+
+func ipKey(c *gin.Context) string {
+	return clientKey(c)
+}
+
+// peekUser decodes the user sent in the request body, leaving the body available for the handler.
+// Bodies larger than maxPeekBytes are truncated, so the handler rejects them as invalid JSON.
+func peekUser(c *gin.Context) *data.User {
+	if v, ok := c.Get(rateBodyKey); ok {
+		return v.(*data.User)
+	}
+	u := &data.User{}
+	if c.Request.Body != nil {
+		b, err := io.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, maxPeekBytes))
+		c.Request.Body = io.NopCloser(bytes.NewReader(b))
+		if err == nil {
+			json.Unmarshal(b, u)
+		}
+	}
+	c.Set(rateBodyKey, u)
+	return u
+}
+
+// emailKey keys on the email as it is registered: lowered and without the plus-tag of the providers
+func emailKey(emails *emailcheck.Checker) keyFunc {
+	return func(c *gin.Context) string {
+		e := peekUser(c).Email
+		if n, err := emails.Normalize(e); err == nil {
+			return n
+		}
+		return data.NormalizeEmail(e)
+	}
+}
+
+func addressKey(c *gin.Context) string {
+	return strings.ToLower(peekUser(c).Address)
+}
+
+func adminKey(c *gin.Context) string {
+	if id := identity(c); id != nil {
+		return id.Method + ":" + id.Subject
+	}
+	return ""
+}
+
+// rateRule limits the requests sharing the same key
+type rateRule struct {
+	name  string
+	limit rate.Limit
+	burst int
+	key   keyFunc
+	l     limiter.Limiter
+}
+
+// ratePolicies maps route patterns to their rate limit rules.
+// A pattern ending with "*" matches any route starting with it, a pattern without rules is exempt.
+type ratePolicies map[string][]*rateRule
+
+// newRatePolicies creates the limiters with f, emails are keyed after their normalization by emails (default providers if nil)
+func newRatePolicies(f limiter.Factory, emails *emailcheck.Checker) ratePolicies {
+	if emails == nil {
+		emails = emailcheck.New(nil, emailcheck.PlusTagDomains...)
+	}
+	p := ratePolicies{
+		"/health": {},
+		"/register": {
+			{name: "ip", limit: 0.1, burst: 10, key: ipKey},
+			{name: "email", limit: rate.Every(time.Hour), burst: 3, key: emailKey(emails)},
+			{name: "address", limit: rate.Every(time.Hour), burst: 3, key: addressKey},
+		},
+		"/challenge": {
+			{name: "ip", limit: 0.2, burst: 20, key: ipKey},
+		},
+		"/activate/resend": {
+			{name: "ip", limit: 0.1, burst: 10, key: ipKey},
+			{name: "email", limit: rate.Every(time.Hour), burst: 3, key: emailKey(emails)},
+			{name: "address", limit: rate.Every(time.Hour), burst: 3, key: addressKey},
+		},
+		"/activate/:token/:hash": {
+			{name: "ip", limit: 0.1, burst: 10, key: ipKey},
+		},
+		"/admin/*": {
+			{name: "ip", limit: 1, burst: 20, key: ipKey},
+			{name: "admin", limit: 0.5, burst: 10, key: adminKey},
+		},
+		"/:path1/:path2/*": { // deprecated
+			{name: "ip", limit: 0.1, burst: 10, key: ipKey},
+		},
+	}
+	for _, rules := range p {
+		for _, r := range rules {
+			r.l = f(r.limit, r.burst)
+		}
+	}
+	return p
+}
+
+// rules returns the pattern and the rules matching the route, the most specific pattern first
+func (p ratePolicies) rules(route string) (string, []*rateRule, bool) {
+	if rules, ok := p[route]; ok {
+		return route, rules, true
+	}
+	var m string
+	for pt := range p {
+		if strings.HasSuffix(pt, "*") && strings.HasPrefix(route, strings.TrimSuffix(pt, "*")) && len(pt) > len(m) {
+			m = pt
+		}
+	}
+	if m == "" {
+		return "", nil, false
+	}
+	return m, p[m], true
+}
+
+func (p ratePolicies) cleanup(t time.Duration) {
+	for _, rules := range p {
+		for _, r := range rules {
+			r.l.Cleanup(t)
+		}
+	}
+}
+
+// limit applies the rate limit rules of the route, or limits the requests per IP with app.rl.
+// It can be called again later in the chain to apply the rules whose key was not available yet (e.g. admin).
+func (app *App) limit(c *gin.Context) {
+	pattern, rules, ok := app.policies.rules(c.FullPath())
+	if !ok {
+		rules = []*rateRule{{name: "ip", key: ipKey, l: app.rl}}
+	}
+	applied, _ := c.Get(rateAppliedKey)
+	done, _ := applied.(map[string]bool)
+	if done == nil {
+		done = map[string]bool{}
+		c.Set(rateAppliedKey, done)
+	}
+	for _, r := range rules {
+		if done[r.name] {
+			continue
+		}
+		k := r.key(c)
+		if k == "" {
+			continue
+		}
+		done[r.name] = true
+		res, err := r.l.Allow(pattern + "|" + r.name + ":" + k)
+		if err != nil { // fail open, the rate limiter must not take the API down
+			log.Printf("⚠️ Rate limiter failure for %s %q: %v\n", r.name, k, err)
+			continue
+		}
+		setRateLimitHeaders(c, res)
+		if !res.Allowed {
+			c.Header("Retry-After", ceilSeconds(res.RetryAfter))
+			c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{
+				"error": "Too Many Requests",
+				"ip":    clientIP(c),
+			})
+			return
+		}
+	}
+	c.Next()
+}
+
+func ceilSeconds(d time.Duration) string {
+	return strconv.Itoa(int(math.Ceil(d.Seconds())))
+}
+
+// setRateLimitHeaders sets the RateLimit-* headers of the most restrictive limit applied to the request
+func setRateLimitHeaders(c *gin.Context, res limiter.Result) {
+	if res.Limit == 0 { // unlimited
+		return
+	}
+	if v, ok := c.Get(rateResultKey); ok {
+		if prev := v.(limiter.Result); prev.Remaining < res.Remaining || (prev.Remaining == res.Remaining && prev.Reset >= res.Reset) {
+			return
+		}
+	}
+	c.Set(rateResultKey, res)
+	c.Header("RateLimit-Limit", strconv.Itoa(res.Limit))
+	c.Header("RateLimit-Remaining", strconv.Itoa(res.Remaining))
+	c.Header("RateLimit-Reset", ceilSeconds(res.Reset))
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/fairhive-labs/preregister/internal/auth"
+	"github.com/fairhive-labs/preregister/internal/crypto"
+	"github.com/fairhive-labs/preregister/internal/crypto/cipher"
+	"github.com/fairhive-labs/preregister/internal/data"
+	"github.com/fairhive-labs/preregister/internal/limiter"
+	"github.com/fairhive-labs/preregister/internal/mailer"
+)
+
+func newRateLimitedApp() (app *App, key1, key2 string) {
+	k, _ := cipher.GenerateKey(32)
+	key1, h1, _ := auth.GenerateAPIKey()
+	key2, h2, _ := auth.GenerateAPIKey()
+	ak, _ := auth.NewAPIKeys(fmt.Sprintf("alice:%s,bob:%s", h1, h2))
+	app = &App{
+		db:       data.MockDB,
+		jwt:      crypto.NewJWTHS256(k),
+		mailer:   &mailer.MockSmtpMailer,
+		wg:       sync.WaitGroup{},
+		rl:       limiter.New(0.1, 2),
+		policies: newRatePolicies(limiter.NewFactory(), nil),
+		secpath1: "path1",
+		secpath2: "path2",
+		auth:     ak,
+	}
+	return app, key1, key2
+}
+
+func TestRatePolicies(t *testing.T) {
+	tt := []struct {
+		route   string
+		pattern string
+		rules   []string
+		ok      bool
+	}{
+		{"/health", "/health", nil, true},
+		{"/register", "/register", []string{"ip", "email", "address"}, true},
+		{"/activate/resend", "/activate/resend", []string{"ip", "email", "address"}, true},
+		{"/activate/:token/:hash", "/activate/:token/:hash", []string{"ip"}, true},
+		{"/admin/count", "/admin/*", []string{"ip", "admin"}, true},
+		{"/admin/users/:address", "/admin/*", []string{"ip", "admin"}, true},
+		{"/:path1/:path2/list", "/:path1/:path2/*", []string{"ip"}, true},
+		{"", "", nil, false},
+	}
+	p := newRatePolicies(limiter.NewFactory(), nil)
+	for _, tc := range tt {
+		t.Run(tc.route, func(t *testing.T) {
+			pattern, rules, ok := p.rules(tc.route)
+			if ok != tc.ok || pattern != tc.pattern {
+				t.Errorf("incorrect pattern, got %q (%v), want %q (%v)", pattern, ok, tc.pattern, tc.ok)
+				t.FailNow()
+			}
+			if len(rules) != len(tc.rules) {
+				t.Errorf("incorrect rules, got %d, want %d", len(rules), len(tc.rules))
+				t.FailNow()
+			}
+			for i, r := range rules {
+				if r.name != tc.rules[i] || r.l == nil {
+					t.Errorf("incorrect rule #%d, got %q (%v), want %q", i, r.name, r.l, tc.rules[i])
+					t.FailNow()
+				}
+			}
+		})
+	}
+}
+
+func TestLimit(t *testing.T) {
+	register := func(r http.Handler, ip, address, email string) int {
+		b, _ := json.Marshal(data.User{Address: address, Email: email, Type: "contractor", Sponsor: sponsor})
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/register", bytes.NewBuffer(b))
+		req.RemoteAddr = ip + ":1234"
+		r.ServeHTTP(w, req)
+		return w.Code
+	}
+	get := func(r http.Handler, path, ip, key string) int {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", path, nil)
+		req.RemoteAddr = ip + ":1234"
+		if key != "" {
+			req.Header.Set(auth.APIKeyHeader, key)
+		}
+		r.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	t.Run("health is exempt", func(t *testing.T) {
+		app, _, _ := newRateLimitedApp()
+		r := setupRouter(app)
+		for i := 0; i < 50; i++ {
+			if s := get(r, "/health", "192.0.2.1", ""); s != http.StatusOK {
+				t.Errorf("incorrect status of request #%d, got %d, want %d", i, s, http.StatusOK)
+				t.FailNow()
+			}
+		}
+	})
+
+	t.Run("register per email", func(t *testing.T) {
+		app, _, _ := newRateLimitedApp()
+		r := setupRouter(app)
+		for i := 0; i < 3; i++ {
+			if s := register(r, fmt.Sprintf("192.0.2.%d", i), fmt.Sprintf("0x8ba1f109551bd432803012645ac136ddd64dba7%d", i), "john.doe@mailservice.com"); s != http.StatusAccepted {
+				t.Errorf("incorrect status of registration #%d, got %d, want %d", i, s, http.StatusAccepted)
+				t.FailNow()
+			}
+		}
+		if s := register(r, "192.0.2.10", "0x8ba1f109551bd432803012645ac136ddd64dba79", " John.Doe@MailService.com"); s != http.StatusTooManyRequests {
+			t.Errorf("email should be rate limited, got %d, want %d", s, http.StatusTooManyRequests)
+			t.FailNow()
+		}
+	})
+
+	t.Run("register per canonical email", func(t *testing.T) {
+		app, _, _ := newRateLimitedApp()
+		r := setupRouter(app)
+		for i := 0; i < 3; i++ {
+			if s := register(r, fmt.Sprintf("192.0.2.%d", i), fmt.Sprintf("0x8ba1f109551bd432803012645ac136ddd64dba7%d", i), fmt.Sprintf("john.doe+%d@gmail.com", i)); s != http.StatusAccepted {
+				t.Errorf("incorrect status of registration #%d, got %d, want %d", i, s, http.StatusAccepted)
+				t.FailNow()
+			}
+		}
+		if s := register(r, "192.0.2.10", "0x8ba1f109551bd432803012645ac136ddd64dba79", "John.Doe+other@gmail.com"); s != http.StatusTooManyRequests {
+			t.Errorf("plus-tagged emails should be rate limited, got %d, want %d", s, http.StatusTooManyRequests)
+			t.FailNow()
+		}
+	})
+
+	t.Run("register per address", func(t *testing.T) {
+		app, _, _ := newRateLimitedApp()
+		r := setupRouter(app)
+		address := "0x8ba1f109551bd432803012645ac136ddd64dba72"
+		for i := 0; i < 3; i++ {
+			if s := register(r, fmt.Sprintf("192.0.2.%d", i), address, fmt.Sprintf("john.doe%d@mailservice.com", i)); s != http.StatusAccepted {
+				t.Errorf("incorrect status of registration #%d, got %d, want %d", i, s, http.StatusAccepted)
+				t.FailNow()
+			}
+		}
+		if s := register(r, "192.0.2.10", address, "jane.doe@mailservice.com"); s != http.StatusTooManyRequests {
+			t.Errorf("address should be rate limited, got %d, want %d", s, http.StatusTooManyRequests)
+			t.FailNow()
+		}
+	})
+
+	t.Run("register with a large body", func(t *testing.T) {
+		app, _, _ := newRateLimitedApp()
+		r := setupRouter(app)
+		b, _ := json.Marshal(data.User{Address: "0x8ba1f109551bd432803012645ac136ddd64dba72", Email: "john.doe@mailservice.com", Type: "contractor", Sponsor: strings.Repeat("0", maxPeekBytes)})
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/register", bytes.NewBuffer(b))
+		r.ServeHTTP(w, req)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("large bodies should be rejected, got %d, want %d", w.Code, http.StatusBadRequest)
+			t.FailNow()
+		}
+	})
+
+	t.Run("register per ip", func(t *testing.T) {
+		app, _, _ := newRateLimitedApp()
+		r := setupRouter(app)
+		for i := 0; i < 10; i++ {
+			if s := register(r, "192.0.2.1", fmt.Sprintf("0x8ba1f109551bd432803012645ac136ddd64db%03d", i), fmt.Sprintf("john.doe%d@mailservice.com", i)); s != http.StatusAccepted {
+				t.Errorf("incorrect status of registration #%d, got %d, want %d", i, s, http.StatusAccepted)
+				t.FailNow()
+			}
+		}
+		if s := register(r, "192.0.2.1", "0x8ba1f109551bd432803012645ac136ddd64db999", "jane.doe@mailservice.com"); s != http.StatusTooManyRequests {
+			t.Errorf("ip should be rate limited, got %d, want %d", s, http.StatusTooManyRequests)
+			t.FailNow()
+		}
+	})
+
+	t.Run("admin per identity", func(t *testing.T) {
+		app, key1, key2 := newRateLimitedApp()
+		r := setupRouter(app)
+		for i := 0; i < 10; i++ {
+			if s := get(r, "/admin/count", fmt.Sprintf("192.0.2.%d", i), key1); s != http.StatusOK {
+				t.Errorf("incorrect status of request #%d, got %d, want %d", i, s, http.StatusOK)
+				t.FailNow()
+			}
+		}
+		if s := get(r, "/admin/count", "192.0.2.100", key1); s != http.StatusTooManyRequests {
+			t.Errorf("admin should be rate limited, got %d, want %d", s, http.StatusTooManyRequests)
+			t.FailNow()
+		}
+		if s := get(r, "/admin/count", "192.0.2.100", key2); s != http.StatusOK {
+			t.Errorf("other admins cannot be rate limited, got %d, want %d", s, http.StatusOK)
+			t.FailNow()
+		}
+	})
+
+	t.Run("default per ip", func(t *testing.T) {
+		app, _, _ := newRateLimitedApp()
+		r := setupRouter(app)
+		for i := 0; i < 2; i++ {
+			if s := get(r, "/unknown", "192.0.2.1", ""); s != http.StatusNotFound {
+				t.Errorf("incorrect status of request #%d, got %d, want %d", i, s, http.StatusNotFound)
+				t.FailNow()
+			}
+		}
+		if s := get(r, "/unknown", "192.0.2.1", ""); s != http.StatusTooManyRequests {
+			t.Errorf("ip should be rate limited, got %d, want %d", s, http.StatusTooManyRequests)
+			t.FailNow()
+		}
+	})
+}
+
+func TestRateLimitHeaders(t *testing.T) {
+	send := func(r http.Handler, method, path string, body []byte) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(method, path, bytes.NewBuffer(body))
+		req.RemoteAddr = "192.0.2.1:1234"
+		r.ServeHTTP(w, req)
+		return w
+	}
+	check := func(t *testing.T, w *httptest.ResponseRecorder, limit, remaining, reset, retry string) {
+		for h, want := range map[string]string{
+			"RateLimit-Limit":     limit,
+			"RateLimit-Remaining": remaining,
+			"RateLimit-Reset":     reset,
+			"Retry-After":         retry,
+		} {
+			if got := w.Header().Get(h); got != want {
+				t.Errorf("incorrect %s header, got %q, want %q", h, got, want)
+				t.FailNow()
+			}
+		}
+	}
+
+	t.Run("default", func(t *testing.T) {
+		app, _, _ := newRateLimitedApp()
+		app.rl = limiter.New(0.5, 2)
+		r := setupRouter(app)
+		check(t, send(r, "GET", "/unknown", nil), "2", "1", "2", "")
+		check(t, send(r, "GET", "/unknown", nil), "2", "0", "4", "")
+		w := send(r, "GET", "/unknown", nil)
+		if w.Code != http.StatusTooManyRequests {
+			t.Errorf("incorrect status, got %d, want %d", w.Code, http.StatusTooManyRequests)
+			t.FailNow()
+		}
+		check(t, w, "2", "0", "4", "2")
+	})
+
+	t.Run("most restrictive", func(t *testing.T) {
+		app, _, _ := newRateLimitedApp()
+		r := setupRouter(app)
+		b, _ := json.Marshal(data.User{Address: "0x8ba1f109551bd432803012645ac136ddd64dba72", Email: "john.doe@mailservice.com", Type: "contractor", Sponsor: sponsor})
+		w := send(r, "POST", "/register", b)
+		if w.Code != http.StatusAccepted {
+			t.Errorf("incorrect status, got %d, want %d", w.Code, http.StatusAccepted)
+			t.FailNow()
+		}
+		check(t, w, "3", "2", "3600", "") // email: 3 per hour
+	})
+
+	t.Run("exempt", func(t *testing.T) {
+		app, _, _ := newRateLimitedApp()
+		check(t, send(setupRouter(app), "GET", "/health", nil), "", "", "", "")
+	})
+
+	t.Run("unlimited", func(t *testing.T) {
+		app, _, _ := newRateLimitedApp()
+		app.rl = limiter.NewUnlimited()
+		check(t, send(setupRouter(app), "GET", "/unknown", nil), "", "", "", "")
+	})
+}
@@ -2,38 +2,100 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"embed"
 	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"expvar"
 	"fmt"
 	"html/template"
+	"log"
+	"net"
 	"net/http"
 	"regexp"
 	"sort"
 	"strconv"
+	"strings"
 	"time"
 
+	"github.com/fairhive-labs/preregister/internal/audit"
+	"github.com/fairhive-labs/preregister/internal/auth"
+	"github.com/fairhive-labs/preregister/internal/captcha"
+	"github.com/fairhive-labs/preregister/internal/clientip"
+	"github.com/fairhive-labs/preregister/internal/crypto"
+	"github.com/fairhive-labs/preregister/internal/crypto/cipher"
 	"github.com/fairhive-labs/preregister/internal/data"
+	"github.com/fairhive-labs/preregister/internal/i18n"
+	"github.com/fairhive-labs/preregister/internal/mailer"
+	"github.com/fairhive-labs/preregister/internal/outbox"
+	"github.com/fairhive-labs/preregister/internal/pending"
 	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"github.com/go-playground/validator/v10"
 )
 
 //go:embed templates
 var tfs embed.FS
 
+const (
+	identityKey     = "identity"
+	auditRowsKey    = "audit.rows"
+	auditFiltersKey = "audit.filters" // recorded with the query and the params
+	clientIPKey     = "client.ip"
+	clientKeyKey    = "client.key"
+
+	powChallengeHeader = "X-PoW-Challenge"
+	powNonceHeader     = "X-PoW-Nonce"
+)
+
 func setupRouter(app *App) *gin.Engine {
-	r := gin.Default()
+	r := gin.New()
+	r.SetTrustedProxies(nil) // client IPs are resolved by app.resolveIP
+	r.Use(gin.LoggerWithFormatter(app.logFormatter), gin.Recovery())
 	t := template.Must(template.ParseFS(tfs, "templates/*"))
 	r.SetHTMLTemplate(t)
-	r.Use(app.cors, app.limit)
+	r.Use(app.resolveIP, app.cors, app.filterIP, app.limit)
 	r.GET("/health", func(c *gin.Context) {
 		c.String(http.StatusOK, "ok")
 	})
-	r.GET("/:path1/:path2/count", app.count)
-	r.GET("/:path1/:path2/list", app.list)
+	admin := r.Group("/admin", app.requireAllowlist, app.adminAuth, app.auditLog, app.limit) // limit again, per admin
+	admin.GET("/count", require(auth.PermCount), app.count)
+	admin.GET("/list", require(auth.PermList), app.list)
+	admin.DELETE("/users/:address", require(auth.PermMutate), app.deleteUser)
+	admin.GET("/audit", require(auth.PermAudit), app.auditEntries)
+	admin.GET("/metrics", require(auth.PermAudit), app.metrics)
+	admin.GET("/outbox/dead", require(auth.PermMutate), app.deadLetters)
+	admin.POST("/outbox/dead/:id/replay", require(auth.PermMutate), app.replayDeadLetter)
+	admin.GET("/funnel", require(auth.PermCount), app.funnel)
+	admin.GET("/templates", require(auth.PermCount), app.emailTemplates)
+	admin.GET("/templates/:name", require(auth.PermCount), app.previewTemplate)
+	admin.POST("/templates/:name/send", require(auth.PermMutate), app.sendTemplate)
+	if app.secpath1 != "" && app.secpath2 != "" { // deprecated
+		r.GET("/:path1/:path2/count", app.requireAllowlist, app.secretPath, app.auditLog, app.limit, require(auth.PermCount), app.count)
+		r.GET("/:path1/:path2/list", app.requireAllowlist, app.secretPath, app.auditLog, app.limit, require(auth.PermList), app.list)
+	}
+	if app.pow != nil {
+		r.GET("/challenge", app.challenge)
+	}
 	r.POST("/register", app.register)
+	r.POST("/activate/resend", app.resend)
 	r.POST("/activate/:token/:hash", app.activate)
 	return r
 }
 
+// locales matches the locales of the users with the locales of the email templates
+var locales = i18n.NewMatcher(mailer.Locales())
+
+// translator localizes the validation errors of the request bodies
+var translator = func() *i18n.Translator {
+	t, err := i18n.NewTranslator(binding.Validator.Engine().(*validator.Validate))
+	if err != nil {
+		panic(err)
+	}
+	return t
+}()
+
 var jwtregexp = regexp.MustCompile(`^[A-Za-z0-9-_]+\.[A-Za-z0-9-_]+\.[A-Za-z0-9-_]*$`)
 
 func generateSecuredLink(t string) string {
@@ -42,8 +104,22 @@ func generateSecuredLink(t string) string {
 
 func (app *App) register(c *gin.Context) {
 	var u data.User
-	if err := c.ShouldBindJSON(&u); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	err := c.ShouldBindJSON(&u)
+	u.Locale = locales.Match(u.Locale, c.GetHeader("Accept-Language"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": translator.Translate(err, u.Locale)})
+		return
+	}
+
+	if !app.verifyHuman(c) {
+		return
+	}
+
+	if !app.validateEmail(c, &u) {
+		return
+	}
+
+	if !app.checkEmail(c, u.Email) {
 		return
 	}
 
@@ -56,8 +132,11 @@ func (app *App) register(c *gin.Context) {
 	app.wg.Add(1)
 	go func() {
 		defer app.wg.Done()
+		if app.pending != nil {
+			app.track(&u)
+		}
 		sl := generateSecuredLink(token)
-		app.mailer.SendActivationEmail(u.Email, sl, hash)
+		app.mailer.SendActivationEmail(u.Email, sl, hash, u.Locale) // throttled emails are not reported to the caller
 	}()
 
 	r := gin.H{
@@ -104,8 +183,12 @@ func (app *App) activate(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err})
 		return
 	}
-	e := u.Email         // user's email will be replaced by encryted value, so better do a copy
-	err = app.db.Save(u) //user data are replaced by saved one
+	if !app.checkEmail(c, u.Email) {
+		return
+	}
+
+	e, l := u.Email, u.Locale // user's email will be replaced by encryted value, so better do a copy
+	err = app.db.Save(u)      //user data are replaced by saved one
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
@@ -114,20 +197,384 @@ func (app *App) activate(c *gin.Context) {
 	app.wg.Add(1)
 	go func() {
 		defer app.wg.Done()
-		app.mailer.SendConfirmationEmail(e)
+		if app.pending != nil {
+			if err := app.pending.Activate(u.Address); err != nil {
+				log.Printf("🔥 Cannot mark pending registration of %s as activated: %v\n", u.Address, err)
+			}
+		}
+		app.mailer.SendConfirmationEmail(e, l)
 	}()
 
 	c.JSON(http.StatusCreated, u)
 }
 
-func (app *App) limit(c *gin.Context) {
-	ip := c.ClientIP()
-	l := app.rl.GetAccess(ip)
-	if !l.Allow() {
-		c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{
-			"error": "Too Many Requests",
-			"ip":    ip,
-		})
+// track follows the registration of u until its activation, registered addresses are not tracked again.
+// Failures are logged, the registration is still valid but it will not be reminded.
+func (app *App) track(u *data.User) {
+	ok, err := app.db.IsPresent(u.Address)
+	if err != nil {
+		log.Printf("🔥 Cannot check registration of %s: %v\n", u.Address, err)
+		return
+	}
+	if ok {
+		return
+	}
+	err = app.pending.Register(u)
+	switch {
+	case errors.Is(err, pending.ErrActivated): // activated while not saved yet, or by another dyno
+	case err != nil:
+		log.Printf("🔥 Cannot track pending registration of %s: %v\n", u.Address, err)
+	}
+}
+
+// resend sends a new activation link to a pending registration, found by address or email.
+// The response is the same whether the registration exists or not, emails are throttled per recipient.
+func (app *App) resend(c *gin.Context) {
+	var r struct {
+		Address string `json:"address" binding:"required_without=Email,omitempty,eth_addr"`
+		Email   string `json:"email" binding:"required_without=Address,omitempty,email"`
+	}
+	if err := c.ShouldBindJSON(&r); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": translator.Translate(err, locales.Match("", c.GetHeader("Accept-Language")))})
+		return
+	}
+	if app.pending == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "no pending registrations"})
+		return
+	}
+
+	app.wg.Add(1)
+	go func() { // looked up after the response, so its time does not reveal the registration either
+		defer app.wg.Done()
+		u, err := app.pending.Find(r.Address, r.Email)
+		if errors.Is(err, pending.ErrNotFound) {
+			return
+		}
+		if err != nil {
+			log.Printf("🔥 Cannot find pending registration: %v\n", err)
+			return
+		}
+		token, err := app.jwt.Create(u, time.Now())
+		if err != nil {
+			log.Printf("🔥 Cannot create activation token for %s: %v\n", u.Address, err)
+			return
+		}
+		app.mailer.SendActivationEmail(u.Email, generateSecuredLink(token), app.jwt.Hash(token), u.Locale)
+	}()
+
+	c.JSON(http.StatusAccepted, gin.H{"message": "if a registration is pending, a new activation link is sent"})
+}
+
+// remind sends a reminder, with a fresh activation link valid for crypto.ReminderTTL, to the pending registrations which are due
+func (app *App) remind() {
+	us, err := app.pending.Due()
+	if err != nil {
+		log.Printf("🔥 Cannot get due pending registrations: %v\n", err)
+	}
+	for _, u := range us {
+		token, err := app.jwt.CreateFor(u, time.Now(), crypto.ReminderTTL)
+		if err != nil {
+			log.Printf("🔥 Cannot create reminder token for %s: %v\n", u.Address, err)
+			continue
+		}
+		app.mailer.SendReminderEmail(u.Email, generateSecuredLink(token), app.jwt.Hash(token), u.Locale)
+	}
+}
+
+func (app *App) challenge(c *gin.Context) {
+	ch, err := app.pow.Issue(time.Now())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, ch)
+}
+
+// verifyHuman verifies the proof of work or the CAPTCHA token of the request and returns false if the request has been aborted.
+// When both are enabled, a request carrying a challenge is verified with the proof of work only.
+func (app *App) verifyHuman(c *gin.Context) bool {
+	if app.pow == nil || (app.captcha != nil && c.GetHeader(powChallengeHeader) == "") {
+		return app.verifyCaptcha(c)
+	}
+	if err := app.pow.Verify(c.GetHeader(powChallengeHeader), c.GetHeader(powNonceHeader), time.Now()); err != nil {
+		c.JSON(http.StatusForbidden, gin.H{"error": "proof of work verification failed"})
+		return false
+	}
+	return true
+}
+
+// verifyCaptcha verifies the CAPTCHA token of the request and returns false if the request has been aborted
+func (app *App) verifyCaptcha(c *gin.Context) bool {
+	if app.captcha == nil {
+		return true
+	}
+	err := app.captcha.Verify(c.GetHeader(captcha.TokenHeader), clientIP(c))
+	switch {
+	case err == nil:
+		return true
+	case errors.Is(err, captcha.ErrUnavailable):
+		log.Printf("⚠️ CAPTCHA verification failure: %v\n", err)
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "captcha verification unavailable"})
+	default:
+		c.JSON(http.StatusForbidden, gin.H{"error": "captcha verification failed"})
+	}
+	return false
+}
+
+// validateEmail rejects the disposable and undeliverable emails, normalizes the email of u
+// and returns false if the request has been aborted
+func (app *App) validateEmail(c *gin.Context, u *data.User) bool {
+	if app.emails == nil {
+		return true
+	}
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 3*time.Second)
+	defer cancel()
+	e, err := app.emails.Check(ctx, u.Email)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return false
+	}
+	u.Email = e
+	return true
+}
+
+// checkEmail applies the duplicate email policy and returns false if the request has been aborted
+func (app *App) checkEmail(c *gin.Context, e string) bool {
+	if app.ep == "" || app.ep == allowDuplicateEmail {
+		return true
+	}
+	n, err := app.db.CountEmail(e)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return false
+	}
+	if n == 0 {
+		return true
+	}
+	if app.ep == rejectDuplicateEmail {
+		c.JSON(http.StatusConflict, gin.H{"error": "email already used"})
+		return false
+	}
+	log.Printf("⚠️ Email already used by %d user(s)\n", n)
+	return true
+}
+
+// adminAuth authenticates the admin with an API key or an OIDC bearer token
+func (app *App) adminAuth(c *gin.Context) {
+	ip, cred := clientKey(c), credential(c.Request)
+	if app.lockedOut(c, ip, cred) {
+		return
+	}
+	if app.auth == nil {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	id, err := app.auth.Authenticate(c.Request)
+	if err != nil {
+		if !errors.Is(err, auth.ErrNoCredentials) {
+			app.failAuth(ip, cred)
+		}
+		c.Header("WWW-Authenticate", `Bearer realm="admin"`)
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	app.resetAuth(ip, cred)
+	c.Set(identityKey, id)
+	c.Next()
+}
+
+// credential returns the hash of the admin credential sent with the request, empty if none
+func credential(r *http.Request) string {
+	if k := r.Header.Get(auth.APIKeyHeader); k != "" {
+		return auth.HashAPIKey(k)
+	}
+	if a := r.Header.Get("Authorization"); a != "" {
+		return auth.HashAPIKey(a)
+	}
+	return ""
+}
+
+func lockoutKeys(ip, cred string) []string {
+	k := []string{"ip:" + ip}
+	if cred != "" {
+		k = append(k, "credential:"+cred)
+	}
+	return k
+}
+
+// lockedOut aborts with 429 if the IP or the credential is locked out after too many admin auth failures
+func (app *App) lockedOut(c *gin.Context, ip, cred string) bool {
+	if app.lo == nil {
+		return false
+	}
+	for _, k := range lockoutKeys(ip, cred) {
+		if d := app.lo.Locked(k); d > 0 {
+			c.Header("Retry-After", strconv.Itoa(int(d.Round(time.Second).Seconds())))
+			c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"error": "Too Many Requests"})
+			return true
+		}
+	}
+	return false
+}
+
+func (app *App) failAuth(ip, cred string) {
+	if app.lo == nil {
+		return
+	}
+	for _, k := range lockoutKeys(ip, cred) {
+		if d := app.lo.Fail(k); d > 0 {
+			log.Printf("🔒 Admin auth locked out %s for %v\n", k, d)
+		}
+	}
+}
+
+func (app *App) resetAuth(ip, cred string) {
+	if app.lo == nil {
+		return
+	}
+	for _, k := range lockoutKeys(ip, cred) {
+		app.lo.Reset(k)
+	}
+}
+
+// identity returns the authenticated admin
+func identity(c *gin.Context) *auth.Identity {
+	id, _ := c.Get(identityKey)
+	v, _ := id.(*auth.Identity)
+	return v
+}
+
+// require forbids the request if the admin is not granted the permission p
+func require(p auth.Permission) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !identity(c).Can(p) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Forbidden"})
+			return
+		}
+		c.Next()
+	}
+}
+
+// auditLog records the admin access, once the request is handled
+func (app *App) auditLog(c *gin.Context) {
+	c.Next()
+	if app.audit == nil {
+		return
+	}
+	id := identity(c)
+	if id == nil {
+		return
+	}
+	filters := map[string]string{}
+	for k, v := range c.Request.URL.Query() {
+		filters[k] = strings.Join(v, ",")
+	}
+	for _, p := range c.Params {
+		if p.Key != "path1" && p.Key != "path2" { // never record the secure paths
+			filters[p.Key] = p.Value
+		}
+	}
+	if fs, ok := c.Get(auditFiltersKey); ok {
+		for k, v := range fs.(map[string]string) {
+			filters[k] = v
+		}
+	}
+	e := audit.NewEntry(id.Subject, id.Method, clientIP(c), c.Request.Method+" "+c.FullPath(), filters, c.GetInt(auditRowsKey), c.Writer.Status())
+	if err := app.audit.Write(e); err != nil {
+		log.Printf("🔥 Cannot write audit entry %v: %v\n", *e, err)
+	}
+}
+
+// secretPath authenticates the admin with the secure paths.
+// Deprecated: use the /admin routes
+func (app *App) secretPath(c *gin.Context) {
+	ip := clientKey(c)
+	if app.lockedOut(c, ip, "") {
+		return
+	}
+	p1, p2 := c.Param("path1"), c.Param("path2")
+	if p1 != app.secpath1 || p2 != app.secpath2 {
+		app.failAuth(ip, "")
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+	app.resetAuth(ip, "")
+	c.Header("Deprecation", "true")
+	c.Set(identityKey, &auth.Identity{Subject: "secure-path", Method: "secpath", Roles: auth.AllRoles})
+	c.Next()
+}
+
+// logFormatter is gin's default log format, with the secure paths redacted
+func (app *App) logFormatter(p gin.LogFormatterParams) string {
+	path := p.Path
+	if app.secpath1 != "" && app.secpath2 != "" {
+		path = strings.Replace(path, "/"+app.secpath1+"/"+app.secpath2+"/", "/***/***/", 1)
+	}
+	return fmt.Sprintf("[GIN] %v | %3d | %13v | %15s | %-7s %#v\n%s",
+		p.TimeStamp.Format("2006/01/02 - 15:04:05"),
+		p.StatusCode,
+		p.Latency,
+		logClientIP(p),
+		p.Method,
+		path,
+		p.ErrorMessage,
+	)
+}
+
+func logClientIP(p gin.LogFormatterParams) string {
+	if ip, ok := p.Keys[clientIPKey].(string); ok {
+		return ip
+	}
+	return p.ClientIP
+}
+
+var directResolver, _ = clientip.New(nil)
+
+// resolveIP resolves the client IP through the trusted proxies, and its key aggregating IPv6 /64 networks
+func (app *App) resolveIP(c *gin.Context) {
+	r := app.ips
+	if r == nil {
+		r = directResolver
+	}
+	ip := r.IP(c.Request)
+	if ip != nil {
+		c.Set(clientIPKey, ip.String())
+	}
+	c.Set(clientKeyKey, clientip.Key(ip))
+	c.Next()
+}
+
+// clientIP returns the client IP resolved by app.resolveIP
+func clientIP(c *gin.Context) string {
+	return c.GetString(clientIPKey)
+}
+
+// clientKey returns the key of the client IP, used to limit the requests per client
+func clientKey(c *gin.Context) string {
+	return c.GetString(clientKeyKey)
+}
+
+// filterIP forbids the clients denied by the IP filter
+func (app *App) filterIP(c *gin.Context) {
+	if app.ipf == nil {
+		c.Next()
+		return
+	}
+	if ok, _ := app.ipf.Allowed(net.ParseIP(clientIP(c))); !ok {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Forbidden"})
+		return
+	}
+	c.Next()
+}
+
+// requireAllowlist forbids the clients not in the allow list of the IP filter, if required for admin routes
+func (app *App) requireAllowlist(c *gin.Context) {
+	if !app.allowlist {
+		c.Next()
+		return
+	}
+	if app.ipf == nil || !app.ipf.Listed(net.ParseIP(clientIP(c))) {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Forbidden"})
 		return
 	}
 	c.Next()
@@ -136,8 +583,9 @@ func (app *App) limit(c *gin.Context) {
 func (app *App) cors(c *gin.Context) {
 	c.Writer.Header().Set("Access-Control-Allow-Origin", "*")
 	c.Writer.Header().Set("Access-Control-Allow-Credentials", "true")
-	c.Writer.Header().Set("Access-Control-Allow-Headers", "origin, content-type, accept, authorization")
+	c.Writer.Header().Set("Access-Control-Allow-Headers", "origin, content-type, accept, authorization, x-api-key, x-captcha-token, x-pow-challenge, x-pow-nonce")
 	c.Writer.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS")
+	c.Writer.Header().Set("Access-Control-Expose-Headers", "RateLimit-Limit, RateLimit-Remaining, RateLimit-Reset, Retry-After")
 
 	if c.Request.Method == "OPTIONS" {
 		c.AbortWithStatus(http.StatusNoContent)
@@ -147,11 +595,6 @@ func (app *App) cors(c *gin.Context) {
 }
 
 func (app *App) count(c *gin.Context) {
-	p1, p2 := c.Param("path1"), c.Param("path2")
-	if p1 != app.secpath1 || p2 != app.secpath2 {
-		c.AbortWithStatus(http.StatusNotFound)
-		return
-	}
 	cn, err := app.db.Count()
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
@@ -162,6 +605,7 @@ func (app *App) count(c *gin.Context) {
 	for _, v := range cn {
 		t += v
 	}
+	c.Set(auditRowsKey, t)
 	mime := c.DefaultQuery("mime", "html")
 	switch mime {
 	case "json":
@@ -201,12 +645,6 @@ func (app *App) count(c *gin.Context) {
 }
 
 func (app *App) list(c *gin.Context) {
-	p1, p2 := c.Param("path1"), c.Param("path2")
-	if p1 != app.secpath1 || p2 != app.secpath2 {
-		c.AbortWithStatus(http.StatusNotFound)
-		return
-	}
-
 	options := []int{}
 	offset := c.Query("offset")
 	if offset != "" {
@@ -226,11 +664,26 @@ func (app *App) list(c *gin.Context) {
 		options = append(options, v)
 	}
 
+	rcpt, encrypt := c.Query("recipient"), c.Query("encrypt") == "true"
+	if rcpt == "" && encrypt {
+		rcpt = app.recipient
+		if rcpt == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "no recipient to encrypt the export"})
+			return
+		}
+	}
+
 	users, err := app.db.List(options...)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
+	if !identity(c).Can(auth.PermDecrypt) {
+		for _, u := range users {
+			u.Email = data.MaskEmail(u.Email)
+		}
+	}
+	c.Set(auditRowsKey, len(users))
 
 	mime := c.DefaultQuery("mime", "json")
 	switch mime {
@@ -251,16 +704,299 @@ func (app *App) list(c *gin.Context) {
 			}
 		}
 		w.Flush()
+		if rcpt != "" {
+			sendEncryptedExport(c, "csv", rcpt, b.Bytes())
+			return
+		}
 		c.Header("Content-Description", "File Transfer")
 		c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=users_list_%s.csv", time.Now().Format("20060102-150405")))
 		c.Data(http.StatusOK, "text/csv", b.Bytes())
 		// c.Writer.Write(b.Bytes())
 		return
 	default:
-		c.JSON(http.StatusOK, gin.H{
+		r := gin.H{
 			"users": users,
 			"count": len(users),
+		}
+		if rcpt != "" {
+			b, err := json.Marshal(r)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			sendEncryptedExport(c, "json", rcpt, b)
+			return
+		}
+		c.JSON(http.StatusOK, r)
+		return
+	}
+}
+
+// sendEncryptedExport sends the export b encrypted for the recipient rcpt (X25519 public key, hex encoded)
+func sendEncryptedExport(c *gin.Context, ext, rcpt string, b []byte) {
+	enc := new(bytes.Buffer)
+	w, err := cipher.NewEncryptWriter(enc, rcpt)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if _, err := w.Write(b); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if err := w.Close(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.Header("Content-Description", "File Transfer")
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=users_list_%s.%s.enc", time.Now().Format("20060102-150405"), ext))
+	c.Data(http.StatusOK, "application/octet-stream", enc.Bytes())
+}
+
+func (app *App) deleteUser(c *gin.Context) {
+	a := c.Param("address")
+	r, err := app.db.IsPresent(a)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if !r {
+		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("user address %s not found", a)})
+		return
+	}
+	if err := app.db.Delete(a); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.Set(auditRowsKey, 1)
+	c.Status(http.StatusNoContent)
+}
+
+// deadLetter is a dead letter without its activation link, the email is masked
+type deadLetter struct {
+	ID        string `json:"id"`
+	Kind      string `json:"kind"`
+	To        string `json:"to"`
+	Attempts  int    `json:"attempts"`
+	LastError string `json:"last_error"`
+	CreatedAt int64  `json:"created_at"`
+}
+
+func (app *App) deadLetters(c *gin.Context) {
+	if app.outbox == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "no outbox"})
+		return
+	}
+	ms, err := app.outbox.DeadLetters()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	dl := make([]deadLetter, len(ms))
+	for i, m := range ms {
+		dl[i] = deadLetter{m.ID, m.Kind, data.MaskEmail(m.To), m.Attempts, m.LastError, m.CreatedAt}
+	}
+	c.Set(auditRowsKey, len(dl))
+	c.JSON(http.StatusOK, gin.H{
+		"messages": dl,
+		"count":    len(dl),
+	})
+}
+
+func (app *App) replayDeadLetter(c *gin.Context) {
+	if app.outbox == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "no outbox"})
+		return
+	}
+	m, err := app.outbox.Replay(c.Param("id"))
+	switch {
+	case errors.Is(err, outbox.ErrNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	case errors.Is(err, outbox.ErrNotDead):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	case errors.Is(err, outbox.ErrLinkExpired):
+		c.JSON(http.StatusGone, gin.H{"error": err.Error()})
+		return
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.Set(auditRowsKey, 1)
+	c.JSON(http.StatusAccepted, gin.H{"id": m.ID, "state": m.State})
+}
+
+// funnel reports the conversion of the pending registrations created since the optional RFC 3339 time
+func (app *App) funnel(c *gin.Context) {
+	if app.pending == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "no pending registrations"})
+		return
+	}
+	var since time.Time
+	if v := c.Query("since"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			c.AbortWithStatus(http.StatusBadRequest)
+			return
+		}
+		since = t
+	}
+	f, err := app.pending.Funnel(since)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.Set(auditRowsKey, f.Registered)
+	c.JSON(http.StatusOK, f)
+}
+
+func (app *App) emailTemplates(c *gin.Context) {
+	if app.templates == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "no email templates"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"templates": mailer.Templates(),
+		"locales":   mailer.Locales(),
+	})
+}
+
+// previewTemplate renders the template with sample data, as html (default), text or json
+func (app *App) previewTemplate(c *gin.Context) {
+	if app.templates == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "no email templates"})
+		return
+	}
+	m, err := app.templates.Preview(c.Param("name"), c.DefaultQuery("locale", i18n.Default), "john.doe@domain.com")
+	switch {
+	case errors.Is(err, mailer.ErrUnknownTemplate), errors.Is(err, mailer.ErrUnknownLocale):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	switch mime := c.DefaultQuery("mime", "html"); mime {
+	case "html":
+		c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(m.HTML))
+	case "text":
+		c.String(http.StatusOK, m.Text)
+	case "json":
+		c.JSON(http.StatusOK, gin.H{
+			"from":    m.From.String(),
+			"subject": m.Subject,
+			"html":    m.HTML,
+			"text":    m.Text,
 		})
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("unsupported mime %q", mime)})
+	}
+}
+
+// sendTemplate delivers the preview to the email of the request with the configured transport,
+// within the limits of the recipient
+func (app *App) sendTemplate(c *gin.Context) {
+	if app.templates == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "no email templates"})
 		return
 	}
+	var r struct {
+		Email  string `json:"email" binding:"required,email"`
+		Locale string `json:"locale"`
+	}
+	if err := c.ShouldBindJSON(&r); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": translator.Translate(err, i18n.Default)})
+		return
+	}
+	if r.Locale == "" {
+		r.Locale = i18n.Default
+	}
+	c.Set(auditFiltersKey, map[string]string{"to": data.MaskEmail(r.Email), "locale": r.Locale})
+	_, err := app.templates.Preview(c.Param("name"), r.Locale, r.Email) // before using the limits of the recipient
+	if errors.Is(err, mailer.ErrUnknownTemplate) || errors.Is(err, mailer.ErrUnknownLocale) {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	if th, ok := app.mailer.(*mailer.Throttled); ok && err == nil {
+		err = th.Allow(r.Email)
+	}
+	if err == nil {
+		err = app.templates.SendPreview(c.Param("name"), r.Locale, r.Email)
+	}
+	switch {
+	case errors.Is(err, mailer.ErrSuppressed):
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": err.Error()})
+		return
+	case err != nil:
+		log.Printf("⚠️ Preview to %q not sent: %v\n", data.MaskEmail(r.Email), err)
+		c.JSON(http.StatusBadGateway, gin.H{"error": "preview not sent"})
+		return
+	}
+	c.Set(auditRowsKey, 1)
+	c.JSON(http.StatusOK, gin.H{"template": c.Param("name"), "locale": r.Locale, "to": r.Email})
+}
+
+// metricNames are the expvar variables published by the app, the standard cmdline and memstats are not exposed
+var metricNames = []string{
+	"ipfilter_denied",
+	"lockout_failures",
+	"lockout_locks",
+	"lockout_rejects",
+	"mailer_suppressed",
+	"outbox",
+	"pending",
+}
+
+func (app *App) metrics(c *gin.Context) {
+	m := map[string]json.RawMessage{}
+	for _, n := range metricNames {
+		if v := expvar.Get(n); v != nil {
+			m[n] = json.RawMessage(v.String())
+		}
+	}
+	c.JSON(http.StatusOK, m)
+}
+
+func (app *App) auditEntries(c *gin.Context) {
+	if app.audit == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "no audit log"})
+		return
+	}
+	f := audit.Filter{Admin: c.Query("admin")}
+	if v := c.Query("since"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			c.AbortWithStatus(http.StatusBadRequest)
+			return
+		}
+		f.Since = t
+	}
+	if v := c.Query("until"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			c.AbortWithStatus(http.StatusBadRequest)
+			return
+		}
+		f.Until = t
+	}
+	if v := c.Query("max"); v != "" {
+		m, err := strconv.Atoi(v)
+		if err != nil || m < 0 {
+			c.AbortWithStatus(http.StatusBadRequest)
+			return
+		}
+		f.Max = m
+	}
+
+	entries, err := app.audit.Query(f)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.Set(auditRowsKey, len(entries))
+	c.JSON(http.StatusOK, gin.H{
+		"entries": entries,
+		"count":   len(entries),
+	})
 }
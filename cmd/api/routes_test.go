@@ -4,19 +4,37 @@ import (
 	"bytes"
 	"encoding/json"
 	"encoding/xml"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"net/mail"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/fairhive-labs/preregister/internal/audit"
+	"github.com/fairhive-labs/preregister/internal/auth"
+	"github.com/fairhive-labs/preregister/internal/captcha"
+	"github.com/fairhive-labs/preregister/internal/clientip"
 	"github.com/fairhive-labs/preregister/internal/crypto"
 	"github.com/fairhive-labs/preregister/internal/crypto/cipher"
 	"github.com/fairhive-labs/preregister/internal/data"
+	"github.com/fairhive-labs/preregister/internal/emailcheck"
+	"github.com/fairhive-labs/preregister/internal/ipfilter"
 	"github.com/fairhive-labs/preregister/internal/limiter"
 	"github.com/fairhive-labs/preregister/internal/mailer"
+	"github.com/fairhive-labs/preregister/internal/outbox"
+	"github.com/fairhive-labs/preregister/internal/pending"
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v4"
 )
 
 const sponsor = "0xD01efFE216E16a85Fc529db66c26aBeCf4D885f8" // real address but empty balance
@@ -25,13 +43,13 @@ func TestRegister(t *testing.T) {
 	var db data.DB = data.MockDB
 	k, _ := cipher.GenerateKey(32)
 	app := &App{
-		db,
-		crypto.NewJWTHS256(k),
-		&mailer.MockSmtpMailer,
-		sync.WaitGroup{},
-		limiter.NewUnlimited(),
-		"path1",
-		"path2",
+		db:       db,
+		jwt:      crypto.NewJWTHS256(k),
+		mailer:   &mailer.MockSmtpMailer,
+		wg:       sync.WaitGroup{},
+		rl:       limiter.NewUnlimited(),
+		secpath1: "path1",
+		secpath2: "path2",
 	}
 	r := setupRouter(app)
 	tt := []struct {
@@ -96,91 +114,91 @@ func TestRegister(t *testing.T) {
 			"john.doe@mailservice.com",
 			"contractor",
 			http.StatusBadRequest,
-			`{"error":"Key: 'User.Address' Error:Field validation for 'Address' failed on the 'required' tag"}`,
+			`{"error":"address is a required field"}`,
 		},
 		{"0x address",
 			"0x",
 			"john.doe@mailservice.com",
 			"contractor",
 			http.StatusBadRequest,
-			`{"error":"Key: 'User.Address' Error:Field validation for 'Address' failed on the 'eth_addr' tag"}`,
+			`{"error":"address must be a valid Ethereum address"}`,
 		},
 		{"0x0000 address",
 			"0x0000",
 			"john.doe@mailservice.com",
 			"contractor",
 			http.StatusBadRequest,
-			`{"error":"Key: 'User.Address' Error:Field validation for 'Address' failed on the 'eth_addr' tag"}`,
+			`{"error":"address must be a valid Ethereum address"}`,
 		},
 		{"non hexadecimal address",
 			"0xYZ25EF3F5B8A186998338A2ADA83795FBA2D695E",
 			"john.doe@mailservice.com",
 			"contractor",
 			http.StatusBadRequest,
-			`{"error":"Key: 'User.Address' Error:Field validation for 'Address' failed on the 'eth_addr' tag"}`,
+			`{"error":"address must be a valid Ethereum address"}`,
 		},
 		{"too short address",
 			"0xDC25EF3F5B8A186998338A2ADA83795FBA2D69",
 			"john.doe@mailservice.com",
 			"contractor",
 			http.StatusBadRequest,
-			`{"error":"Key: 'User.Address' Error:Field validation for 'Address' failed on the 'eth_addr' tag"}`,
+			`{"error":"address must be a valid Ethereum address"}`,
 		},
 		{"too long address",
 			"0xDC25EF3F5B8A186998338A2ADA83795FBA2D695E5E5E5E",
 			"john.doe@mailservice.com",
 			"contractor",
 			http.StatusBadRequest,
-			`{"error":"Key: 'User.Address' Error:Field validation for 'Address' failed on the 'eth_addr' tag"}`,
+			`{"error":"address must be a valid Ethereum address"}`,
 		},
 		{"empty email",
 			"0x8ba1f109551bD432803012645Ac136ddd64DBA72",
 			"",
 			"contractor",
 			http.StatusBadRequest,
-			`{"error":"Key: 'User.Email' Error:Field validation for 'Email' failed on the 'required' tag"}`,
+			`{"error":"email is a required field"}`,
 		},
 		{"malformated email unsupported special characters",
 			"0x8ba1f109551bD432803012645Ac136ddd64DBA72",
 			"john/doe@email_^me.fr",
 			"contractor",
 			http.StatusBadRequest,
-			`{"error":"Key: 'User.Email' Error:Field validation for 'Email' failed on the 'email' tag"}`,
+			`{"error":"email must be a valid email address"}`,
 		},
 		{"malformated email no @",
 			"0x8ba1f109551bD432803012645Ac136ddd64DBA72",
 			"john.doe.email.fr",
 			"contractor",
 			http.StatusBadRequest,
-			`{"error":"Key: 'User.Email' Error:Field validation for 'Email' failed on the 'email' tag"}`,
+			`{"error":"email must be a valid email address"}`,
 		},
 		{"malformated email no user",
 			"0x8ba1f109551bD432803012645Ac136ddd64DBA72",
 			"@ovh.com",
 			"contractor",
 			http.StatusBadRequest,
-			`{"error":"Key: 'User.Email' Error:Field validation for 'Email' failed on the 'email' tag"}`,
+			`{"error":"email must be a valid email address"}`,
 		},
 		{"malformated email no domain",
 			"0x8ba1f109551bD432803012645Ac136ddd64DBA72",
 			"john.doe@",
 			"contractor",
 			http.StatusBadRequest,
-			`{"error":"Key: 'User.Email' Error:Field validation for 'Email' failed on the 'email' tag"}`,
+			`{"error":"email must be a valid email address"}`,
 		},
 		{"empty type of user",
 			"0x8ba1f109551bD432803012645Ac136ddd64DBA72",
 			"john.doe@mailservice.com",
 			"",
 			http.StatusBadRequest,
-			`{"error":"Key: 'User.Type' Error:Field validation for 'Type' failed on the 'required' tag"}`,
+			`{"error":"type is a required field"}`,
 		},
 		{"unsupported type of user",
 			"0x8ba1f109551bD432803012645Ac136ddd64DBA72",
 			"john.doe@mailservice.com",
 			"dev",
 			http.StatusBadRequest,
-			`{"error":"Key: 'User.Type' Error:Field validation for 'Type' failed on the 'oneof' tag"}`,
+			`{"error":"type must be one of [advisor agent initiator contributor investor mentor contractor]"}`,
 		},
 	}
 
@@ -248,13 +266,13 @@ func TestActivate(t *testing.T) {
 	var db data.DB = data.NewMockDBContent([]string{sponsor})
 	k, _ := cipher.GenerateKey(32)
 	app := &App{
-		db,
-		crypto.NewJWTHS256(k),
-		&mailer.MockSmtpMailer,
-		sync.WaitGroup{},
-		limiter.NewUnlimited(),
-		"path1",
-		"path2",
+		db:       db,
+		jwt:      crypto.NewJWTHS256(k),
+		mailer:   &mailer.MockSmtpMailer,
+		wg:       sync.WaitGroup{},
+		rl:       limiter.NewUnlimited(),
+		secpath1: "path1",
+		secpath2: "path2",
 	}
 	r := setupRouter(app)
 
@@ -408,13 +426,13 @@ func TestCount(t *testing.T) {
 	var db data.DB = data.MockDB
 	k, _ := cipher.GenerateKey(32)
 	app := &App{
-		db,
-		crypto.NewJWTHS256(k),
-		&mailer.MockSmtpMailer,
-		sync.WaitGroup{},
-		limiter.NewUnlimited(),
-		"path1",
-		"path2",
+		db:       db,
+		jwt:      crypto.NewJWTHS256(k),
+		mailer:   &mailer.MockSmtpMailer,
+		wg:       sync.WaitGroup{},
+		rl:       limiter.NewUnlimited(),
+		secpath1: "path1",
+		secpath2: "path2",
 	}
 	r := setupRouter(app)
 
@@ -576,13 +594,13 @@ func TestHealth(t *testing.T) {
 	var db data.DB = data.MockDB
 	k, _ := cipher.GenerateKey(32)
 	app := &App{
-		db,
-		crypto.NewJWTHS256(k),
-		&mailer.MockSmtpMailer,
-		sync.WaitGroup{},
-		limiter.NewUnlimited(),
-		"path1",
-		"path2",
+		db:       db,
+		jwt:      crypto.NewJWTHS256(k),
+		mailer:   &mailer.MockSmtpMailer,
+		wg:       sync.WaitGroup{},
+		rl:       limiter.NewUnlimited(),
+		secpath1: "path1",
+		secpath2: "path2",
 	}
 	r := setupRouter(app)
 
@@ -620,13 +638,13 @@ func TestList(t *testing.T) {
 	var db data.DB = data.MockDB
 	k, _ := cipher.GenerateKey(32)
 	app := &App{
-		db,
-		crypto.NewJWTHS256(k),
-		&mailer.MockSmtpMailer,
-		sync.WaitGroup{},
-		limiter.NewUnlimited(),
-		"path1",
-		"path2",
+		db:       db,
+		jwt:      crypto.NewJWTHS256(k),
+		mailer:   &mailer.MockSmtpMailer,
+		wg:       sync.WaitGroup{},
+		rl:       limiter.NewUnlimited(),
+		secpath1: "path1",
+		secpath2: "path2",
 	}
 	r := setupRouter(app)
 
@@ -790,3 +808,1422 @@ func TestList(t *testing.T) {
 		}
 	})
 }
+
+func TestDuplicateEmail(t *testing.T) {
+	k, _ := cipher.GenerateKey(32)
+	address, email, utype := "0x8ba1f109551bD432803012645Ac136ddd64DBA72", "john.doe@mailservice.com", "contractor"
+	app := &App{
+		jwt:      crypto.NewJWTHS256(k),
+		mailer:   &mailer.MockSmtpMailer,
+		wg:       sync.WaitGroup{},
+		rl:       limiter.NewUnlimited(),
+		secpath1: "path1",
+		secpath2: "path2",
+	}
+	jsonUser, _ := json.Marshal(data.User{
+		Address: address,
+		Email:   "John.Doe@MailService.com",
+		Type:    utype,
+		Sponsor: sponsor,
+	})
+	vt, _ := app.jwt.Create(&data.User{
+		Address: address,
+		Email:   email,
+		Type:    utype,
+		Sponsor: sponsor}, time.Now())
+	vh := app.jwt.Hash(vt)
+
+	tt := []struct {
+		name             string
+		ep               emailPolicy
+		db               data.DB
+		register, activa int
+	}{
+		{"no policy", "", data.NewMockDBContent([]string{sponsor, email}), http.StatusAccepted, http.StatusCreated},
+		{"allow", allowDuplicateEmail, data.NewMockDBContent([]string{sponsor, email}), http.StatusAccepted, http.StatusCreated},
+		{"warn", warnDuplicateEmail, data.NewMockDBContent([]string{sponsor, email}), http.StatusAccepted, http.StatusCreated},
+		{"reject", rejectDuplicateEmail, data.NewMockDBContent([]string{sponsor, email}), http.StatusConflict, http.StatusConflict},
+		{"reject new email", rejectDuplicateEmail, data.NewMockDBContent([]string{sponsor}), http.StatusAccepted, http.StatusCreated},
+		{"reject faulty DB", rejectDuplicateEmail, data.NewMockErrDB([]string{sponsor}), http.StatusInternalServerError, http.StatusInternalServerError},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			app.db = tc.db
+			app.ep = tc.ep
+			r := setupRouter(app)
+
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest("POST", "/register", bytes.NewBuffer(jsonUser))
+			r.ServeHTTP(w, req)
+			if w.Code != tc.register {
+				t.Errorf("incorrect register status, got %d, want %d", w.Code, tc.register)
+				t.FailNow()
+			}
+
+			w = httptest.NewRecorder()
+			req, _ = http.NewRequest("POST", fmt.Sprintf("/activate/%s/%s", vt, vh), nil)
+			r.ServeHTTP(w, req)
+			if w.Code != tc.activa {
+				t.Errorf("incorrect activate status, got %d, want %d", w.Code, tc.activa)
+				t.FailNow()
+			}
+		})
+	}
+}
+
+func TestEncryptedList(t *testing.T) {
+	k, _ := cipher.GenerateKey(32)
+	id, rcpt, _ := cipher.GenerateX25519Key()
+	app := &App{
+		db:       data.MockDB,
+		jwt:      crypto.NewJWTHS256(k),
+		mailer:   &mailer.MockSmtpMailer,
+		wg:       sync.WaitGroup{},
+		rl:       limiter.NewUnlimited(),
+		secpath1: "path1",
+		secpath2: "path2",
+	}
+	r := setupRouter(app)
+
+	tt := []struct {
+		name      string
+		query     string
+		recipient string
+		status    int
+		ext       string
+	}{
+		{"csv recipient", "mime=csv&recipient=" + rcpt, "", http.StatusOK, ".csv.enc"},
+		{"json recipient", "recipient=" + rcpt, "", http.StatusOK, ".json.enc"},
+		{"csv configured recipient", "mime=csv&encrypt=true", rcpt, http.StatusOK, ".csv.enc"},
+		{"no configured recipient", "mime=csv&encrypt=true", "", http.StatusBadRequest, ""},
+		{"invalid recipient", "mime=csv&recipient=n0tH3x", "", http.StatusBadRequest, ""},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			app.recipient = tc.recipient
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest("GET", fmt.Sprintf("/%s/%s/list?%s", app.secpath1, app.secpath2, tc.query), nil)
+			r.ServeHTTP(w, req)
+			if w.Code != tc.status {
+				t.Errorf("incorrect status, got %d, want %d", w.Code, tc.status)
+				t.FailNow()
+			}
+			if w.Code != http.StatusOK {
+				return
+			}
+
+			headers := w.Result().Header
+			if headers.Get("Content-Type") != "application/octet-stream" {
+				t.Errorf("incorrect Content-Type, got %q, want %q\n", headers.Get("Content-Type"), "application/octet-stream")
+				t.FailNow()
+			}
+			if !strings.HasSuffix(headers.Get("Content-Disposition"), tc.ext) {
+				t.Errorf("incorrect Content-Disposition, must end with %q", tc.ext)
+				t.FailNow()
+			}
+			dr, err := cipher.NewDecryptReader(w.Body, id)
+			if err != nil {
+				t.Errorf("cannot decrypt export: %v", err)
+				t.FailNow()
+			}
+			b, err := io.ReadAll(dr)
+			if err != nil {
+				t.Errorf("cannot decrypt export: %v", err)
+				t.FailNow()
+			}
+			if !strings.Contains(string(b), "@domain.com") {
+				t.Errorf("decrypted export should contain emails")
+				t.FailNow()
+			}
+		})
+	}
+}
+
+func TestAdminAuth(t *testing.T) {
+	k, _ := cipher.GenerateKey(32)
+	key, hash, _ := auth.GenerateAPIKey()
+	ak, _ := auth.NewAPIKeys("alice:" + hash + ":exporter")
+	app := &App{
+		db:     data.MockDB,
+		jwt:    crypto.NewJWTHS256(k),
+		mailer: &mailer.MockSmtpMailer,
+		wg:     sync.WaitGroup{},
+		rl:     limiter.NewUnlimited(),
+		auth:   auth.Chain(ak),
+	}
+	r := setupRouter(app)
+
+	tt := []struct {
+		name   string
+		path   string
+		key    string
+		status int
+	}{
+		{"count", "/admin/count?mime=json", key, http.StatusOK},
+		{"list", "/admin/list", key, http.StatusOK},
+		{"list csv", "/admin/list?mime=csv", key, http.StatusOK},
+		{"count no key", "/admin/count?mime=json", "", http.StatusUnauthorized},
+		{"list no key", "/admin/list", "", http.StatusUnauthorized},
+		{"count wrong key", "/admin/count?mime=json", "wr0ngK3y", http.StatusUnauthorized},
+		{"list hash as key", "/admin/list", hash, http.StatusUnauthorized},
+		{"no secure paths", "/path1/path2/count?mime=json", key, http.StatusNotFound},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest("GET", tc.path, nil)
+			if tc.key != "" {
+				req.Header.Set(auth.APIKeyHeader, tc.key)
+			}
+			r.ServeHTTP(w, req)
+			if w.Code != tc.status {
+				t.Errorf("incorrect status, got %d, want %d", w.Code, tc.status)
+				t.FailNow()
+			}
+			if w.Code == http.StatusUnauthorized && w.Result().Header.Get("WWW-Authenticate") == "" {
+				t.Errorf("WWW-Authenticate header cannot be empty")
+				t.FailNow()
+			}
+		})
+	}
+
+	t.Run("no authenticator", func(t *testing.T) {
+		app.auth = nil
+		r := setupRouter(app)
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/admin/count", nil)
+		req.Header.Set(auth.APIKeyHeader, key)
+		r.ServeHTTP(w, req)
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("incorrect status, got %d, want %d", w.Code, http.StatusUnauthorized)
+			t.FailNow()
+		}
+	})
+}
+
+func TestSecretPathFallback(t *testing.T) {
+	k, _ := cipher.GenerateKey(32)
+	app := &App{
+		db:       data.MockDB,
+		jwt:      crypto.NewJWTHS256(k),
+		mailer:   &mailer.MockSmtpMailer,
+		wg:       sync.WaitGroup{},
+		rl:       limiter.NewUnlimited(),
+		secpath1: "path1",
+		secpath2: "path2",
+	}
+	r := setupRouter(app)
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/path1/path2/count?mime=json", nil)
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("incorrect status, got %d, want %d", w.Code, http.StatusOK)
+		t.FailNow()
+	}
+	if w.Result().Header.Get("Deprecation") != "true" {
+		t.Errorf("incorrect Deprecation header, got %q, want %q", w.Result().Header.Get("Deprecation"), "true")
+		t.FailNow()
+	}
+
+	l := app.logFormatter(gin.LogFormatterParams{Path: "/path1/path2/list?mime=csv", Method: "GET", StatusCode: http.StatusOK})
+	if strings.Contains(l, "path1") || strings.Contains(l, "path2") {
+		t.Errorf("secure paths must be redacted from logs, got %q", l)
+		t.FailNow()
+	}
+	if !strings.Contains(l, "/***/***/list") {
+		t.Errorf("incorrect log, got %q", l)
+		t.FailNow()
+	}
+}
+
+func TestRoles(t *testing.T) {
+	k, _ := cipher.GenerateKey(32)
+	keys := map[auth.Role]string{}
+	spec := []string{}
+	for _, r := range auth.AllRoles {
+		key, hash, _ := auth.GenerateAPIKey()
+		keys[r] = key
+		spec = append(spec, fmt.Sprintf("%s:%s:%s", r, hash, r))
+	}
+	ak, _ := auth.NewAPIKeys(strings.Join(spec, ","))
+	app := &App{
+		db:     data.NewMockDBContent([]string{sponsor}),
+		jwt:    crypto.NewJWTHS256(k),
+		mailer: &mailer.MockSmtpMailer,
+		wg:     sync.WaitGroup{},
+		rl:     limiter.NewUnlimited(),
+		auth:   ak,
+	}
+	r := setupRouter(app)
+
+	tt := []struct {
+		role   auth.Role
+		method string
+		path   string
+		status int
+	}{
+		{auth.Viewer, "GET", "/admin/count?mime=json", http.StatusOK},
+		{auth.Viewer, "GET", "/admin/list", http.StatusForbidden},
+		{auth.Viewer, "DELETE", "/admin/users/" + sponsor, http.StatusForbidden},
+		{auth.Exporter, "GET", "/admin/count?mime=json", http.StatusOK},
+		{auth.Exporter, "GET", "/admin/list", http.StatusOK},
+		{auth.Exporter, "DELETE", "/admin/users/" + sponsor, http.StatusForbidden},
+		{auth.Operator, "GET", "/admin/count?mime=json", http.StatusOK},
+		{auth.Operator, "GET", "/admin/list", http.StatusOK},
+		{auth.Operator, "DELETE", "/admin/users/" + sponsor, http.StatusNoContent},
+		{auth.Operator, "DELETE", "/admin/users/0x8ba1f109551bD432803012645Ac136ddd64DBA72", http.StatusNotFound},
+	}
+	for _, tc := range tt {
+		t.Run(fmt.Sprintf("%s %s %s", tc.role, tc.method, tc.path), func(t *testing.T) {
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest(tc.method, tc.path, nil)
+			req.Header.Set(auth.APIKeyHeader, keys[tc.role])
+			r.ServeHTTP(w, req)
+			if w.Code != tc.status {
+				t.Errorf("incorrect status, got %d, want %d", w.Code, tc.status)
+				t.FailNow()
+			}
+		})
+	}
+
+	mask := map[auth.Role]bool{auth.Exporter: false, auth.Operator: true}
+	for role, masked := range mask {
+		t.Run(fmt.Sprintf("%s list emails", role), func(t *testing.T) {
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest("GET", "/admin/list", nil)
+			req.Header.Set(auth.APIKeyHeader, keys[role])
+			r.ServeHTTP(w, req)
+			var res struct {
+				Users []*data.User
+				Count int
+			}
+			if err := json.NewDecoder(w.Body).Decode(&res); err != nil {
+				t.Errorf("Cannot decode response body %v, %v", w.Body, err)
+				t.FailNow()
+			}
+			for _, u := range res.Users {
+				if strings.Contains(u.Email, "***") != masked {
+					t.Errorf("incorrect email %q, masked must be %v", u.Email, masked)
+					t.FailNow()
+				}
+			}
+		})
+	}
+
+	t.Run("faulty DB delete", func(t *testing.T) {
+		app.db = data.NewMockErrDB([]string{sponsor})
+		r := setupRouter(app)
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("DELETE", "/admin/users/"+sponsor, nil)
+		req.Header.Set(auth.APIKeyHeader, keys[auth.Operator])
+		r.ServeHTTP(w, req)
+		if w.Code != http.StatusInternalServerError {
+			t.Errorf("incorrect status, got %d, want %d", w.Code, http.StatusInternalServerError)
+			t.FailNow()
+		}
+	})
+}
+
+func TestAudit(t *testing.T) {
+	k, _ := cipher.GenerateKey(32)
+	ek, eh, _ := auth.GenerateAPIKey()
+	ok, oh, _ := auth.GenerateAPIKey()
+	ak, _ := auth.NewAPIKeys(fmt.Sprintf("alice:%s:exporter,bob:%s:operator", eh, oh))
+	sink := audit.NewMemorySink()
+	app := &App{
+		db:       data.NewMockDBContent([]string{sponsor}),
+		jwt:      crypto.NewJWTHS256(k),
+		mailer:   &mailer.MockSmtpMailer,
+		wg:       sync.WaitGroup{},
+		rl:       limiter.NewUnlimited(),
+		secpath1: "path1",
+		secpath2: "path2",
+		auth:     ak,
+		audit:    sink,
+	}
+	r := setupRouter(app)
+
+	requests := []struct {
+		method, path, key string
+		status            int
+	}{
+		{"GET", "/admin/count?mime=json", ek, http.StatusOK},
+		{"GET", "/admin/list?offset=5&max=3", ek, http.StatusOK},
+		{"DELETE", "/admin/users/" + sponsor, ek, http.StatusForbidden},
+		{"DELETE", "/admin/users/" + sponsor, ok, http.StatusNoContent},
+		{"GET", "/admin/list", "wr0ngK3y", http.StatusUnauthorized},
+		{"GET", "/path1/path2/list?mime=csv", "", http.StatusOK},
+		{"GET", "/fakepath1/path2/list?mime=csv", "", http.StatusNotFound},
+	}
+	for _, rq := range requests {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(rq.method, rq.path, nil)
+		req.RemoteAddr = "192.0.2.1:1234"
+		req.Header.Set(auth.APIKeyHeader, rq.key)
+		r.ServeHTTP(w, req)
+		if w.Code != rq.status {
+			t.Errorf("incorrect status for %s %s, got %d, want %d", rq.method, rq.path, w.Code, rq.status)
+			t.FailNow()
+		}
+	}
+
+	entries, _ := sink.Query(audit.Filter{})
+	if len(entries) != 5 { // unauthenticated requests are not recorded
+		t.Errorf("incorrect number of audit entries, got %d, want %d", len(entries), 5)
+		t.FailNow()
+	}
+	exp := []struct {
+		admin, route string
+		rows, status int
+	}{
+		{"alice", "GET /admin/count", data.UsersCountMock, http.StatusOK},
+		{"alice", "GET /admin/list", 3, http.StatusOK},
+		{"alice", "DELETE /admin/users/:address", 0, http.StatusForbidden},
+		{"bob", "DELETE /admin/users/:address", 1, http.StatusNoContent},
+		{"secure-path", "GET /:path1/:path2/list", data.UsersCountMock, http.StatusOK},
+	}
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].Timestamp < entries[j].Timestamp })
+	for i, e := range exp {
+		if entries[i].Admin != e.admin || entries[i].Route != e.route || entries[i].Rows != e.rows || entries[i].Status != e.status {
+			t.Errorf("incorrect audit entry #%d, got %+v, want %+v", i, *entries[i], e)
+			t.FailNow()
+		}
+		if entries[i].IP != "192.0.2.1" {
+			t.Errorf("incorrect IP in audit entry #%d, got %q, want %q", i, entries[i].IP, "192.0.2.1")
+			t.FailNow()
+		}
+	}
+	if entries[1].Filters["offset"] != "5" || entries[1].Filters["max"] != "3" {
+		t.Errorf("incorrect filters, got %v", entries[1].Filters)
+		t.FailNow()
+	}
+	if entries[3].Filters["address"] != sponsor {
+		t.Errorf("incorrect filters, got %v", entries[3].Filters)
+		t.FailNow()
+	}
+	for _, v := range entries[4].Filters {
+		if v == "path1" || v == "path2" {
+			t.Errorf("secure paths cannot be recorded, got %v", entries[4].Filters)
+			t.FailNow()
+		}
+	}
+
+	tt := []struct {
+		name   string
+		key    string
+		query  string
+		status int
+		count  int
+	}{
+		{"operator", ok, "", http.StatusOK, 5},
+		{"operator admin", ok, "?admin=alice", http.StatusOK, 3},
+		{"operator max", ok, "?max=2", http.StatusOK, 2},
+		{"operator since", ok, "?since=" + time.Now().Add(time.Hour).UTC().Format(time.RFC3339), http.StatusOK, 0},
+		{"operator bad since", ok, "?since=yesterday", http.StatusBadRequest, 0},
+		{"operator bad max", ok, "?max=-1", http.StatusBadRequest, 0},
+		{"exporter", ek, "", http.StatusForbidden, 0},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest("GET", "/admin/audit"+tc.query, nil)
+			req.Header.Set(auth.APIKeyHeader, tc.key)
+			r.ServeHTTP(w, req)
+			if w.Code != tc.status {
+				t.Errorf("incorrect status, got %d, want %d", w.Code, tc.status)
+				t.FailNow()
+			}
+			if w.Code != http.StatusOK {
+				return
+			}
+			var res struct {
+				Entries []*audit.Entry
+				Count   int
+			}
+			if err := json.NewDecoder(w.Body).Decode(&res); err != nil {
+				t.Errorf("Cannot decode response body %v, %v", w.Body, err)
+				t.FailNow()
+			}
+			if res.Count != tc.count || len(res.Entries) != tc.count {
+				t.Errorf("incorrect count, got %d, want %d", res.Count, tc.count)
+				t.FailNow()
+			}
+		})
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	k, _ := cipher.GenerateKey(32)
+	ok, oh, _ := auth.GenerateAPIKey()
+	ak, _ := auth.NewAPIKeys(fmt.Sprintf("bob:%s:operator", oh))
+	app := &App{
+		db:   data.MockDB,
+		jwt:  crypto.NewJWTHS256(k),
+		wg:   sync.WaitGroup{},
+		rl:   limiter.NewUnlimited(),
+		auth: ak,
+	}
+	r := setupRouter(app)
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/admin/metrics", nil)
+	req.Header.Set(auth.APIKeyHeader, ok)
+	r.ServeHTTP(w, req)
+	var m map[string]json.RawMessage
+	if err := json.NewDecoder(w.Body).Decode(&m); err != nil || w.Code != http.StatusOK {
+		t.Errorf("cannot get metrics, got %d (%v)", w.Code, err)
+		t.FailNow()
+	}
+	for _, n := range []string{"lockout_failures", "outbox", "pending", "mailer_suppressed"} {
+		if _, ok := m[n]; !ok {
+			t.Errorf("missing metric %q in %v", n, m)
+		}
+	}
+	for _, n := range []string{"cmdline", "memstats"} {
+		if _, ok := m[n]; ok {
+			t.Errorf("metric %q should not be exposed", n)
+		}
+	}
+}
+
+func TestAdminLockout(t *testing.T) {
+	k, _ := cipher.GenerateKey(32)
+	key, h, _ := auth.GenerateAPIKey()
+	ak, _ := auth.NewAPIKeys("alice:" + h)
+	app := &App{
+		db:       data.MockDB,
+		jwt:      crypto.NewJWTHS256(k),
+		mailer:   &mailer.MockSmtpMailer,
+		wg:       sync.WaitGroup{},
+		rl:       limiter.NewUnlimited(),
+		lo:       limiter.NewLockout(3, time.Minute, time.Hour),
+		secpath1: "path1",
+		secpath2: "path2",
+		auth:     ak,
+	}
+	r := setupRouter(app)
+
+	send := func(path, ip, key string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", path, nil)
+		req.RemoteAddr = ip + ":1234"
+		if key != "" {
+			req.Header.Set(auth.APIKeyHeader, key)
+		}
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	t.Run("api key", func(t *testing.T) {
+		ip := "192.0.2.1"
+		for i := 0; i < 3; i++ {
+			if w := send("/admin/count", ip, fmt.Sprintf("wr0ngK3y%d", i)); w.Code != http.StatusUnauthorized {
+				t.Errorf("incorrect status, got %d, want %d", w.Code, http.StatusUnauthorized)
+				t.FailNow()
+			}
+		}
+		w := send("/admin/count", ip, key)
+		if w.Code != http.StatusTooManyRequests {
+			t.Errorf("IP should be locked out, got %d, want %d", w.Code, http.StatusTooManyRequests)
+			t.FailNow()
+		}
+		if ra := w.Header().Get("Retry-After"); ra != "60" {
+			t.Errorf("incorrect Retry-After, got %q, want %q", ra, "60")
+			t.FailNow()
+		}
+		if w := send("/admin/count", "192.0.2.2", key); w.Code != http.StatusOK {
+			t.Errorf("other IPs cannot be locked out, got %d, want %d", w.Code, http.StatusOK)
+			t.FailNow()
+		}
+	})
+
+	t.Run("credential", func(t *testing.T) {
+		for i := 0; i < 3; i++ {
+			send("/admin/count", fmt.Sprintf("198.51.100.%d", i), "wr0ngK3y")
+		}
+		if w := send("/admin/count", "198.51.100.10", "wr0ngK3y"); w.Code != http.StatusTooManyRequests {
+			t.Errorf("credential should be locked out, got %d, want %d", w.Code, http.StatusTooManyRequests)
+			t.FailNow()
+		}
+	})
+
+	t.Run("no credentials", func(t *testing.T) {
+		for i := 0; i < 5; i++ {
+			if w := send("/admin/count", "203.0.113.1", ""); w.Code != http.StatusUnauthorized {
+				t.Errorf("missing credentials cannot lock out, got %d, want %d", w.Code, http.StatusUnauthorized)
+				t.FailNow()
+			}
+		}
+	})
+
+	t.Run("secret path", func(t *testing.T) {
+		ip := "203.0.113.2"
+		for i := 0; i < 3; i++ {
+			if w := send(fmt.Sprintf("/guess%d/path2/count", i), ip, ""); w.Code != http.StatusNotFound {
+				t.Errorf("incorrect status, got %d, want %d", w.Code, http.StatusNotFound)
+				t.FailNow()
+			}
+		}
+		if w := send("/path1/path2/count", ip, ""); w.Code != http.StatusTooManyRequests {
+			t.Errorf("IP should be locked out, got %d, want %d", w.Code, http.StatusTooManyRequests)
+			t.FailNow()
+		}
+		if w := send("/admin/count", ip, key); w.Code != http.StatusTooManyRequests {
+			t.Errorf("IP should be locked out of admin routes, got %d, want %d", w.Code, http.StatusTooManyRequests)
+			t.FailNow()
+		}
+	})
+
+	t.Run("reset on success", func(t *testing.T) {
+		ip := "203.0.113.3"
+		send("/admin/count", ip, "wr0ngK3y1")
+		send("/admin/count", ip, "wr0ngK3y2")
+		send("/admin/count", ip, key)
+		send("/admin/count", ip, "wr0ngK3y3")
+		if w := send("/admin/count", ip, key); w.Code != http.StatusOK {
+			t.Errorf("failures should be reset on success, got %d, want %d", w.Code, http.StatusOK)
+			t.FailNow()
+		}
+	})
+}
+
+func TestClientIP(t *testing.T) {
+	heroku, _ := clientip.New(nil, clientip.Heroku)
+	newApp := func(ips *clientip.Resolver) *App {
+		k, _ := cipher.GenerateKey(32)
+		return &App{
+			db:     data.MockDB,
+			jwt:    crypto.NewJWTHS256(k),
+			mailer: &mailer.MockSmtpMailer,
+			wg:     sync.WaitGroup{},
+			rl:     limiter.New(0.01, 1),
+			ips:    ips,
+		}
+	}
+	send := func(r http.Handler, remote, xff string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/unknown", nil)
+		req.RemoteAddr = remote
+		if xff != "" {
+			req.Header.Set(clientip.ForwardedForHeader, xff)
+		}
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	tt := []struct {
+		name          string
+		ips           *clientip.Resolver
+		first, second [2]string // remote address and X-Forwarded-For
+		limited       bool
+	}{
+		{"direct spoofing", nil, [2]string{"203.0.113.7:1234", "198.51.100.1"}, [2]string{"203.0.113.7:1234", "198.51.100.2"}, true},
+		{"direct ignores xff", nil, [2]string{"203.0.113.7:1234", "198.51.100.1"}, [2]string{"203.0.113.8:1234", "198.51.100.1"}, false},
+		{"heroku", heroku, [2]string{"10.1.2.3:1234", "203.0.113.7"}, [2]string{"10.1.2.4:1234", "203.0.113.8"}, false},
+		{"heroku same client", heroku, [2]string{"10.1.2.3:1234", "203.0.113.7"}, [2]string{"10.1.2.4:1234", "203.0.113.7"}, true},
+		{"heroku spoofing", heroku, [2]string{"10.1.2.3:1234", "198.51.100.1, 203.0.113.7"}, [2]string{"10.1.2.3:1234", "198.51.100.2, 203.0.113.7"}, true},
+		{"ipv6 same /64", nil, [2]string{"[2001:db8:1:2::1]:1234", ""}, [2]string{"[2001:db8:1:2:ffff::2]:1234", ""}, true},
+		{"ipv6 other /64", nil, [2]string{"[2001:db8:1:2::1]:1234", ""}, [2]string{"[2001:db8:1:3::1]:1234", ""}, false},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			r := setupRouter(newApp(tc.ips))
+			if w := send(r, tc.first[0], tc.first[1]); w.Code != http.StatusNotFound {
+				t.Errorf("incorrect status, got %d, want %d", w.Code, http.StatusNotFound)
+				t.FailNow()
+			}
+			w := send(r, tc.second[0], tc.second[1])
+			if limited := w.Code == http.StatusTooManyRequests; limited != tc.limited {
+				t.Errorf("incorrect rate limit, got %v, want %v", limited, tc.limited)
+				t.FailNow()
+			}
+		})
+	}
+
+	t.Run("audit", func(t *testing.T) {
+		key, h, _ := auth.GenerateAPIKey()
+		ak, _ := auth.NewAPIKeys("alice:" + h)
+		sink := audit.NewMemorySink()
+		app := newApp(heroku)
+		app.rl = limiter.NewUnlimited()
+		app.auth = ak
+		app.audit = sink
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/admin/count", nil)
+		req.RemoteAddr = "10.1.2.3:1234"
+		req.Header.Set(clientip.ForwardedForHeader, "198.51.100.1, 203.0.113.7")
+		req.Header.Set(auth.APIKeyHeader, key)
+		setupRouter(app).ServeHTTP(w, req)
+		entries, _ := sink.Query(audit.Filter{})
+		if len(entries) != 1 || entries[0].IP != "203.0.113.7" {
+			t.Errorf("incorrect audit entries, got %v, want IP %q", entries, "203.0.113.7")
+			t.FailNow()
+		}
+	})
+}
+
+func TestIPFilter(t *testing.T) {
+	rs, _ := ipfilter.ParseRules(strings.NewReader("allow 203.0.113.0/24\ndeny 198.51.100.0/24\n"))
+	key, h, _ := auth.GenerateAPIKey()
+	ak, _ := auth.NewAPIKeys("alice:" + h)
+	k, _ := cipher.GenerateKey(32)
+	newApp := func(allowlist bool) *App {
+		return &App{
+			db:        data.MockDB,
+			jwt:       crypto.NewJWTHS256(k),
+			mailer:    &mailer.MockSmtpMailer,
+			wg:        sync.WaitGroup{},
+			rl:        limiter.NewUnlimited(),
+			secpath1:  "path1",
+			secpath2:  "path2",
+			auth:      ak,
+			ipf:       ipfilter.New(rs, nil),
+			allowlist: allowlist,
+		}
+	}
+
+	tt := []struct {
+		name      string
+		allowlist bool
+		path      string
+		ip        string
+		status    int
+	}{
+		{"health allowed", false, "/health", "192.0.2.1", http.StatusOK},
+		{"health denied", false, "/health", "198.51.100.7", http.StatusForbidden},
+		{"admin", false, "/admin/count", "192.0.2.1", http.StatusOK},
+		{"admin denied", false, "/admin/count", "198.51.100.7", http.StatusForbidden},
+		{"admin not listed", true, "/admin/count", "192.0.2.1", http.StatusForbidden},
+		{"admin listed", true, "/admin/count", "203.0.113.7", http.StatusOK},
+		{"secret path not listed", true, "/path1/path2/count", "192.0.2.1", http.StatusForbidden},
+		{"secret path listed", true, "/path1/path2/count", "203.0.113.7", http.StatusOK},
+		{"public with allow list", true, "/health", "192.0.2.1", http.StatusOK},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest("GET", tc.path, nil)
+			req.RemoteAddr = tc.ip + ":1234"
+			req.Header.Set(auth.APIKeyHeader, key)
+			setupRouter(newApp(tc.allowlist)).ServeHTTP(w, req)
+			if w.Code != tc.status {
+				t.Errorf("incorrect status, got %d, want %d", w.Code, tc.status)
+				t.FailNow()
+			}
+		})
+	}
+
+	t.Run("register denied", func(t *testing.T) {
+		b, _ := json.Marshal(data.User{Address: "0x8ba1f109551bD432803012645Ac136ddd64DBA72", Email: "john.doe@mailservice.com", Type: "contractor", Sponsor: sponsor})
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/register", bytes.NewBuffer(b))
+		req.RemoteAddr = "198.51.100.7:1234"
+		setupRouter(newApp(false)).ServeHTTP(w, req)
+		if w.Code != http.StatusForbidden {
+			t.Errorf("incorrect status, got %d, want %d", w.Code, http.StatusForbidden)
+			t.FailNow()
+		}
+	})
+}
+
+// unavailableCaptcha simulates a CAPTCHA provider outage
+type unavailableCaptcha struct{}
+
+func (unavailableCaptcha) Verify(token, remoteIP string) error {
+	return captcha.ErrUnavailable
+}
+
+func TestCaptcha(t *testing.T) {
+	k, _ := cipher.GenerateKey(32)
+	tt := []struct {
+		name     string
+		verifier captcha.Verifier
+		token    string
+		status   int
+		err      string
+	}{
+		{"disabled", nil, "", http.StatusAccepted, ""},
+		{"valid token", captcha.Fake("t0k3n"), "t0k3n", http.StatusAccepted, ""},
+		{"invalid token", captcha.Fake("t0k3n"), "wr0ngT0k3n", http.StatusForbidden, `{"error":"captcha verification failed"}`},
+		{"no token", captcha.Fake("t0k3n"), "", http.StatusForbidden, `{"error":"captcha verification failed"}`},
+		{"unavailable", unavailableCaptcha{}, "t0k3n", http.StatusServiceUnavailable, `{"error":"captcha verification unavailable"}`},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			app := &App{
+				db:      data.MockDB,
+				jwt:     crypto.NewJWTHS256(k),
+				mailer:  &mailer.MockSmtpMailer,
+				wg:      sync.WaitGroup{},
+				rl:      limiter.NewUnlimited(),
+				captcha: tc.verifier,
+			}
+			b, _ := json.Marshal(data.User{Address: "0x8ba1f109551bD432803012645Ac136ddd64DBA72", Email: "john.doe@mailservice.com", Type: "contractor", Sponsor: sponsor})
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest("POST", "/register", bytes.NewBuffer(b))
+			if tc.token != "" {
+				req.Header.Set(captcha.TokenHeader, tc.token)
+			}
+			setupRouter(app).ServeHTTP(w, req)
+			if w.Code != tc.status {
+				t.Errorf("incorrect status, got %d, want %d", w.Code, tc.status)
+				t.FailNow()
+			}
+			if tc.err != "" && w.Body.String() != tc.err {
+				t.Errorf("incorrect error, got %s, want %s", w.Body.String(), tc.err)
+				t.FailNow()
+			}
+		})
+	}
+}
+
+func TestProofOfWork(t *testing.T) {
+	k, _ := cipher.GenerateKey(32)
+	newPoWApp := func(v captcha.Verifier) *App {
+		return &App{
+			db:      data.MockDB,
+			jwt:     crypto.NewJWTHS256(k),
+			mailer:  &mailer.MockSmtpMailer,
+			wg:      sync.WaitGroup{},
+			rl:      limiter.NewUnlimited(),
+			captcha: v,
+			pow:     crypto.NewPoW(k, 8, time.Minute),
+		}
+	}
+	challenge := func(r http.Handler) *crypto.Challenge {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/challenge", nil)
+		r.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Errorf("incorrect status, got %d, want %d", w.Code, http.StatusOK)
+			t.FailNow()
+		}
+		var ch crypto.Challenge
+		if err := json.Unmarshal(w.Body.Bytes(), &ch); err != nil || ch.Challenge == "" || ch.Difficulty != 8 {
+			t.Errorf("incorrect challenge %s", w.Body.String())
+			t.FailNow()
+		}
+		return &ch
+	}
+
+	tt := []struct {
+		name     string
+		verifier captcha.Verifier
+		send     bool // send the challenge
+		solve    bool
+		token    string
+		status   int
+	}{
+		{"solved", nil, true, true, "", http.StatusAccepted},
+		{"not solved", nil, true, false, "", http.StatusForbidden},
+		{"not sent", nil, false, false, "", http.StatusForbidden},
+		{"solved with captcha enabled", captcha.Fake("t0k3n"), true, true, "", http.StatusAccepted},
+		{"not solved with captcha enabled", captcha.Fake("t0k3n"), true, false, "t0k3n", http.StatusForbidden},
+		{"captcha instead", captcha.Fake("t0k3n"), false, false, "t0k3n", http.StatusAccepted},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			r := setupRouter(newPoWApp(tc.verifier))
+			ch := challenge(r)
+			nonce := crypto.Solve(ch.Challenge, ch.Difficulty)
+			if !tc.solve {
+				nonce = ""
+			}
+			register := func() *httptest.ResponseRecorder {
+				b, _ := json.Marshal(data.User{Address: "0x8ba1f109551bD432803012645Ac136ddd64DBA72", Email: "john.doe@mailservice.com", Type: "contractor", Sponsor: sponsor})
+				w := httptest.NewRecorder()
+				req, _ := http.NewRequest("POST", "/register", bytes.NewBuffer(b))
+				if tc.send {
+					req.Header.Set(powChallengeHeader, ch.Challenge)
+					req.Header.Set(powNonceHeader, nonce)
+				}
+				if tc.token != "" {
+					req.Header.Set(captcha.TokenHeader, tc.token)
+				}
+				r.ServeHTTP(w, req)
+				return w
+			}
+			w := register()
+			if w.Code != tc.status {
+				t.Errorf("incorrect status, got %d, want %d", w.Code, tc.status)
+				t.FailNow()
+			}
+			if w.Code == http.StatusForbidden && w.Body.String() != `{"error":"proof of work verification failed"}` {
+				t.Errorf("incorrect error, got %s", w.Body.String())
+				t.FailNow()
+			}
+			if tc.solve {
+				if w := register(); w.Code != http.StatusForbidden {
+					t.Errorf("challenge should not be replayed, got %d, want %d", w.Code, http.StatusForbidden)
+					t.FailNow()
+				}
+			}
+		})
+	}
+
+	t.Run("disabled", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/challenge", nil)
+		setupRouter(&App{rl: limiter.NewUnlimited()}).ServeHTTP(w, req)
+		if w.Code != http.StatusNotFound {
+			t.Errorf("incorrect status, got %d, want %d", w.Code, http.StatusNotFound)
+		}
+	})
+}
+
+func TestValidateEmail(t *testing.T) {
+	k, _ := cipher.GenerateKey(32)
+	tt := []struct {
+		email  string
+		status int
+		err    string
+	}{
+		{"john.doe@mailservice.com", http.StatusAccepted, ""},
+		{"john.doe+poln@gmail.com", http.StatusAccepted, ""},
+		{"john.doe@mailinator.com", http.StatusBadRequest, `{"error":"disposable email domain"}`},
+		{"john.doe@sub.yopmail.com", http.StatusBadRequest, `{"error":"disposable email domain"}`},
+	}
+	for _, tc := range tt {
+		t.Run(tc.email, func(t *testing.T) {
+			app := &App{
+				db:     data.MockDB,
+				jwt:    crypto.NewJWTHS256(k),
+				mailer: &mailer.MockSmtpMailer,
+				wg:     sync.WaitGroup{},
+				rl:     limiter.NewUnlimited(),
+				emails: emailcheck.New(nil, "gmail.com"),
+			}
+			b, _ := json.Marshal(data.User{Address: "0x8ba1f109551bD432803012645Ac136ddd64DBA72", Email: tc.email, Type: "contractor", Sponsor: sponsor})
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest("POST", "/register", bytes.NewBuffer(b))
+			setupRouter(app).ServeHTTP(w, req)
+			if w.Code != tc.status {
+				t.Errorf("incorrect status, got %d, want %d", w.Code, tc.status)
+				t.FailNow()
+			}
+			if tc.err != "" {
+				if w.Body.String() != tc.err {
+					t.Errorf("incorrect error, got %s, want %s", w.Body.String(), tc.err)
+				}
+				return
+			}
+			var r struct{ Token string }
+			json.Unmarshal(w.Body.Bytes(), &r)
+			u, err := app.jwt.Extract(r.Token)
+			if err != nil || u.Email != "john.doe@"+strings.SplitN(tc.email, "@", 2)[1] {
+				t.Errorf("email should be normalized before the token is created, got %v %v", u, err)
+			}
+		})
+	}
+}
+
+// countingMailer counts the activation emails sent
+type countingMailer struct {
+	sent atomic.Int32
+}
+
+func (m *countingMailer) SendActivationEmail(e, u, h, l string) error {
+	m.sent.Add(1)
+	return nil
+}
+
+func (m *countingMailer) SendConfirmationEmail(e, l string) error {
+	return nil
+}
+
+func (m *countingMailer) SendReminderEmail(e, u, h, l string) error {
+	return nil
+}
+
+func TestEmailThrottling(t *testing.T) {
+	k, _ := cipher.GenerateKey(32)
+	m := &countingMailer{}
+	app := &App{
+		db:     data.MockDB,
+		jwt:    crypto.NewJWTHS256(k),
+		mailer: mailer.NewThrottled(m, time.Hour, 5),
+		wg:     sync.WaitGroup{},
+		rl:     limiter.NewUnlimited(),
+	}
+	r := setupRouter(app)
+	for i := 0; i < 3; i++ {
+		b, _ := json.Marshal(data.User{Address: "0x8ba1f109551bD432803012645Ac136ddd64DBA72", Email: "john.doe@mailservice.com", Type: "contractor", Sponsor: sponsor})
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/register", bytes.NewBuffer(b))
+		r.ServeHTTP(w, req)
+		if w.Code != http.StatusAccepted || !strings.Contains(w.Body.String(), `"hash"`) {
+			t.Errorf("suppressed emails should not be revealed, got %d %s", w.Code, w.Body.String())
+			t.FailNow()
+		}
+	}
+	app.wg.Wait()
+	if n := m.sent.Load(); n != 1 {
+		t.Errorf("incorrect emails sent, got %d, want %d", n, 1)
+	}
+}
+
+// downMailer cannot send any email
+type downMailer struct{}
+
+func (downMailer) SendActivationEmail(e, u, h, l string) error {
+	return errors.New("smtp is down")
+}
+
+func (downMailer) SendConfirmationEmail(e, l string) error {
+	return errors.New("smtp is down")
+}
+
+func (downMailer) SendReminderEmail(e, u, h, l string) error {
+	return errors.New("smtp is down")
+}
+
+func TestOutbox(t *testing.T) {
+	k, _ := cipher.GenerateKey(32)
+	ek, eh, _ := auth.GenerateAPIKey()
+	ok, oh, _ := auth.GenerateAPIKey()
+	ak, _ := auth.NewAPIKeys(fmt.Sprintf("alice:%s:exporter,bob:%s:operator", eh, oh))
+	ob := outbox.New(outbox.NewMemoryStore(), downMailer{}, k, 1, time.Minute, time.Minute)
+	app := &App{
+		db:     data.MockDB,
+		jwt:    crypto.NewJWTHS256(k),
+		mailer: ob,
+		wg:     sync.WaitGroup{},
+		rl:     limiter.NewUnlimited(),
+		auth:   ak,
+		outbox: ob,
+	}
+	r := setupRouter(app)
+
+	b, _ := json.Marshal(data.User{Address: "0x8ba1f109551bD432803012645Ac136ddd64DBA72", Email: "john.doe@mailservice.com", Type: "contractor", Sponsor: sponsor})
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/register", bytes.NewBuffer(b))
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusAccepted {
+		t.Errorf("incorrect status, got %d, want %d", w.Code, http.StatusAccepted)
+		t.FailNow()
+	}
+	app.wg.Wait()
+	if n, _ := ob.Drain(1); n != 1 {
+		t.Errorf("activation email should be queued, got %d messages", n)
+		t.FailNow()
+	}
+
+	var res struct {
+		Messages []deadLetter
+		Count    int
+	}
+	tt := []struct {
+		name, method, path, key string
+		status                  int
+	}{
+		{"exporter", "GET", "/admin/outbox/dead", ek, http.StatusForbidden},
+		{"dead letters", "GET", "/admin/outbox/dead", ok, http.StatusOK},
+		{"unknown", "POST", "/admin/outbox/dead/n0t-an-1d/replay", ok, http.StatusNotFound},
+		{"replay", "POST", "/admin/outbox/dead/{id}/replay", ok, http.StatusAccepted},
+		{"replayed", "POST", "/admin/outbox/dead/{id}/replay", ok, http.StatusConflict},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			path := tc.path
+			if len(res.Messages) > 0 {
+				path = strings.Replace(path, "{id}", res.Messages[0].ID, 1)
+			}
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest(tc.method, path, nil)
+			req.Header.Set(auth.APIKeyHeader, tc.key)
+			r.ServeHTTP(w, req)
+			if w.Code != tc.status {
+				t.Errorf("incorrect status, got %d, want %d", w.Code, tc.status)
+				t.FailNow()
+			}
+			if tc.name == "dead letters" {
+				json.Unmarshal(w.Body.Bytes(), &res)
+				if res.Count != 1 || res.Messages[0].To != "j***@mailservice.com" || res.Messages[0].LastError != "smtp is down" {
+					t.Errorf("incorrect dead letters, got %s", w.Body.String())
+					t.FailNow()
+				}
+				if strings.Contains(w.Body.String(), "activate") {
+					t.Errorf("activation links should not be listed, got %s", w.Body.String())
+					t.FailNow()
+				}
+			}
+		})
+	}
+
+	t.Run("disabled", func(t *testing.T) {
+		app.outbox = nil
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/admin/outbox/dead", nil)
+		req.Header.Set(auth.APIKeyHeader, ok)
+		r.ServeHTTP(w, req)
+		if w.Code != http.StatusNotFound {
+			t.Errorf("incorrect status, got %d, want %d", w.Code, http.StatusNotFound)
+		}
+	})
+}
+
+// localeMailer records the locales of the emails sent
+type localeMailer struct {
+	locales []string
+	sync.Mutex
+}
+
+func (m *localeMailer) SendActivationEmail(e, u, h, l string) error {
+	m.Lock()
+	defer m.Unlock()
+	m.locales = append(m.locales, "activation:"+l)
+	return nil
+}
+
+func (m *localeMailer) SendConfirmationEmail(e, l string) error {
+	m.Lock()
+	defer m.Unlock()
+	m.locales = append(m.locales, "confirmation:"+l)
+	return nil
+}
+
+func (m *localeMailer) SendReminderEmail(e, u, h, l string) error {
+	m.Lock()
+	defer m.Unlock()
+	m.locales = append(m.locales, "reminder:"+l)
+	return nil
+}
+
+func TestLocale(t *testing.T) {
+	k, _ := cipher.GenerateKey(32)
+	m := &localeMailer{}
+	app := &App{
+		db:     data.NewMockDBContent([]string{sponsor}),
+		jwt:    crypto.NewJWTHS256(k),
+		mailer: m,
+		wg:     sync.WaitGroup{},
+		rl:     limiter.NewUnlimited(),
+	}
+	r := setupRouter(app)
+
+	register := func(u data.User, acceptLanguage string) *httptest.ResponseRecorder {
+		b, _ := json.Marshal(u)
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/register", bytes.NewBuffer(b))
+		req.Header.Set("Accept-Language", acceptLanguage)
+		r.ServeHTTP(w, req)
+		return w
+	}
+	u := data.User{Address: "0x8ba1f109551bD432803012645Ac136ddd64DBA72", Email: "john.doe@mailservice.com", Type: "contractor", Sponsor: sponsor}
+
+	t.Run("validation errors", func(t *testing.T) {
+		invalid := u
+		invalid.Email, invalid.Type = "john.doe@", "dev"
+		want := `{"error":"email doit être une adresse email valide; type doit être l'un des choix suivants [advisor agent initiator contributor investor mentor contractor]"}`
+		if w := register(invalid, "fr-FR,fr;q=0.9,en;q=0.8"); w.Code != http.StatusBadRequest || w.Body.String() != want {
+			t.Errorf("incorrect response, got %d %s, want %s", w.Code, w.Body.String(), want)
+		}
+		invalid.Locale = "en-GB" // explicit locale first
+		if w := register(invalid, "fr"); !strings.HasPrefix(w.Body.String(), `{"error":"email must be a valid email address;`) {
+			t.Errorf("incorrect response, got %s", w.Body.String())
+		}
+	})
+
+	t.Run("emails", func(t *testing.T) {
+		w := register(u, "fr-CH, fr;q=0.9, en;q=0.8")
+		var res struct{ Hash, Token string }
+		if err := json.NewDecoder(w.Body).Decode(&res); err != nil || w.Code != http.StatusAccepted {
+			t.Errorf("cannot register, got %d (%v)", w.Code, err)
+			t.FailNow()
+		}
+		app.wg.Wait()
+		u.Locale = "en"
+		register(u, "fr")
+		app.wg.Wait()
+
+		w = httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", fmt.Sprintf("/activate/%s/%s", res.Token, res.Hash), nil)
+		r.ServeHTTP(w, req)
+		if w.Code != http.StatusCreated {
+			t.Errorf("cannot activate, got %d %s", w.Code, w.Body.String())
+			t.FailNow()
+		}
+		app.wg.Wait()
+		want := []string{"activation:fr", "activation:en", "confirmation:fr"}
+		if fmt.Sprint(m.locales) != fmt.Sprint(want) {
+			t.Errorf("incorrect locales, got %v, want %v", m.locales, want)
+		}
+	})
+}
+
+// reminderMailer records the links of the reminders sent
+type reminderMailer struct {
+	localeMailer
+	links []string
+}
+
+func (m *reminderMailer) SendReminderEmail(e, u, h, l string) error {
+	m.localeMailer.SendReminderEmail(e, u, h, l)
+	m.Lock()
+	defer m.Unlock()
+	m.links = append(m.links, strings.TrimPrefix(u, "http://poln.org/activate/")+"/"+h)
+	return nil
+}
+
+func TestPending(t *testing.T) {
+	k, _ := cipher.GenerateKey(32)
+	ek, _ := cipher.GenerateKey(32)
+	vk, vh, _ := auth.GenerateAPIKey()
+	ak, _ := auth.NewAPIKeys(fmt.Sprintf("alice:%s", vh))
+	m := &reminderMailer{}
+	app := &App{
+		db:      data.NewMockDBContent([]string{sponsor}),
+		jwt:     crypto.NewJWTHS256(k),
+		mailer:  m,
+		wg:      sync.WaitGroup{},
+		rl:      limiter.NewUnlimited(),
+		auth:    ak,
+		pending: pending.New(pending.NewMemoryStore(), ek, 0, time.Hour), // reminded as soon as possible
+	}
+	r := setupRouter(app)
+
+	funnel := func(query string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/admin/funnel"+query, nil)
+		req.Header.Set(auth.APIKeyHeader, vk)
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	u := data.User{Address: "0x8ba1f109551bD432803012645Ac136ddd64DBA72", Email: "john.doe@mailservice.com", Type: "contractor", Sponsor: sponsor, Locale: "fr"}
+	b, _ := json.Marshal(u)
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/register", bytes.NewBuffer(b))
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusAccepted {
+		t.Errorf("cannot register, got %d %s", w.Code, w.Body.String())
+		t.FailNow()
+	}
+	app.wg.Wait()
+	if w := funnel(""); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"registered":1,"reminded":0,"activated":0,"activated_after_reminder":0,"pending":1`) {
+		t.Errorf("incorrect funnel, got %d %s", w.Code, w.Body.String())
+		t.FailNow()
+	}
+
+	app.remind()
+	app.remind() // reminded once
+	if len(m.links) != 1 || fmt.Sprint(m.locales) != "[activation:fr reminder:fr]" {
+		t.Errorf("incorrect reminders, got %v %v", m.links, m.locales)
+		t.FailNow()
+	}
+	if s, _, _ := jwt.NewParser().ParseUnverified(strings.Split(m.links[0], "/")[0], &jwt.RegisteredClaims{}); s == nil ||
+		s.Claims.(*jwt.RegisteredClaims).ExpiresAt.Before(time.Now().Add(crypto.ActivationTTL+time.Hour)) {
+		t.Errorf("the reminder link should outlive the activation link, got %v", s)
+	}
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/activate/"+m.links[0], nil)
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusCreated {
+		t.Errorf("cannot activate with the reminder link, got %d %s", w.Code, w.Body.String())
+		t.FailNow()
+	}
+	app.wg.Wait()
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/register", bytes.NewBuffer(b))
+	r.ServeHTTP(w, req)
+	app.wg.Wait()
+	if w.Code != http.StatusAccepted || len(m.locales) != 4 { // activation, reminder, confirmation and activation again
+		t.Errorf("cannot register again, got %d %v", w.Code, m.locales)
+	}
+
+	tt := []struct {
+		name, query string
+		status      int
+		contains    string
+	}{
+		{"funnel", "", http.StatusOK, `{"registered":1,"reminded":1,"activated":1,"activated_after_reminder":1,"pending":0,"conversion_rate":1,"reminder_conversion_rate":1}`},
+		{"since", "?since=" + url.QueryEscape(time.Now().Add(time.Hour).Format(time.RFC3339)), http.StatusOK, `"registered":0`},
+		{"invalid since", "?since=yesterday", http.StatusBadRequest, ""},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			w := funnel(tc.query)
+			if w.Code != tc.status || !strings.Contains(w.Body.String(), tc.contains) {
+				t.Errorf("incorrect response, got %d %s, want %d %s", w.Code, w.Body.String(), tc.status, tc.contains)
+			}
+		})
+	}
+
+	app.pending = nil
+	if w := funnel(""); w.Code != http.StatusNotFound {
+		t.Errorf("incorrect status without pending registrations, got %d, want %d", w.Code, http.StatusNotFound)
+	}
+}
+
+func TestTrack(t *testing.T) {
+	ek, _ := cipher.GenerateKey(32)
+	u := data.NewUser("0x8ba1f109551bD432803012645Ac136ddd64DBA72", "john.doe@mailservice.com", "contractor", sponsor)
+	app := &App{
+		db:      data.NewMockDBContent([]string{u.Address}),
+		pending: pending.New(pending.NewMemoryStore(), ek, 0, time.Hour),
+	}
+	app.track(u)
+	if _, err := app.pending.Find(u.Address, ""); !errors.Is(err, pending.ErrNotFound) {
+		t.Errorf("registered addresses should not be tracked, got %v", err)
+	}
+	app.db = data.NewMockDBContent([]string{sponsor})
+	app.track(u)
+	if _, err := app.pending.Find(u.Address, ""); err != nil {
+		t.Errorf("pending registration should be tracked, got %v", err)
+	}
+}
+
+func TestResend(t *testing.T) {
+	k, _ := cipher.GenerateKey(32)
+	ek, _ := cipher.GenerateKey(32)
+	m := &localeMailer{}
+	app := &App{
+		db:       data.NewMockDBContent([]string{sponsor}),
+		jwt:      crypto.NewJWTHS256(k),
+		mailer:   m,
+		wg:       sync.WaitGroup{},
+		rl:       limiter.NewUnlimited(),
+		policies: newRatePolicies(limiter.NewFactory(), nil),
+		pending:  pending.New(pending.NewMemoryStore(), ek, time.Hour, 24*time.Hour),
+	}
+	r := setupRouter(app)
+	u := data.NewUser("0x8ba1f109551bD432803012645Ac136ddd64DBA72", "john.doe@mailservice.com", "contractor", sponsor)
+	u.Locale = "fr"
+	app.pending.Register(u)
+	app.pending.Register(data.NewUser(sponsor, "jane.doe@mailservice.com", "agent", u.Address))
+	app.pending.Activate(sponsor)
+
+	resend := func(body, acceptLanguage string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/activate/resend", strings.NewReader(body))
+		req.Header.Set("Accept-Language", acceptLanguage)
+		r.ServeHTTP(w, req)
+		app.wg.Wait()
+		return w
+	}
+
+	tt := []struct {
+		name, body, acceptLanguage string
+		status                     int
+		contains                   string
+		sent                       int
+	}{
+		{"address", `{"address":"0x8ba1f109551bD432803012645Ac136ddd64DBA72"}`, "", http.StatusAccepted, "new activation link", 1},
+		{"email", `{"email":"John.Doe@mailservice.com"}`, "", http.StatusAccepted, "new activation link", 2},
+		{"unknown address", `{"address":"0x71C7656EC7ab88b098defB751B7401B5f6d8976F"}`, "", http.StatusAccepted, "new activation link", 2},
+		{"unknown email", `{"email":"joe@mailservice.com"}`, "", http.StatusAccepted, "new activation link", 2},
+		{"activated", `{"email":"jane.doe@mailservice.com"}`, "", http.StatusAccepted, "new activation link", 2},
+		{"empty", `{}`, "", http.StatusBadRequest, "address is a required field; email is a required field", 2},
+		{"invalid", `{"address":"0x0","email":"john.doe@"}`, "fr", http.StatusBadRequest, "address doit être une adresse Ethereum valide; email doit être une adresse email valide", 2},
+		{"email again", `{"email":"john.doe@mailservice.com"}`, "", http.StatusAccepted, "new activation link", 3},
+		{"email once more", `{"email":"john.doe@mailservice.com"}`, "", http.StatusAccepted, "new activation link", 4},
+		{"too many requests", `{"email":"john.doe@mailservice.com"}`, "", http.StatusTooManyRequests, "Too Many Requests", 4}, // 3 per hour and email
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			w := resend(tc.body, tc.acceptLanguage)
+			if w.Code != tc.status || !strings.Contains(w.Body.String(), tc.contains) {
+				t.Errorf("incorrect response, got %d %s, want %d %s", w.Code, w.Body.String(), tc.status, tc.contains)
+				t.FailNow()
+			}
+			if len(m.locales) != tc.sent {
+				t.Errorf("incorrect emails, got %v, want %d", m.locales, tc.sent)
+			}
+		})
+	}
+	if m.locales[0] != "activation:fr" {
+		t.Errorf("the locale of the registration should be used, got %v", m.locales)
+	}
+
+	app.pending, app.policies = nil, nil
+	if w := resend(`{"email":"john.doe@mailservice.com"}`, ""); w.Code != http.StatusNotFound {
+		t.Errorf("incorrect status without pending registrations, got %d, want %d", w.Code, http.StatusNotFound)
+	}
+}
+
+func TestTemplates(t *testing.T) {
+	k, _ := cipher.GenerateKey(32)
+	vk, vh, _ := auth.GenerateAPIKey()
+	ok, oh, _ := auth.GenerateAPIKey()
+	ak, _ := auth.NewAPIKeys(fmt.Sprintf("alice:%s,bob:%s:operator", vh, oh))
+	dir := t.TempDir()
+	tr, _ := mailer.NewFileTransport(dir)
+	sink := audit.NewMemorySink()
+	app := &App{
+		audit:     sink,
+		db:        data.MockDB,
+		jwt:       crypto.NewJWTHS256(k),
+		mailer:    mailer.NewThrottled(&mailer.MockSmtpMailer, time.Hour, 5),
+		templates: mailer.NewTemplateMailer(tr, &mail.Address{Name: "poln", Address: "hello@poln.org"}),
+		wg:        sync.WaitGroup{},
+		rl:        limiter.NewUnlimited(),
+		auth:      ak,
+	}
+	r := setupRouter(app)
+
+	tt := []struct {
+		name, method, path, key, body string
+		status                        int
+		contentType, contains         string
+	}{
+		{"list", "GET", "/admin/templates", vk, "", http.StatusOK, "application/json", `"locales":["en","fr"]`},
+		{"html", "GET", "/admin/templates/emailActivation", vk, "", http.StatusOK, "text/html", "Complete Preregistration"},
+		{"text", "GET", "/admin/templates/emailActivation?locale=fr&mime=text", vk, "", http.StatusOK, "text/plain", "Terminer la préinscription : http://poln.org/activate/"},
+		{"json", "GET", "/admin/templates/emailConfirmation?locale=fr&mime=json", vk, "", http.StatusOK, "application/json", `"subject":"poln - préinscription terminée"`},
+		{"unsupported mime", "GET", "/admin/templates/emailConfirmation?mime=pdf", vk, "", http.StatusBadRequest, "application/json", "unsupported mime"},
+		{"unknown template", "GET", "/admin/templates/emailWelcome", vk, "", http.StatusNotFound, "application/json", "unknown email template"},
+		{"unknown locale", "GET", "/admin/templates/emailActivation?locale=de", vk, "", http.StatusNotFound, "application/json", "unknown email locale"},
+		{"viewer send", "POST", "/admin/templates/emailActivation/send", vk, `{"email":"jane.doe@poln.org"}`, http.StatusForbidden, "application/json", ""},
+		{"invalid email", "POST", "/admin/templates/emailActivation/send", ok, `{"email":"jane.doe@"}`, http.StatusBadRequest, "application/json", "email must be a valid email address"},
+		{"send unknown", "POST", "/admin/templates/emailWelcome/send", ok, `{"email":"jane.doe@poln.org"}`, http.StatusNotFound, "application/json", ""},
+		{"send", "POST", "/admin/templates/emailActivation/send", ok, `{"email":"jane.doe@poln.org","locale":"fr"}`, http.StatusOK, "application/json", `"to":"jane.doe@poln.org"`},
+		{"send again", "POST", "/admin/templates/emailActivation/send", ok, `{"email":"Jane.Doe@poln.org"}`, http.StatusTooManyRequests, "application/json", "email suppressed"},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest(tc.method, tc.path, strings.NewReader(tc.body))
+			req.Header.Set(auth.APIKeyHeader, tc.key)
+			r.ServeHTTP(w, req)
+			if w.Code != tc.status || !strings.HasPrefix(w.Header().Get("Content-Type"), tc.contentType) || !strings.Contains(w.Body.String(), tc.contains) {
+				t.Errorf("incorrect response, got %d %s %s, want %d %s %q", w.Code, w.Header().Get("Content-Type"), w.Body.String(), tc.status, tc.contentType, tc.contains)
+			}
+		})
+	}
+
+	es, _ := os.ReadDir(filepath.Join(dir, "new"))
+	if len(es) != 1 {
+		t.Errorf("preview should be delivered, got %d emails", len(es))
+		t.FailNow()
+	}
+	b, _ := os.ReadFile(filepath.Join(dir, "new", es[0].Name()))
+	if !bytes.Contains(b, []byte("To: jane.doe@poln.org")) || !bytes.Contains(b, []byte("Subject: =?UTF-8?q?[preview]_poln_-_pr=C3=A9inscription?=")) {
+		t.Errorf("incorrect preview, got:\n%s", b)
+	}
+
+	entries, _ := sink.Query(audit.Filter{Admin: "bob"})
+	sent := 0
+	for _, e := range entries {
+		if e.Status == http.StatusOK && e.Route == "POST /admin/templates/:name/send" {
+			sent++
+			if e.Filters["to"] != data.MaskEmail("jane.doe@poln.org") || e.Filters["locale"] != "fr" {
+				t.Errorf("the recipient should be audited, got %v", e.Filters)
+			}
+		}
+	}
+	if sent != 1 {
+		t.Errorf("incorrect audited previews, got %d, want 1", sent)
+	}
+
+	app.templates = nil
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/admin/templates", nil)
+	req.Header.Set(auth.APIKeyHeader, vk)
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("incorrect status without templates, got %d, want %d", w.Code, http.StatusNotFound)
+	}
+}
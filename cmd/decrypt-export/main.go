@@ -0,0 +1,84 @@
+// decrypt-export decrypts the users list exported encrypted by the list endpoint
+// and generates the X25519 key pairs used to encrypt exports.
+//
+//	decrypt-export -keygen
+//	decrypt-export -identity-file export.key -in users_list.csv.enc -out users_list.csv
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/fairhive-labs/preregister/internal/crypto/cipher"
+)
+
+var ErrNoIdentity = errors.New("identity is missing: use -identity, -identity-file or FAIRHIVE_EXPORT_IDENTITY")
+
+func run(args []string, stdin io.Reader, stdout io.Writer) error {
+	fs := flag.NewFlagSet("decrypt-export", flag.ContinueOnError)
+	keygen := fs.Bool("keygen", false, "generate a new identity (private key) and its recipient (public key)")
+	identity := fs.String("identity", os.Getenv("FAIRHIVE_EXPORT_IDENTITY"), "identity (hex encoded private key)")
+	identityFile := fs.String("identity-file", "", "file containing the identity")
+	in := fs.String("in", "", "encrypted export (default stdin)")
+	out := fs.String("out", "", "decrypted export (default stdout)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if *keygen {
+		id, rcpt, err := cipher.GenerateX25519Key()
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(stdout, "identity:  %s\nrecipient: %s\n", id, rcpt)
+		return nil
+	}
+
+	if *identityFile != "" {
+		b, err := os.ReadFile(*identityFile)
+		if err != nil {
+			return err
+		}
+		*identity = strings.TrimSpace(string(b))
+	}
+	if *identity == "" {
+		return ErrNoIdentity
+	}
+
+	r := stdin
+	if *in != "" {
+		f, err := os.Open(*in)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+	dr, err := cipher.NewDecryptReader(r, *identity)
+	if err != nil {
+		return err
+	}
+
+	w := stdout
+	if *out != "" {
+		f, err := os.OpenFile(*out, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	_, err = io.Copy(w, dr)
+	return err
+}
+
+func main() {
+	if err := run(os.Args[1:], os.Stdin, os.Stdout); err != nil {
+		log.Fatalf("👹 %v", err)
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/fairhive-labs/preregister/internal/crypto/cipher"
+)
+
+const export = "address,email,uuid,timestamp,type,sponsor\n"
+
+func TestKeygen(t *testing.T) {
+	var out bytes.Buffer
+	if err := run([]string{"-keygen"}, nil, &out); err != nil {
+		t.Errorf("incorrect error, got %v, want nil", err)
+		t.FailNow()
+	}
+	if !strings.Contains(out.String(), "identity: ") || !strings.Contains(out.String(), "recipient: ") {
+		t.Errorf("incorrect output, got %q", out.String())
+		t.FailNow()
+	}
+}
+
+func TestDecrypt(t *testing.T) {
+	id, rcpt, _ := cipher.GenerateX25519Key()
+	var enc bytes.Buffer
+	w, _ := cipher.NewEncryptWriter(&enc, rcpt)
+	w.Write([]byte(export))
+	w.Close()
+
+	dir := t.TempDir()
+	in, idf, out := filepath.Join(dir, "users.csv.enc"), filepath.Join(dir, "export.key"), filepath.Join(dir, "users.csv")
+	os.WriteFile(in, enc.Bytes(), 0600)
+	os.WriteFile(idf, []byte(id+"\n"), 0600)
+
+	t.Run("stdin stdout", func(t *testing.T) {
+		var b bytes.Buffer
+		if err := run([]string{"-identity", id}, bytes.NewReader(enc.Bytes()), &b); err != nil {
+			t.Errorf("incorrect error, got %v, want nil", err)
+			t.FailNow()
+		}
+		if b.String() != export {
+			t.Errorf("incorrect decrypted export, got %q, want %q", b.String(), export)
+			t.FailNow()
+		}
+	})
+
+	t.Run("files", func(t *testing.T) {
+		if err := run([]string{"-identity-file", idf, "-in", in, "-out", out}, nil, nil); err != nil {
+			t.Errorf("incorrect error, got %v, want nil", err)
+			t.FailNow()
+		}
+		if b, _ := os.ReadFile(out); string(b) != export {
+			t.Errorf("incorrect decrypted export, got %q, want %q", b, export)
+			t.FailNow()
+		}
+	})
+
+	t.Run("no identity", func(t *testing.T) {
+		t.Setenv("FAIRHIVE_EXPORT_IDENTITY", "")
+		if err := run([]string{"-in", in}, nil, nil); !errors.Is(err, ErrNoIdentity) {
+			t.Errorf("incorrect error, got %v, want %v", err, ErrNoIdentity)
+			t.FailNow()
+		}
+	})
+
+	t.Run("wrong identity", func(t *testing.T) {
+		id2, _, _ := cipher.GenerateX25519Key()
+		var b bytes.Buffer
+		if err := run([]string{"-identity", id2, "-in", in}, nil, &b); !errors.Is(err, cipher.ErrInvalidStream) {
+			t.Errorf("incorrect error, got %v, want %v", err, cipher.ErrInvalidStream)
+			t.FailNow()
+		}
+	})
+}
@@ -0,0 +1,104 @@
+package audit
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Entry records an admin access
+type Entry struct {
+	ID        string            `json:"id"`
+	Timestamp int64             `json:"timestamp"` // milliseconds
+	Admin     string            `json:"admin"`
+	Method    string            `json:"method"` // authentication method
+	IP        string            `json:"ip"`
+	Route     string            `json:"route"`
+	Filters   map[string]string `json:"filters,omitempty"`
+	Rows      int               `json:"rows"`
+	Status    int               `json:"status"`
+}
+
+func NewEntry(admin, method, ip, route string, filters map[string]string, rows, status int) *Entry {
+	return &Entry{
+		ID:        uuid.New().String(),
+		Timestamp: time.Now().UnixMilli(),
+		Admin:     admin,
+		Method:    method,
+		IP:        ip,
+		Route:     route,
+		Filters:   filters,
+		Rows:      rows,
+		Status:    status,
+	}
+}
+
+// Filter selects entries, zero values match everything
+type Filter struct {
+	Admin        string
+	Since, Until time.Time
+	Max          int
+}
+
+func (f Filter) Match(e *Entry) bool {
+	if f.Admin != "" && f.Admin != e.Admin {
+		return false
+	}
+	if !f.Since.IsZero() && e.Timestamp < f.Since.UnixMilli() {
+		return false
+	}
+	if !f.Until.IsZero() && e.Timestamp > f.Until.UnixMilli() {
+		return false
+	}
+	return true
+}
+
+// Sink persists entries, it is append-only: entries are never updated nor deleted
+type Sink interface {
+	Write(e *Entry) error
+	Query(f Filter) ([]*Entry, error)
+}
+
+// sortAndLimit sorts entries, most recent first, and keeps at most f.Max entries
+func sortAndLimit(entries []*Entry, f Filter) []*Entry {
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].Timestamp > entries[j].Timestamp
+	})
+	if f.Max > 0 && len(entries) > f.Max {
+		entries = entries[:f.Max]
+	}
+	return entries
+}
+
+// MemorySink keeps entries in memory, for development and tests
+type MemorySink struct {
+	entries []*Entry
+	sync.Mutex
+}
+
+func NewMemorySink() *MemorySink {
+	return &MemorySink{}
+}
+
+func (s *MemorySink) Write(e *Entry) error {
+	s.Lock()
+	defer s.Unlock()
+	c := *e
+	s.entries = append(s.entries, &c)
+	return nil
+}
+
+func (s *MemorySink) Query(f Filter) ([]*Entry, error) {
+	s.Lock()
+	defer s.Unlock()
+	entries := []*Entry{}
+	for _, e := range s.entries {
+		if f.Match(e) {
+			c := *e
+			entries = append(entries, &c)
+		}
+	}
+	return sortAndLimit(entries, f), nil
+}
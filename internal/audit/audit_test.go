@@ -0,0 +1,106 @@
+package audit
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFilterMatch(t *testing.T) {
+	now := time.Now()
+	e := NewEntry("alice", "apikey", "10.10.10.10", "GET /admin/list", nil, 42, 200)
+	tt := []struct {
+		name string
+		f    Filter
+		m    bool
+	}{
+		{"no filter", Filter{}, true},
+		{"admin", Filter{Admin: "alice"}, true},
+		{"another admin", Filter{Admin: "bob"}, false},
+		{"since", Filter{Since: now.Add(-time.Minute)}, true},
+		{"since future", Filter{Since: now.Add(time.Minute)}, false},
+		{"until", Filter{Until: now.Add(time.Minute)}, true},
+		{"until past", Filter{Until: now.Add(-time.Minute)}, false},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			if m := tc.f.Match(e); m != tc.m {
+				t.Errorf("incorrect match, got %v, want %v", m, tc.m)
+				t.FailNow()
+			}
+		})
+	}
+}
+
+func TestSinks(t *testing.T) {
+	sinks := map[string]Sink{
+		"memory": NewMemorySink(),
+		"file":   NewFileSink(filepath.Join(t.TempDir(), "audit.jsonl")),
+	}
+	for n, s := range sinks {
+		t.Run(n, func(t *testing.T) {
+			entries, err := s.Query(Filter{})
+			if err != nil || len(entries) != 0 {
+				t.Errorf("incorrect empty query, got %d entries (%v), want 0", len(entries), err)
+				t.FailNow()
+			}
+
+			for i := 0; i < 10; i++ {
+				admin := "alice"
+				if i%2 == 1 {
+					admin = "bob"
+				}
+				e := NewEntry(admin, "apikey", "10.10.10.10", "GET /admin/list", map[string]string{"max": fmt.Sprintf("%d", i)}, i, 200)
+				e.Timestamp += int64(i) // strictly ordered
+				if err := s.Write(e); err != nil {
+					t.Errorf("cannot write entry: %v", err)
+					t.FailNow()
+				}
+			}
+
+			entries, err = s.Query(Filter{})
+			if err != nil || len(entries) != 10 {
+				t.Errorf("incorrect query, got %d entries (%v), want 10", len(entries), err)
+				t.FailNow()
+			}
+			if entries[0].Rows != 9 || entries[9].Rows != 0 {
+				t.Errorf("entries must be sorted, most recent first")
+				t.FailNow()
+			}
+			if entries[0].Filters["max"] != "9" {
+				t.Errorf("incorrect filters, got %v", entries[0].Filters)
+				t.FailNow()
+			}
+
+			entries, _ = s.Query(Filter{Admin: "bob", Max: 3})
+			if len(entries) != 3 {
+				t.Errorf("incorrect query, got %d entries, want 3", len(entries))
+				t.FailNow()
+			}
+			for _, e := range entries {
+				if e.Admin != "bob" {
+					t.Errorf("incorrect admin, got %s, want bob", e.Admin)
+					t.FailNow()
+				}
+			}
+
+			entries, _ = s.Query(Filter{Since: time.Now().Add(time.Hour)})
+			if len(entries) != 0 {
+				t.Errorf("incorrect query, got %d entries, want 0", len(entries))
+				t.FailNow()
+			}
+		})
+	}
+}
+
+func TestNewDynamoDBSink(t *testing.T) {
+	if _, err := NewDynamoDBSink(""); err != ErrDynamoDBNoTableName {
+		t.Errorf("incorrect error, got %v, want %v", err, ErrDynamoDBNoTableName)
+		t.FailNow()
+	}
+	if _, err := NewDynamoDBSink("Audit"); err != nil {
+		t.Errorf("incorrect error, got %v, want nil", err)
+		t.FailNow()
+	}
+}
@@ -0,0 +1,71 @@
+package audit
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+)
+
+var ErrDynamoDBNoTableName = errors.New("cannot create DynamoDB audit sink: no table name")
+
+// DynamoDBSink stores entries in a DynamoDB table (partition key "id")
+type DynamoDBSink struct {
+	tn string
+}
+
+func NewDynamoDBSink(tn string) (*DynamoDBSink, error) {
+	if tn == "" {
+		return nil, ErrDynamoDBNoTableName
+	}
+	return &DynamoDBSink{tn}, nil
+}
+
+func (s *DynamoDBSink) Write(e *Entry) error {
+	sess := session.Must(session.NewSession())
+	svc := dynamodb.New(sess)
+	av, err := dynamodbattribute.MarshalMap(*e)
+	if err != nil {
+		return err
+	}
+	_, err = svc.PutItem(&dynamodb.PutItemInput{
+		Item:                av,
+		TableName:           aws.String(s.tn),
+		ConditionExpression: aws.String("attribute_not_exists(id)"), // append-only
+	})
+	return err
+}
+
+func (s *DynamoDBSink) Query(f Filter) ([]*Entry, error) {
+	sess := session.Must(session.NewSession())
+	svc := dynamodb.New(sess)
+
+	input := &dynamodb.ScanInput{
+		TableName: aws.String(s.tn),
+	}
+	entries := []*Entry{}
+	for {
+		result, err := svc.Scan(input)
+		if err != nil {
+			return nil, err
+		}
+		for _, i := range result.Items {
+			e := &Entry{}
+			if err := dynamodbattribute.UnmarshalMap(i, e); err != nil {
+				return nil, fmt.Errorf("cannot read audit entry: %w", err)
+			}
+			if f.Match(e) {
+				entries = append(entries, e)
+			}
+		}
+		// pagination
+		input.ExclusiveStartKey = result.LastEvaluatedKey
+		if result.LastEvaluatedKey == nil {
+			break
+		}
+	}
+	return sortAndLimit(entries, f), nil
+}
@@ -0,0 +1,86 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+const APIKeyHeader = "X-API-Key"
+
+type apiKey struct {
+	name  string
+	hash  []byte
+	roles []Role
+}
+
+// APIKeys authenticates admins presenting an API key in the X-API-Key header.
+// Only the SHA-256 hashes of the keys are stored.
+type APIKeys struct {
+	keys []apiKey
+}
+
+// NewAPIKeys parses a comma separated list of "name:sha256 hex hash[:role|role...]" entries.
+// Keys without roles are granted the viewer role.
+func NewAPIKeys(spec string) (*APIKeys, error) {
+	ak := &APIKeys{}
+	for _, e := range strings.Split(spec, ",") {
+		e = strings.TrimSpace(e)
+		if e == "" {
+			continue
+		}
+		f := strings.Split(e, ":")
+		if len(f) < 2 || len(f) > 3 || f[0] == "" {
+			return nil, fmt.Errorf("incorrect API key entry %q, want name:hash[:roles]", e)
+		}
+		b, err := hex.DecodeString(f[1])
+		if err != nil || len(b) != sha256.Size {
+			return nil, fmt.Errorf("incorrect API key hash for %q", f[0])
+		}
+		roles := []Role{Viewer}
+		if len(f) == 3 {
+			if roles, err = ParseRoles(f[2], "|"); err != nil {
+				return nil, err
+			}
+		}
+		ak.keys = append(ak.keys, apiKey{f[0], b, roles})
+	}
+	return ak, nil
+}
+
+// GenerateAPIKey generates a new API key and its hash
+func GenerateAPIKey() (key, hash string, err error) {
+	b := make([]byte, 32)
+	if _, err = rand.Read(b); err != nil {
+		return "", "", err
+	}
+	key = hex.EncodeToString(b)
+	return key, HashAPIKey(key), nil
+}
+
+func HashAPIKey(key string) string {
+	h := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(h[:])
+}
+
+func (ak *APIKeys) Authenticate(r *http.Request) (*Identity, error) {
+	k := r.Header.Get(APIKeyHeader)
+	if k == "" {
+		return nil, ErrNoCredentials
+	}
+	h := sha256.Sum256([]byte(k))
+	var id *Identity
+	for _, e := range ak.keys { // no early exit, compare all the hashes
+		if subtle.ConstantTimeCompare(h[:], e.hash) == 1 {
+			id = &Identity{Subject: e.name, Method: "apikey", Roles: e.roles}
+		}
+	}
+	if id == nil {
+		return nil, ErrInvalidCredentials
+	}
+	return id, nil
+}
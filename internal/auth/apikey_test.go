@@ -0,0 +1,82 @@
+package auth
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+)
+
+func TestNewAPIKeys(t *testing.T) {
+	_, h, _ := GenerateAPIKey()
+	tt := []struct {
+		name string
+		spec string
+		n    int
+		fail bool
+	}{
+		{"empty", "", 0, false},
+		{"one key", "alice:" + h, 1, false},
+		{"two keys", "alice:" + h + ", bob:" + h, 2, false},
+		{"no name", ":" + h, 0, true},
+		{"no hash", "alice", 0, true},
+		{"short hash", "alice:abcd", 0, true},
+		{"not hex", "alice:n0tH3x", 0, true},
+		{"roles", "alice:" + h + ":viewer|exporter, bob:" + h + ":operator", 2, false},
+		{"unknown role", "alice:" + h + ":admin", 0, true},
+		{"too many fields", "alice:" + h + ":viewer:operator", 0, true},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			ak, err := NewAPIKeys(tc.spec)
+			if (err != nil) != tc.fail {
+				t.Errorf("incorrect error, got %v", err)
+				t.FailNow()
+			}
+			if err == nil && len(ak.keys) != tc.n {
+				t.Errorf("incorrect number of keys, got %d, want %d", len(ak.keys), tc.n)
+				t.FailNow()
+			}
+		})
+	}
+}
+
+func TestAPIKeysAuthenticate(t *testing.T) {
+	k1, h1, _ := GenerateAPIKey()
+	k2, h2, _ := GenerateAPIKey()
+	if HashAPIKey(k1) != h1 {
+		t.Errorf("incorrect hash, got %s, want %s", HashAPIKey(k1), h1)
+		t.FailNow()
+	}
+	ak, _ := NewAPIKeys("alice:" + h1 + ",bob:" + h2 + ":exporter|operator")
+
+	tt := []struct {
+		name  string
+		key   string
+		sub   string
+		roles int
+		err   error
+	}{
+		{"alice", k1, "alice", 1, nil},
+		{"bob", k2, "bob", 2, nil},
+		{"no key", "", "", 0, ErrNoCredentials},
+		{"wrong key", "wr0ngK3y", "", 0, ErrInvalidCredentials},
+		{"hash as key", h1, "", 0, ErrInvalidCredentials},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			r, _ := http.NewRequest("GET", "/admin/count", nil)
+			if tc.key != "" {
+				r.Header.Set(APIKeyHeader, tc.key)
+			}
+			id, err := ak.Authenticate(r)
+			if !errors.Is(err, tc.err) {
+				t.Errorf("incorrect error, got %v, want %v", err, tc.err)
+				t.FailNow()
+			}
+			if id != nil && (id.Subject != tc.sub || id.Method != "apikey" || len(id.Roles) != tc.roles) {
+				t.Errorf("incorrect identity, got %v, want subject %s with %d role(s)", *id, tc.sub, tc.roles)
+				t.FailNow()
+			}
+		})
+	}
+}
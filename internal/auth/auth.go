@@ -0,0 +1,42 @@
+package auth
+
+import (
+	"errors"
+	"net/http"
+)
+
+var (
+	ErrNoCredentials      = errors.New("no credentials")
+	ErrInvalidCredentials = errors.New("invalid credentials")
+)
+
+// Identity is an authenticated admin
+type Identity struct {
+	Subject string `json:"subject"`
+	Method  string `json:"method"`
+	Roles   []Role `json:"roles"`
+}
+
+// Authenticator authenticates the admin issuing a request
+type Authenticator interface {
+	Authenticate(r *http.Request) (*Identity, error)
+}
+
+type chain []Authenticator
+
+// Chain returns an Authenticator trying each authenticator in turn.
+// Invalid credentials are never retried with the next authenticator.
+func Chain(a ...Authenticator) Authenticator {
+	return chain(a)
+}
+
+func (c chain) Authenticate(r *http.Request) (*Identity, error) {
+	for _, a := range c {
+		id, err := a.Authenticate(r)
+		if errors.Is(err, ErrNoCredentials) {
+			continue
+		}
+		return id, err
+	}
+	return nil, ErrNoCredentials
+}
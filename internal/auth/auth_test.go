@@ -0,0 +1,46 @@
+package auth
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+func TestChain(t *testing.T) {
+	k, h, _ := GenerateAPIKey()
+	keys, jwks := newTestKeys()
+	ak, _ := NewAPIKeys("alice:" + h)
+	o, _ := NewOIDC(jwks, issuer, audience)
+	a := Chain(ak, o)
+
+	tt := []struct {
+		name   string
+		header map[string]string
+		method string
+		err    error
+	}{
+		{"api key", map[string]string{APIKeyHeader: k}, "apikey", nil},
+		{"bearer", map[string]string{"Authorization": "Bearer " + sign(jwt.SigningMethodRS256, "rsa1", keys.rsa, validClaims())}, "oidc", nil},
+		{"no credentials", map[string]string{}, "", ErrNoCredentials},
+		{"wrong api key with valid bearer", map[string]string{APIKeyHeader: "wr0ng", "Authorization": "Bearer " + sign(jwt.SigningMethodRS256, "rsa1", keys.rsa, validClaims())}, "", ErrInvalidCredentials},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			r, _ := http.NewRequest("GET", "/admin/count", nil)
+			for k, v := range tc.header {
+				r.Header.Set(k, v)
+			}
+			id, err := a.Authenticate(r)
+			if !errors.Is(err, tc.err) {
+				t.Errorf("incorrect error, got %v, want %v", err, tc.err)
+				t.FailNow()
+			}
+			if err == nil && id.Method != tc.method {
+				t.Errorf("incorrect method, got %s, want %s", id.Method, tc.method)
+				t.FailNow()
+			}
+		})
+	}
+}
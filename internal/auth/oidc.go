@@ -0,0 +1,200 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+var ErrUnknownKey = errors.New("unknown signing key")
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// OIDC authenticates admins presenting an OIDC bearer token (JWT) signed by one of the keys of a local JWKS
+type OIDC struct {
+	keys     map[string]interface{}
+	issuer   string
+	audience string
+	parser   *jwt.Parser
+}
+
+func LoadOIDC(path, issuer, audience string) (*OIDC, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return NewOIDC(b, issuer, audience)
+}
+
+// NewOIDC parses the JWKS and returns an authenticator accepting tokens issued by issuer for audience
+func NewOIDC(jwks []byte, issuer, audience string) (*OIDC, error) {
+	if issuer == "" || audience == "" {
+		return nil, errors.New("OIDC issuer and audience are required")
+	}
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(jwks, &set); err != nil {
+		return nil, err
+	}
+	o := &OIDC{
+		keys:     map[string]interface{}{},
+		issuer:   issuer,
+		audience: audience,
+		parser:   jwt.NewParser(jwt.WithValidMethods([]string{"RS256", "RS384", "RS512", "ES256", "ES384", "ES512", "EdDSA"})),
+	}
+	for _, k := range set.Keys {
+		pk, err := k.publicKey()
+		if err != nil {
+			return nil, fmt.Errorf("incorrect JWK %q: %w", k.Kid, err)
+		}
+		o.keys[k.Kid] = pk
+	}
+	if len(o.keys) == 0 {
+		return nil, errors.New("JWKS contains no key")
+	}
+	return o, nil
+}
+
+func decodeB64(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+}
+
+func (k jwk) publicKey() (interface{}, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeB64(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeB64(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		var c elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			c = elliptic.P256()
+		case "P-384":
+			c = elliptic.P384()
+		case "P-521":
+			c = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decodeB64(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeB64(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		pk := &ecdsa.PublicKey{Curve: c, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !c.IsOnCurve(pk.X, pk.Y) {
+			return nil, errors.New("point is not on curve")
+		}
+		return pk, nil
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decodeB64(k.X)
+		if err != nil {
+			return nil, err
+		}
+		if len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("incorrect Ed25519 key size")
+		}
+		return ed25519.PublicKey(x), nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+	}
+}
+
+func (o *OIDC) key(t *jwt.Token) (interface{}, error) {
+	kid, _ := t.Header["kid"].(string)
+	k, ok := o.keys[kid]
+	if !ok {
+		return nil, ErrUnknownKey
+	}
+	switch t.Method.(type) {
+	case *jwt.SigningMethodRSA:
+		_, ok = k.(*rsa.PublicKey)
+	case *jwt.SigningMethodECDSA:
+		_, ok = k.(*ecdsa.PublicKey)
+	case *jwt.SigningMethodEd25519:
+		_, ok = k.(ed25519.PublicKey)
+	default:
+		ok = false
+	}
+	if !ok {
+		return nil, jwt.ErrSignatureInvalid
+	}
+	return k, nil
+}
+
+func (o *OIDC) Authenticate(r *http.Request) (*Identity, error) {
+	h := r.Header.Get("Authorization")
+	if len(h) < 7 || !strings.EqualFold(h[:7], "Bearer ") {
+		return nil, ErrNoCredentials
+	}
+	claims := jwt.MapClaims{}
+	tk, err := o.parser.ParseWithClaims(strings.TrimSpace(h[7:]), claims, o.key)
+	if err != nil || !tk.Valid {
+		return nil, ErrInvalidCredentials
+	}
+	now := time.Now().Unix()
+	if !claims.VerifyExpiresAt(now, true) || !claims.VerifyIssuer(o.issuer, true) || !claims.VerifyAudience(o.audience, true) {
+		return nil, ErrInvalidCredentials
+	}
+	sub, _ := claims["sub"].(string)
+	if sub == "" {
+		return nil, ErrInvalidCredentials
+	}
+	return &Identity{Subject: sub, Method: "oidc", Roles: rolesClaim(claims["roles"])}, nil
+}
+
+// rolesClaim reads the roles claim (array or space separated string), ignoring the roles unknown to the service
+func rolesClaim(c interface{}) []Role {
+	var l []string
+	switch v := c.(type) {
+	case string:
+		l = strings.Fields(v)
+	case []interface{}:
+		for _, r := range v {
+			if s, ok := r.(string); ok {
+				l = append(l, s)
+			}
+		}
+	}
+	roles := []Role{}
+	for _, r := range l {
+		if _, ok := permissions[Role(r)]; ok {
+			roles = append(roles, Role(r))
+		}
+	}
+	return roles
+}
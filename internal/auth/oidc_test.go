@@ -0,0 +1,191 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+const (
+	issuer   = "https://auth.poln.org"
+	audience = "preregister-admin"
+)
+
+func b64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+type testKeys struct {
+	rsa *rsa.PrivateKey
+	ec  *ecdsa.PrivateKey
+	ed  ed25519.PrivateKey
+}
+
+func newTestKeys() (*testKeys, []byte) {
+	rk, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ek, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	_, edk, _ := ed25519.GenerateKey(rand.Reader)
+	jwks, _ := json.Marshal(map[string]interface{}{
+		"keys": []map[string]string{
+			{"kty": "RSA", "kid": "rsa1", "n": b64(rk.N.Bytes()), "e": b64(big.NewInt(int64(rk.E)).Bytes())},
+			{"kty": "EC", "kid": "ec1", "crv": "P-256", "x": b64(ek.X.Bytes()), "y": b64(ek.Y.Bytes())},
+			{"kty": "OKP", "kid": "ed1", "crv": "Ed25519", "x": b64(edk.Public().(ed25519.PublicKey))},
+		},
+	})
+	return &testKeys{rk, ek, edk}, jwks
+}
+
+func sign(m jwt.SigningMethod, kid string, k interface{}, claims jwt.MapClaims) string {
+	tk := jwt.NewWithClaims(m, claims)
+	tk.Header["kid"] = kid
+	s, _ := tk.SignedString(k)
+	return s
+}
+
+func validClaims() jwt.MapClaims {
+	return jwt.MapClaims{
+		"sub": "alice@poln.org",
+		"iss": issuer,
+		"aud": audience,
+		"exp": time.Now().Add(time.Hour).Unix(),
+	}
+}
+
+func TestNewOIDC(t *testing.T) {
+	_, jwks := newTestKeys()
+	tt := []struct {
+		name             string
+		jwks             string
+		issuer, audience string
+		fail             bool
+	}{
+		{"valid", string(jwks), issuer, audience, false},
+		{"no issuer", string(jwks), "", audience, true},
+		{"no audience", string(jwks), issuer, "", true},
+		{"no key", `{"keys":[]}`, issuer, audience, true},
+		{"not json", `keys`, issuer, audience, true},
+		{"unsupported key type", `{"keys":[{"kty":"oct","kid":"k"}]}`, issuer, audience, true},
+		{"unsupported curve", `{"keys":[{"kty":"EC","kid":"k","crv":"P-192","x":"AA","y":"AA"}]}`, issuer, audience, true},
+		{"point not on curve", `{"keys":[{"kty":"EC","kid":"k","crv":"P-256","x":"AQ","y":"AQ"}]}`, issuer, audience, true},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := NewOIDC([]byte(tc.jwks), tc.issuer, tc.audience)
+			if (err != nil) != tc.fail {
+				t.Errorf("incorrect error, got %v", err)
+				t.FailNow()
+			}
+		})
+	}
+}
+
+func TestOIDCAuthenticate(t *testing.T) {
+	keys, jwks := newTestKeys()
+	o, err := NewOIDC(jwks, issuer, audience)
+	if err != nil {
+		t.Errorf("cannot create OIDC authenticator: %v", err)
+		t.FailNow()
+	}
+	other, _ := rsa.GenerateKey(rand.Reader, 2048)
+
+	expired := validClaims()
+	expired["exp"] = time.Now().Add(-time.Minute).Unix()
+	wrongIssuer := validClaims()
+	wrongIssuer["iss"] = "https://evil.org"
+	wrongAudience := validClaims()
+	wrongAudience["aud"] = "another-app"
+	noSubject := validClaims()
+	delete(noSubject, "sub")
+	noExpiration := validClaims()
+	delete(noExpiration, "exp")
+
+	tt := []struct {
+		name  string
+		authz string
+		err   error
+	}{
+		{"RS256", "Bearer " + sign(jwt.SigningMethodRS256, "rsa1", keys.rsa, validClaims()), nil},
+		{"ES256", "Bearer " + sign(jwt.SigningMethodES256, "ec1", keys.ec, validClaims()), nil},
+		{"EdDSA", "Bearer " + sign(jwt.SigningMethodEdDSA, "ed1", keys.ed, validClaims()), nil},
+		{"no header", "", ErrNoCredentials},
+		{"basic auth", "Basic YWxpY2U6cGFzc3dvcmQ=", ErrNoCredentials},
+		{"garbage", "Bearer g4rb4ge", ErrInvalidCredentials},
+		{"unknown kid", "Bearer " + sign(jwt.SigningMethodRS256, "rsa2", keys.rsa, validClaims()), ErrInvalidCredentials},
+		{"wrong key", "Bearer " + sign(jwt.SigningMethodRS256, "rsa1", other, validClaims()), ErrInvalidCredentials},
+		{"key type mismatch", "Bearer " + sign(jwt.SigningMethodES256, "rsa1", keys.ec, validClaims()), ErrInvalidCredentials},
+		{"HS256 with public key", "Bearer " + sign(jwt.SigningMethodHS256, "rsa1", []byte("s3cr3t"), validClaims()), ErrInvalidCredentials},
+		{"expired", "Bearer " + sign(jwt.SigningMethodRS256, "rsa1", keys.rsa, expired), ErrInvalidCredentials},
+		{"no expiration", "Bearer " + sign(jwt.SigningMethodRS256, "rsa1", keys.rsa, noExpiration), ErrInvalidCredentials},
+		{"wrong issuer", "Bearer " + sign(jwt.SigningMethodRS256, "rsa1", keys.rsa, wrongIssuer), ErrInvalidCredentials},
+		{"wrong audience", "Bearer " + sign(jwt.SigningMethodRS256, "rsa1", keys.rsa, wrongAudience), ErrInvalidCredentials},
+		{"no subject", "Bearer " + sign(jwt.SigningMethodRS256, "rsa1", keys.rsa, noSubject), ErrInvalidCredentials},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			r, _ := http.NewRequest("GET", "/admin/count", nil)
+			if tc.authz != "" {
+				r.Header.Set("Authorization", tc.authz)
+			}
+			id, err := o.Authenticate(r)
+			if !errors.Is(err, tc.err) {
+				t.Errorf("incorrect error, got %v, want %v", err, tc.err)
+				t.FailNow()
+			}
+			if err == nil && (id.Subject != "alice@poln.org" || id.Method != "oidc") {
+				t.Errorf("incorrect identity, got %v", *id)
+				t.FailNow()
+			}
+		})
+	}
+}
+
+func TestOIDCRoles(t *testing.T) {
+	keys, jwks := newTestKeys()
+	o, _ := NewOIDC(jwks, issuer, audience)
+	tt := []struct {
+		name  string
+		roles interface{}
+		exp   []Role
+	}{
+		{"no roles", nil, []Role{}},
+		{"array", []string{"viewer", "exporter"}, []Role{Viewer, Exporter}},
+		{"string", "operator viewer", []Role{Operator, Viewer}},
+		{"unknown roles ignored", []string{"admin", "operator", "billing"}, []Role{Operator}},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			c := validClaims()
+			if tc.roles != nil {
+				c["roles"] = tc.roles
+			}
+			r, _ := http.NewRequest("GET", "/admin/count", nil)
+			r.Header.Set("Authorization", "Bearer "+sign(jwt.SigningMethodRS256, "rsa1", keys.rsa, c))
+			id, err := o.Authenticate(r)
+			if err != nil {
+				t.Errorf("incorrect error, got %v, want nil", err)
+				t.FailNow()
+			}
+			if len(id.Roles) != len(tc.exp) {
+				t.Errorf("incorrect roles, got %v, want %v", id.Roles, tc.exp)
+				t.FailNow()
+			}
+			for i := range id.Roles {
+				if id.Roles[i] != tc.exp[i] {
+					t.Errorf("incorrect roles, got %v, want %v", id.Roles, tc.exp)
+					t.FailNow()
+				}
+			}
+		})
+	}
+}
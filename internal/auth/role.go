@@ -0,0 +1,64 @@
+package auth
+
+import (
+	"fmt"
+	"strings"
+)
+
+type Role string
+
+const (
+	Viewer   Role = "viewer"   // counts users
+	Exporter Role = "exporter" // lists users with their emails
+	Operator Role = "operator" // lists users with masked emails, mutates data and reviews the audit log
+)
+
+type Permission string
+
+const (
+	PermCount   Permission = "count"
+	PermList    Permission = "list"
+	PermDecrypt Permission = "decrypt"
+	PermMutate  Permission = "mutate"
+	PermAudit   Permission = "audit"
+)
+
+var permissions = map[Role][]Permission{
+	Viewer:   {PermCount},
+	Exporter: {PermCount, PermList, PermDecrypt},
+	Operator: {PermCount, PermList, PermMutate, PermAudit},
+}
+
+// AllRoles is granted to the deprecated secure paths
+var AllRoles = []Role{Viewer, Exporter, Operator}
+
+// ParseRoles parses a list of roles separated by sep
+func ParseRoles(s, sep string) ([]Role, error) {
+	roles := []Role{}
+	for _, r := range strings.Split(s, sep) {
+		r = strings.TrimSpace(r)
+		if r == "" {
+			continue
+		}
+		if _, ok := permissions[Role(r)]; !ok {
+			return nil, fmt.Errorf("unknown role %q", r)
+		}
+		roles = append(roles, Role(r))
+	}
+	return roles, nil
+}
+
+// Can tests if one of the identity's roles grants the permission p
+func (id *Identity) Can(p Permission) bool {
+	if id == nil {
+		return false
+	}
+	for _, r := range id.Roles {
+		for _, v := range permissions[r] {
+			if v == p {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,64 @@
+package auth
+
+import (
+	"testing"
+)
+
+func TestParseRoles(t *testing.T) {
+	tt := []struct {
+		name  string
+		s     string
+		roles []Role
+		fail  bool
+	}{
+		{"empty", "", []Role{}, false},
+		{"viewer", "viewer", []Role{Viewer}, false},
+		{"all", "viewer|exporter|operator", AllRoles, false},
+		{"spaces", " viewer | operator ", []Role{Viewer, Operator}, false},
+		{"unknown", "viewer|admin", nil, true},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			roles, err := ParseRoles(tc.s, "|")
+			if (err != nil) != tc.fail {
+				t.Errorf("incorrect error, got %v", err)
+				t.FailNow()
+			}
+			if len(roles) != len(tc.roles) {
+				t.Errorf("incorrect roles, got %v, want %v", roles, tc.roles)
+				t.FailNow()
+			}
+			for i := range roles {
+				if roles[i] != tc.roles[i] {
+					t.Errorf("incorrect roles, got %v, want %v", roles, tc.roles)
+					t.FailNow()
+				}
+			}
+		})
+	}
+}
+
+func TestCan(t *testing.T) {
+	tt := []struct {
+		name  string
+		id    *Identity
+		perms map[Permission]bool
+	}{
+		{"nil", nil, map[Permission]bool{PermCount: false, PermList: false, PermDecrypt: false, PermMutate: false, PermAudit: false}},
+		{"no role", &Identity{}, map[Permission]bool{PermCount: false, PermList: false, PermDecrypt: false, PermMutate: false, PermAudit: false}},
+		{"viewer", &Identity{Roles: []Role{Viewer}}, map[Permission]bool{PermCount: true, PermList: false, PermDecrypt: false, PermMutate: false, PermAudit: false}},
+		{"exporter", &Identity{Roles: []Role{Exporter}}, map[Permission]bool{PermCount: true, PermList: true, PermDecrypt: true, PermMutate: false, PermAudit: false}},
+		{"operator", &Identity{Roles: []Role{Operator}}, map[Permission]bool{PermCount: true, PermList: true, PermDecrypt: false, PermMutate: true, PermAudit: true}},
+		{"all", &Identity{Roles: AllRoles}, map[Permission]bool{PermCount: true, PermList: true, PermDecrypt: true, PermMutate: true, PermAudit: true}},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			for p, v := range tc.perms {
+				if tc.id.Can(p) != v {
+					t.Errorf("incorrect permission %q, got %v, want %v", p, !v, v)
+					t.FailNow()
+				}
+			}
+		})
+	}
+}
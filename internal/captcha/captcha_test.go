@@ -0,0 +1,137 @@
+package captcha
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+const (
+	secret = "0x0000000000000000000000000000000000000000"
+	token  = "10000000-aaaa-bbbb-cccc-000000000001"
+)
+
+// newSiteverifyServer simulates the siteverify API
+func newSiteverifyServer(t *testing.T, score string) *httptest.Server {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		r.ParseForm()
+		switch {
+		case r.PostForm.Get("secret") != secret:
+			fmt.Fprint(w, `{"success":false,"error-codes":["invalid-input-secret"]}`)
+		case r.PostForm.Get("response") == "unavailable":
+			w.WriteHeader(http.StatusInternalServerError)
+		case r.PostForm.Get("response") == "garbage":
+			fmt.Fprint(w, `<html>`)
+		case r.PostForm.Get("response") != token:
+			fmt.Fprint(w, `{"success":false,"error-codes":["invalid-input-response"]}`)
+		case r.PostForm.Get("remoteip") != "203.0.113.7":
+			fmt.Fprint(w, `{"success":false,"error-codes":["invalid-remoteip"]}`)
+		case score != "":
+			fmt.Fprintf(w, `{"success":true,"score":%s}`, score)
+		default:
+			fmt.Fprint(w, `{"success":true}`)
+		}
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func TestNew(t *testing.T) {
+	for _, p := range []string{HCaptcha, Turnstile, ReCaptcha, "HCaptcha"} {
+		t.Run(p, func(t *testing.T) {
+			v, err := New(p, secret)
+			if err != nil {
+				t.Errorf("incorrect error, got %v, want nil", err)
+				t.FailNow()
+			}
+			if v.url == "" {
+				t.Errorf("siteverify url cannot be empty")
+				t.FailNow()
+			}
+		})
+	}
+	if _, err := New("friendly", secret); !errors.Is(err, ErrUnsupportedProvider) {
+		t.Errorf("incorrect error, got %v, want %v", err, ErrUnsupportedProvider)
+	}
+	if _, err := New(HCaptcha, ""); !errors.Is(err, ErrNoSecret) {
+		t.Errorf("incorrect error, got %v, want %v", err, ErrNoSecret)
+	}
+}
+
+func TestSiteverify(t *testing.T) {
+	s := newSiteverifyServer(t, "")
+	tt := []struct {
+		name   string
+		secret string
+		token  string
+		ip     string
+		err    error
+	}{
+		{"valid", secret, token, "203.0.113.7", nil},
+		{"no token", secret, "", "203.0.113.7", ErrNoToken},
+		{"invalid token", secret, "n0t-a-t0k3n", "203.0.113.7", ErrInvalidToken},
+		{"other ip", secret, token, "198.51.100.7", ErrInvalidToken},
+		{"invalid secret", "n0t-a-s3cr3t", token, "203.0.113.7", ErrInvalidToken},
+		{"unavailable", secret, "unavailable", "203.0.113.7", ErrUnavailable},
+		{"invalid response", secret, "garbage", "203.0.113.7", ErrUnavailable},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := NewSiteverify(s.URL, tc.secret).Verify(tc.token, tc.ip); !errors.Is(err, tc.err) {
+				t.Errorf("incorrect error, got %v, want %v", err, tc.err)
+				t.FailNow()
+			}
+		})
+	}
+
+	t.Run("unreachable", func(t *testing.T) {
+		s := httptest.NewServer(http.NotFoundHandler())
+		s.Close()
+		if err := NewSiteverify(s.URL, secret).Verify(token, "203.0.113.7"); !errors.Is(err, ErrUnavailable) {
+			t.Errorf("incorrect error, got %v, want %v", err, ErrUnavailable)
+		}
+	})
+}
+
+func TestSiteverifyScore(t *testing.T) {
+	tt := []struct {
+		score    string
+		minScore float64
+		err      error
+	}{
+		{"0.9", 0.5, nil},
+		{"0.5", 0.5, nil},
+		{"0.1", 0.5, ErrInvalidToken},
+		{"0.1", 0, nil},
+		{"", 0.5, nil}, // no score (hCaptcha, Turnstile)
+	}
+	for _, tc := range tt {
+		t.Run(fmt.Sprintf("%s>=%.1f", tc.score, tc.minScore), func(t *testing.T) {
+			v := NewSiteverify(newSiteverifyServer(t, tc.score).URL, secret)
+			v.MinScore = tc.minScore
+			if err := v.Verify(token, "203.0.113.7"); !errors.Is(err, tc.err) {
+				t.Errorf("incorrect error, got %v, want %v", err, tc.err)
+				t.FailNow()
+			}
+		})
+	}
+}
+
+func TestFake(t *testing.T) {
+	f := Fake(token)
+	if err := f.Verify(token, ""); err != nil {
+		t.Errorf("incorrect error, got %v, want nil", err)
+	}
+	if err := f.Verify("n0t-a-t0k3n", ""); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("incorrect error, got %v, want %v", err, ErrInvalidToken)
+	}
+	if err := f.Verify("", ""); !errors.Is(err, ErrNoToken) {
+		t.Errorf("incorrect error, got %v, want %v", err, ErrNoToken)
+	}
+}
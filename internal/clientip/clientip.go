@@ -0,0 +1,157 @@
+package clientip
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Platforms whose proxies are trusted
+const (
+	Heroku     = "heroku"     // the Heroku router appends the client IP to X-Forwarded-For
+	Cloudflare = "cloudflare" // Cloudflare sets CF-Connecting-IP
+)
+
+const (
+	ForwardedForHeader     = "X-Forwarded-For"
+	CloudflareConnectingIP = "CF-Connecting-IP"
+)
+
+// CloudflareRanges are the IP ranges of Cloudflare, see https://www.cloudflare.com/ips/
+var CloudflareRanges = []string{
+	"173.245.48.0/20",
+	"103.21.244.0/22",
+	"103.22.200.0/22",
+	"103.31.4.0/22",
+	"141.101.64.0/18",
+	"108.162.192.0/18",
+	"190.93.240.0/20",
+	"188.114.96.0/20",
+	"197.234.240.0/22",
+	"198.41.128.0/17",
+	"162.158.0.0/15",
+	"104.16.0.0/13",
+	"104.24.0.0/14",
+	"172.64.0.0/13",
+	"131.0.72.0/22",
+	"2400:cb00::/32",
+	"2606:4700::/32",
+	"2803:f800::/32",
+	"2405:b500::/32",
+	"2405:8100::/32",
+	"2a06:98c0::/29",
+	"2c0f:f248::/32",
+}
+
+var ErrUnsupportedPlatform = errors.New("unsupported platform")
+
+// Resolver resolves the IP of the client, trusting only the configured proxies
+type Resolver struct {
+	trusted    []*net.IPNet
+	heroku     bool
+	cloudflare bool
+}
+
+// New returns a Resolver trusting the proxies in the CIDRs and the platforms (Heroku, Cloudflare).
+// Without trusted proxies nor platforms, the client IP is the remote address.
+func New(cidrs []string, platforms ...string) (*Resolver, error) {
+	r := &Resolver{}
+	for _, p := range platforms {
+		switch strings.ToLower(strings.TrimSpace(p)) {
+		case "":
+		case Heroku:
+			r.heroku = true
+		case Cloudflare:
+			r.cloudflare = true
+			cidrs = append(cidrs, CloudflareRanges...)
+		default:
+			return nil, ErrUnsupportedPlatform
+		}
+	}
+	for _, c := range cidrs {
+		c = strings.TrimSpace(c)
+		if c == "" {
+			continue
+		}
+		if !strings.Contains(c, "/") { // single IP
+			if ip := net.ParseIP(c); ip != nil && ip.To4() != nil {
+				c += "/32"
+			} else {
+				c += "/128"
+			}
+		}
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			return nil, err
+		}
+		r.trusted = append(r.trusted, n)
+	}
+	return r, nil
+}
+
+func (r *Resolver) isTrusted(ip net.IP) bool {
+	for _, n := range r.trusted {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func parseIP(s string) net.IP {
+	s = strings.TrimSpace(s)
+	if h, _, err := net.SplitHostPort(s); err == nil {
+		s = h
+	}
+	ip := net.ParseIP(s)
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4
+	}
+	return ip
+}
+
+// IP returns the client IP, nil if it cannot be resolved.
+// The hops are walked from the remote address back to the client, stopping at the first untrusted one,
+// so a client cannot spoof its IP by sending forwarding headers.
+func (r *Resolver) IP(req *http.Request) net.IP {
+	var hops []net.IP
+	for _, h := range req.Header.Values(ForwardedForHeader) {
+		for _, ip := range strings.Split(h, ",") {
+			hops = append(hops, parseIP(ip))
+		}
+	}
+	hops = append(hops, parseIP(req.RemoteAddr))
+
+	i := len(hops) - 1
+	if hops[i] == nil {
+		return nil
+	}
+	if r.heroku && i > 0 { // the remote address is the Heroku router
+		i--
+	}
+	if r.cloudflare && hops[i] != nil && r.isTrusted(hops[i]) {
+		if ip := parseIP(req.Header.Get(CloudflareConnectingIP)); ip != nil {
+			return ip
+		}
+	}
+	for i > 0 && hops[i] != nil && r.isTrusted(hops[i]) {
+		i--
+	}
+	if hops[i] == nil { // malformed hop, keep the last valid one
+		return hops[i+1]
+	}
+	return hops[i]
+}
+
+// Key returns the key of the IP to aggregate clients: the IP itself for IPv4,
+// its /64 network for IPv6 as a single host usually owns a whole /64
+func Key(ip net.IP) string {
+	if ip == nil {
+		return ""
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.String()
+	}
+	return ip.Mask(net.CIDRMask(64, 128)).String() + "/64"
+}
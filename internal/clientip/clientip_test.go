@@ -0,0 +1,133 @@
+package clientip
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"testing"
+)
+
+func TestNew(t *testing.T) {
+	tt := []struct {
+		name      string
+		cidrs     []string
+		platforms []string
+		trusted   int
+		err       bool
+	}{
+		{"none", nil, nil, 0, false},
+		{"cidrs", []string{"10.0.0.0/8", " 192.168.0.0/16 ", ""}, nil, 2, false},
+		{"single ips", []string{"10.1.2.3", "2001:db8::1"}, nil, 2, false},
+		{"heroku", nil, []string{"Heroku"}, 0, false},
+		{"cloudflare", []string{"10.0.0.0/8"}, []string{"heroku", "cloudflare"}, 1 + len(CloudflareRanges), false},
+		{"invalid cidr", []string{"10.0.0.0/33"}, nil, 0, true},
+		{"invalid ip", []string{"n0t-an-ip"}, nil, 0, true},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			r, err := New(tc.cidrs, tc.platforms...)
+			if (err != nil) != tc.err {
+				t.Errorf("incorrect error, got %v", err)
+				t.FailNow()
+			}
+			if err == nil && len(r.trusted) != tc.trusted {
+				t.Errorf("incorrect trusted proxies, got %d, want %d", len(r.trusted), tc.trusted)
+				t.FailNow()
+			}
+		})
+	}
+
+	if _, err := New(nil, "fly"); !errors.Is(err, ErrUnsupportedPlatform) {
+		t.Errorf("incorrect error, got %v, want %v", err, ErrUnsupportedPlatform)
+	}
+}
+
+func TestIP(t *testing.T) {
+	direct, _ := New(nil)
+	proxied, _ := New([]string{"10.0.0.0/8"})
+	heroku, _ := New(nil, Heroku)
+	cloudflare, _ := New(nil, Cloudflare)
+	herokuCloudflare, _ := New(nil, Heroku, Cloudflare)
+
+	tt := []struct {
+		name   string
+		r      *Resolver
+		remote string
+		xff    []string
+		cf     string
+		ip     string
+	}{
+		{"direct", direct, "203.0.113.7:1234", nil, "", "203.0.113.7"},
+		{"direct spoofing xff", direct, "203.0.113.7:1234", []string{"198.51.100.1"}, "", "203.0.113.7"},
+		{"direct spoofing cf", direct, "203.0.113.7:1234", nil, "198.51.100.1", "203.0.113.7"},
+		{"direct ipv6", direct, "[2001:db8::1]:1234", nil, "", "2001:db8::1"},
+		{"direct no port", direct, "203.0.113.7", nil, "", "203.0.113.7"},
+		{"no remote address", direct, "", nil, "", ""},
+
+		{"trusted proxy", proxied, "10.0.0.1:1234", []string{"203.0.113.7"}, "", "203.0.113.7"},
+		{"trusted proxies chain", proxied, "10.0.0.1:1234", []string{"203.0.113.7, 10.0.0.3", "10.0.0.2"}, "", "203.0.113.7"},
+		{"trusted proxy spoofing xff", proxied, "10.0.0.1:1234", []string{"198.51.100.1, 203.0.113.7"}, "", "203.0.113.7"},
+		{"trusted proxy malformed xff", proxied, "10.0.0.1:1234", []string{"n0t-an-ip, 10.0.0.2"}, "", "10.0.0.2"},
+		{"trusted proxy only", proxied, "10.0.0.1:1234", nil, "", "10.0.0.1"},
+		{"untrusted proxy", proxied, "203.0.113.9:1234", []string{"203.0.113.7"}, "", "203.0.113.9"},
+
+		{"heroku", heroku, "10.1.2.3:1234", []string{"203.0.113.7"}, "", "203.0.113.7"},
+		{"heroku spoofing xff", heroku, "10.1.2.3:1234", []string{"198.51.100.1, 203.0.113.7"}, "", "203.0.113.7"},
+		{"heroku spoofing cf", heroku, "10.1.2.3:1234", []string{"203.0.113.7"}, "198.51.100.1", "203.0.113.7"},
+		{"heroku without xff", heroku, "10.1.2.3:1234", nil, "", "10.1.2.3"},
+
+		{"cloudflare", cloudflare, "173.245.48.1:1234", []string{"203.0.113.7"}, "203.0.113.7", "203.0.113.7"},
+		{"cloudflare ipv6", cloudflare, "[2606:4700::1]:1234", nil, "2001:db8::7", "2001:db8::7"},
+		{"cloudflare bypassed", cloudflare, "198.51.100.9:1234", nil, "203.0.113.7", "198.51.100.9"},
+		{"cloudflare malformed cf", cloudflare, "173.245.48.1:1234", []string{"203.0.113.7"}, "n0t-an-ip", "203.0.113.7"},
+
+		{"heroku cloudflare", herokuCloudflare, "10.1.2.3:1234", []string{"203.0.113.7, 173.245.48.1"}, "203.0.113.7", "203.0.113.7"},
+		{"heroku cloudflare bypassed", herokuCloudflare, "10.1.2.3:1234", []string{"198.51.100.9"}, "203.0.113.7", "198.51.100.9"},
+		{"heroku cloudflare spoofing xff", herokuCloudflare, "10.1.2.3:1234", []string{"173.245.48.1, 198.51.100.9"}, "203.0.113.7", "198.51.100.9"},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			req, _ := http.NewRequest("GET", "/", nil)
+			req.RemoteAddr = tc.remote
+			for _, v := range tc.xff {
+				req.Header.Add(ForwardedForHeader, v)
+			}
+			if tc.cf != "" {
+				req.Header.Set(CloudflareConnectingIP, tc.cf)
+			}
+			ip := tc.r.IP(req)
+			var got string
+			if ip != nil {
+				got = ip.String()
+			}
+			if got != tc.ip {
+				t.Errorf("incorrect client ip, got %q, want %q", got, tc.ip)
+				t.FailNow()
+			}
+		})
+	}
+}
+
+func TestKey(t *testing.T) {
+	tt := []struct {
+		ip  string
+		key string
+	}{
+		{"203.0.113.7", "203.0.113.7"},
+		{"::ffff:203.0.113.7", "203.0.113.7"},
+		{"2001:db8:1:2:3:4:5:6", "2001:db8:1:2::/64"},
+		{"2001:db8:1:2:ffff::1", "2001:db8:1:2::/64"},
+		{"2001:db8:1:3::1", "2001:db8:1:3::/64"},
+	}
+	for _, tc := range tt {
+		t.Run(tc.ip, func(t *testing.T) {
+			if k := Key(net.ParseIP(tc.ip)); k != tc.key {
+				t.Errorf("incorrect key, got %q, want %q", k, tc.key)
+				t.FailNow()
+			}
+		})
+	}
+	if k := Key(nil); k != "" {
+		t.Errorf("incorrect key of nil ip, got %q, want empty", k)
+	}
+}
@@ -3,7 +3,9 @@ package cipher
 import (
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/hmac"
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/hex"
 	"errors"
 	"fmt"
@@ -22,6 +24,12 @@ func GenerateKey(size int) (s string, err error) {
 }
 
 func Encrypt(text, ks string) (string, error) {
+	return EncryptWithAD(text, ks, "")
+}
+
+// EncryptWithAD encrypts text and binds the ciphertext to the additional data ad:
+// it can only be decrypted with the same additional data
+func EncryptWithAD(text, ks, ad string) (string, error) {
 	k, err := hex.DecodeString(ks)
 	if err != nil {
 		return "", err
@@ -39,10 +47,15 @@ func Encrypt(text, ks string) (string, error) {
 	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
 		return "", err
 	}
-	return fmt.Sprintf("%x", gcm.Seal(nonce, nonce, []byte(text), nil)), nil
+	return fmt.Sprintf("%x", gcm.Seal(nonce, nonce, []byte(text), []byte(ad))), nil
 }
 
 func Decrypt(ctext, ks string) (string, error) {
+	return DecryptWithAD(ctext, ks, "")
+}
+
+// DecryptWithAD decrypts a ciphertext produced by EncryptWithAD with the same additional data ad
+func DecryptWithAD(ctext, ks, ad string) (string, error) {
 	k, err := hex.DecodeString(ks)
 	if err != nil {
 		return "", err
@@ -61,14 +74,28 @@ func Decrypt(ctext, ks string) (string, error) {
 	}
 
 	nonceSize := gcm.NonceSize()
-	if len(ctext) < nonceSize {
-		return "nil", ErrTooShortCipherText
+	if len(enc) < nonceSize {
+		return "", ErrTooShortCipherText
 	}
 
 	nonce, ciphertext := enc[:nonceSize], enc[nonceSize:]
-	b, err := gcm.Open(nil, nonce, ciphertext, nil)
+	b, err := gcm.Open(nil, nonce, ciphertext, []byte(ad))
 	if err != nil {
 		return "", err
 	}
 	return string(b), nil
 }
+
+// BlindIndex returns a deterministic keyed hash (HMAC-SHA256) of text, hex encoded.
+// The HMAC key is derived from ks, so the encryption key is never used directly to index.
+func BlindIndex(text, ks string) (string, error) {
+	k, err := hex.DecodeString(ks)
+	if err != nil {
+		return "", err
+	}
+	dk := hmac.New(sha256.New, k)
+	dk.Write([]byte("blind-index"))
+	m := hmac.New(sha256.New, dk.Sum(nil))
+	m.Write([]byte(text))
+	return hex.EncodeToString(m.Sum(nil)), nil
+}
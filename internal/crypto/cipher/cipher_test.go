@@ -120,3 +120,82 @@ func TestEncryptDecryptRotation(t *testing.T) {
 		})
 	}
 }
+
+func TestBlindIndex(t *testing.T) {
+	i1, err := BlindIndex(plaintext, keys[32])
+	if err != nil {
+		t.Errorf("incorrect error, got %v, want nil", err)
+		t.FailNow()
+	}
+	if len(i1) != 64 {
+		t.Errorf("incorrect length, got %d, want %d", len(i1), 64)
+		t.FailNow()
+	}
+	i2, _ := BlindIndex(plaintext, keys[32])
+	if i1 != i2 {
+		t.Errorf("blind index must be deterministic, got %s and %s", i1, i2)
+		t.FailNow()
+	}
+	i3, _ := BlindIndex(plaintext, keys[16])
+	if i1 == i3 {
+		t.Errorf("blind indexes computed with different keys cannot be equal")
+		t.FailNow()
+	}
+	i4, _ := BlindIndex("another message", keys[32])
+	if i1 == i4 {
+		t.Errorf("blind indexes of different texts cannot be equal")
+		t.FailNow()
+	}
+
+	t.Run("invalid key", func(t *testing.T) {
+		if _, err := BlindIndex(plaintext, "n0tH3x"); err == nil {
+			t.Errorf("incorrect error, should not be nil")
+			t.FailNow()
+		}
+	})
+}
+
+func TestEncryptDecryptWithAD(t *testing.T) {
+	ad1, ad2 := "0x8ba1f109551bD432803012645Ac136ddd64DBA72", "0xD01efFE216E16a85Fc529db66c26aBeCf4D885f8"
+	for _, s := range []int{16, 24, 32} {
+		t.Run(fmt.Sprintf("%d", s), func(t *testing.T) {
+			ctext, err := EncryptWithAD(plaintext, keys[s], ad1)
+			if err != nil {
+				t.Errorf("incorrect error, got %v, want nil", err)
+				t.FailNow()
+			}
+			txt, err := DecryptWithAD(ctext, keys[s], ad1)
+			if err != nil {
+				t.Errorf("incorrect error, got %v, want nil", err)
+				t.FailNow()
+			}
+			if txt != plaintext {
+				t.Errorf("incorrect decrypted text, got %q, want %q", txt, plaintext)
+				t.FailNow()
+			}
+			if _, err := DecryptWithAD(ctext, keys[s], ad2); err == nil {
+				t.Errorf("ciphertext bound to %s cannot be decrypted with %s", ad1, ad2)
+				t.FailNow()
+			}
+			if _, err := Decrypt(ctext, keys[s]); err == nil {
+				t.Errorf("ciphertext bound to %s cannot be decrypted without additional data", ad1)
+				t.FailNow()
+			}
+		})
+	}
+
+	t.Run("legacy ciphertext", func(t *testing.T) {
+		txt, err := DecryptWithAD(ctexts[32], keys[32], "")
+		if err != nil || txt != plaintext {
+			t.Errorf("incorrect decrypted text, got %q (%v), want %q", txt, err, plaintext)
+			t.FailNow()
+		}
+	})
+
+	t.Run("too short ciphertext", func(t *testing.T) {
+		if _, err := DecryptWithAD("abcdef", keys[32], ad1); !errors.Is(err, ErrTooShortCipherText) {
+			t.Errorf("incorrect error, got %v, want %v", err, ErrTooShortCipherText)
+			t.FailNow()
+		}
+	})
+}
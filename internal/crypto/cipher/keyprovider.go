@@ -0,0 +1,176 @@
+package cipher
+
+import (
+	"encoding/hex"
+	"errors"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/kms"
+	"github.com/aws/aws-sdk-go/service/kms/kmsiface"
+)
+
+var (
+	ErrNoDataKey    = errors.New("data key is missing")
+	ErrNoWrappedKey = errors.New("wrapped data key is missing")
+)
+
+// KeyProvider provides the hex encoded data key used to Encrypt and Decrypt
+type KeyProvider interface {
+	DataKey() (string, error)
+}
+
+// StaticKeyProvider provides a data key known in advance (e.g. read from the environment)
+type StaticKeyProvider string
+
+func (kp StaticKeyProvider) DataKey() (string, error) {
+	if kp == "" {
+		return "", ErrNoDataKey
+	}
+	return string(kp), nil
+}
+
+// FileKeyProvider reads the hex encoded data key from a local file
+type FileKeyProvider struct {
+	path string
+}
+
+func NewFileKeyProvider(path string) *FileKeyProvider {
+	return &FileKeyProvider{path}
+}
+
+func (kp *FileKeyProvider) DataKey() (string, error) {
+	b, err := os.ReadFile(kp.path)
+	if err != nil {
+		return "", err
+	}
+	k := strings.TrimSpace(string(b))
+	if k == "" {
+		return "", ErrNoDataKey
+	}
+	if _, err := hex.DecodeString(k); err != nil {
+		return "", err
+	}
+	return k, nil
+}
+
+// KMS is a key management service generating data keys and unwrapping them.
+// The master key never leaves the KMS.
+type KMS interface {
+	GenerateDataKey(size int) (plain, wrapped []byte, err error)
+	Decrypt(wrapped []byte) ([]byte, error)
+}
+
+// KMSKeyProvider provides a data key stored wrapped (encrypted) by a KMS, unwrapped once on first use
+type KMSKeyProvider struct {
+	kms     KMS
+	wrapped string
+	once    sync.Once
+	k       string
+	err     error
+}
+
+func NewKMSKeyProvider(kms KMS, wrapped string) *KMSKeyProvider {
+	return &KMSKeyProvider{kms: kms, wrapped: wrapped}
+}
+
+func (kp *KMSKeyProvider) DataKey() (string, error) {
+	kp.once.Do(func() {
+		if kp.wrapped == "" {
+			kp.err = ErrNoWrappedKey
+			return
+		}
+		w, err := hex.DecodeString(kp.wrapped)
+		if err != nil {
+			kp.err = err
+			return
+		}
+		k, err := kp.kms.Decrypt(w)
+		if err != nil {
+			kp.err = err
+			return
+		}
+		kp.k = hex.EncodeToString(k)
+	})
+	return kp.k, kp.err
+}
+
+// NewWrappedDataKey generates a new data key of size bytes and returns it wrapped by the KMS, hex encoded
+func NewWrappedDataKey(kms KMS, size int) (string, error) {
+	_, w, err := kms.GenerateDataKey(size)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(w), nil
+}
+
+// AWSKMS wraps data keys using an AWS KMS key
+type AWSKMS struct {
+	svc   kmsiface.KMSAPI
+	keyID string
+}
+
+func NewAWSKMS(keyID string) *AWSKMS {
+	sess := session.Must(session.NewSession())
+	return NewAWSKMSWithClient(kms.New(sess), keyID)
+}
+
+func NewAWSKMSWithClient(svc kmsiface.KMSAPI, keyID string) *AWSKMS {
+	return &AWSKMS{svc, keyID}
+}
+
+func (k *AWSKMS) GenerateDataKey(size int) (plain, wrapped []byte, err error) {
+	r, err := k.svc.GenerateDataKey(&kms.GenerateDataKeyInput{
+		KeyId:         aws.String(k.keyID),
+		NumberOfBytes: aws.Int64(int64(size)),
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return r.Plaintext, r.CiphertextBlob, nil
+}
+
+func (k *AWSKMS) Decrypt(wrapped []byte) ([]byte, error) {
+	r, err := k.svc.Decrypt(&kms.DecryptInput{
+		KeyId:          aws.String(k.keyID),
+		CiphertextBlob: wrapped,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return r.Plaintext, nil
+}
+
+// LocalKMS wraps data keys with a local master key (AES-GCM), for development and tests
+type LocalKMS struct {
+	mk string
+}
+
+func NewLocalKMS(mk string) *LocalKMS {
+	return &LocalKMS{mk}
+}
+
+func (k *LocalKMS) GenerateDataKey(size int) (plain, wrapped []byte, err error) {
+	dk, err := GenerateKey(size)
+	if err != nil {
+		return nil, nil, err
+	}
+	w, err := Encrypt(dk, k.mk)
+	if err != nil {
+		return nil, nil, err
+	}
+	plain, _ = hex.DecodeString(dk)
+	wrapped, _ = hex.DecodeString(w)
+	return plain, wrapped, nil
+}
+
+func (k *LocalKMS) Decrypt(wrapped []byte) ([]byte, error) {
+	dk, err := Decrypt(hex.EncodeToString(wrapped), k.mk)
+	if err != nil {
+		return nil, err
+	}
+	return hex.DecodeString(dk)
+}
@@ -0,0 +1,148 @@
+package cipher
+
+import (
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kms"
+	"github.com/aws/aws-sdk-go/service/kms/kmsiface"
+)
+
+// kmsStub simulates the AWS KMS API with a local master key
+type kmsStub struct {
+	kmsiface.KMSAPI
+	keyID string
+	local *LocalKMS
+}
+
+func (s *kmsStub) GenerateDataKey(in *kms.GenerateDataKeyInput) (*kms.GenerateDataKeyOutput, error) {
+	if aws.StringValue(in.KeyId) != s.keyID {
+		return nil, errors.New("NotFoundException")
+	}
+	p, w, err := s.local.GenerateDataKey(int(aws.Int64Value(in.NumberOfBytes)))
+	if err != nil {
+		return nil, err
+	}
+	return &kms.GenerateDataKeyOutput{KeyId: in.KeyId, Plaintext: p, CiphertextBlob: w}, nil
+}
+
+func (s *kmsStub) Decrypt(in *kms.DecryptInput) (*kms.DecryptOutput, error) {
+	if aws.StringValue(in.KeyId) != s.keyID {
+		return nil, errors.New("IncorrectKeyException")
+	}
+	p, err := s.local.Decrypt(in.CiphertextBlob)
+	if err != nil {
+		return nil, err
+	}
+	return &kms.DecryptOutput{KeyId: in.KeyId, Plaintext: p}, nil
+}
+
+func TestStaticKeyProvider(t *testing.T) {
+	k, err := StaticKeyProvider(keys[32]).DataKey()
+	if err != nil || k != keys[32] {
+		t.Errorf("incorrect data key, got %q (%v), want %q", k, err, keys[32])
+		t.FailNow()
+	}
+	if _, err := StaticKeyProvider("").DataKey(); !errors.Is(err, ErrNoDataKey) {
+		t.Errorf("incorrect error, got %v, want %v", err, ErrNoDataKey)
+		t.FailNow()
+	}
+}
+
+func TestFileKeyProvider(t *testing.T) {
+	dir := t.TempDir()
+	tt := []struct {
+		name    string
+		content string
+		key     string
+		fail    bool
+	}{
+		{"valid key", keys[32] + "\n", keys[32], false},
+		{"empty file", "", "", true},
+		{"not hex", "n0tH3x", "", true},
+	}
+	for i, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			p := filepath.Join(dir, string(rune('a'+i)))
+			os.WriteFile(p, []byte(tc.content), 0600)
+			k, err := NewFileKeyProvider(p).DataKey()
+			if (err != nil) != tc.fail {
+				t.Errorf("incorrect error, got %v", err)
+				t.FailNow()
+			}
+			if k != tc.key {
+				t.Errorf("incorrect data key, got %q, want %q", k, tc.key)
+				t.FailNow()
+			}
+		})
+	}
+
+	t.Run("missing file", func(t *testing.T) {
+		if _, err := NewFileKeyProvider(filepath.Join(dir, "missing")).DataKey(); err == nil {
+			t.Errorf("incorrect error, should not be nil")
+			t.FailNow()
+		}
+	})
+}
+
+func TestKMSKeyProvider(t *testing.T) {
+	mk, _ := GenerateKey(32)
+	kmss := map[string]KMS{
+		"local": NewLocalKMS(mk),
+		"aws":   NewAWSKMSWithClient(&kmsStub{keyID: "alias/poln", local: NewLocalKMS(mk)}, "alias/poln"),
+	}
+	for n, kms := range kmss {
+		t.Run(n, func(t *testing.T) {
+			w, err := NewWrappedDataKey(kms, 32)
+			if err != nil {
+				t.Errorf("cannot generate wrapped data key: %v", err)
+				t.FailNow()
+			}
+			kp := NewKMSKeyProvider(kms, w)
+			k, err := kp.DataKey()
+			if err != nil {
+				t.Errorf("cannot unwrap data key: %v", err)
+				t.FailNow()
+			}
+			if b, _ := hex.DecodeString(k); len(b) != 32 {
+				t.Errorf("incorrect data key length, got %d, want %d", len(b), 32)
+				t.FailNow()
+			}
+			if k == w {
+				t.Errorf("data key and wrapped data key cannot be equal")
+				t.FailNow()
+			}
+
+			ctext, err := Encrypt(plaintext, k)
+			if err != nil {
+				t.Errorf("cannot encrypt with data key: %v", err)
+				t.FailNow()
+			}
+			k2, _ := NewKMSKeyProvider(kms, w).DataKey()
+			if txt, _ := Decrypt(ctext, k2); txt != plaintext {
+				t.Errorf("incorrect decrypted text, got %q, want %q", txt, plaintext)
+				t.FailNow()
+			}
+		})
+	}
+
+	t.Run("wrong master key", func(t *testing.T) {
+		w, _ := NewWrappedDataKey(NewLocalKMS(mk), 32)
+		k2, _ := GenerateKey(32)
+		if _, err := NewKMSKeyProvider(NewLocalKMS(k2), w).DataKey(); err == nil {
+			t.Errorf("incorrect error, should not be nil")
+			t.FailNow()
+		}
+	})
+
+	t.Run("no wrapped key", func(t *testing.T) {
+		if _, err := NewKMSKeyProvider(NewLocalKMS(mk), "").DataKey(); !errors.Is(err, ErrNoWrappedKey) {
+			t.Errorf("incorrect error, got %v, want %v", err, ErrNoWrappedKey)
+			t.FailNow()
+		}
+	})
+}
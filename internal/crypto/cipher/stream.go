@@ -0,0 +1,237 @@
+package cipher
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+// Streams are encrypted to a X25519 recipient (age style):
+//
+//	magic | ephemeral public key | chunk 0 | chunk 1 | ... | last chunk
+//
+// Each chunk holds at most chunkSize bytes of plaintext sealed with ChaCha20-Poly1305.
+// The nonce is the chunk counter followed by a flag set for the last chunk, so a
+// truncated, reordered or extended stream cannot be decrypted.
+const (
+	streamMagic = "poln-x1\n"
+	chunkSize   = 64 * 1024
+	lastChunk   = 1
+)
+
+var (
+	ErrInvalidStream    = errors.New("invalid encrypted stream")
+	ErrTruncatedStream  = errors.New("truncated encrypted stream")
+	ErrClosedStream     = errors.New("encrypted stream already closed")
+	ErrInvalidRecipient = errors.New("invalid recipient public key")
+	ErrInvalidIdentity  = errors.New("invalid identity private key")
+)
+
+// GenerateX25519Key generates a new identity (private key) and its recipient (public key), both hex encoded
+func GenerateX25519Key() (identity, recipient string, err error) {
+	k, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return "", "", err
+	}
+	return hex.EncodeToString(k.Bytes()), hex.EncodeToString(k.PublicKey().Bytes()), nil
+}
+
+func streamKey(shared, ephemeral, recipient []byte) ([]byte, error) {
+	salt := append(append([]byte{}, ephemeral...), recipient...)
+	k := make([]byte, chacha20poly1305.KeySize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, shared, salt, []byte(streamMagic)), k); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+func chunkNonce(counter uint64, last bool) []byte {
+	n := make([]byte, chacha20poly1305.NonceSize)
+	binary.BigEndian.PutUint64(n[3:11], counter)
+	if last {
+		n[11] = lastChunk
+	}
+	return n
+}
+
+type encryptWriter struct {
+	w       io.Writer
+	aead    cipher.AEAD
+	buf     []byte
+	counter uint64
+	closed  bool
+}
+
+// NewEncryptWriter returns a WriteCloser encrypting everything written to w for the hex encoded recipient.
+// Close must be called to write the last chunk.
+func NewEncryptWriter(w io.Writer, recipient string) (io.WriteCloser, error) {
+	b, err := hex.DecodeString(recipient)
+	if err != nil {
+		return nil, ErrInvalidRecipient
+	}
+	pub, err := ecdh.X25519().NewPublicKey(b)
+	if err != nil {
+		return nil, ErrInvalidRecipient
+	}
+	eph, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	shared, err := eph.ECDH(pub)
+	if err != nil {
+		return nil, err
+	}
+	k, err := streamKey(shared, eph.PublicKey().Bytes(), pub.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	aead, err := chacha20poly1305.New(k)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := io.WriteString(w, streamMagic); err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(eph.PublicKey().Bytes()); err != nil {
+		return nil, err
+	}
+	return &encryptWriter{w: w, aead: aead, buf: make([]byte, 0, chunkSize)}, nil
+}
+
+func (ew *encryptWriter) Write(p []byte) (n int, err error) {
+	if ew.closed {
+		return 0, ErrClosedStream
+	}
+	for len(p) > 0 {
+		if len(ew.buf) == chunkSize { // more data is coming: the buffered chunk is not the last one
+			if err := ew.flush(false); err != nil {
+				return n, err
+			}
+		}
+		c := copy(ew.buf[len(ew.buf):chunkSize], p)
+		ew.buf = ew.buf[:len(ew.buf)+c]
+		p = p[c:]
+		n += c
+	}
+	return n, nil
+}
+
+func (ew *encryptWriter) flush(last bool) error {
+	_, err := ew.w.Write(ew.aead.Seal(nil, chunkNonce(ew.counter, last), ew.buf, nil))
+	ew.buf = ew.buf[:0]
+	ew.counter++
+	return err
+}
+
+func (ew *encryptWriter) Close() error {
+	if ew.closed {
+		return ErrClosedStream
+	}
+	ew.closed = true
+	return ew.flush(true)
+}
+
+type decryptReader struct {
+	r       *bufio.Reader
+	aead    cipher.AEAD
+	buf     []byte
+	chunk   []byte
+	counter uint64
+	done    bool
+	err     error
+}
+
+// NewDecryptReader returns a Reader decrypting the stream r with the hex encoded identity
+func NewDecryptReader(r io.Reader, identity string) (io.Reader, error) {
+	b, err := hex.DecodeString(identity)
+	if err != nil {
+		return nil, ErrInvalidIdentity
+	}
+	pvk, err := ecdh.X25519().NewPrivateKey(b)
+	if err != nil {
+		return nil, ErrInvalidIdentity
+	}
+
+	br := bufio.NewReader(r)
+	h := make([]byte, len(streamMagic)+32)
+	if _, err := io.ReadFull(br, h); err != nil {
+		return nil, ErrInvalidStream
+	}
+	if !bytes.Equal(h[:len(streamMagic)], []byte(streamMagic)) {
+		return nil, ErrInvalidStream
+	}
+	eph, err := ecdh.X25519().NewPublicKey(h[len(streamMagic):])
+	if err != nil {
+		return nil, ErrInvalidStream
+	}
+	shared, err := pvk.ECDH(eph)
+	if err != nil {
+		return nil, err
+	}
+	k, err := streamKey(shared, eph.Bytes(), pvk.PublicKey().Bytes())
+	if err != nil {
+		return nil, err
+	}
+	aead, err := chacha20poly1305.New(k)
+	if err != nil {
+		return nil, err
+	}
+	return &decryptReader{r: br, aead: aead, chunk: make([]byte, chunkSize+aead.Overhead())}, nil
+}
+
+func (dr *decryptReader) Read(p []byte) (int, error) {
+	for len(dr.buf) == 0 {
+		if dr.err != nil {
+			return 0, dr.err
+		}
+		if dr.done {
+			return 0, io.EOF
+		}
+		dr.err = dr.next()
+	}
+	n := copy(p, dr.buf)
+	dr.buf = dr.buf[n:]
+	return n, nil
+}
+
+// next reads and opens the next chunk
+func (dr *decryptReader) next() error {
+	n, err := io.ReadFull(dr.r, dr.chunk)
+	last := false
+	switch {
+	case err == io.EOF:
+		return ErrTruncatedStream
+	case err == io.ErrUnexpectedEOF:
+		last = true
+	case err != nil:
+		return err
+	default:
+		if _, err := dr.r.Peek(1); err == io.EOF {
+			last = true
+		}
+	}
+	b, err := dr.aead.Open(nil, chunkNonce(dr.counter, last), dr.chunk[:n], nil)
+	if err != nil {
+		if last && n == len(dr.chunk) { // a full chunk is missing its successors
+			if _, err := dr.aead.Open(nil, chunkNonce(dr.counter, false), dr.chunk[:n], nil); err == nil {
+				return ErrTruncatedStream
+			}
+		}
+		return ErrInvalidStream
+	}
+	dr.counter++
+	dr.buf = b
+	dr.done = last
+	return nil
+}
@@ -0,0 +1,138 @@
+package cipher
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+)
+
+func encryptStream(t *testing.T, p []byte, recipient string) []byte {
+	var b bytes.Buffer
+	w, err := NewEncryptWriter(&b, recipient)
+	if err != nil {
+		t.Errorf("cannot create encrypt writer: %v", err)
+		t.FailNow()
+	}
+	if _, err := w.Write(p); err != nil {
+		t.Errorf("cannot write: %v", err)
+		t.FailNow()
+	}
+	if err := w.Close(); err != nil {
+		t.Errorf("cannot close: %v", err)
+		t.FailNow()
+	}
+	return b.Bytes()
+}
+
+func decryptStream(enc []byte, identity string) ([]byte, error) {
+	r, err := NewDecryptReader(bytes.NewReader(enc), identity)
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(r)
+}
+
+func TestGenerateX25519Key(t *testing.T) {
+	id, rcpt, err := GenerateX25519Key()
+	if err != nil {
+		t.Errorf("incorrect error, got %v, want nil", err)
+		t.FailNow()
+	}
+	if len(id) != 64 || len(rcpt) != 64 {
+		t.Errorf("incorrect key lengths, got %d and %d, want 64", len(id), len(rcpt))
+		t.FailNow()
+	}
+	if id == rcpt {
+		t.Errorf("identity and recipient cannot be equal")
+		t.FailNow()
+	}
+}
+
+func TestEncryptDecryptStream(t *testing.T) {
+	id, rcpt, _ := GenerateX25519Key()
+	for _, n := range []int{0, 1, 100, chunkSize - 1, chunkSize, chunkSize + 1, 3*chunkSize + 42} {
+		t.Run(fmt.Sprintf("%d bytes", n), func(t *testing.T) {
+			p := make([]byte, n)
+			rand.Read(p)
+			enc := encryptStream(t, p, rcpt)
+			if n >= 100 && bytes.Contains(enc, p) {
+				t.Errorf("encrypted stream cannot contain plaintext")
+				t.FailNow()
+			}
+			b, err := decryptStream(enc, id)
+			if err != nil {
+				t.Errorf("cannot decrypt stream: %v", err)
+				t.FailNow()
+			}
+			if !bytes.Equal(b, p) {
+				t.Errorf("incorrect decrypted stream, got %d bytes, want %d bytes", len(b), len(p))
+				t.FailNow()
+			}
+		})
+	}
+
+	t.Run("small writes", func(t *testing.T) {
+		var b bytes.Buffer
+		w, _ := NewEncryptWriter(&b, rcpt)
+		for i := 0; i < 1000; i++ {
+			fmt.Fprintf(w, "%s,%d\n", plaintext, i)
+		}
+		w.Close()
+		d, err := decryptStream(b.Bytes(), id)
+		if err != nil {
+			t.Errorf("cannot decrypt stream: %v", err)
+			t.FailNow()
+		}
+		if !bytes.HasSuffix(d, []byte(fmt.Sprintf("%s,%d\n", plaintext, 999))) {
+			t.Errorf("incorrect decrypted stream")
+			t.FailNow()
+		}
+	})
+}
+
+func TestDecryptStreamErrors(t *testing.T) {
+	id, rcpt, _ := GenerateX25519Key()
+	id2, _, _ := GenerateX25519Key()
+	p := make([]byte, 2*chunkSize+10)
+	rand.Read(p)
+	enc := encryptStream(t, p, rcpt)
+	hl := len(streamMagic) + 32
+	ecs := chunkSize + 16
+
+	tampered := append([]byte{}, enc...)
+	tampered[hl+10] ^= 0xFF
+
+	tt := []struct {
+		name     string
+		enc      []byte
+		identity string
+		err      error
+	}{
+		{"wrong identity", enc, id2, ErrInvalidStream},
+		{"invalid identity", enc, "n0tH3x", ErrInvalidIdentity},
+		{"tampered chunk", tampered, id, ErrInvalidStream},
+		{"bad magic", append([]byte("poln-x0\n"), enc[len(streamMagic):]...), id, ErrInvalidStream},
+		{"no header", enc[:10], id, ErrInvalidStream},
+		{"truncated last chunk", enc[:len(enc)-5], id, ErrInvalidStream},
+		{"dropped last chunk", enc[:hl+ecs], id, ErrTruncatedStream},
+		{"extended stream", append(append([]byte{}, enc...), enc[hl:hl+ecs]...), id, ErrInvalidStream},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := decryptStream(tc.enc, tc.identity); !errors.Is(err, tc.err) {
+				t.Errorf("incorrect error, got %v, want %v", err, tc.err)
+				t.FailNow()
+			}
+		})
+	}
+
+	t.Run("invalid recipient", func(t *testing.T) {
+		if _, err := NewEncryptWriter(io.Discard, "n0tH3x"); !errors.Is(err, ErrInvalidRecipient) {
+			t.Errorf("incorrect error, got %v, want %v", err, ErrInvalidRecipient)
+			t.FailNow()
+		}
+	})
+}
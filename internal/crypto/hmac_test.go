@@ -158,3 +158,25 @@ func TestExtractHMAC(t *testing.T) {
 	})
 
 }
+
+func TestExtractLocale(t *testing.T) {
+	j := NewJWTHS256(secret)
+	lu := *u
+	lu.Locale = "fr"
+	ss, _ := j.Create(&lu, time.Now())
+	if user, err := j.Extract(ss); err != nil || user.Locale != "fr" {
+		t.Errorf("incorrect locale, got %v (%v), want %q", user, err, "fr")
+	}
+}
+
+func TestCreateFor(t *testing.T) {
+	j := NewJWTHS256(secret)
+	ss, _ := j.CreateFor(u, time.Now().Add(-time.Hour), 72*time.Hour)
+	if _, err := j.Extract(ss); err != nil {
+		t.Errorf("token should be valid after the activation TTL, got %v", err)
+	}
+	ss, _ = j.CreateFor(u, time.Now().Add(-time.Hour), ActivationTTL)
+	if _, err := j.Extract(ss); err != ErrInvalidToken {
+		t.Errorf("incorrect error, got %v, want %v", err, ErrInvalidToken)
+	}
+}
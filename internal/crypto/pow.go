@@ -0,0 +1,207 @@
+package crypto
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"math/bits"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"golang.org/x/crypto/sha3"
+)
+
+var (
+	ErrInvalidChallenge = errors.New("invalid proof of work challenge")
+	ErrInvalidSolution  = errors.New("invalid proof of work solution")
+	ErrChallengeUsed    = errors.New("proof of work challenge already used")
+)
+
+// ChallengeClaims are the claims of a signed proof of work challenge
+type ChallengeClaims struct {
+	Difficulty int `json:"difficulty"` // leading zero bits of the solution hash
+	jwt.RegisteredClaims
+}
+
+// Challenge is an expiring hashcash-style puzzle: find a nonce such as the
+// sha3-512 hash of "challenge:nonce" starts with Difficulty zero bits
+type Challenge struct {
+	Challenge  string    `json:"challenge"`
+	Difficulty int       `json:"difficulty"`
+	ExpiresAt  time.Time `json:"expires_at"`
+}
+
+// UsedChallenges records the IDs of the solved challenges until they expire, shared by several processes
+type UsedChallenges interface {
+	// Add records the ID until exp, it returns false if the ID is already recorded
+	Add(id string, exp time.Time) (bool, error)
+}
+
+// PoW issues signed proof of work challenges and verifies their solutions.
+// The difficulty grows by one bit each time the number of challenges issued
+// in the last minute doubles above the load threshold, up to max.
+type PoW struct {
+	k         []byte
+	ttl       time.Duration
+	base, max int
+	threshold int // challenges per minute, 0 keeps the difficulty fixed
+	window    time.Time
+	issued    int
+	used      map[string]time.Time // IDs of the solved challenges until they expire
+	shared    UsedChallenges
+	sync.Mutex
+}
+
+// NewPoW returns a PoW signing its challenges with the HMAC secret s
+func NewPoW(s string, difficulty int, ttl time.Duration) *PoW {
+	return &PoW{
+		k:    []byte(s),
+		ttl:  ttl,
+		base: difficulty,
+		max:  difficulty,
+		used: map[string]time.Time{},
+	}
+}
+
+// AdjustUnderLoad raises the difficulty up to max when more than threshold challenges are issued per minute
+func (p *PoW) AdjustUnderLoad(threshold, max int) {
+	p.Lock()
+	defer p.Unlock()
+	p.threshold = threshold
+	if max < p.base {
+		max = p.base
+	}
+	p.max = max
+}
+
+// ShareUsed records the solved challenges in u, so a challenge cannot be replayed on another process.
+// If u fails, the challenges are recorded in memory.
+func (p *PoW) ShareUsed(u UsedChallenges) {
+	p.Lock()
+	defer p.Unlock()
+	p.shared = u
+}
+
+// difficulty counts an issued challenge and returns the current difficulty, p must be locked
+func (p *PoW) difficulty(t time.Time) int {
+	if t.Sub(p.window) >= time.Minute {
+		p.window = t
+		p.issued = 0
+	}
+	p.issued++
+	if p.threshold <= 0 || p.issued <= p.threshold {
+		return p.base
+	}
+	d := p.base + bits.Len(uint((p.issued-1)/p.threshold))
+	if d > p.max {
+		d = p.max
+	}
+	return d
+}
+
+// Issue returns a new challenge, valid until t + ttl
+func (p *PoW) Issue(t time.Time) (*Challenge, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	p.Lock()
+	d := p.difficulty(t)
+	p.Unlock()
+
+	exp := t.Add(p.ttl)
+	claims := ChallengeClaims{
+		d,
+		jwt.RegisteredClaims{
+			ID:        hex.EncodeToString(id),
+			ExpiresAt: jwt.NewNumericDate(exp), // seconds
+			IssuedAt:  jwt.NewNumericDate(t),   // seconds
+			Issuer:    "poln.org",
+		},
+	}
+	ss, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(p.k)
+	if err != nil {
+		return nil, ErrSigningToken
+	}
+	return &Challenge{ss, d, exp.Truncate(time.Second)}, nil
+}
+
+// Verify checks the signature and the expiration of the challenge, then the nonce solving it.
+// A challenge can be solved only once.
+func (p *PoW) Verify(challenge, nonce string, t time.Time) error {
+	claims := &ChallengeClaims{}
+	tk, err := jwt.ParseWithClaims(challenge, claims, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, jwt.ErrSignatureInvalid
+		}
+		return p.k, nil
+	}, jwt.WithoutClaimsValidation())
+	if err != nil || !tk.Valid || claims.ID == "" || claims.ExpiresAt == nil || !t.Before(claims.ExpiresAt.Time) {
+		return ErrInvalidChallenge
+	}
+	if nonce == "" || LeadingZeroBits(challenge, nonce) < claims.Difficulty {
+		return ErrInvalidSolution
+	}
+
+	p.Lock()
+	_, used := p.used[claims.ID]
+	shared := p.shared
+	p.Unlock()
+	if used {
+		return ErrChallengeUsed
+	}
+	if shared != nil { // not locked, the verifications do not wait for each other's round trip
+		ok, err := shared.Add(claims.ID, claims.ExpiresAt.Time)
+		switch {
+		case err != nil: // recorded in memory, at least this process rejects the replays
+		case !ok:
+			return ErrChallengeUsed
+		default:
+			return nil
+		}
+	}
+
+	p.Lock()
+	defer p.Unlock()
+	if _, ok := p.used[claims.ID]; ok {
+		return ErrChallengeUsed
+	}
+	p.used[claims.ID] = claims.ExpiresAt.Time
+	return nil
+}
+
+// Cleanup forgets the used challenges expired at t
+func (p *PoW) Cleanup(t time.Time) {
+	p.Lock()
+	defer p.Unlock()
+	for id, exp := range p.used {
+		if !t.Before(exp) {
+			delete(p.used, id)
+		}
+	}
+}
+
+// LeadingZeroBits returns the number of leading zero bits of the sha3-512 hash of "challenge:nonce"
+func LeadingZeroBits(challenge, nonce string) int {
+	h := sha3.Sum512([]byte(challenge + ":" + nonce))
+	n := 0
+	for _, b := range h {
+		if b != 0 {
+			return n + bits.LeadingZeros8(b)
+		}
+		n += 8
+	}
+	return n
+}
+
+// Solve finds a nonce solving the challenge, as clients do
+func Solve(challenge string, difficulty int) string {
+	for i := 0; ; i++ {
+		n := strconv.Itoa(i)
+		if LeadingZeroBits(challenge, n) >= difficulty {
+			return n
+		}
+	}
+}
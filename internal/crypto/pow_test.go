@@ -0,0 +1,184 @@
+package crypto
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPoW(t *testing.T) {
+	now := time.UnixMicro(timestamp)
+	p := NewPoW(secret, 8, 5*time.Minute)
+	c, err := p.Issue(now)
+	if err != nil {
+		t.Errorf("cannot issue challenge: %v", err)
+		t.FailNow()
+	}
+	if c.Difficulty != 8 || !c.ExpiresAt.Equal(now.Add(5*time.Minute).Truncate(time.Second)) {
+		t.Errorf("incorrect challenge, got difficulty %d expiring at %v", c.Difficulty, c.ExpiresAt)
+		t.FailNow()
+	}
+	nonce := Solve(c.Challenge, c.Difficulty)
+	if LeadingZeroBits(c.Challenge, nonce) < 8 {
+		t.Errorf("incorrect solution %q", nonce)
+		t.FailNow()
+	}
+	wrong := nonce + "0"
+	for LeadingZeroBits(c.Challenge, wrong) >= 8 {
+		wrong += "0"
+	}
+	other, _ := NewPoW("n0t-th3-s3cr3t", 8, 5*time.Minute).Issue(now)
+
+	tt := []struct {
+		name      string
+		challenge string
+		nonce     string
+		time      time.Time
+		err       error
+	}{
+		{"wrong nonce", c.Challenge, wrong, now, ErrInvalidSolution},
+		{"no nonce", c.Challenge, "", now, ErrInvalidSolution},
+		{"expired", c.Challenge, nonce, now.Add(5 * time.Minute), ErrInvalidChallenge},
+		{"other secret", other.Challenge, Solve(other.Challenge, 8), now, ErrInvalidChallenge},
+		{"not a challenge", "n0t-a-ch4ll3ng3", nonce, now, ErrInvalidChallenge},
+		{"user token", tokenHS256, nonce, now, ErrInvalidChallenge},
+		{"valid", c.Challenge, nonce, now.Add(time.Minute), nil},
+		{"replay", c.Challenge, nonce, now.Add(time.Minute), ErrChallengeUsed},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := p.Verify(tc.challenge, tc.nonce, tc.time); !errors.Is(err, tc.err) {
+				t.Errorf("incorrect error, got %v, want %v", err, tc.err)
+				t.FailNow()
+			}
+		})
+	}
+
+	t.Run("cleanup", func(t *testing.T) {
+		p.Cleanup(now.Add(time.Minute))
+		if len(p.used) != 1 {
+			t.Errorf("used challenge should be kept until it expires")
+			t.FailNow()
+		}
+		p.Cleanup(now.Add(5 * time.Minute))
+		if len(p.used) != 0 {
+			t.Errorf("expired challenge should be forgotten")
+		}
+	})
+}
+
+// usedChallenges is a set shared by several PoWs, failing when down
+type usedChallenges struct {
+	ids  map[string]time.Time
+	down bool
+}
+
+func (u *usedChallenges) Add(id string, exp time.Time) (bool, error) {
+	if u.down {
+		return false, errors.New("unavailable")
+	}
+	if _, ok := u.ids[id]; ok {
+		return false, nil
+	}
+	u.ids[id] = exp
+	return true, nil
+}
+
+func TestPoWShareUsed(t *testing.T) {
+	now := time.UnixMicro(timestamp)
+	u := &usedChallenges{ids: map[string]time.Time{}}
+	p1, p2 := NewPoW(secret, 4, 5*time.Minute), NewPoW(secret, 4, 5*time.Minute)
+	p1.ShareUsed(u)
+	p2.ShareUsed(u)
+
+	c, _ := p1.Issue(now)
+	nonce := Solve(c.Challenge, c.Difficulty)
+	if err := p1.Verify(c.Challenge, nonce, now); err != nil {
+		t.Errorf("incorrect error, got %v, want nil", err)
+		t.FailNow()
+	}
+	if err := p2.Verify(c.Challenge, nonce, now); !errors.Is(err, ErrChallengeUsed) {
+		t.Errorf("challenge should not be replayed on another process, got %v", err)
+		t.FailNow()
+	}
+
+	u.down = true
+	c, _ = p1.Issue(now)
+	nonce = Solve(c.Challenge, c.Difficulty)
+	if err := p1.Verify(c.Challenge, nonce, now); err != nil {
+		t.Errorf("incorrect error, got %v, want nil", err)
+		t.FailNow()
+	}
+	if err := p1.Verify(c.Challenge, nonce, now); !errors.Is(err, ErrChallengeUsed) {
+		t.Errorf("challenge should be recorded in memory when the shared set is down, got %v", err)
+	}
+}
+
+// slowChallenges blocks the first Add until released, like a slow Redis
+type slowChallenges struct {
+	calls   atomic.Int32
+	release chan struct{}
+}
+
+func (u *slowChallenges) Add(id string, exp time.Time) (bool, error) {
+	if u.calls.Add(1) == 1 {
+		<-u.release
+	}
+	return true, nil
+}
+
+func TestPoWVerifyNotLocked(t *testing.T) {
+	now := time.UnixMicro(timestamp)
+	u := &slowChallenges{release: make(chan struct{})}
+	defer close(u.release)
+	p := NewPoW(secret, 4, 5*time.Minute)
+	p.ShareUsed(u)
+
+	c1, _ := p.Issue(now)
+	go p.Verify(c1.Challenge, Solve(c1.Challenge, c1.Difficulty), now)
+	time.Sleep(10 * time.Millisecond) // waiting for the shared set
+
+	c2, _ := p.Issue(now)
+	done := make(chan error)
+	go func() { done <- p.Verify(c2.Challenge, Solve(c2.Challenge, c2.Difficulty), now) }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("incorrect error, got %v, want nil", err)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("verifications should not wait for each other's shared set")
+	}
+}
+
+func TestPoWUnderLoad(t *testing.T) {
+	now := time.UnixMicro(timestamp)
+	p := NewPoW(secret, 8, 5*time.Minute)
+	p.AdjustUnderLoad(10, 11)
+	tt := []struct {
+		issued     int // total challenges issued in the minute
+		difficulty int
+	}{
+		{10, 8},
+		{11, 9},
+		{20, 9},
+		{21, 10},
+		{41, 11},
+		{100, 11}, // max
+	}
+	n := 0
+	for _, tc := range tt {
+		var c *Challenge
+		for ; n < tc.issued; n++ {
+			c, _ = p.Issue(now)
+		}
+		if c.Difficulty != tc.difficulty {
+			t.Errorf("incorrect difficulty after %d challenges, got %d, want %d", tc.issued, c.Difficulty, tc.difficulty)
+			t.FailNow()
+		}
+	}
+	if c, _ := p.Issue(now.Add(time.Minute)); c.Difficulty != 8 {
+		t.Errorf("incorrect difficulty in the next minute, got %d, want %d", c.Difficulty, 8)
+	}
+}
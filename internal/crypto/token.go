@@ -11,8 +11,16 @@ import (
 	"golang.org/x/crypto/sha3"
 )
 
+// Validity of the tokens of the activation links
+const (
+	ActivationTTL = 10 * time.Minute
+	ReminderTTL   = 72 * time.Hour // reminders are read hours after they are sent, see the reminder templates
+)
+
 type Token interface {
 	Create(user *data.User, t time.Time) (string, error)
+	// CreateFor creates a token valid for ttl, e.g. for the reminders read hours after they are sent
+	CreateFor(user *data.User, t time.Time, ttl time.Duration) (string, error)
 	Extract(token string) (*data.User, error)
 	Hash(token string) string
 }
@@ -44,13 +52,13 @@ func (JWTBase[K]) Hash(token string) string {
 	return hash(token)
 }
 
-func create(user *data.User, t time.Time, m jwt.SigningMethod, k interface{}) (string, error) {
+func create(user *data.User, t time.Time, ttl time.Duration, m jwt.SigningMethod, k interface{}) (string, error) {
 	claims := UserClaims{
 		*user,
 		jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(t.Add(10 * time.Minute)), // seconds
-			IssuedAt:  jwt.NewNumericDate(t),                       // seconds
-			NotBefore: jwt.NewNumericDate(t),                       // seconds
+			ExpiresAt: jwt.NewNumericDate(t.Add(ttl)), // seconds
+			IssuedAt:  jwt.NewNumericDate(t),          // seconds
+			NotBefore: jwt.NewNumericDate(t),          // seconds
 			Issuer:    "poln.org",
 		},
 	}
@@ -64,7 +72,11 @@ func create(user *data.User, t time.Time, m jwt.SigningMethod, k interface{}) (s
 }
 
 func (j JWTBase[K]) Create(user *data.User, t time.Time) (string, error) {
-	return create(user, t, j.method, j.k)
+	return create(user, t, ActivationTTL, j.method, j.k)
+}
+
+func (j JWTBase[K]) CreateFor(user *data.User, t time.Time, ttl time.Duration) (string, error) {
+	return create(user, t, ttl, j.method, j.k)
 }
 
 func extract[SM *jwt.SigningMethodHMAC | *jwt.SigningMethodECDSA](token string, k interface{}) (u *data.User, err error) {
@@ -78,7 +90,9 @@ func extract[SM *jwt.SigningMethodHMAC | *jwt.SigningMethodECDSA](token string,
 	})
 
 	if tk.Valid && uclaims.IsSet() {
-		return data.NewUser(uclaims.Address, uclaims.Email, uclaims.Type, uclaims.Sponsor), nil
+		u = data.NewUser(uclaims.Address, uclaims.Email, uclaims.Type, uclaims.Sponsor)
+		u.Locale = uclaims.Locale
+		return u, nil
 	}
 	//fmt.Printf("Error extracting JWT: %v\n", err)
 	err = ErrInvalidToken
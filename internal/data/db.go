@@ -3,6 +3,7 @@ package data
 import (
 	"errors"
 	"fmt"
+	"strings"
 
 	key "github.com/fairhive-labs/ethkeygen/pkg"
 )
@@ -12,6 +13,8 @@ type DB interface {
 	Count() (map[string]int, error)
 	List(options ...int) ([]*User, error)
 	IsPresent(a string) (bool, error)
+	CountEmail(e string) (int, error)
+	Delete(a string) error
 }
 
 // MOCK
@@ -88,6 +91,15 @@ func (db mockDB) IsPresent(a string) (bool, error) {
 	return true, nil
 }
 
+func (db mockDB) CountEmail(e string) (int, error) {
+	return 0, nil
+}
+
+func (db mockDB) Delete(a string) (err error) {
+	fmt.Printf("🗑️ User [ %s ] deleted from DB\n", a)
+	return
+}
+
 var MockDB = mockDB{}
 
 type mockDBContent struct {
@@ -104,6 +116,16 @@ func (db mockDBContent) IsPresent(a string) (bool, error) {
 	return false, nil
 }
 
+func (db mockDBContent) CountEmail(e string) (int, error) {
+	n := 0
+	for _, v := range db.l {
+		if strings.EqualFold(v, NormalizeEmail(e)) {
+			n++
+		}
+	}
+	return n, nil
+}
+
 func NewMockDBContent(l []string) *mockDBContent {
 	return &mockDBContent{MockDB, l}
 }
@@ -128,6 +150,18 @@ func (db mockErrDB) Count() (map[string]int, error) {
 	return nil, errors.New(m)
 }
 
+func (db mockErrDB) Delete(a string) error {
+	m := fmt.Sprintf("🔥 Error deleting User [ %s ] from DB", a)
+	fmt.Println(m)
+	return errors.New(m)
+}
+
+func (db mockErrDB) CountEmail(e string) (int, error) {
+	m := "🔥 Error counting email in DB"
+	fmt.Println(m)
+	return 0, errors.New(m)
+}
+
 func (db mockErrDB) List(options ...int) ([]*User, error) {
 	m := "🔥 Error listing Users in DB"
 	fmt.Println(m)
@@ -16,6 +16,27 @@ type dynamoDB struct {
 	ek string
 }
 
+// record is the item stored in DynamoDB: the user, its email's blind index
+// and the version of the email encryption
+type record struct {
+	User
+	EmailIndex string `dynamodbav:"email_index,omitempty"`
+	EncVersion int    `dynamodbav:"enc_version,omitempty"`
+}
+
+// emailIndexName is the global secondary index of the table on email_index (partition key), records without blind index are not in it
+const emailIndexName = "email_index"
+
+const (
+	legacyEncryption = 0 // email encrypted without additional data
+	boundEncryption  = 1 // email encrypted and bound to the user's address
+)
+
+// Migrator rewrites the records encrypted with a legacy scheme
+type Migrator interface {
+	MigrateEmails() (int, error)
+}
+
 var (
 	ErrDynamoDBNoEncryptionKey = errors.New("cannot create DynamoDB: poln's encryption key is missing")
 	ErrDynamoDBNoTableName     = errors.New("cannot create DynamoDB: no table name")
@@ -64,12 +85,17 @@ func (db *dynamoDB) Save(u *User) error {
 		return errors.New("cannot create dynamodb client")
 	}
 
-	encEmail, err := cipher.Encrypt(u.Email, db.ek)
+	encEmail, err := cipher.EncryptWithAD(u.Email, db.ek, u.Address)
+	if err != nil {
+		return err
+	}
+	ei, err := cipher.BlindIndex(NormalizeEmail(u.Email), db.ek)
 	if err != nil {
 		return err
 	}
 	u2 := NewUser(u.Address, encEmail, u.Type, u.Sponsor)
-	av, err := dynamodbattribute.MarshalMap(*u2)
+	u2.Locale = u.Locale
+	av, err := dynamodbattribute.MarshalMap(record{*u2, ei, boundEncryption})
 	if err != nil {
 		return err
 	}
@@ -163,15 +189,16 @@ func (db *dynamoDB) List(options ...int) ([]*User, error) {
 		}
 
 		for _, u := range result.Items {
-			user := User{}
-			err = dynamodbattribute.UnmarshalMap(u, &user)
+			r := record{}
+			err = dynamodbattribute.UnmarshalMap(u, &r)
 			if err != nil {
 				return nil, err
 			}
-			e, err := cipher.Decrypt(user.Email, db.ek)
+			e, err := db.decryptEmail(&r)
 			if err != nil {
 				return nil, err
 			}
+			user := r.User
 			user.Email = e
 			users = append(users, &user)
 		}
@@ -187,3 +214,141 @@ func (db *dynamoDB) List(options ...int) ([]*User, error) {
 
 	return users, nil
 }
+
+func (db *dynamoDB) CountEmail(e string) (int, error) {
+	ei, err := cipher.BlindIndex(NormalizeEmail(e), db.ek)
+	if err != nil {
+		return 0, err
+	}
+
+	sess := session.Must(session.NewSession())
+	svc := dynamodb.New(sess)
+	if svc == nil {
+		return 0, errors.New("cannot create dynamodb client")
+	}
+
+	input := &dynamodb.QueryInput{
+		TableName:              aws.String(db.tn),
+		IndexName:              aws.String(emailIndexName),
+		KeyConditionExpression: aws.String("email_index = :ei"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":ei": {
+				S: aws.String(ei),
+			},
+		},
+		Select: aws.String(dynamodb.SelectCount),
+	}
+	n := 0
+	for {
+		result, err := svc.Query(input)
+		if err != nil {
+			return 0, err
+		}
+		n += int(aws.Int64Value(result.Count))
+		// pagination
+		input.ExclusiveStartKey = result.LastEvaluatedKey
+		if result.LastEvaluatedKey == nil {
+			break
+		}
+	}
+	return n, nil
+}
+
+func (db *dynamoDB) Delete(a string) error {
+	sess := session.Must(session.NewSession())
+	svc := dynamodb.New(sess)
+	if svc == nil {
+		return errors.New("cannot create dynamodb client")
+	}
+	_, err := svc.DeleteItem(&dynamodb.DeleteItemInput{
+		TableName: aws.String(db.tn),
+		Key: map[string]*dynamodb.AttributeValue{
+			"address": {
+				S: aws.String(a),
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("🗑️ User deleted from DB: [%s]\n", a)
+	return nil
+}
+
+func (db *dynamoDB) decryptEmail(r *record) (string, error) {
+	if r.EncVersion == legacyEncryption {
+		return cipher.Decrypt(r.Email, db.ek)
+	}
+	return cipher.DecryptWithAD(r.Email, db.ek, r.Address)
+}
+
+// MigrateEmails re-encrypts the legacy emails, binding them to the user's address.
+// It returns the number of migrated records.
+func (db *dynamoDB) MigrateEmails() (int, error) {
+	sess := session.Must(session.NewSession())
+	svc := dynamodb.New(sess)
+	if svc == nil {
+		return 0, errors.New("cannot create dynamodb client")
+	}
+
+	input := &dynamodb.ScanInput{
+		TableName:        aws.String(db.tn),
+		FilterExpression: aws.String("attribute_not_exists(enc_version)"),
+	}
+	n := 0
+	for {
+		result, err := svc.Scan(input)
+		if err != nil {
+			return n, err
+		}
+
+		for _, u := range result.Items {
+			r := record{}
+			err = dynamodbattribute.UnmarshalMap(u, &r)
+			if err != nil {
+				return n, err
+			}
+			e, err := db.decryptEmail(&r)
+			if err != nil {
+				return n, err
+			}
+			encEmail, err := cipher.EncryptWithAD(e, db.ek, r.Address)
+			if err != nil {
+				return n, err
+			}
+			ei, err := cipher.BlindIndex(NormalizeEmail(e), db.ek)
+			if err != nil {
+				return n, err
+			}
+			_, err = svc.UpdateItem(&dynamodb.UpdateItemInput{
+				TableName: aws.String(db.tn),
+				Key: map[string]*dynamodb.AttributeValue{
+					"address": {
+						S: aws.String(r.Address),
+					},
+				},
+				ConditionExpression: aws.String("attribute_not_exists(enc_version)"),
+				UpdateExpression:    aws.String("SET #e = :e, email_index = :ei, enc_version = :v"),
+				ExpressionAttributeNames: map[string]*string{
+					"#e": aws.String("email"),
+				},
+				ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+					":e":  {S: aws.String(encEmail)},
+					":ei": {S: aws.String(ei)},
+					":v":  {N: aws.String(fmt.Sprintf("%d", boundEncryption))},
+				},
+			})
+			if err != nil {
+				return n, err
+			}
+			n++
+		}
+		// pagination
+		input.ExclusiveStartKey = result.LastEvaluatedKey
+		if result.LastEvaluatedKey == nil {
+			break
+		}
+	}
+	fmt.Printf("🔁 %d email(s) migrated\n", n)
+	return n, nil
+}
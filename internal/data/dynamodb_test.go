@@ -232,3 +232,67 @@ func TestIsPresent(t *testing.T) {
 		})
 	}
 }
+
+func TestCountEmail(t *testing.T) {
+	db, _ := NewDynamoDB(tableName, ek)
+	tt := []struct {
+		e   string
+		min int
+	}{
+		{"john.doe@mailservice.com", 1},
+		{" John.Doe@MailService.com ", 1},
+		{"nobody@nowhere.void", 0},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.e, func(t *testing.T) {
+			n, err := db.CountEmail(tc.e)
+			if err != nil {
+				t.Errorf("cannot count email %s: %v", tc.e, err)
+				t.FailNow()
+			}
+			if n < tc.min {
+				t.Errorf("incorrect CountEmail(%s) result, got %d, want at least %d", tc.e, n, tc.min)
+				t.FailNow()
+			}
+		})
+	}
+}
+
+func TestMigrateEmails(t *testing.T) {
+	db, _ := NewDynamoDB(tableName, ek)
+	if _, err := db.MigrateEmails(); err != nil {
+		t.Errorf("cannot migrate emails: %v", err)
+		t.FailNow()
+	}
+	n, err := db.MigrateEmails()
+	if err != nil {
+		t.Errorf("cannot migrate emails: %v", err)
+		t.FailNow()
+	}
+	if n != 0 {
+		t.Errorf("incorrect number of migrated emails, got %d, want 0", n)
+		t.FailNow()
+	}
+	if _, err := db.List(); err != nil {
+		t.Errorf("cannot list users after migration: %v", err)
+		t.FailNow()
+	}
+}
+
+func TestDelete(t *testing.T) {
+	db, _ := NewDynamoDB(tableName, ek)
+	a := "0x9C93c71065ea9101F252dE2e0f277437f473ac04"
+	if err := db.Save(NewUser(a, "user2@domain.com", "initiator", sponsor)); err != nil {
+		t.Errorf("cannot save user %s: %v", a, err)
+		t.FailNow()
+	}
+	if err := db.Delete(a); err != nil {
+		t.Errorf("cannot delete user %s: %v", a, err)
+		t.FailNow()
+	}
+	if r, _ := db.IsPresent(a); r {
+		t.Errorf("user %s should not be present after deletion", a)
+		t.FailNow()
+	}
+}
@@ -3,6 +3,7 @@ package data
 import (
 	"encoding/json"
 	"log"
+	"strings"
 	"time"
 
 	"github.com/go-playground/validator/v10"
@@ -16,6 +17,7 @@ type User struct {
 	Timestamp int64  `json:"timestamp,omitempty" validate:"gt=0"`
 	Type      string `json:"type" binding:"required,oneof=advisor agent initiator contributor investor mentor contractor" validate:"required,oneof=advisor agent initiator contributor investor mentor contractor"`
 	Sponsor   string `json:"sponsor" binding:"required,eth_addr" validate:"required,eth_addr"`
+	Locale    string `json:"locale,omitempty"` // language of the emails, see i18n.Matcher
 }
 
 var validate = validator.New()
@@ -36,6 +38,20 @@ func NewUser(a, e, t, s string) *User {
 	return u
 }
 
+// NormalizeEmail returns the canonical form of an email, used to compare emails
+func NormalizeEmail(e string) string {
+	return strings.ToLower(strings.TrimSpace(e))
+}
+
+// MaskEmail hides the local part of an email, except its first character
+func MaskEmail(e string) string {
+	l, d, ok := strings.Cut(e, "@")
+	if !ok || l == "" {
+		return "***"
+	}
+	return l[:1] + "***@" + d
+}
+
 // IsValid tests if all fields are valid
 func (u *User) IsValid() bool {
 	return nil == validate.Struct(u)
@@ -202,47 +202,47 @@ func TestString(t *testing.T) {
 	}{
 		{
 			"valid_user1",
-			&User{a1, e1, id1, int64(tm1), ty1, s1},
+			&User{a1, e1, id1, int64(tm1), ty1, s1, ""},
 			"{\"address\":\"0xaD51c5ac7612DB8dD1611c6B2e317E4950c40942\",\"email\":\"user1@domain.com\",\"uuid\":\"4a8e9808-563e-4761-a8fa-305fef099a3e\",\"type\":\"contractor\",\"sponsor\":\"0x095cb719f8f69952599c15af31c80Ccb825E15d4\",\"timestamp\":\"2023-05-12T18:00:20.519+02:00\"}",
 		},
 		{
 			"valid_user2",
-			&User{a2, e2, id2, int64(tm2), ty2, s2},
+			&User{a2, e2, id2, int64(tm2), ty2, s2, ""},
 			"{\"address\":\"0x9C93c71065ea9101F252dE2e0f277437f473ac04\",\"email\":\"user2@domain.com\",\"uuid\":\"942a5811-926d-4014-baff-ef707f38407e\",\"type\":\"initiator\",\"sponsor\":\"0x233F858EaF43AFFE5DDFBD3AD69ACc6f5de6C529\",\"timestamp\":\"2023-05-11T14:13:10.432+02:00\"}",
 		},
 		{
 			"empty_address",
-			&User{"", e2, id2, int64(tm2), ty2, s2},
+			&User{"", e2, id2, int64(tm2), ty2, s2, ""},
 			"{\"address\":\"\",\"email\":\"user2@domain.com\",\"uuid\":\"942a5811-926d-4014-baff-ef707f38407e\",\"type\":\"initiator\",\"sponsor\":\"0x233F858EaF43AFFE5DDFBD3AD69ACc6f5de6C529\",\"timestamp\":\"2023-05-11T14:13:10.432+02:00\"}",
 		},
 		{
 			"empty_address_empty_sponsor",
-			&User{"", e2, id2, int64(tm2), ty2, ""},
+			&User{"", e2, id2, int64(tm2), ty2, "", ""},
 			"{\"address\":\"\",\"email\":\"user2@domain.com\",\"uuid\":\"942a5811-926d-4014-baff-ef707f38407e\",\"type\":\"initiator\",\"sponsor\":\"\",\"timestamp\":\"2023-05-11T14:13:10.432+02:00\"}",
 		},
 		{
 			"no_email",
-			&User{a2, "", id2, int64(tm2), ty2, s2},
+			&User{a2, "", id2, int64(tm2), ty2, s2, ""},
 			"{\"address\":\"0x9C93c71065ea9101F252dE2e0f277437f473ac04\",\"uuid\":\"942a5811-926d-4014-baff-ef707f38407e\",\"type\":\"initiator\",\"sponsor\":\"0x233F858EaF43AFFE5DDFBD3AD69ACc6f5de6C529\",\"timestamp\":\"2023-05-11T14:13:10.432+02:00\"}",
 		},
 		{
 			"no_uuid",
-			&User{a2, e2, "", int64(tm2), ty2, s2},
+			&User{a2, e2, "", int64(tm2), ty2, s2, ""},
 			"{\"address\":\"0x9C93c71065ea9101F252dE2e0f277437f473ac04\",\"email\":\"user2@domain.com\",\"type\":\"initiator\",\"sponsor\":\"0x233F858EaF43AFFE5DDFBD3AD69ACc6f5de6C529\",\"timestamp\":\"2023-05-11T14:13:10.432+02:00\"}",
 		},
 		{
 			"no_uuid_no_type",
-			&User{a2, e2, "", int64(tm2), "", s2},
+			&User{a2, e2, "", int64(tm2), "", s2, ""},
 			"{\"address\":\"0x9C93c71065ea9101F252dE2e0f277437f473ac04\",\"email\":\"user2@domain.com\",\"sponsor\":\"0x233F858EaF43AFFE5DDFBD3AD69ACc6f5de6C529\",\"timestamp\":\"2023-05-11T14:13:10.432+02:00\"}",
 		},
 		{
 			"epoch_T0_no_timestamp",
-			&User{a1, e1, id1, 0, ty1, s1},
+			&User{a1, e1, id1, 0, ty1, s1, ""},
 			"{\"address\":\"0xaD51c5ac7612DB8dD1611c6B2e317E4950c40942\",\"email\":\"user1@domain.com\",\"uuid\":\"4a8e9808-563e-4761-a8fa-305fef099a3e\",\"type\":\"contractor\",\"sponsor\":\"0x095cb719f8f69952599c15af31c80Ccb825E15d4\"}",
 		},
 		{
 			"epoch_T0",
-			&User{a1, e1, id1, 0, ty1, s1},
+			&User{a1, e1, id1, 0, ty1, s1, ""},
 			"{\"address\":\"0xaD51c5ac7612DB8dD1611c6B2e317E4950c40942\",\"email\":\"user1@domain.com\",\"uuid\":\"4a8e9808-563e-4761-a8fa-305fef099a3e\",\"type\":\"contractor\",\"sponsor\":\"0x095cb719f8f69952599c15af31c80Ccb825E15d4\",\"timestamp\":\"1970-01-01T00:00:00.000+00:00\"}",
 		},
 	}
@@ -303,3 +303,42 @@ func TestString(t *testing.T) {
 		})
 	}
 }
+
+func TestNormalizeEmail(t *testing.T) {
+	tt := []struct {
+		e, exp string
+	}{
+		{"john.doe@mailservice.com", "john.doe@mailservice.com"},
+		{"John.Doe@MailService.COM", "john.doe@mailservice.com"},
+		{"  john.doe@mailservice.com\n", "john.doe@mailservice.com"},
+		{"", ""},
+	}
+	for _, tc := range tt {
+		t.Run(tc.e, func(t *testing.T) {
+			if n := NormalizeEmail(tc.e); n != tc.exp {
+				t.Errorf("incorrect normalized email, got %q, want %q", n, tc.exp)
+				t.FailNow()
+			}
+		})
+	}
+}
+
+func TestMaskEmail(t *testing.T) {
+	tt := []struct {
+		e, exp string
+	}{
+		{"john.doe@mailservice.com", "j***@mailservice.com"},
+		{"j@mailservice.com", "j***@mailservice.com"},
+		{"@mailservice.com", "***"},
+		{"john.doe", "***"},
+		{"", "***"},
+	}
+	for _, tc := range tt {
+		t.Run(tc.e, func(t *testing.T) {
+			if m := MaskEmail(tc.e); m != tc.exp {
+				t.Errorf("incorrect masked email, got %q, want %q", m, tc.exp)
+				t.FailNow()
+			}
+		})
+	}
+}
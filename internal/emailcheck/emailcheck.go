@@ -0,0 +1,167 @@
+package emailcheck
+
+import (
+	"bufio"
+	"context"
+	_ "embed"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync/atomic"
+)
+
+//go:embed disposable.txt
+var disposable string
+
+// PlusTagDomains are the default providers delivering user+tag@domain to user@domain
+var PlusTagDomains = []string{"gmail.com", "googlemail.com", "outlook.com", "hotmail.com", "live.com", "icloud.com", "protonmail.com", "proton.me", "fastmail.com"}
+
+var (
+	ErrInvalidEmail = errors.New("invalid email")
+	ErrDisposable   = errors.New("disposable email domain")
+	ErrNoMX         = errors.New("email domain cannot receive emails")
+)
+
+// MXResolver looks up the MX records of a domain, and its addresses without MX records (RFC 5321 §5.1).
+// *net.Resolver is a MXResolver.
+type MXResolver interface {
+	LookupMX(ctx context.Context, name string) ([]*net.MX, error)
+	LookupHost(ctx context.Context, host string) ([]string, error)
+}
+
+// Checker rejects the disposable domains and, with a resolver, the domains which cannot receive emails
+type Checker struct {
+	disposable atomic.Pointer[map[string]bool]
+	plusTags   map[string]bool
+	resolver   MXResolver
+}
+
+// New returns a Checker with the embedded disposable domains, stripping the plus-tags of the domains.
+// MX records are not verified if resolver is nil.
+func New(resolver MXResolver, plusTagDomains ...string) *Checker {
+	ch := &Checker{plusTags: map[string]bool{}, resolver: resolver}
+	for _, d := range plusTagDomains {
+		ch.plusTags[strings.ToLower(strings.TrimSpace(d))] = true
+	}
+	ds, _ := ParseDomains(strings.NewReader(disposable))
+	ch.disposable.Store(&ds)
+	return ch
+}
+
+// ParseDomains reads the domains, one per line, # starts a comment
+func ParseDomains(r io.Reader) (map[string]bool, error) {
+	ds := map[string]bool{}
+	s := bufio.NewScanner(r)
+	for l := 1; s.Scan(); l++ {
+		line := s.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		d := strings.ToLower(strings.TrimSpace(line))
+		if d == "" {
+			continue
+		}
+		if strings.ContainsAny(d, " \t@") || !strings.Contains(d, ".") {
+			return nil, fmt.Errorf("line %d: invalid domain %q", l, d)
+		}
+		ds[d] = true
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return ds, nil
+}
+
+// Update adds the disposable domains of r to the embedded list
+func (ch *Checker) Update(r io.Reader) error {
+	ds, err := ParseDomains(r)
+	if err != nil {
+		return err
+	}
+	for d := range *ch.disposable.Load() {
+		ds[d] = true
+	}
+	ch.disposable.Store(&ds)
+	return nil
+}
+
+// Load adds the disposable domains of the file at path to the embedded list
+func (ch *Checker) Load(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return ch.Update(f)
+}
+
+// Normalize lowers the email and removes the plus-tag of the configured providers
+func (ch *Checker) Normalize(e string) (string, error) {
+	l, d, ok := strings.Cut(strings.ToLower(strings.TrimSpace(e)), "@")
+	if !ok || l == "" || d == "" || strings.Contains(d, "@") {
+		return "", ErrInvalidEmail
+	}
+	if ch.plusTags[d] {
+		if i := strings.Index(l, "+"); i > 0 {
+			l = l[:i]
+		}
+	}
+	return l + "@" + d, nil
+}
+
+// Disposable tells if the domain, or one of its parents, is a disposable domain
+func (ch *Checker) Disposable(domain string) bool {
+	ds := *ch.disposable.Load()
+	for d := strings.ToLower(domain); strings.Contains(d, "."); {
+		if ds[d] {
+			return true
+		}
+		_, d, _ = strings.Cut(d, ".")
+	}
+	return false
+}
+
+// Check returns the normalized email, or an error if its domain is disposable or cannot receive emails:
+// a null MX (RFC 7505), or neither MX records nor addresses. Resolver failures other than a missing domain are logged and ignored.
+func (ch *Checker) Check(ctx context.Context, e string) (string, error) {
+	n, err := ch.Normalize(e)
+	if err != nil {
+		return "", err
+	}
+	_, d, _ := strings.Cut(n, "@")
+	if ch.Disposable(d) {
+		return "", ErrDisposable
+	}
+	if ch.resolver == nil {
+		return n, nil
+	}
+	mx, err := ch.resolver.LookupMX(ctx, d)
+	var dnsErr *net.DNSError
+	switch {
+	case errors.As(err, &dnsErr) && dnsErr.IsNotFound, err == nil && len(mx) == 0:
+		return ch.checkHost(ctx, n, d) // the domain itself is the mail server
+	case err != nil:
+		log.Printf("⚠️ Cannot lookup MX records of %q: %v\n", d, err)
+		return n, nil
+	case len(mx) == 1 && mx[0].Host == ".": // null MX, RFC 7505
+		return "", ErrNoMX
+	}
+	return n, nil
+}
+
+// checkHost returns the normalized email n if its domain d without MX records has an address
+func (ch *Checker) checkHost(ctx context.Context, n, d string) (string, error) {
+	addrs, err := ch.resolver.LookupHost(ctx, d)
+	var dnsErr *net.DNSError
+	switch {
+	case errors.As(err, &dnsErr) && dnsErr.IsNotFound, err == nil && len(addrs) == 0:
+		return "", ErrNoMX
+	case err != nil:
+		log.Printf("⚠️ Cannot lookup addresses of %q: %v\n", d, err)
+	}
+	return n, nil
+}
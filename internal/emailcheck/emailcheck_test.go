@@ -0,0 +1,144 @@
+package emailcheck
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// resolver is a MXResolver stub, domains without records do not exist
+type resolver struct {
+	mx    map[string][]*net.MX
+	hosts map[string][]string
+}
+
+func (r resolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	if name == "timeout.com" {
+		return nil, &net.DNSError{Err: "i/o timeout", Name: name, IsTimeout: true}
+	}
+	mx, ok := r.mx[name]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+	return mx, nil
+}
+
+func (r resolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	addrs, ok := r.hosts[host]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	return addrs, nil
+}
+
+var mx = resolver{
+	mx: map[string][]*net.MX{
+		"mailservice.com": {{Host: "mx.mailservice.com.", Pref: 10}},
+		"gmail.com":       {{Host: "gmail-smtp-in.l.google.com.", Pref: 5}},
+		"nomail.com":      {{Host: ".", Pref: 0}},
+		"nomx.com":        {},
+	},
+	hosts: map[string][]string{
+		"nomail.com":    {"192.0.2.2"},
+		"a-only.com":    {"192.0.2.1"},
+		"aaaa-only.com": {"2001:db8::1"},
+	},
+}
+
+func TestNormalize(t *testing.T) {
+	ch := New(nil, PlusTagDomains...)
+	tt := []struct {
+		email, normalized string
+		err               error
+	}{
+		{"john.doe@mailservice.com", "john.doe@mailservice.com", nil},
+		{" John.Doe@MailService.com ", "john.doe@mailservice.com", nil},
+		{"john.doe+poln@gmail.com", "john.doe@gmail.com", nil},
+		{"John.Doe+Poln+2@GMail.com", "john.doe@gmail.com", nil},
+		{"john.doe+poln@mailservice.com", "john.doe+poln@mailservice.com", nil}, // not configured
+		{"+poln@gmail.com", "+poln@gmail.com", nil},
+		{"john.doe", "", ErrInvalidEmail},
+		{"@gmail.com", "", ErrInvalidEmail},
+		{"john@doe@gmail.com", "", ErrInvalidEmail},
+	}
+	for _, tc := range tt {
+		t.Run(tc.email, func(t *testing.T) {
+			n, err := ch.Normalize(tc.email)
+			if !errors.Is(err, tc.err) || n != tc.normalized {
+				t.Errorf("incorrect normalization, got %q %v, want %q %v", n, err, tc.normalized, tc.err)
+				t.FailNow()
+			}
+		})
+	}
+}
+
+func TestCheck(t *testing.T) {
+	ch := New(mx, "gmail.com")
+	tt := []struct {
+		email, normalized string
+		err               error
+	}{
+		{"john.doe@mailservice.com", "john.doe@mailservice.com", nil},
+		{"john.doe+poln@gmail.com", "john.doe@gmail.com", nil},
+		{"john.doe@mailinator.com", "", ErrDisposable},
+		{"john.doe@MAILINATOR.com", "", ErrDisposable},
+		{"john.doe@eu.mailinator.com", "", ErrDisposable},
+		{"john.doe@unknown-domain.com", "", ErrNoMX},
+		{"john.doe@nomail.com", "", ErrNoMX}, // null MX, even with an address
+		{"john.doe@a-only.com", "john.doe@a-only.com", nil},
+		{"john.doe@aaaa-only.com", "john.doe@aaaa-only.com", nil},
+		{"john.doe@nomx.com", "", ErrNoMX},                    // neither MX records nor addresses
+		{"john.doe@timeout.com", "john.doe@timeout.com", nil}, // fails open
+		{"john.doe", "", ErrInvalidEmail},
+	}
+	for _, tc := range tt {
+		t.Run(tc.email, func(t *testing.T) {
+			n, err := ch.Check(context.Background(), tc.email)
+			if !errors.Is(err, tc.err) || n != tc.normalized {
+				t.Errorf("incorrect check, got %q %v, want %q %v", n, err, tc.normalized, tc.err)
+				t.FailNow()
+			}
+		})
+	}
+
+	t.Run("without resolver", func(t *testing.T) {
+		if _, err := New(nil).Check(context.Background(), "john.doe@unknown-domain.com"); err != nil {
+			t.Errorf("incorrect error, got %v, want nil", err)
+		}
+	})
+}
+
+func TestUpdate(t *testing.T) {
+	ch := New(nil)
+	if ch.Disposable("poln-trash.org") {
+		t.Errorf("poln-trash.org should not be disposable yet")
+		t.FailNow()
+	}
+	p := filepath.Join(t.TempDir(), "disposable.txt")
+	os.WriteFile(p, []byte("# more domains\nPOLN-trash.org\n\nthrowaway.example # comment\n"), 0600)
+	if err := ch.Load(p); err != nil {
+		t.Errorf("cannot load domains: %v", err)
+		t.FailNow()
+	}
+	for _, d := range []string{"poln-trash.org", "throwaway.example", "mailinator.com"} {
+		if !ch.Disposable(d) {
+			t.Errorf("%s should be disposable", d)
+			t.FailNow()
+		}
+	}
+
+	for _, l := range []string{"localhost", "john@trash.org", "trash .org"} {
+		t.Run(l, func(t *testing.T) {
+			if err := ch.Update(strings.NewReader(l)); err == nil {
+				t.Errorf("incorrect error, should not be nil")
+			}
+		})
+	}
+	if err := ch.Load(filepath.Join(t.TempDir(), "missing")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("incorrect error, got %v, want %v", err, os.ErrNotExist)
+	}
+}
@@ -0,0 +1,118 @@
+package i18n
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+
+	"github.com/go-playground/locales/en"
+	"github.com/go-playground/locales/fr"
+	ut "github.com/go-playground/universal-translator"
+	"github.com/go-playground/validator/v10"
+	entranslations "github.com/go-playground/validator/v10/translations/en"
+	frtranslations "github.com/go-playground/validator/v10/translations/fr"
+	"golang.org/x/text/language"
+)
+
+// Default is the locale used when none of the preferred languages is supported, it must always be supported
+const Default = "en"
+
+// Matcher finds the best supported locale of the user
+type Matcher struct {
+	locales []string
+	m       language.Matcher
+}
+
+// NewMatcher supports the locales (e.g. the locales of the email templates) and Default, invalid locales are ignored
+func NewMatcher(locales []string) *Matcher {
+	m := &Matcher{locales: []string{Default}}
+	tags := []language.Tag{language.Make(Default)}
+	for _, l := range locales {
+		t, err := language.Parse(l)
+		if err != nil || l == Default {
+			continue
+		}
+		m.locales = append(m.locales, l)
+		tags = append(tags, t)
+	}
+	m.m = language.NewMatcher(tags)
+	return m
+}
+
+// Locales returns the supported locales, Default first
+func (m *Matcher) Locales() []string {
+	return append([]string{}, m.locales...)
+}
+
+// Match returns the supported locale of the explicit locale, if any, else of the Accept-Language header
+func (m *Matcher) Match(locale, acceptLanguage string) string {
+	var tags []language.Tag
+	if t, err := language.Parse(locale); err == nil {
+		tags = append(tags, t)
+	}
+	if ts, _, err := language.ParseAcceptLanguage(acceptLanguage); err == nil {
+		tags = append(tags, ts...)
+	}
+	_, i, c := m.m.Match(tags...)
+	if c == language.No {
+		return Default
+	}
+	return m.locales[i]
+}
+
+// ethAddr are the translations of the custom eth_addr validation
+var ethAddr = map[string]string{
+	"en": "{0} must be a valid Ethereum address",
+	"fr": "{0} doit être une adresse Ethereum valide",
+}
+
+// Translator translates the validation errors of a validator in the supported locales
+type Translator struct {
+	uni *ut.UniversalTranslator
+}
+
+// NewTranslator registers the translations in v, fields are named after their json tag
+func NewTranslator(v *validator.Validate) (*Translator, error) {
+	e, f := en.New(), fr.New()
+	t := &Translator{ut.New(e, e, f)}
+	for l, register := range map[string]func(*validator.Validate, ut.Translator) error{
+		"en": entranslations.RegisterDefaultTranslations,
+		"fr": frtranslations.RegisterDefaultTranslations,
+	} {
+		trans, _ := t.uni.GetTranslator(l)
+		if err := register(v, trans); err != nil {
+			return nil, err
+		}
+		err := v.RegisterTranslation("eth_addr", trans, func(ut ut.Translator) error {
+			return ut.Add("eth_addr", ethAddr[l], false)
+		}, func(ut ut.Translator, fe validator.FieldError) string {
+			s, _ := ut.T("eth_addr", fe.Field())
+			return s
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	v.RegisterTagNameFunc(func(f reflect.StructField) string {
+		n, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if n == "-" || n == "" {
+			return f.Name
+		}
+		return n
+	})
+	return t, nil
+}
+
+// Translate returns the messages of the validation errors in the locale, other errors are not translated
+func (t *Translator) Translate(err error, locale string) string {
+	var ves validator.ValidationErrors
+	if !errors.As(err, &ves) {
+		return err.Error()
+	}
+	trans, _ := t.uni.GetTranslator(locale) // fallback is English
+	ms := make([]string, len(ves))
+	for i, fe := range ves {
+		ms[i] = fe.Translate(trans)
+	}
+	return strings.Join(ms, "; ")
+}
@@ -0,0 +1,79 @@
+package i18n
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/go-playground/validator/v10"
+)
+
+func TestMatch(t *testing.T) {
+	m := NewMatcher([]string{"fr", "en", "not a locale"})
+	if ls := m.Locales(); len(ls) != 2 || ls[0] != Default || ls[1] != "fr" {
+		t.Errorf("incorrect locales, got %v", ls)
+		t.FailNow()
+	}
+	tt := []struct {
+		name, locale, acceptLanguage, want string
+	}{
+		{"none", "", "", "en"},
+		{"locale", "fr", "", "fr"},
+		{"regional locale", "fr-CA", "", "fr"},
+		{"locale first", "en", "fr-FR,fr;q=0.9", "en"},
+		{"accept language", "", "fr-CH, fr;q=0.9, en;q=0.8, *;q=0.5", "fr"},
+		{"accept language order", "", "de-DE, en;q=0.8, fr;q=0.5", "en"},
+		{"unsupported", "de", "ja, zh;q=0.9", "en"},
+		{"invalid", "not a locale", "=;;", "en"},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			if l := m.Match(tc.locale, tc.acceptLanguage); l != tc.want {
+				t.Errorf("incorrect locale, got %q, want %q", l, tc.want)
+			}
+		})
+	}
+}
+
+func TestMatchNewLocale(t *testing.T) {
+	m := NewMatcher([]string{"en", "fr", "de"})
+	if l := m.Match("", "de-CH, fr;q=0.9"); l != "de" {
+		t.Errorf("incorrect locale, got %q, want %q", l, "de")
+	}
+	if l := NewMatcher(nil).Match("fr", ""); l != Default {
+		t.Errorf("incorrect locale, got %q, want %q", l, Default)
+	}
+}
+
+func TestTranslate(t *testing.T) {
+	v := validator.New()
+	tr, err := NewTranslator(v)
+	if err != nil {
+		t.Errorf("cannot create translator: %v", err)
+		t.FailNow()
+	}
+	u := struct {
+		Address string `json:"address" validate:"required,eth_addr"`
+		Email   string `json:"email,omitempty" validate:"email"`
+		Type    string `json:"type" validate:"oneof=agent mentor"`
+	}{"0x0", "john.doe@", "dev"}
+	err = v.Struct(u)
+
+	tt := []struct {
+		locale, want string
+	}{
+		{"en", "address must be a valid Ethereum address; email must be a valid email address; type must be one of [agent mentor]"},
+		{"fr", "address doit être une adresse Ethereum valide; email doit être une adresse email valide; type doit être l'un des choix suivants [agent mentor]"},
+		{"de", "address must be a valid Ethereum address; email must be a valid email address; type must be one of [agent mentor]"},
+	}
+	for _, tc := range tt {
+		t.Run(tc.locale, func(t *testing.T) {
+			if m := tr.Translate(err, tc.locale); m != tc.want {
+				t.Errorf("incorrect translation, got %q, want %q", m, tc.want)
+			}
+		})
+	}
+
+	if m := tr.Translate(errors.New("unexpected EOF"), "fr"); m != "unexpected EOF" {
+		t.Errorf("other errors should not be translated, got %q", m)
+	}
+}
@@ -0,0 +1,211 @@
+package ipfilter
+
+import (
+	"bufio"
+	"expvar"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// filter metrics, published with expvar
+var (
+	filterDenied = expvar.NewMap("ipfilter_denied")
+)
+
+// Reasons of a denial
+const (
+	Denied         = "denied"
+	CountryBlocked = "country"
+	NotAllowed     = "not allowed"
+)
+
+// Rules are the allow and deny lists of networks and the blocked countries.
+// The file format is one rule per line, # starts a comment:
+//
+//	allow 203.0.113.0/24
+//	deny 198.51.100.0/24
+//	deny-country XX
+type Rules struct {
+	Allow     []*net.IPNet
+	Deny      []*net.IPNet
+	Countries map[string]bool // ISO 3166-1 alpha-2 codes
+}
+
+func parseCIDR(s string) (*net.IPNet, error) {
+	if !strings.Contains(s, "/") { // single IP
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid IP %q", s)
+		}
+		if ip.To4() != nil {
+			s += "/32"
+		} else {
+			s += "/128"
+		}
+	}
+	_, n, err := net.ParseCIDR(s)
+	return n, err
+}
+
+// ParseRules reads the rules, one per line
+func ParseRules(r io.Reader) (*Rules, error) {
+	rs := &Rules{Countries: map[string]bool{}}
+	s := bufio.NewScanner(r)
+	for l := 1; s.Scan(); l++ {
+		line := s.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		f := strings.Fields(line)
+		if len(f) == 0 {
+			continue
+		}
+		if len(f) != 2 {
+			return nil, fmt.Errorf("line %d: invalid rule %q", l, line)
+		}
+		switch f[0] {
+		case "allow", "deny":
+			n, err := parseCIDR(f[1])
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", l, err)
+			}
+			if f[0] == "allow" {
+				rs.Allow = append(rs.Allow, n)
+			} else {
+				rs.Deny = append(rs.Deny, n)
+			}
+		case "deny-country":
+			if len(f[1]) != 2 {
+				return nil, fmt.Errorf("line %d: invalid country code %q", l, f[1])
+			}
+			rs.Countries[strings.ToUpper(f[1])] = true
+		default:
+			return nil, fmt.Errorf("line %d: unknown rule %q", l, f[0])
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return rs, nil
+}
+
+func contains(ns []*net.IPNet, ip net.IP) bool {
+	for _, n := range ns {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// CountryLookup returns the ISO country code of an IP, empty if unknown
+type CountryLookup interface {
+	Country(ip net.IP) (string, error)
+}
+
+// Filter allows or denies IPs with its rules, reloaded from a file when it changes
+type Filter struct {
+	rules   atomic.Pointer[Rules]
+	geo     CountryLookup
+	path    string
+	modTime time.Time
+	sync.Mutex
+}
+
+// New returns a Filter with fixed rules, countries are looked up with geo (optional)
+func New(rules *Rules, geo CountryLookup) *Filter {
+	f := &Filter{geo: geo}
+	f.rules.Store(rules)
+	return f
+}
+
+// Load returns a Filter with the rules of the file at path, see Reload
+func Load(path string, geo CountryLookup) (*Filter, error) {
+	f := &Filter{geo: geo, path: path}
+	if err := f.Reload(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Reload reads the rules file again if it has been modified. The current rules are kept on error.
+func (f *Filter) Reload() error {
+	f.Lock()
+	defer f.Unlock()
+
+	st, err := os.Stat(f.path)
+	if err != nil {
+		return err
+	}
+	if st.ModTime().Equal(f.modTime) && f.rules.Load() != nil {
+		return nil
+	}
+	file, err := os.Open(f.path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	rs, err := ParseRules(file)
+	if err != nil {
+		return err
+	}
+	f.rules.Store(rs)
+	f.modTime = st.ModTime()
+	return nil
+}
+
+// Watch reloads the rules file every interval, until stop is closed
+func (f *Filter) Watch(interval time.Duration, stop <-chan struct{}) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+			if err := f.Reload(); err != nil {
+				log.Printf("⚠️ Cannot reload IP filter %q: %v\n", f.path, err)
+			}
+		}
+	}
+}
+
+// Allowed tells if the IP is allowed, and the reason if it is not.
+// Allowed networks bypass the deny list and the blocked countries.
+func (f *Filter) Allowed(ip net.IP) (bool, string) {
+	rs := f.rules.Load()
+	if ip == nil || contains(rs.Allow, ip) {
+		return true, ""
+	}
+	if contains(rs.Deny, ip) {
+		filterDenied.Add(Denied, 1)
+		return false, Denied
+	}
+	if f.geo != nil && len(rs.Countries) > 0 {
+		c, err := f.geo.Country(ip)
+		if err != nil {
+			log.Printf("⚠️ Cannot lookup country of %s: %v\n", ip, err)
+		}
+		if rs.Countries[c] {
+			filterDenied.Add(CountryBlocked, 1)
+			return false, CountryBlocked
+		}
+	}
+	return true, ""
+}
+
+// Listed tells if the IP is in the allow list
+func (f *Filter) Listed(ip net.IP) bool {
+	ok := ip != nil && contains(f.rules.Load().Allow, ip)
+	if !ok {
+		filterDenied.Add(NotAllowed, 1)
+	}
+	return ok
+}
@@ -0,0 +1,293 @@
+package ipfilter
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const rules = `# test rules
+allow 203.0.113.0/24
+allow 2001:db8:a::/48
+deny 198.51.100.0/24 # bots
+deny 192.0.2.66
+deny 2001:db8:b::/48
+deny-country xx
+deny-country YY
+`
+
+// countries is a CountryLookup stub
+type countries map[string]string
+
+func (c countries) Country(ip net.IP) (string, error) {
+	for cidr, code := range c {
+		if _, n, _ := net.ParseCIDR(cidr); n.Contains(ip) {
+			return code, nil
+		}
+	}
+	return "", nil
+}
+
+func TestParseRules(t *testing.T) {
+	rs, err := ParseRules(strings.NewReader(rules))
+	if err != nil {
+		t.Errorf("cannot parse rules: %v", err)
+		t.FailNow()
+	}
+	if len(rs.Allow) != 2 || len(rs.Deny) != 3 || len(rs.Countries) != 2 || !rs.Countries["XX"] {
+		t.Errorf("incorrect rules, got %d allowed, %d denied, countries %v", len(rs.Allow), len(rs.Deny), rs.Countries)
+		t.FailNow()
+	}
+
+	for _, r := range []string{
+		"allow",
+		"allow 10.0.0.0/33",
+		"deny n0t-an-ip",
+		"deny-country XXX",
+		"block 10.0.0.0/8",
+		"allow 10.0.0.0/8 10.0.0.0/8",
+	} {
+		t.Run(r, func(t *testing.T) {
+			if _, err := ParseRules(strings.NewReader(r)); err == nil {
+				t.Errorf("incorrect error, should not be nil")
+				t.FailNow()
+			}
+		})
+	}
+}
+
+func TestAllowed(t *testing.T) {
+	rs, _ := ParseRules(strings.NewReader(rules))
+	f := New(rs, countries{"100.64.0.0/10": "XX", "172.16.0.0/12": "FR", "203.0.113.0/24": "YY"})
+	tt := []struct {
+		ip      string
+		allowed bool
+		reason  string
+		listed  bool
+	}{
+		{"203.0.113.7", true, "", true}, // allowed bypasses the blocked country
+		{"2001:db8:a::1", true, "", true},
+		{"198.51.100.7", false, Denied, false},
+		{"192.0.2.66", false, Denied, false},
+		{"192.0.2.67", true, "", false},
+		{"2001:db8:b::1", false, Denied, false},
+		{"100.64.1.1", false, CountryBlocked, false},
+		{"172.16.1.1", true, "", false},
+		{"10.0.0.1", true, "", false},
+	}
+	for _, tc := range tt {
+		t.Run(tc.ip, func(t *testing.T) {
+			ip := net.ParseIP(tc.ip)
+			ok, reason := f.Allowed(ip)
+			if ok != tc.allowed || reason != tc.reason {
+				t.Errorf("incorrect decision, got %v %q, want %v %q", ok, reason, tc.allowed, tc.reason)
+				t.FailNow()
+			}
+			if l := f.Listed(ip); l != tc.listed {
+				t.Errorf("incorrect listing, got %v, want %v", l, tc.listed)
+				t.FailNow()
+			}
+		})
+	}
+
+	t.Run("without country lookup", func(t *testing.T) {
+		if ok, _ := New(rs, nil).Allowed(net.ParseIP("100.64.1.1")); !ok {
+			t.Errorf("countries cannot be blocked without lookup")
+		}
+	})
+	t.Run("metrics", func(t *testing.T) {
+		v := filterDenied.Get(Denied).String()
+		f.Allowed(net.ParseIP("198.51.100.8"))
+		if filterDenied.Get(Denied).String() == v {
+			t.Errorf("denied metric should be incremented")
+		}
+	})
+}
+
+func TestReload(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "ipfilter.txt")
+	os.WriteFile(p, []byte("deny 198.51.100.0/24\n"), 0600)
+	f, err := Load(p, nil)
+	if err != nil {
+		t.Errorf("cannot load rules: %v", err)
+		t.FailNow()
+	}
+	ip := net.ParseIP("198.51.100.7")
+	if ok, _ := f.Allowed(ip); ok {
+		t.Errorf("%s should be denied", ip)
+		t.FailNow()
+	}
+
+	set := func(content string, mt time.Time) {
+		os.WriteFile(p, []byte(content), 0600)
+		os.Chtimes(p, mt, mt)
+	}
+	set("allow 198.51.100.0/24\n", time.Now().Add(time.Minute))
+	if err := f.Reload(); err != nil {
+		t.Errorf("cannot reload rules: %v", err)
+		t.FailNow()
+	}
+	if ok, _ := f.Allowed(ip); !ok {
+		t.Errorf("%s should be allowed after reload", ip)
+		t.FailNow()
+	}
+
+	set("bad rule\n", time.Now().Add(2*time.Minute))
+	if err := f.Reload(); err == nil {
+		t.Errorf("incorrect error, should not be nil")
+		t.FailNow()
+	}
+	if ok, _ := f.Allowed(ip); !ok {
+		t.Errorf("rules should be kept on reload error")
+		t.FailNow()
+	}
+
+	t.Run("watch", func(t *testing.T) {
+		stop := make(chan struct{})
+		defer close(stop)
+		go f.Watch(10*time.Millisecond, stop)
+		set("deny 198.51.100.0/24\n", time.Now().Add(3*time.Minute))
+		for i := 0; i < 100; i++ {
+			if ok, _ := f.Allowed(ip); !ok {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Errorf("rules should be reloaded by Watch")
+	})
+
+	t.Run("missing file", func(t *testing.T) {
+		if _, err := Load(filepath.Join(t.TempDir(), "missing"), nil); err == nil {
+			t.Errorf("incorrect error, should not be nil")
+		}
+	})
+}
+
+// writeMMDB writes an IPv4 MaxMind DB mapping the networks to their country ISO code
+func writeMMDB(t *testing.T, networks map[string]string) string {
+	enc := func(typ byte, b []byte) []byte { // type and size < 29 in the control byte
+		return append([]byte{typ<<5 | byte(len(b))}, b...)
+	}
+	str := func(s string) []byte { return enc(2, []byte(s)) }
+	u16 := func(v uint16) []byte { return enc(5, binary.BigEndian.AppendUint16(nil, v)) }
+	u32 := func(v uint32) []byte { return enc(6, binary.BigEndian.AppendUint32(nil, v)) }
+	mp := func(kvs ...[]byte) []byte { return append([]byte{7<<5 | byte(len(kvs)/2)}, bytes.Join(kvs, nil)...) }
+
+	const empty = -1
+	nodes := [][2]int{{empty, empty}}
+	var data []byte
+	var offsets []int
+	for cidr, code := range networks {
+		_, n, _ := net.ParseCIDR(cidr)
+		ones, _ := n.Mask.Size()
+		offsets = append(offsets, len(data))
+		data = append(data, mp(str("country"), mp(str("iso_code"), str(code)))...)
+		node := 0
+		for i := 0; i < ones; i++ {
+			b := int(n.IP.To4()[i/8]>>(7-i%8)) & 1
+			if i == ones-1 {
+				nodes[node][b] = -2 - (len(offsets) - 1) // data record
+				break
+			}
+			if nodes[node][b] == empty {
+				nodes = append(nodes, [2]int{empty, empty})
+				nodes[node][b] = len(nodes) - 1
+			}
+			node = nodes[node][b]
+		}
+	}
+
+	var db []byte
+	nc := len(nodes)
+	for _, n := range nodes {
+		for _, r := range n {
+			v := r
+			switch {
+			case r == empty:
+				v = nc
+			case r <= -2:
+				v = nc + 16 + offsets[-2-r]
+			}
+			db = append(db, byte(v>>16), byte(v>>8), byte(v))
+		}
+	}
+	db = append(db, make([]byte, 16)...)
+	db = append(db, data...)
+	db = append(db, []byte("\xAB\xCD\xEFMaxMind.com")...)
+	db = append(db, mp(
+		str("node_count"), u32(uint32(nc)),
+		str("record_size"), u16(24),
+		str("ip_version"), u16(4),
+		str("database_type"), str("Test-Country"),
+		str("binary_format_major_version"), u16(2),
+	)...)
+
+	p := filepath.Join(t.TempDir(), "country.mmdb")
+	if err := os.WriteFile(p, db, 0600); err != nil {
+		t.Fatalf("cannot write database: %v", err)
+	}
+	return p
+}
+
+func TestMaxMind(t *testing.T) {
+	p := writeMMDB(t, map[string]string{"100.64.0.0/10": "XX", "172.16.0.0/12": "FR"})
+	m, err := OpenMaxMind(p)
+	if err != nil {
+		t.Errorf("cannot open database: %v", err)
+		t.FailNow()
+	}
+	defer m.Close()
+
+	tt := []struct {
+		ip      string
+		country string
+		err     bool
+	}{
+		{"100.64.1.1", "XX", false},
+		{"100.127.255.255", "XX", false},
+		{"172.31.0.1", "FR", false},
+		{"10.0.0.1", "", false},
+		{"2001:db8::1", "", true}, // IPv4 only database
+	}
+	for _, tc := range tt {
+		t.Run(tc.ip, func(t *testing.T) {
+			c, err := m.Country(net.ParseIP(tc.ip))
+			if (err != nil) != tc.err {
+				t.Errorf("incorrect error, got %v", err)
+				t.FailNow()
+			}
+			if c != tc.country {
+				t.Errorf("incorrect country, got %q, want %q", c, tc.country)
+				t.FailNow()
+			}
+		})
+	}
+
+	t.Run("filter", func(t *testing.T) {
+		rs, _ := ParseRules(strings.NewReader("deny-country XX"))
+		f := New(rs, m)
+		if ok, reason := f.Allowed(net.ParseIP("100.64.1.1")); ok || reason != CountryBlocked {
+			t.Errorf("incorrect decision, got %v %q, want %v %q", ok, reason, false, CountryBlocked)
+		}
+		if ok, _ := f.Allowed(net.ParseIP("172.16.1.1")); !ok {
+			t.Errorf("other countries should be allowed")
+		}
+	})
+
+	t.Run("invalid database", func(t *testing.T) {
+		p := filepath.Join(t.TempDir(), "invalid.mmdb")
+		os.WriteFile(p, []byte("n0t a database"), 0600)
+		if _, err := OpenMaxMind(p); err == nil {
+			t.Errorf("incorrect error, should not be nil")
+		}
+		if _, err := OpenMaxMind(filepath.Join(t.TempDir(), "missing.mmdb")); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("incorrect error, got %v, want %v", err, os.ErrNotExist)
+		}
+	})
+}
@@ -0,0 +1,36 @@
+package ipfilter
+
+import (
+	"net"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// MaxMind looks up countries in a local MaxMind database (GeoLite2-Country, GeoIP2-Country or GeoIP2-City)
+type MaxMind struct {
+	r *maxminddb.Reader
+}
+
+func OpenMaxMind(path string) (*MaxMind, error) {
+	r, err := maxminddb.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return &MaxMind{r}, nil
+}
+
+func (m *MaxMind) Country(ip net.IP) (string, error) {
+	var rec struct {
+		Country struct {
+			ISOCode string `maxminddb:"iso_code"`
+		} `maxminddb:"country"`
+	}
+	if err := m.r.Lookup(ip, &rec); err != nil {
+		return "", err
+	}
+	return rec.Country.ISOCode, nil
+}
+
+func (m *MaxMind) Close() error {
+	return m.r.Close()
+}
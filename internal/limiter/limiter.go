@@ -7,6 +7,35 @@ import (
 	"golang.org/x/time/rate"
 )
 
+// Limiter limits the requests per key (e.g. IP)
+type Limiter interface {
+	Allow(key string) (Result, error)
+	Cleanup(t time.Duration)
+}
+
+// Result tells if a request is allowed and how many requests remain. Limit is 0 when unlimited.
+type Result struct {
+	Allowed    bool
+	Limit      int           // requests allowed at once
+	Remaining  int           // requests still allowed now
+	Reset      time.Duration // until Limit requests are allowed again
+	RetryAfter time.Duration // until the next request is allowed, if not allowed
+}
+
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
+
+// Factory creates a Limiter allowing r requests per second with bursts of b requests
+type Factory func(r rate.Limit, b int) Limiter
+
+// NewFactory returns a Factory of in-memory RateLimiters
+func NewFactory() Factory {
+	return func(r rate.Limit, b int) Limiter {
+		return New(r, b)
+	}
+}
+
 type Access struct {
 	lat     time.Time //last access tieme
 	limiter *rate.Limiter
@@ -48,6 +77,27 @@ func (rl *RateLimiter) GetAccess(ip string) *rate.Limiter {
 	return a.limiter
 }
 
+// Allow reports whether a request of the key can happen now, consuming 1 token of its bucket
+func (rl *RateLimiter) Allow(key string) (Result, error) {
+	l := rl.GetAccess(key)
+	if rl.limit == rate.Inf {
+		return Result{Allowed: true}, nil
+	}
+	now := time.Now()
+	res := Result{Allowed: l.AllowN(now, 1), Limit: rl.burst}
+	tokens := l.TokensAt(now)
+	if tokens > 0 {
+		res.Remaining = int(tokens)
+	}
+	if rl.limit > 0 {
+		res.Reset = seconds((float64(rl.burst) - tokens) / float64(rl.limit))
+		if !res.Allowed {
+			res.RetryAfter = seconds((1 - tokens) / float64(rl.limit))
+		}
+	}
+	return res, nil
+}
+
 func (rl *RateLimiter) Cleanup(t time.Duration) {
 	rl.Lock()
 	defer rl.Unlock()
@@ -128,3 +128,42 @@ func Test(t *testing.T) {
 		t.FailNow()
 	}
 }
+
+func TestAllow(t *testing.T) {
+	limiter := New(1, 3)
+	ip := "10.10.10.10"
+	for i := 0; i < 3; i++ {
+		res, err := limiter.Allow(ip)
+		if !res.Allowed || err != nil {
+			t.Errorf("request #%d should be allowed, got %v (%v)", i, res.Allowed, err)
+			t.FailNow()
+		}
+		if res.Limit != 3 || res.Remaining != 2-i {
+			t.Errorf("incorrect result, got limit %d remaining %d, want limit %d remaining %d", res.Limit, res.Remaining, 3, 2-i)
+			t.FailNow()
+		}
+		if want := time.Duration(i+1) * time.Second; res.Reset <= want-100*time.Millisecond || res.Reset > want {
+			t.Errorf("incorrect reset, got %v, want about %v", res.Reset, want)
+			t.FailNow()
+		}
+		if res.RetryAfter != 0 {
+			t.Errorf("incorrect retry after, got %v, want 0", res.RetryAfter)
+			t.FailNow()
+		}
+	}
+	res, _ := limiter.Allow(ip)
+	if res.Allowed || res.Remaining != 0 {
+		t.Errorf("request should not be allowed, got %+v", res)
+		t.FailNow()
+	}
+	if res.RetryAfter <= 900*time.Millisecond || res.RetryAfter > time.Second {
+		t.Errorf("incorrect retry after, got %v, want about %v", res.RetryAfter, time.Second)
+		t.FailNow()
+	}
+
+	res, _ = NewUnlimited().Allow(ip)
+	if !res.Allowed || res.Limit != 0 {
+		t.Errorf("unlimited request should be allowed without limit, got %+v", res)
+		t.FailNow()
+	}
+}
@@ -0,0 +1,107 @@
+package limiter
+
+import (
+	"expvar"
+	"sync"
+	"time"
+)
+
+// lockout metrics, published with expvar
+var (
+	lockoutFailures = expvar.NewInt("lockout_failures")
+	lockoutLocks    = expvar.NewInt("lockout_locks")
+	lockoutRejects  = expvar.NewInt("lockout_rejects")
+)
+
+type failure struct {
+	count int
+	until time.Time // locked until
+	lat   time.Time // last failure time
+}
+
+// Lockout tracks authentication failures per key (IP, credential...) and locks a key out
+// after max failures, for a backoff doubling on every new failure
+type Lockout struct {
+	max        int
+	backoff    time.Duration
+	maxBackoff time.Duration
+	failures   map[string]*failure
+	now        func() time.Time
+	sync.Mutex
+}
+
+func NewLockout(max int, backoff, maxBackoff time.Duration) *Lockout {
+	return &Lockout{
+		max:        max,
+		backoff:    backoff,
+		maxBackoff: maxBackoff,
+		failures:   make(map[string]*failure),
+		now:        time.Now,
+	}
+}
+
+// Locked returns the remaining lockout duration of the key, 0 if the key is not locked out
+func (l *Lockout) Locked(key string) time.Duration {
+	l.Lock()
+	defer l.Unlock()
+
+	f, ok := l.failures[key]
+	if !ok {
+		return 0
+	}
+	if d := f.until.Sub(l.now()); d > 0 {
+		lockoutRejects.Add(1)
+		return d
+	}
+	return 0
+}
+
+// Fail records a failure of the key and returns the lockout duration, 0 if the key is not locked out yet
+func (l *Lockout) Fail(key string) time.Duration {
+	l.Lock()
+	defer l.Unlock()
+
+	lockoutFailures.Add(1)
+	now := l.now()
+	f, ok := l.failures[key]
+	if !ok {
+		f = &failure{}
+		l.failures[key] = f
+	}
+	f.count++
+	f.lat = now
+	if f.count < l.max {
+		return 0
+	}
+	d := l.backoff
+	for i := l.max; i < f.count && d < l.maxBackoff; i++ {
+		d *= 2
+	}
+	if d > l.maxBackoff {
+		d = l.maxBackoff
+	}
+	f.until = now.Add(d)
+	lockoutLocks.Add(1)
+	return d
+}
+
+// Reset forgets the failures of the key
+func (l *Lockout) Reset(key string) {
+	l.Lock()
+	defer l.Unlock()
+
+	delete(l.failures, key)
+}
+
+// Cleanup forgets the keys neither locked out nor failing since t
+func (l *Lockout) Cleanup(t time.Duration) {
+	l.Lock()
+	defer l.Unlock()
+
+	now := l.now()
+	for k, f := range l.failures {
+		if now.Sub(f.lat) > t && now.After(f.until) {
+			delete(l.failures, k)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package limiter
+
+import (
+	"testing"
+	"time"
+)
+
+func newTestLockout(now *time.Time) *Lockout {
+	l := NewLockout(3, time.Minute, 10*time.Minute)
+	l.now = func() time.Time { return *now }
+	return l
+}
+
+func TestLockout(t *testing.T) {
+	now := time.Now()
+	l := newTestLockout(&now)
+	ip := "10.10.10.10"
+
+	for i := 1; i < 3; i++ {
+		if d := l.Fail(ip); d != 0 {
+			t.Errorf("incorrect lockout after %d failures, got %v, want 0", i, d)
+			t.FailNow()
+		}
+		if d := l.Locked(ip); d != 0 {
+			t.Errorf("%s should not be locked out after %d failures", ip, i)
+			t.FailNow()
+		}
+	}
+
+	for _, want := range []time.Duration{time.Minute, 2 * time.Minute, 4 * time.Minute, 8 * time.Minute, 10 * time.Minute, 10 * time.Minute} {
+		if d := l.Fail(ip); d != want {
+			t.Errorf("incorrect lockout, got %v, want %v", d, want)
+			t.FailNow()
+		}
+		if d := l.Locked(ip); d != want {
+			t.Errorf("incorrect remaining lockout, got %v, want %v", d, want)
+			t.FailNow()
+		}
+	}
+	if d := l.Locked("10.10.10.11"); d != 0 {
+		t.Errorf("other keys cannot be locked out, got %v", d)
+		t.FailNow()
+	}
+
+	now = now.Add(4 * time.Minute)
+	if d := l.Locked(ip); d != 6*time.Minute {
+		t.Errorf("incorrect remaining lockout, got %v, want %v", d, 6*time.Minute)
+		t.FailNow()
+	}
+	now = now.Add(6 * time.Minute)
+	if d := l.Locked(ip); d != 0 {
+		t.Errorf("%s should not be locked out anymore, got %v", ip, d)
+		t.FailNow()
+	}
+
+	l.Reset(ip)
+	if d := l.Fail(ip); d != 0 {
+		t.Errorf("failures should be reset, got %v", d)
+		t.FailNow()
+	}
+}
+
+func TestLockoutCleanup(t *testing.T) {
+	now := time.Now()
+	l := newTestLockout(&now)
+	for i := 0; i < 3; i++ {
+		l.Fail("locked")
+	}
+	l.Fail("failed")
+
+	now = now.Add(30 * time.Second)
+	l.Cleanup(10 * time.Second)
+	if _, ok := l.failures["locked"]; !ok {
+		t.Errorf("locked out keys cannot be purged")
+		t.FailNow()
+	}
+	if _, ok := l.failures["failed"]; ok {
+		t.Errorf("failures older than 10s should be purged")
+		t.FailNow()
+	}
+
+	now = now.Add(time.Minute)
+	l.Cleanup(10 * time.Second)
+	if len(l.failures) != 0 {
+		t.Errorf("failures map should be empty, got %d keys", len(l.failures))
+		t.FailNow()
+	}
+}
+
+func TestLockoutMetrics(t *testing.T) {
+	now := time.Now()
+	l := newTestLockout(&now)
+	f, k, r := lockoutFailures.Value(), lockoutLocks.Value(), lockoutRejects.Value()
+	for i := 0; i < 4; i++ {
+		l.Fail("10.10.10.10")
+	}
+	l.Locked("10.10.10.10")
+	if v := lockoutFailures.Value() - f; v != 4 {
+		t.Errorf("incorrect failures metric, got %d, want %d", v, 4)
+	}
+	if v := lockoutLocks.Value() - k; v != 2 {
+		t.Errorf("incorrect lockouts metric, got %d, want %d", v, 2)
+	}
+	if v := lockoutRejects.Value() - r; v != 1 {
+		t.Errorf("incorrect rejects metric, got %d, want %d", v, 1)
+	}
+}
@@ -0,0 +1,329 @@
+package limiter
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+var (
+	ErrInvalidRedisURL   = errors.New("invalid redis url")
+	ErrInvalidRedisReply = errors.New("invalid redis reply")
+)
+
+// redisError is an error reply sent by the server
+type redisError string
+
+func (e redisError) Error() string {
+	return "redis: " + string(e)
+}
+
+// redisClient is a minimal client speaking the Redis protocol (RESP) over a single connection.
+// Commands are pipelined and the connection is reopened after any network error.
+type redisClient struct {
+	addr     string
+	password string
+	db       int
+	tls      bool
+	timeout  time.Duration
+	conn     net.Conn
+	r        *bufio.Reader
+	sync.Mutex
+}
+
+// newRedisClient parses a redis://[:password@]host:port[/db] url, rediss:// enables TLS
+func newRedisClient(u string) (*redisClient, error) {
+	p, err := url.Parse(u)
+	if err != nil {
+		return nil, ErrInvalidRedisURL
+	}
+	c := &redisClient{addr: p.Host, timeout: 2 * time.Second}
+	switch p.Scheme {
+	case "redis":
+	case "rediss":
+		c.tls = true
+	default:
+		return nil, ErrInvalidRedisURL
+	}
+	if p.Port() == "" {
+		return nil, ErrInvalidRedisURL
+	}
+	if pwd, ok := p.User.Password(); ok {
+		c.password = pwd
+	}
+	if db := strings.TrimPrefix(p.Path, "/"); db != "" {
+		if c.db, err = strconv.Atoi(db); err != nil {
+			return nil, ErrInvalidRedisURL
+		}
+	}
+	return c, nil
+}
+
+func (c *redisClient) connect() error {
+	d := &net.Dialer{Timeout: c.timeout}
+	var err error
+	if c.tls {
+		c.conn, err = tls.DialWithDialer(d, "tcp", c.addr, &tls.Config{ServerName: strings.Split(c.addr, ":")[0]})
+	} else {
+		c.conn, err = d.Dial("tcp", c.addr)
+	}
+	if err != nil {
+		return err
+	}
+	c.r = bufio.NewReader(c.conn)
+
+	var init [][]string
+	if c.password != "" {
+		init = append(init, []string{"AUTH", c.password})
+	}
+	if c.db != 0 {
+		init = append(init, []string{"SELECT", strconv.Itoa(c.db)})
+	}
+	if len(init) > 0 {
+		if _, err := c.pipeline(init); err != nil {
+			c.close()
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *redisClient) close() {
+	if c.conn != nil {
+		c.conn.Close()
+		c.conn = nil
+	}
+}
+
+// do sends the commands in a single round trip and returns their replies
+func (c *redisClient) do(cmds ...[]string) ([]interface{}, error) {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.conn == nil {
+		if err := c.connect(); err != nil {
+			return nil, err
+		}
+	}
+	rs, err := c.pipeline(cmds)
+	if err != nil {
+		var re redisError
+		if !errors.As(err, &re) { // the connection cannot be trusted anymore
+			c.close()
+		}
+		return nil, err
+	}
+	return rs, nil
+}
+
+func (c *redisClient) pipeline(cmds [][]string) ([]interface{}, error) {
+	c.conn.SetDeadline(time.Now().Add(c.timeout))
+	var b strings.Builder
+	for _, cmd := range cmds {
+		fmt.Fprintf(&b, "*%d\r\n", len(cmd))
+		for _, a := range cmd {
+			fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(a), a)
+		}
+	}
+	if _, err := io.WriteString(c.conn, b.String()); err != nil {
+		return nil, err
+	}
+	rs := make([]interface{}, len(cmds))
+	var rerr error
+	for i := range cmds {
+		r, err := readReply(c.r)
+		var re redisError
+		switch {
+		case errors.As(err, &re): // keep reading the other replies
+			if rerr == nil {
+				rerr = err
+			}
+		case err != nil:
+			return nil, err
+		}
+		rs[i] = r
+	}
+	return rs, rerr
+}
+
+// readReply reads a RESP reply: string, int64, nil, []interface{} or redisError
+func readReply(r *bufio.Reader) (interface{}, error) {
+	l, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(l) < 3 || l[len(l)-2] != '\r' {
+		return nil, ErrInvalidRedisReply
+	}
+	t, v := l[0], l[1:len(l)-2]
+	switch t {
+	case '+':
+		return v, nil
+	case '-':
+		return nil, redisError(v)
+	case ':':
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return nil, ErrInvalidRedisReply
+		}
+		return n, nil
+	case '$':
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, ErrInvalidRedisReply
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		b := make([]byte, n+2)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+		return string(b[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, ErrInvalidRedisReply
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		a := make([]interface{}, n)
+		for i := range a {
+			if a[i], err = readReply(r); err != nil {
+				return nil, err
+			}
+		}
+		return a, nil
+	}
+	return nil, ErrInvalidRedisReply
+}
+
+// RedisLimiter is a sliding window limiter sharing its counters in Redis, so the limit holds across processes.
+// The requests of the previous window are weighted by the part of it still covered by the sliding window.
+type RedisLimiter struct {
+	client *redisClient
+	limit  int
+	window time.Duration
+	prefix string
+	now    func() time.Time
+}
+
+// NewRedisLimiter allows limit requests per key in any window, using the redis server at url
+func NewRedisLimiter(url string, limit int, window time.Duration) (*RedisLimiter, error) {
+	c, err := newRedisClient(url)
+	if err != nil {
+		return nil, err
+	}
+	return &RedisLimiter{
+		client: c,
+		limit:  limit,
+		window: window,
+		prefix: "ratelimit:",
+		now:    time.Now,
+	}, nil
+}
+
+// WithLimit returns a RedisLimiter sharing the connection of rl, with another limit and window
+func (rl *RedisLimiter) WithLimit(limit int, window time.Duration) *RedisLimiter {
+	return &RedisLimiter{
+		client: rl.client,
+		limit:  limit,
+		window: window,
+		prefix: fmt.Sprintf("ratelimit:%d:%s:", limit, window),
+		now:    rl.now,
+	}
+}
+
+// Factory returns a Factory of RedisLimiters sharing the connection of rl.
+// A rate r with bursts of b becomes a limit of b requests per window of b/r.
+func (rl *RedisLimiter) Factory() Factory {
+	return func(r rate.Limit, b int) Limiter {
+		if r == rate.Inf {
+			return NewUnlimited()
+		}
+		return rl.WithLimit(b, time.Duration(float64(b)/float64(r)*float64(time.Second)))
+	}
+}
+
+func (rl *RedisLimiter) Allow(key string) (Result, error) {
+	now := rl.now()
+	w := now.UnixNano() / int64(rl.window)
+	elapsed := float64(now.UnixNano()%int64(rl.window)) / float64(rl.window)
+	cur := fmt.Sprintf("%s%s:%d", rl.prefix, key, w)
+	prev := fmt.Sprintf("%s%s:%d", rl.prefix, key, w-1)
+
+	rs, err := rl.client.do(
+		[]string{"INCR", cur},
+		[]string{"PEXPIRE", cur, strconv.FormatInt(2*rl.window.Milliseconds(), 10)},
+		[]string{"GET", prev},
+	)
+	if err != nil {
+		return Result{}, err
+	}
+	n, ok := rs[0].(int64)
+	if !ok {
+		return Result{}, ErrInvalidRedisReply
+	}
+	var p int64
+	if s, ok := rs[2].(string); ok {
+		if p, err = strconv.ParseInt(s, 10, 64); err != nil {
+			return Result{}, ErrInvalidRedisReply
+		}
+	}
+	count := float64(n) + float64(p)*(1-elapsed)
+	res := Result{
+		Allowed: count <= float64(rl.limit),
+		Limit:   rl.limit,
+		Reset:   time.Duration((1 - elapsed) * float64(rl.window)), // end of the current window
+	}
+	if r := float64(rl.limit) - count; r > 0 {
+		res.Remaining = int(r)
+	}
+	if !res.Allowed {
+		res.RetryAfter = res.Reset
+	}
+	return res, nil
+}
+
+// Cleanup does nothing: counters expire in Redis
+func (rl *RedisLimiter) Cleanup(t time.Duration) {}
+
+// RedisSet records keys until they expire, in the Redis server of a RedisLimiter
+type RedisSet struct {
+	client *redisClient
+	prefix string
+	now    func() time.Time
+}
+
+// Set returns a RedisSet sharing the connection of rl, its keys are prefixed with prefix
+func (rl *RedisLimiter) Set(prefix string) *RedisSet {
+	return &RedisSet{
+		client: rl.client,
+		prefix: prefix,
+		now:    rl.now,
+	}
+}
+
+// Add records the key until exp, it returns false if the key is already recorded
+func (s *RedisSet) Add(key string, exp time.Time) (bool, error) {
+	ttl := exp.Sub(s.now()).Milliseconds()
+	if ttl < 1 {
+		ttl = 1
+	}
+	rs, err := s.client.do([]string{"SET", s.prefix + key, "1", "NX", "PX", strconv.FormatInt(ttl, 10)})
+	if err != nil {
+		return false, err
+	}
+	return rs[0] != nil, nil // nil when the key exists
+}
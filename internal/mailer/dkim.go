@@ -0,0 +1,176 @@
+package mailer
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+var (
+	ErrDKIMKey    = errors.New("unsupported DKIM private key, want PEM encoded RSA (2048 bits or more) or Ed25519")
+	ErrDKIMConfig = errors.New("DKIM domain and selector are required")
+)
+
+// dkimHeaders are the headers signed when present, From is mandatory
+var dkimHeaders = []string{"From", "Reply-To", "To", "Subject", "Date", "Message-ID", "List-Unsubscribe", "MIME-Version", "Content-Type"}
+
+// DKIM signs messages (RFC 6376) with relaxed/relaxed canonicalization, using an RSA (rsa-sha256) or Ed25519 (ed25519-sha256, RFC 8463) key
+type DKIM struct {
+	domain    string
+	selector  string
+	key       crypto.Signer
+	algorithm string
+}
+
+// NewDKIM parses the PEM private key (PKCS#8, or PKCS#1 for RSA) published under <selector>._domainkey.<domain>
+func NewDKIM(domain, selector string, key []byte) (*DKIM, error) {
+	if domain == "" || selector == "" {
+		return nil, ErrDKIMConfig
+	}
+	b, _ := pem.Decode(key)
+	if b == nil {
+		return nil, ErrDKIMKey
+	}
+	var pk any
+	pk, err := x509.ParsePKCS8PrivateKey(b.Bytes)
+	if err != nil {
+		if pk, err = x509.ParsePKCS1PrivateKey(b.Bytes); err != nil {
+			return nil, ErrDKIMKey
+		}
+	}
+	d := &DKIM{domain: domain, selector: selector}
+	switch k := pk.(type) {
+	case *rsa.PrivateKey:
+		if k.N.BitLen() < 2048 {
+			return nil, ErrDKIMKey
+		}
+		d.key, d.algorithm = k, "rsa-sha256"
+	case ed25519.PrivateKey:
+		d.key, d.algorithm = k, "ed25519-sha256"
+	default:
+		return nil, ErrDKIMKey
+	}
+	return d, nil
+}
+
+// DNSRecord returns the TXT record to publish under <selector>._domainkey.<domain>
+func (d *DKIM) DNSRecord() string {
+	var p []byte
+	k := "rsa"
+	switch pub := d.key.Public().(type) {
+	case *rsa.PublicKey:
+		p, _ = x509.MarshalPKIXPublicKey(pub)
+	case ed25519.PublicKey:
+		k, p = "ed25519", pub // raw key, RFC 8463
+	}
+	return fmt.Sprintf("v=DKIM1; k=%s; p=%s", k, base64.StdEncoding.EncodeToString(p))
+}
+
+// Name returns the DNS name of the public key
+func (d *DKIM) Name() string {
+	return d.selector + "._domainkey." + d.domain
+}
+
+// Sign returns the DKIM-Signature header of the raw message, signed at t
+func (d *DKIM) Sign(raw []byte, t time.Time) (string, error) {
+	hs, body, _ := bytes.Cut(raw, []byte("\r\n\r\n"))
+	headers := parseHeaders(string(hs))
+
+	bh := sha256.Sum256(canonicalBody(body))
+	var names []string
+	var data strings.Builder
+	for _, n := range dkimHeaders {
+		if v, ok := headers[strings.ToLower(n)]; ok {
+			names = append(names, n)
+			data.WriteString(canonicalHeader(n, v) + "\r\n")
+		}
+	}
+	sig := fmt.Sprintf("v=1; a=%s; c=relaxed/relaxed; d=%s; s=%s; t=%d;\r\n\th=%s;\r\n\tbh=%s;\r\n\tb=",
+		d.algorithm, d.domain, d.selector, t.Unix(), strings.Join(names, ":"), base64.StdEncoding.EncodeToString(bh[:]))
+	data.WriteString(canonicalHeader("DKIM-Signature", sig)) // without the trailing CRLF
+
+	h := sha256.Sum256([]byte(data.String()))
+	var b []byte
+	var err error
+	switch k := d.key.(type) {
+	case ed25519.PrivateKey:
+		b = ed25519.Sign(k, h[:]) // PureEdDSA of the SHA-256 hash
+	default:
+		b, err = d.key.Sign(rand.Reader, h[:], crypto.SHA256)
+	}
+	if err != nil {
+		return "", err
+	}
+	return "DKIM-Signature: " + sig + base64.StdEncoding.EncodeToString(b) + "\r\n", nil
+}
+
+// parseHeaders returns the unfolded values of the headers, by lowercase name
+func parseHeaders(s string) map[string]string {
+	headers := map[string]string{}
+	var last string
+	for _, l := range strings.Split(s, "\r\n") {
+		if l != "" && (l[0] == ' ' || l[0] == '\t') { // folded
+			headers[last] += "\r\n" + l
+			continue
+		}
+		n, v, ok := strings.Cut(l, ":")
+		if !ok {
+			continue
+		}
+		last = strings.ToLower(strings.TrimSpace(n))
+		headers[last] = v
+	}
+	return headers
+}
+
+// collapse replaces the runs of whitespaces with a single space
+func collapse(s string) string {
+	var b strings.Builder
+	ws := false
+	for _, r := range s {
+		if r == ' ' || r == '\t' {
+			ws = true
+			continue
+		}
+		if ws {
+			b.WriteByte(' ')
+			ws = false
+		}
+		b.WriteRune(r)
+	}
+	if ws {
+		b.WriteByte(' ')
+	}
+	return b.String()
+}
+
+// canonicalHeader is the relaxed header canonicalization
+func canonicalHeader(n, v string) string {
+	v = strings.ReplaceAll(v, "\r\n", "")
+	return strings.ToLower(strings.TrimSpace(n)) + ":" + strings.TrimSpace(collapse(v))
+}
+
+// canonicalBody is the relaxed body canonicalization
+func canonicalBody(body []byte) []byte {
+	lines := strings.Split(string(body), "\r\n")
+	for i, l := range lines {
+		lines[i] = strings.TrimRight(collapse(l), " ")
+	}
+	for len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	if len(lines) == 0 {
+		return nil
+	}
+	return []byte(strings.Join(lines, "\r\n") + "\r\n")
+}
@@ -0,0 +1,213 @@
+package mailer
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"net/mail"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// dkimTags parses the tag list of a DKIM-Signature or a DNS record
+func dkimTags(s string) map[string]string {
+	tags := map[string]string{}
+	for _, t := range strings.Split(s, ";") {
+		k, v, ok := strings.Cut(t, "=")
+		if !ok {
+			continue
+		}
+		tags[strings.TrimSpace(k)] = strings.Join(strings.Fields(v), "")
+	}
+	return tags
+}
+
+// publicKey reads the public key of the DNS record
+func publicKey(t *testing.T, record string) crypto.PublicKey {
+	tags := dkimTags(record)
+	p, err := base64.StdEncoding.DecodeString(tags["p"])
+	if err != nil {
+		t.Fatalf("cannot decode public key: %v", err)
+	}
+	if tags["k"] == "ed25519" {
+		return ed25519.PublicKey(p)
+	}
+	pub, err := x509.ParsePKIXPublicKey(p)
+	if err != nil {
+		t.Fatalf("cannot parse public key: %v", err)
+	}
+	return pub
+}
+
+var bTag = regexp.MustCompile(`;\s*b=`)
+
+// verify checks the DKIM signature of the raw message against the public key
+func verify(raw []byte, pub crypto.PublicKey) error {
+	hs, body, _ := bytes.Cut(raw, []byte("\r\n\r\n"))
+	headers := parseHeaders(string(hs))
+	sig, ok := headers["dkim-signature"]
+	if !ok {
+		return errors.New("missing signature")
+	}
+	tags := dkimTags(sig)
+	if tags["c"] != "relaxed/relaxed" || tags["v"] != "1" {
+		return errors.New("unexpected tags")
+	}
+
+	bh := sha256.Sum256(canonicalBody(body))
+	if base64.StdEncoding.EncodeToString(bh[:]) != tags["bh"] {
+		return errors.New("body hash mismatch")
+	}
+	var data strings.Builder
+	for _, n := range strings.Split(tags["h"], ":") {
+		data.WriteString(canonicalHeader(n, headers[strings.ToLower(n)]) + "\r\n")
+	}
+	i := bTag.FindStringIndex(sig) // the signature is hashed with an empty b= tag
+	data.WriteString(canonicalHeader("DKIM-Signature", sig[:i[1]]))
+	h := sha256.Sum256([]byte(data.String()))
+
+	b, err := base64.StdEncoding.DecodeString(tags["b"])
+	if err != nil {
+		return err
+	}
+	switch k := pub.(type) {
+	case *rsa.PublicKey:
+		if tags["a"] != "rsa-sha256" {
+			return errors.New("unexpected algorithm")
+		}
+		return rsa.VerifyPKCS1v15(k, crypto.SHA256, h[:], b)
+	case ed25519.PublicKey:
+		if tags["a"] != "ed25519-sha256" || !ed25519.Verify(k, h[:], b) {
+			return errors.New("invalid signature")
+		}
+	}
+	return nil
+}
+
+func newKeys(t *testing.T) map[string][]byte {
+	rk, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("cannot generate RSA key: %v", err)
+	}
+	_, ek, _ := ed25519.GenerateKey(rand.Reader)
+	pk, _ := x509.MarshalPKCS8PrivateKey(ek)
+	return map[string][]byte{
+		"rsa":     pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rk)}),
+		"ed25519": pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: pk}),
+	}
+}
+
+func TestDKIM(t *testing.T) {
+	for n, k := range newKeys(t) {
+		t.Run(n, func(t *testing.T) {
+			d, err := NewDKIM("fairhive-labs.com", "poln", k)
+			if err != nil {
+				t.Errorf("cannot create DKIM signer: %v", err)
+				t.FailNow()
+			}
+			if d.Name() != "poln._domainkey.fairhive-labs.com" || !strings.HasPrefix(d.DNSRecord(), "v=DKIM1; k="+n+"; p=") {
+				t.Errorf("incorrect DNS record, got %s %q", d.Name(), d.DNSRecord())
+				t.FailNow()
+			}
+			pub := publicKey(t, d.DNSRecord())
+
+			msg := *message
+			if err := msg.Sign(d); err != nil {
+				t.Errorf("cannot sign message: %v", err)
+				t.FailNow()
+			}
+			b := messageBytes(t, &msg)
+			if !bytes.HasPrefix(b, []byte("DKIM-Signature: v=1; a=")) || !bytes.HasSuffix(b, messageBytes(t, message)) {
+				t.Errorf("signature should be prepended, got:\n%s", b)
+				t.FailNow()
+			}
+			if err := verify(b, pub); err != nil {
+				t.Errorf("incorrect signature: %v", err)
+				t.FailNow()
+			}
+			if _, err := mail.ReadMessage(bytes.NewReader(b)); err != nil {
+				t.Errorf("signed message cannot be parsed: %v", err)
+			}
+
+			// relaxed canonicalization tolerates whitespace changes
+			relayed := bytes.Replace(b, []byte("Subject: "), []byte("Subject:   "), 1)
+			relayed = bytes.Replace(relayed, []byte("Hi there"), []byte("Hi  there \t"), 1)
+			if err := verify(relayed, pub); err != nil {
+				t.Errorf("relaxed canonicalization should accept whitespace changes: %v", err)
+			}
+			for name, tampered := range map[string][]byte{
+				"body":    bytes.Replace(b, []byte("Hi there"), []byte("Hi thief"), 1),
+				"subject": bytes.Replace(b, []byte("preregistration"), []byte("registration"), 1),
+				"to":      bytes.Replace(b, []byte("To: john.doe"), []byte("To: jane.doe"), 1),
+			} {
+				if err := verify(tampered, pub); err == nil {
+					t.Errorf("tampered %s should not be verified", name)
+				}
+			}
+		})
+	}
+}
+
+func TestTemplateMailerDKIM(t *testing.T) {
+	d, err := NewDKIM("poln.org", "mail", newKeys(t)["ed25519"])
+	if err != nil {
+		t.Fatalf("cannot create DKIM signer: %v", err)
+	}
+	tr := &recorder{}
+	m := NewTemplateMailer(tr, &mail.Address{Name: "poln", Address: "hello@poln.org"})
+	m.DKIM = d
+	if err := m.SendActivationEmail(email, "http://poln.org/activate/"+token, hash, "en"); err != nil {
+		t.Fatalf("cannot send email: %v", err)
+	}
+	if err := verify(messageBytes(t, tr.messages[0]), publicKey(t, d.DNSRecord())); err != nil {
+		t.Errorf("incorrect signature: %v", err)
+	}
+}
+
+func TestNewDKIM(t *testing.T) {
+	weak, _ := rsa.GenerateKey(rand.Reader, 1024)
+	wk, _ := x509.MarshalPKCS8PrivateKey(weak)
+	tt := []struct {
+		name             string
+		domain, selector string
+		key              []byte
+		err              error
+	}{
+		{"no domain", "", "poln", newKeys(t)["rsa"], ErrDKIMConfig},
+		{"no selector", "poln.org", "", newKeys(t)["rsa"], ErrDKIMConfig},
+		{"not pem", "poln.org", "poln", []byte("s3cr3t"), ErrDKIMKey},
+		{"not a key", "poln.org", "poln", pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: []byte("s3cr3t")}), ErrDKIMKey},
+		{"weak rsa", "poln.org", "poln", pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: wk}), ErrDKIMKey},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := NewDKIM(tc.domain, tc.selector, tc.key); err != tc.err {
+				t.Errorf("incorrect error, got %v, want %v", err, tc.err)
+			}
+		})
+	}
+}
+
+func TestCanonicalization(t *testing.T) {
+	if h := canonicalHeader("Subject ", " poln  -\r\n\t preregistration \t"); h != "subject:poln - preregistration" {
+		t.Errorf("incorrect header canonicalization, got %q", h)
+	}
+	for body, want := range map[string]string{
+		"":                              "",
+		"\r\n\r\n":                      "",
+		"Hi  there \r\n\r\nbye\r\n\r\n": "Hi there\r\n\r\nbye\r\n",
+		"no newline":                    "no newline\r\n",
+	} {
+		if got := string(canonicalBody([]byte(body))); got != want {
+			t.Errorf("incorrect body canonicalization of %q, got %q, want %q", body, got, want)
+		}
+	}
+}
@@ -3,68 +3,155 @@ package mailer
 import (
 	"bytes"
 	"embed"
+	"encoding/json"
 	"fmt"
-	"html/template"
-	"net/smtp"
+	htmltemplate "html/template"
+	"io/fs"
+	"net/mail"
+	"path"
+	"sort"
+	texttemplate "text/template"
 	"time"
-)
 
-const (
-	headers = "MIME-Version: 1.0\nContent-Type: text/html; charset=\"UTF-8\";\n\n"
+	"github.com/fairhive-labs/preregister/internal/i18n"
 )
 
+// Mailer sends the emails in the locale l, or in i18n.Default if l is not supported
 type Mailer interface {
-	SendActivationEmail(e, u, h string) error
-	SendConfirmationEmail(e string) error
+	SendActivationEmail(e, u, h, l string) error
+	SendConfirmationEmail(e, l string) error
+	SendReminderEmail(e, u, h, l string) error
 }
 
-type smtpConfig struct {
-	from     string
-	password string
-	host     string
-	port     int
-	server   string
+// templates are the templates and the message catalog (subjects by template name) of a locale
+type templates struct {
+	html     *htmltemplate.Template
+	text     *texttemplate.Template
+	messages map[string]string
 }
 
-type SmtpMailer struct {
-	*smtpConfig
-	t *template.Template
+// TemplateMailer renders the email templates, HTML and plaintext, and delivers them with its Transport
+type TemplateMailer struct {
+	tr              Transport
+	from            *mail.Address
+	ReplyTo         *mail.Address // optional
+	ListUnsubscribe []string      // mailto: or https: URIs, optional
+	DKIM            *DKIM         // optional
+	locales         map[string]*templates
+	now             func() time.Time
 }
 
-//go:embed templates/*.html
+//go:embed templates
 var tfs embed.FS
 
-func New(from, password, host string, port int) *SmtpMailer {
-	t := template.Must(template.ParseFS(tfs, "templates/*"))
-	return &SmtpMailer{&smtpConfig{
-		from:     from,
-		password: password,
-		host:     host,
-		port:     port,
-		server:   fmt.Sprintf("%s:%d", host, port),
-	}, t}
-}
-
-func sendEmail(m *SmtpMailer, e, s, n string, data any) (err error) {
-	to := []string{e}
-	auth := smtp.PlainAuth("", m.from, m.password, m.host)
-
-	var body bytes.Buffer
-	body.Write([]byte(fmt.Sprintf(`From: %s
-To: %s
-Subject: %s
-%s
-`, "no_reply@fairhive-labs.com",
-		e,
-		s,
-		headers)))
-
-	m.t.ExecuteTemplate(&body, n, data)
+// parseTemplates parses the templates of each locale folder, they all must define the same templates
+func parseTemplates() map[string]*templates {
+	ds, err := fs.ReadDir(tfs, "templates")
+	if err != nil {
+		panic(err)
+	}
+	ls := map[string]*templates{}
+	for _, d := range ds {
+		dir := path.Join("templates", d.Name())
+		b, err := fs.ReadFile(tfs, path.Join(dir, "messages.json"))
+		if err != nil {
+			panic(err)
+		}
+		t := &templates{
+			html: htmltemplate.Must(htmltemplate.ParseFS(tfs, path.Join(dir, "*.html"))),
+			text: texttemplate.Must(texttemplate.ParseFS(tfs, path.Join(dir, "*.txt"))),
+		}
+		if err := json.Unmarshal(b, &t.messages); err != nil {
+			panic(fmt.Sprintf("invalid message catalog %q: %v", d.Name(), err))
+		}
+		ls[d.Name()] = t
+	}
+	if ls[i18n.Default] == nil {
+		panic(fmt.Sprintf("no templates for the default locale %q", i18n.Default))
+	}
+	return ls
+}
+
+var locales = parseTemplates()
+
+// Locales returns the locales of the templates, they are the locales supported by the app
+func Locales() []string {
+	ls := make([]string, 0, len(locales))
+	for l := range locales {
+		ls = append(ls, l)
+	}
+	sort.Strings(ls)
+	return ls
+}
+
+// DefaultFrom is the sender of the emails
+const DefaultFrom = "no_reply@fairhive-labs.com"
+
+func NewTemplateMailer(tr Transport, from *mail.Address) *TemplateMailer {
+	return &TemplateMailer{
+		tr:      tr,
+		from:    from,
+		locales: locales,
+		now:     time.Now,
+	}
+}
+
+// New returns a TemplateMailer sending emails with an SMTP server, from the authenticated user
+func New(from, password, host string, port int) *TemplateMailer {
+	return NewTemplateMailer(NewSMTPTransport(from, password, host, port), &mail.Address{Address: from})
+}
+
+// render returns the message of the template n in the locale l, and its plaintext alternative "<n>Text".
+// The subject is the message n of the catalog.
+func (m *TemplateMailer) render(e, l, n string, data any) (*Message, error) {
+	t, ok := m.locales[l]
+	if !ok {
+		t = m.locales[i18n.Default]
+	}
+	var html, text bytes.Buffer
+	if err := t.html.ExecuteTemplate(&html, n, data); err != nil {
+		return nil, err
+	}
+	if err := t.text.ExecuteTemplate(&text, n+"Text", data); err != nil {
+		return nil, err
+	}
+	id, err := NewMessageID(m.from)
+	if err != nil {
+		return nil, err
+	}
+	return &Message{
+		From:            m.from,
+		ReplyTo:         m.ReplyTo,
+		To:              e,
+		Subject:         t.messages[n],
+		Text:            text.String(),
+		HTML:            html.String(),
+		Date:            m.now(),
+		MessageID:       id,
+		ListUnsubscribe: m.ListUnsubscribe,
+	}, nil
+}
+
+func sendEmail(m *TemplateMailer, e, l, n string, data any) (err error) {
+	msg, err := m.render(e, l, n, data)
+	if err != nil {
+		return err
+	}
+	return m.deliver(msg)
+}
+
+// deliver signs the message, if DKIM is set, and sends it with the transport
+func (m *TemplateMailer) deliver(msg *Message) (err error) {
+	if m.DKIM != nil {
+		if err := msg.Sign(m.DKIM); err != nil {
+			return err
+		}
+	}
 
 	fmt.Println("Sending email...")
 	r := 3
 	for i := 0; i < r; i++ {
-		err = smtp.SendMail(m.server, auth, m.from, to, body.Bytes())
+		err = m.tr.Send(msg)
 		if nil == err {
 			break
 		}
@@ -74,21 +161,26 @@ Subject: %s
 	return
 }
 
-func (m *SmtpMailer) SendActivationEmail(e, u, h string) (err error) {
-	err = sendEmail(m, e, "poln - preregistration", "emailActivation",
-		struct {
-			Hash string
-			Url  string
-		}{
-			Hash: h,
-			Url:  u,
-		})
+type activationData struct {
+	Hash string
+	Url  string
+}
+
+func (m *TemplateMailer) SendActivationEmail(e, u, h, l string) (err error) {
+	err = sendEmail(m, e, l, "emailActivation", activationData{Hash: h, Url: u})
 	logEmailSent(e, fmt.Sprintf("💌 Email to %q: [ \033[1;32mSent\033[0m ]\n🧬 Hash: %s\n", e, h), err)
 	return
 }
 
-func (m *SmtpMailer) SendConfirmationEmail(e string) (err error) {
-	err = sendEmail(m, e, "poln - preregistration completed", "emailConfirmation",
+// SendReminderEmail sends a new activation link to a registration which has not been activated
+func (m *TemplateMailer) SendReminderEmail(e, u, h, l string) (err error) {
+	err = sendEmail(m, e, l, "emailReminder", activationData{Hash: h, Url: u})
+	logEmailSent(e, fmt.Sprintf("💌 Reminder to %q: [ \033[1;32mSent\033[0m ]\n🧬 Hash: %s\n", e, h), err)
+	return
+}
+
+func (m *TemplateMailer) SendConfirmationEmail(e, l string) (err error) {
+	err = sendEmail(m, e, l, "emailConfirmation",
 		struct{}{})
 	logEmailSent(e, fmt.Sprintf("💌 Email to %q: [ \033[1;32mSent\033[0m ]\n", e), err)
 	return
@@ -105,16 +197,22 @@ func logEmailSent(e, m string, err error) {
 // MOCK
 type mockSmtpMailer struct{}
 
-func (m *mockSmtpMailer) SendActivationEmail(e, u, h string) (err error) {
+func (m *mockSmtpMailer) SendActivationEmail(e, u, h, l string) (err error) {
 	// do nothing just log
 	logEmailSent(e, "📧 Activation Email Sent !!!", err)
 	return
 }
 
-func (m *mockSmtpMailer) SendConfirmationEmail(e string) (err error) {
+func (m *mockSmtpMailer) SendConfirmationEmail(e, l string) (err error) {
 	// do nothing just log
 	logEmailSent(e, "📧 Confirmation Email Sent !!!", err)
 	return
 }
 
+func (m *mockSmtpMailer) SendReminderEmail(e, u, h, l string) (err error) {
+	// do nothing just log
+	logEmailSent(e, "📧 Reminder Email Sent !!!", err)
+	return
+}
+
 var MockSmtpMailer = mockSmtpMailer{}
@@ -2,8 +2,11 @@ package mailer
 
 import (
 	"fmt"
+	"net/mail"
 	"os"
 	"testing"
+
+	"github.com/fairhive-labs/preregister/internal/i18n"
 )
 
 const (
@@ -22,19 +25,44 @@ var (
 
 func TestNewMailer(t *testing.T) {
 	mailer := New(from, password, host, port)
-	if mailer.server == "" {
+	if mailer.tr.(*SMTPTransport).server == "" {
 		t.Errorf("incorrect server, got empty string, want %q", fmt.Sprintf("%s:%d", host, port))
 		t.FailNow()
 	}
-	if mailer.t == nil {
+	if mailer.locales[i18n.Default] == nil {
 		t.Errorf("template cannot be nil")
 		t.FailNow()
 	}
 }
 
+func TestLocales(t *testing.T) {
+	if ls := Locales(); len(ls) != 2 || ls[0] != "en" || ls[1] != "fr" {
+		t.Errorf("incorrect locales, got %v", ls)
+		t.FailNow()
+	}
+	for l, ts := range locales {
+		for _, n := range []string{"emailActivation", "emailConfirmation", "emailReminder"} {
+			if ts.html.Lookup(n) == nil || ts.text.Lookup(n+"Text") == nil || ts.messages[n] == "" {
+				t.Errorf("template %q is incomplete in locale %q", n, l)
+			}
+		}
+	}
+
+	tr := &recorder{}
+	m := NewTemplateMailer(tr, &mail.Address{Address: DefaultFrom})
+	for _, l := range []string{"fr", "de", ""} {
+		m.SendConfirmationEmail(email, l)
+	}
+	for i, want := range []string{"poln - préinscription terminée", "poln - preregistration completed", "poln - preregistration completed"} {
+		if s := tr.messages[i].Subject; s != want {
+			t.Errorf("incorrect subject, got %q, want %q", s, want)
+		}
+	}
+}
+
 func TestSendActivationEmail(t *testing.T) {
 	m := New(from, password, host, port)
-	if err := m.SendActivationEmail(email, fmt.Sprintf("http://poln.org/activate/%s", token), hash); err != nil {
+	if err := m.SendActivationEmail(email, fmt.Sprintf("http://poln.org/activate/%s", token), hash, "en"); err != nil {
 		t.Errorf("error sending activation email : %v", err)
 		t.FailNow()
 	}
@@ -42,7 +70,7 @@ func TestSendActivationEmail(t *testing.T) {
 
 func TestSendConfirmationEmail(t *testing.T) {
 	m := New(from, password, host, port)
-	if err := m.SendConfirmationEmail(email); err != nil {
+	if err := m.SendConfirmationEmail(email, "en"); err != nil {
 		t.Errorf("error sending confirmation email : %v", err)
 		t.FailNow()
 	}
@@ -0,0 +1,129 @@
+package mailer
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+// Message is a rendered email, with a plaintext alternative to its HTML
+type Message struct {
+	From            *mail.Address
+	ReplyTo         *mail.Address // optional
+	To              string
+	Subject         string
+	Text            string
+	HTML            string
+	Date            time.Time
+	MessageID       string   // without angle brackets
+	ListUnsubscribe []string // mailto: or https: URIs, optional
+	signature       string   // DKIM-Signature header, see Sign
+}
+
+// NewMessageID returns a unique Message-ID in the domain of the sender
+func NewMessageID(from *mail.Address) (string, error) {
+	r := make([]byte, 16)
+	if _, err := rand.Read(r); err != nil {
+		return "", err
+	}
+	_, d, ok := strings.Cut(from.Address, "@")
+	if !ok || d == "" {
+		d = "localhost"
+	}
+	return hex.EncodeToString(r) + "@" + d, nil
+}
+
+// boundary is derived from the Message-ID, so the same message is always built the same way
+func (m *Message) boundary() string {
+	h := sha256.Sum256([]byte(m.MessageID))
+	return "poln-" + hex.EncodeToString(h[:12])
+}
+
+// listUnsubscribe returns the List-Unsubscribe header value
+func (m *Message) listUnsubscribe() string {
+	us := make([]string, len(m.ListUnsubscribe))
+	for i, u := range m.ListUnsubscribe {
+		us[i] = "<" + u + ">"
+	}
+	return strings.Join(us, ", ")
+}
+
+func writeHeader(b *bytes.Buffer, k, v string) {
+	b.WriteString(k + ": " + v + "\r\n")
+}
+
+func writePart(w *multipart.Writer, contentType, body string) error {
+	pw, err := w.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {contentType + "; charset=UTF-8"},
+		"Content-Transfer-Encoding": {"quoted-printable"},
+	})
+	if err != nil {
+		return err
+	}
+	qw := quotedprintable.NewWriter(pw)
+	if _, err := qw.Write([]byte(body)); err != nil {
+		return err
+	}
+	return qw.Close()
+}
+
+// Sign adds the DKIM-Signature header of the message, it must be called once the message is complete
+func (m *Message) Sign(d *DKIM) error {
+	raw, err := m.raw()
+	if err != nil {
+		return err
+	}
+	m.signature, err = d.Sign(raw, m.Date)
+	return err
+}
+
+// Bytes returns the RFC 5322 message: the DKIM signature if signed, headers, then the multipart/alternative body
+func (m *Message) Bytes() ([]byte, error) {
+	raw, err := m.raw()
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(m.signature), raw...), nil
+}
+
+func (m *Message) raw() ([]byte, error) {
+	var b bytes.Buffer
+	writeHeader(&b, "From", m.From.String())
+	if m.ReplyTo != nil {
+		writeHeader(&b, "Reply-To", m.ReplyTo.String())
+	}
+	writeHeader(&b, "To", m.To)
+	writeHeader(&b, "Subject", mime.QEncoding.Encode("UTF-8", m.Subject))
+	writeHeader(&b, "Date", m.Date.Format(time.RFC1123Z))
+	writeHeader(&b, "Message-ID", "<"+m.MessageID+">")
+	if len(m.ListUnsubscribe) > 0 {
+		writeHeader(&b, "List-Unsubscribe", m.listUnsubscribe())
+	}
+	writeHeader(&b, "MIME-Version", "1.0")
+	writeHeader(&b, "Content-Type", fmt.Sprintf("multipart/alternative; boundary=%q", m.boundary()))
+	b.WriteString("\r\n")
+
+	w := multipart.NewWriter(&b)
+	if err := w.SetBoundary(m.boundary()); err != nil {
+		return nil, err
+	}
+	if err := writePart(w, "text/plain", m.Text); err != nil {
+		return nil, err
+	}
+	if err := writePart(w, "text/html", m.HTML); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
@@ -0,0 +1,121 @@
+package mailer
+
+import (
+	"bytes"
+	"flag"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+var update = flag.Bool("update", false, "update the golden files")
+
+// golden compares b with the golden file, or updates it with -update
+func golden(t *testing.T, name string, b []byte) {
+	p := filepath.Join("testdata", name+".golden")
+	if *update {
+		os.MkdirAll("testdata", 0755)
+		if err := os.WriteFile(p, b, 0644); err != nil {
+			t.Fatalf("cannot update golden file: %v", err)
+		}
+	}
+	want, err := os.ReadFile(p)
+	if err != nil {
+		t.Fatalf("cannot read golden file: %v", err)
+	}
+	if !bytes.Equal(b, want) {
+		t.Errorf("incorrect message %s, got:\n%s\nwant:\n%s", name, b, want)
+	}
+}
+
+// messageBytes returns the bytes of the message, failing the test on error
+func messageBytes(t *testing.T, m *Message) []byte {
+	b, err := m.Bytes()
+	if err != nil {
+		t.Fatalf("cannot build message: %v", err)
+	}
+	return b
+}
+
+func TestMessageBytes(t *testing.T) {
+	b := messageBytes(t, message)
+	golden(t, "message", b)
+
+	m, err := mail.ReadMessage(bytes.NewReader(b))
+	if err != nil {
+		t.Errorf("cannot parse message: %v", err)
+		t.FailNow()
+	}
+	dec := new(mime.WordDecoder)
+	if s, _ := dec.DecodeHeader(m.Header.Get("Subject")); s != message.Subject {
+		t.Errorf("incorrect subject, got %q, want %q", s, message.Subject)
+	}
+	if d, _ := m.Header.Date(); !d.Equal(message.Date) {
+		t.Errorf("incorrect date, got %v, want %v", d, message.Date)
+	}
+	if from, _ := m.Header.AddressList("From"); len(from) != 1 || *from[0] != *message.From {
+		t.Errorf("incorrect from, got %v, want %v", from, message.From)
+	}
+
+	mt, params, _ := mime.ParseMediaType(m.Header.Get("Content-Type"))
+	if mt != "multipart/alternative" {
+		t.Errorf("incorrect content type, got %q", mt)
+		t.FailNow()
+	}
+	r := multipart.NewReader(m.Body, params["boundary"])
+	for _, want := range []struct{ contentType, body string }{
+		{"text/plain; charset=UTF-8", message.Text},
+		{"text/html; charset=UTF-8", message.HTML},
+	} {
+		p, err := r.NextPart() // decodes quoted-printable
+		if err != nil {
+			t.Errorf("cannot read part: %v", err)
+			t.FailNow()
+		}
+		body, _ := io.ReadAll(p)
+		if p.Header.Get("Content-Type") != want.contentType || strings.ReplaceAll(string(body), "\r\n", "\n") != want.body {
+			t.Errorf("incorrect part, got %q %q, want %q %q", p.Header.Get("Content-Type"), body, want.contentType, want.body)
+		}
+	}
+}
+
+func TestTemplates(t *testing.T) {
+	tr := &recorder{}
+	m := NewTemplateMailer(tr, &mail.Address{Name: "poln", Address: "hello@poln.org"})
+	m.ReplyTo = &mail.Address{Address: "support@poln.org"}
+	m.ListUnsubscribe = []string{"mailto:unsubscribe@poln.org"}
+	m.now = func() time.Time { return time.Date(2022, 3, 22, 12, 28, 48, 0, time.UTC) }
+	for _, l := range []string{"en", "fr"} {
+		m.SendActivationEmail(email, "http://poln.org/activate/"+token, hash, l)
+		m.SendConfirmationEmail(email, l)
+		m.SendReminderEmail(email, "http://poln.org/activate/"+token, hash, l)
+	}
+
+	for i, n := range []string{"activation", "confirmation", "reminder", "activation_fr", "confirmation_fr", "reminder_fr"} {
+		t.Run(n, func(t *testing.T) {
+			msg := tr.messages[i]
+			if !strings.HasSuffix(msg.MessageID, "@poln.org") {
+				t.Errorf("incorrect Message-ID domain, got %q", msg.MessageID)
+			}
+			msg.MessageID = "0123456789abcdef@poln.org" // random
+			golden(t, n, messageBytes(t, msg))
+		})
+	}
+}
+
+func TestNewMessageID(t *testing.T) {
+	a, _ := NewMessageID(&mail.Address{Address: DefaultFrom})
+	b, err := NewMessageID(&mail.Address{Address: DefaultFrom})
+	if err != nil || a == b || !strings.HasSuffix(a, "@fairhive-labs.com") {
+		t.Errorf("incorrect Message-IDs, got %q and %q (%v)", a, b, err)
+	}
+	if id, _ := NewMessageID(&mail.Address{}); !strings.HasSuffix(id, "@localhost") {
+		t.Errorf("incorrect Message-ID without domain, got %q", id)
+	}
+}
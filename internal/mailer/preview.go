@@ -0,0 +1,59 @@
+package mailer
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+)
+
+var (
+	ErrUnknownTemplate = errors.New("unknown email template")
+	ErrUnknownLocale   = errors.New("unknown email locale")
+)
+
+var activationSample = activationData{
+	Hash: "2A0C454A589B1CA4BA7FEF07828DF8F8BFD13E894B086FAB19415B137D33A18901F223995D8737B81B8A3354419035F5A0BC8A7DC73B51A84383A4876A5DB3E5",
+	Url:  "http://poln.org/activate/eyJhbGciOiJFUzI1NiIsInR5cCI6IkpXVCJ9.c2FtcGxl.c2lnbmF0dXJl",
+}
+
+// samples are the data rendered by the previews, by template name
+var samples = map[string]any{
+	"emailActivation":   activationSample,
+	"emailConfirmation": struct{}{},
+	"emailReminder":     activationSample,
+}
+
+// Templates returns the names of the templates which can be previewed
+func Templates() []string {
+	ns := make([]string, 0, len(samples))
+	for n := range samples {
+		ns = append(ns, n)
+	}
+	sort.Strings(ns)
+	return ns
+}
+
+// Preview renders the template n of the locale l with sample data, for the recipient e
+func (m *TemplateMailer) Preview(n, l, e string) (*Message, error) {
+	data, ok := samples[n]
+	if !ok {
+		return nil, ErrUnknownTemplate
+	}
+	if _, ok := m.locales[l]; !ok {
+		return nil, ErrUnknownLocale
+	}
+	return m.render(e, l, n, data)
+}
+
+// SendPreview delivers the preview of the template n of the locale l to e with the transport, bypassing the outbox (see Throttled.Allow)
+func (m *TemplateMailer) SendPreview(n, l, e string) error {
+	msg, err := m.Preview(n, l, e)
+	if err != nil {
+		return err
+	}
+	msg.Subject = "[preview] " + msg.Subject
+	if err := m.deliver(msg); err != nil {
+		return fmt.Errorf("cannot send preview: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,63 @@
+package mailer
+
+import (
+	"errors"
+	"net/mail"
+	"strings"
+	"testing"
+)
+
+func TestPreview(t *testing.T) {
+	m := NewTemplateMailer(&recorder{}, &mail.Address{Name: "poln", Address: "hello@poln.org"})
+	if ns := Templates(); len(ns) != 3 || ns[0] != "emailActivation" || ns[1] != "emailConfirmation" || ns[2] != "emailReminder" {
+		t.Errorf("incorrect templates, got %v", ns)
+		t.FailNow()
+	}
+	for _, l := range Locales() {
+		for _, n := range Templates() {
+			msg, err := m.Preview(n, l, email)
+			if err != nil || msg.Subject != locales[l].messages[n] || msg.HTML == "" || msg.Text == "" || msg.To != email {
+				t.Errorf("incorrect preview of %s in %s, got %v (%v)", n, l, msg, err)
+			}
+		}
+	}
+	if msg, _ := m.Preview("emailActivation", "fr", email); !strings.Contains(msg.HTML, samples["emailActivation"].(activationData).Hash) ||
+		!strings.Contains(msg.Text, "Terminer la préinscription") {
+		t.Errorf("sample data should be rendered, got %s", msg.Text)
+	}
+
+	tt := []struct {
+		name, template, locale string
+		err                    error
+	}{
+		{"unknown template", "emailWelcome", "en", ErrUnknownTemplate},
+		{"unknown locale", "emailActivation", "de", ErrUnknownLocale},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := m.Preview(tc.template, tc.locale, email); err != tc.err {
+				t.Errorf("incorrect error, got %v, want %v", err, tc.err)
+			}
+		})
+	}
+}
+
+func TestSendPreview(t *testing.T) {
+	tr := &recorder{}
+	m := NewTemplateMailer(tr, &mail.Address{Name: "poln", Address: "hello@poln.org"})
+	if err := m.SendPreview("emailConfirmation", "fr", email); err != nil {
+		t.Errorf("cannot send preview: %v", err)
+		t.FailNow()
+	}
+	if len(tr.messages) != 1 || tr.messages[0].To != email || tr.messages[0].Subject != "[preview] poln - préinscription terminée" {
+		t.Errorf("incorrect preview sent, got %v", tr.messages)
+		t.FailNow()
+	}
+	if err := m.SendPreview("emailWelcome", "fr", email); err != ErrUnknownTemplate {
+		t.Errorf("incorrect error, got %v, want %v", err, ErrUnknownTemplate)
+	}
+	tr.failures = 3
+	if err := m.SendPreview("emailConfirmation", "en", email); err == nil || errors.Is(err, ErrUnknownTemplate) {
+		t.Errorf("transport errors should be returned, got %v", err)
+	}
+}
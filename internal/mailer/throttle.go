@@ -0,0 +1,170 @@
+package mailer
+
+import (
+	"errors"
+	"expvar"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fairhive-labs/preregister/internal/data"
+	"github.com/fairhive-labs/preregister/internal/limiter"
+)
+
+// throttle metrics, published with expvar
+var (
+	mailerSuppressed = expvar.NewMap("mailer_suppressed")
+)
+
+// Reasons of a suppression
+const (
+	Cooldown = "cooldown"
+	DailyCap = "daily cap"
+)
+
+var ErrSuppressed = errors.New("email suppressed")
+
+type recipient struct {
+	last  time.Time // last email sent
+	start time.Time // start of the 24h window
+	count int       // emails sent in the window
+}
+
+// Recipients records the recipients until they expire, shared by several processes
+type Recipients interface {
+	// Add records the key until exp, it returns false if the key is already recorded
+	Add(key string, exp time.Time) (bool, error)
+}
+
+// Throttled limits the activation emails sent to a recipient: one per cooldown and at most
+// daily per 24 hours. Suppressed emails are logged and counted, not sent.
+// The limits hold per process, unless they are shared.
+type Throttled struct {
+	Mailer
+	cooldown   time.Duration
+	daily      int // 0 for no cap
+	recipients map[string]*recipient
+	cooling    Recipients      // shared recipients in their cooldown
+	capped     limiter.Limiter // shared daily cap
+	now        func() time.Time
+	sync.Mutex
+}
+
+func NewThrottled(m Mailer, cooldown time.Duration, daily int) *Throttled {
+	return &Throttled{
+		Mailer:     m,
+		cooldown:   cooldown,
+		daily:      daily,
+		recipients: map[string]*recipient{},
+		now:        time.Now,
+	}
+}
+
+func recipientKey(e string) string {
+	return strings.ToLower(strings.TrimSpace(e))
+}
+
+// Share keeps the recipients in their cooldown in r, and limits them with daily, a limiter of the daily cap per 24 hours.
+// The limits then hold across processes, the counters in memory are only used when the shared ones fail.
+func (t *Throttled) Share(r Recipients, daily limiter.Limiter) {
+	t.Lock()
+	defer t.Unlock()
+	t.cooling, t.capped = r, daily
+}
+
+// allowShared records an email sent to e in the shared limits, or returns the reason why it is suppressed
+func (t *Throttled) allowShared(e string) (bool, string, error) {
+	k := recipientKey(e)
+	if t.cooldown > 0 {
+		ok, err := t.cooling.Add(k, t.now().Add(t.cooldown))
+		if err != nil || !ok {
+			return false, Cooldown, err
+		}
+	}
+	if t.daily > 0 {
+		res, err := t.capped.Allow(k)
+		if err != nil || !res.Allowed {
+			return false, DailyCap, err
+		}
+	}
+	return true, "", nil
+}
+
+// allow records an email sent to e, or returns the reason why it is suppressed
+func (t *Throttled) allow(e string) (bool, string) {
+	t.Lock()
+	shared := t.cooling != nil
+	t.Unlock()
+	if shared {
+		ok, reason, err := t.allowShared(e)
+		if err == nil {
+			return ok, reason
+		}
+		log.Printf("⚠️ Cannot share the email limits of %q, using memory: %v\n", data.MaskEmail(recipientKey(e)), err)
+	}
+
+	t.Lock()
+	defer t.Unlock()
+	now := t.now()
+	k := recipientKey(e)
+	r, ok := t.recipients[k]
+	if !ok {
+		r = &recipient{start: now}
+		t.recipients[k] = r
+	}
+	if now.Sub(r.start) >= 24*time.Hour {
+		r.start, r.count = now, 0
+	}
+	switch {
+	case r.count > 0 && now.Sub(r.last) < t.cooldown:
+		return false, Cooldown
+	case t.daily > 0 && r.count >= t.daily:
+		return false, DailyCap
+	}
+	r.last = now
+	r.count++
+	return true, ""
+}
+
+// suppress records an email of the kind sent to e, or logs and counts it and returns ErrSuppressed
+func (t *Throttled) suppress(kind, e string) error {
+	if ok, reason := t.allow(e); !ok {
+		mailerSuppressed.Add(reason, 1)
+		log.Printf("🚫 %s email to %q suppressed (%s)\n", kind, data.MaskEmail(recipientKey(e)), reason)
+		return ErrSuppressed
+	}
+	return nil
+}
+
+// Allow records an email sent to e by another mailer (e.g. a preview), sharing the limits of the recipient.
+// It returns ErrSuppressed if the email must not be sent.
+func (t *Throttled) Allow(e string) error {
+	return t.suppress("Preview", e)
+}
+
+func (t *Throttled) SendActivationEmail(e, u, h, l string) error {
+	if err := t.suppress("Activation", e); err != nil {
+		return err
+	}
+	return t.Mailer.SendActivationEmail(e, u, h, l)
+}
+
+func (t *Throttled) SendReminderEmail(e, u, h, l string) error {
+	if err := t.suppress("Reminder", e); err != nil {
+		return err
+	}
+	return t.Mailer.SendReminderEmail(e, u, h, l)
+}
+
+// Cleanup forgets the recipients without email for 24 hours
+func (t *Throttled) Cleanup() {
+	t.Lock()
+	defer t.Unlock()
+	now := t.now()
+	for k, r := range t.recipients {
+		if now.Sub(r.last) >= 24*time.Hour && now.Sub(r.start) >= 24*time.Hour {
+			delete(t.recipients, k)
+		}
+	}
+}
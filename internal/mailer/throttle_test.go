@@ -0,0 +1,166 @@
+package mailer
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fairhive-labs/preregister/internal/limiter"
+	"golang.org/x/time/rate"
+)
+
+// countingMailer counts the emails sent
+type countingMailer struct {
+	activations, confirmations, reminders int
+}
+
+func (m *countingMailer) SendActivationEmail(e, u, h, l string) error {
+	m.activations++
+	return nil
+}
+
+func (m *countingMailer) SendConfirmationEmail(e, l string) error {
+	m.confirmations++
+	return nil
+}
+
+func (m *countingMailer) SendReminderEmail(e, u, h, l string) error {
+	m.reminders++
+	return nil
+}
+
+func TestThrottled(t *testing.T) {
+	now := time.Date(2022, 3, 22, 12, 0, 0, 0, time.UTC)
+	m := &countingMailer{}
+	th := NewThrottled(m, time.Minute, 3)
+	th.now = func() time.Time { return now }
+
+	tt := []struct {
+		name    string
+		email   string
+		elapsed time.Duration
+		err     error
+		sent    int // activations sent in total
+	}{
+		{"first", email, 0, nil, 1},
+		{"cooldown", email, 30 * time.Second, ErrSuppressed, 1},
+		{"same recipient", " John.Doe@Domain.com", 0, ErrSuppressed, 1},
+		{"other recipient", "jane.doe@domain.com", 0, nil, 2},
+		{"after cooldown", email, time.Minute, nil, 3},
+		{"third", email, time.Minute, nil, 4},
+		{"daily cap", email, time.Hour, ErrSuppressed, 4},
+		{"next day", email, 24 * time.Hour, nil, 5},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			now = now.Add(tc.elapsed)
+			if err := th.SendActivationEmail(tc.email, "http://poln.org/activate/"+token, hash, "en"); !errors.Is(err, tc.err) {
+				t.Errorf("incorrect error, got %v, want %v", err, tc.err)
+				t.FailNow()
+			}
+			if m.activations != tc.sent {
+				t.Errorf("incorrect emails sent, got %d, want %d", m.activations, tc.sent)
+				t.FailNow()
+			}
+		})
+	}
+
+	t.Run("confirmation", func(t *testing.T) {
+		if err := th.SendConfirmationEmail(email, "en"); err != nil || m.confirmations != 1 {
+			t.Errorf("confirmation emails should not be throttled, got %v", err)
+		}
+	})
+	t.Run("metrics", func(t *testing.T) {
+		if mailerSuppressed.Get(Cooldown).String() == "0" || mailerSuppressed.Get(DailyCap) == nil {
+			t.Errorf("suppressed emails should be counted")
+		}
+	})
+	t.Run("cleanup", func(t *testing.T) {
+		th.Cleanup()
+		if len(th.recipients) != 1 { // jane.doe@domain.com had no email for 24 hours
+			t.Errorf("recent recipients should be kept, got %d", len(th.recipients))
+			t.FailNow()
+		}
+		now = now.Add(24 * time.Hour)
+		th.Cleanup()
+		if len(th.recipients) != 0 {
+			t.Errorf("recipients should be forgotten after 24 hours, got %d", len(th.recipients))
+		}
+	})
+}
+
+func TestThrottledAllow(t *testing.T) {
+	m := &countingMailer{}
+	th := NewThrottled(m, time.Minute, 3)
+	if err := th.Allow("jane.doe@domain.com"); err != nil {
+		t.Errorf("first email should be allowed, got %v", err)
+	}
+	if err := th.SendActivationEmail("Jane.Doe@domain.com", "url", "hash", "en"); !errors.Is(err, ErrSuppressed) || m.activations != 0 {
+		t.Errorf("allowed emails should share the cooldown, got %v", err)
+	}
+}
+
+func TestThrottledReminder(t *testing.T) {
+	m := &countingMailer{}
+	th := NewThrottled(m, time.Minute, 3)
+	if err := th.SendActivationEmail("jane.doe@domain.com", "url", "hash", "en"); err != nil {
+		t.Errorf("activation email should be sent, got %v", err)
+	}
+	if err := th.SendReminderEmail("jane.doe@domain.com", "url", "hash", "en"); !errors.Is(err, ErrSuppressed) || m.reminders != 0 {
+		t.Errorf("reminder emails should be throttled, got %v", err)
+	}
+	if err := th.SendReminderEmail("john.doe@domain.com", "url", "hash", "en"); err != nil || m.reminders != 1 {
+		t.Errorf("reminder email should be sent, got %v", err)
+	}
+}
+
+// sharedRecipients is a Recipients shared by several Throttled, like Redis
+type sharedRecipients struct {
+	keys map[string]time.Time
+	err  error
+	sync.Mutex
+}
+
+func (s *sharedRecipients) Add(key string, exp time.Time) (bool, error) {
+	s.Lock()
+	defer s.Unlock()
+	if s.err != nil {
+		return false, s.err
+	}
+	if _, ok := s.keys[key]; ok {
+		return false, nil
+	}
+	s.keys[key] = exp
+	return true, nil
+}
+
+func TestThrottledShare(t *testing.T) {
+	r := &sharedRecipients{keys: map[string]time.Time{}}
+	daily := limiter.New(rate.Every(24*time.Hour), 2)
+	m1, m2 := &countingMailer{}, &countingMailer{}
+	th1, th2 := NewThrottled(m1, time.Minute, 2), NewThrottled(m2, time.Minute, 2)
+	th1.Share(r, daily)
+	th2.Share(r, daily)
+
+	if err := th1.SendActivationEmail("jane.doe@domain.com", "url", "hash", "en"); err != nil || m1.activations != 1 {
+		t.Errorf("first email should be sent, got %v", err)
+	}
+	if err := th2.SendActivationEmail("Jane.Doe@domain.com", "url", "hash", "en"); !errors.Is(err, ErrSuppressed) || m2.activations != 0 {
+		t.Errorf("the cooldown should be shared, got %v", err)
+	}
+	r.keys = map[string]time.Time{} // cooldown expired
+	th2.SendActivationEmail("jane.doe@domain.com", "url", "hash", "en")
+	r.keys = map[string]time.Time{}
+	if err := th1.SendActivationEmail("jane.doe@domain.com", "url", "hash", "en"); !errors.Is(err, ErrSuppressed) || m1.activations != 1 || m2.activations != 1 {
+		t.Errorf("the daily cap should be shared, got %v", err)
+	}
+
+	r.err = errors.New("redis is down")
+	if err := th1.SendActivationEmail("john.doe@domain.com", "url", "hash", "en"); err != nil || m1.activations != 2 {
+		t.Errorf("limits should fall back to memory, got %v", err)
+	}
+	if err := th1.SendActivationEmail("john.doe@domain.com", "url", "hash", "en"); !errors.Is(err, ErrSuppressed) {
+		t.Errorf("limits in memory should apply, got %v", err)
+	}
+}
@@ -0,0 +1,196 @@
+package mailer
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ses"
+	"github.com/aws/aws-sdk-go/service/ses/sesiface"
+)
+
+// Transport delivers the rendered emails
+type Transport interface {
+	Send(m *Message) error
+}
+
+type smtpConfig struct {
+	from     string
+	password string
+	host     string
+	port     int
+	server   string
+}
+
+// SMTPTransport sends emails with an authenticated SMTP server
+type SMTPTransport struct {
+	*smtpConfig
+}
+
+func NewSMTPTransport(user, password, host string, port int) *SMTPTransport {
+	return &SMTPTransport{&smtpConfig{
+		from:     user,
+		password: password,
+		host:     host,
+		port:     port,
+		server:   fmt.Sprintf("%s:%d", host, port),
+	}}
+}
+
+func (t *SMTPTransport) Send(m *Message) error {
+	b, err := m.Bytes()
+	if err != nil {
+		return err
+	}
+	auth := smtp.PlainAuth("", t.from, t.password, t.host)
+	return smtp.SendMail(t.server, auth, t.from, []string{m.To}, b)
+}
+
+// SESTransport sends raw emails with the AWS SES API, the sender must be verified
+type SESTransport struct {
+	svc sesiface.SESAPI
+}
+
+// NewSESTransport uses the AWS credentials and region of the environment, unless region is set
+func NewSESTransport(region string) *SESTransport {
+	cfg := aws.NewConfig()
+	if region != "" {
+		cfg = cfg.WithRegion(region)
+	}
+	return &SESTransport{ses.New(session.Must(session.NewSession(cfg)))}
+}
+
+func (t *SESTransport) Send(m *Message) error {
+	b, err := m.Bytes()
+	if err != nil {
+		return err
+	}
+	_, err = t.svc.SendRawEmail(&ses.SendRawEmailInput{
+		Source:       aws.String(m.From.Address),
+		Destinations: []*string{aws.String(m.To)},
+		RawMessage:   &ses.RawMessage{Data: b},
+	})
+	return err
+}
+
+// SendGridURL is the endpoint of the SendGrid v3 API, other providers accept the same payload
+const SendGridURL = "https://api.sendgrid.com/v3/mail/send"
+
+var ErrHTTPTransport = errors.New("email API error")
+
+// HTTPTransport sends emails to a SendGrid-style HTTP API, authenticated with a bearer API key
+type HTTPTransport struct {
+	url    string
+	key    string
+	client *http.Client
+}
+
+func NewHTTPTransport(url, key string) *HTTPTransport {
+	return &HTTPTransport{
+		url:    url,
+		key:    key,
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+type httpAddress struct {
+	Email string `json:"email"`
+	Name  string `json:"name,omitempty"`
+}
+
+type httpContent struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+type httpPersonalization struct {
+	To []httpAddress `json:"to"`
+}
+
+type httpPayload struct {
+	Personalizations []httpPersonalization `json:"personalizations"`
+	From             httpAddress           `json:"from"`
+	ReplyTo          *httpAddress          `json:"reply_to,omitempty"`
+	Subject          string                `json:"subject"`
+	Content          []httpContent         `json:"content"`
+	Headers          map[string]string     `json:"headers,omitempty"`
+}
+
+func (t *HTTPTransport) Send(m *Message) error {
+	p := httpPayload{
+		Personalizations: []httpPersonalization{{To: []httpAddress{{Email: m.To}}}},
+		From:             httpAddress{m.From.Address, m.From.Name},
+		Subject:          m.Subject,
+		Content:          []httpContent{{"text/plain", m.Text}, {"text/html", m.HTML}}, // plaintext first
+	}
+	if m.ReplyTo != nil {
+		p.ReplyTo = &httpAddress{m.ReplyTo.Address, m.ReplyTo.Name}
+	}
+	if len(m.ListUnsubscribe) > 0 { // the provider sets Date and Message-ID
+		p.Headers = map[string]string{"List-Unsubscribe": m.listUnsubscribe()}
+	}
+	b, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, t.url, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+t.key)
+	r, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer r.Body.Close()
+	if r.StatusCode/100 != 2 {
+		body, _ := io.ReadAll(io.LimitReader(r.Body, 512))
+		return fmt.Errorf("%w: status %d: %s", ErrHTTPTransport, r.StatusCode, bytes.TrimSpace(body))
+	}
+	return nil
+}
+
+// FileTransport writes emails in a local maildir, for development
+type FileTransport struct {
+	dir string
+}
+
+// NewFileTransport creates the tmp, new and cur folders of the maildir
+func NewFileTransport(dir string) (*FileTransport, error) {
+	for _, d := range []string{"tmp", "new", "cur"} {
+		if err := os.MkdirAll(filepath.Join(dir, d), 0700); err != nil {
+			return nil, err
+		}
+	}
+	return &FileTransport{dir}, nil
+}
+
+// Send writes the email in tmp then moves it to new, as maildir readers expect
+func (t *FileTransport) Send(m *Message) error {
+	r := make([]byte, 8)
+	if _, err := rand.Read(r); err != nil {
+		return err
+	}
+	b, err := m.Bytes()
+	if err != nil {
+		return err
+	}
+	n := fmt.Sprintf("%d.%s.preregister.eml", time.Now().UnixNano(), hex.EncodeToString(r))
+	tmp := filepath.Join(t.dir, "tmp", n)
+	if err := os.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(t.dir, "new", n))
+}
@@ -0,0 +1,161 @@
+package mailer
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/ses"
+	"github.com/aws/aws-sdk-go/service/ses/sesiface"
+)
+
+var message = &Message{
+	From:            &mail.Address{Name: "poln", Address: DefaultFrom},
+	ReplyTo:         &mail.Address{Address: "hello@poln.org"},
+	To:              email,
+	Subject:         "poln - preregistration 🐝",
+	Text:            "Hi there",
+	HTML:            "<p>Hi there</p>",
+	Date:            time.Date(2022, 3, 22, 12, 28, 48, 0, time.UTC),
+	MessageID:       "0123456789abcdef@fairhive-labs.com",
+	ListUnsubscribe: []string{"mailto:unsubscribe@poln.org", "https://poln.org/unsubscribe"},
+}
+
+// recorder is a Transport recording the messages, failing the first ones
+type recorder struct {
+	failures int
+	messages []*Message
+}
+
+func (r *recorder) Send(m *Message) error {
+	if r.failures > 0 {
+		r.failures--
+		return errors.New("transport is down")
+	}
+	r.messages = append(r.messages, m)
+	return nil
+}
+
+func TestTemplateMailer(t *testing.T) {
+	tr := &recorder{failures: 1}
+	m := NewTemplateMailer(tr, &mail.Address{Name: "poln", Address: "hello@poln.org"})
+	if err := m.SendActivationEmail(email, "http://poln.org/activate/"+token, hash, "en"); err != nil {
+		t.Errorf("error sending activation email : %v", err)
+		t.FailNow()
+	}
+	if err := m.SendConfirmationEmail(email, "en"); err != nil {
+		t.Errorf("error sending confirmation email : %v", err)
+		t.FailNow()
+	}
+	if len(tr.messages) != 2 {
+		t.Errorf("incorrect messages, got %d, want 2", len(tr.messages))
+		t.FailNow()
+	}
+	a := tr.messages[0]
+	if a.From.Address != "hello@poln.org" || a.To != email || a.Subject != "poln - preregistration" || !strings.Contains(a.HTML, hash) || !strings.Contains(a.Text, hash) || !strings.Contains(a.Text, token) {
+		t.Errorf("incorrect activation email, got %+v", a)
+	}
+
+	tr.failures = 3
+	if err := m.SendConfirmationEmail(email, "en"); err == nil {
+		t.Errorf("incorrect error, should not be nil after 3 attempts")
+	}
+}
+
+func TestHTTPTransport(t *testing.T) {
+	var payload httpPayload
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer k3y" {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"errors":[{"message":"invalid api key"}]}`))
+			return
+		}
+		json.NewDecoder(r.Body).Decode(&payload)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer s.Close()
+
+	if err := NewHTTPTransport(s.URL, "k3y").Send(message); err != nil {
+		t.Errorf("cannot send message: %v", err)
+		t.FailNow()
+	}
+	if len(payload.Personalizations) != 1 || payload.Personalizations[0].To[0].Email != email ||
+		payload.From.Email != DefaultFrom || payload.From.Name != "poln" || payload.ReplyTo.Email != "hello@poln.org" ||
+		payload.Subject != message.Subject || len(payload.Content) != 2 ||
+		payload.Content[0].Type != "text/plain" || payload.Content[0].Value != message.Text ||
+		payload.Content[1].Type != "text/html" || payload.Content[1].Value != message.HTML ||
+		payload.Headers["List-Unsubscribe"] != "<mailto:unsubscribe@poln.org>, <https://poln.org/unsubscribe>" {
+		t.Errorf("incorrect payload, got %+v", payload)
+		t.FailNow()
+	}
+
+	err := NewHTTPTransport(s.URL, "wr0ngK3y").Send(message)
+	if !errors.Is(err, ErrHTTPTransport) || !strings.Contains(err.Error(), "invalid api key") {
+		t.Errorf("incorrect error, got %v, want %v", err, ErrHTTPTransport)
+	}
+}
+
+// sesStub records the raw emails
+type sesStub struct {
+	sesiface.SESAPI
+	input *ses.SendRawEmailInput
+}
+
+func (s *sesStub) SendRawEmail(in *ses.SendRawEmailInput) (*ses.SendRawEmailOutput, error) {
+	s.input = in
+	return &ses.SendRawEmailOutput{}, nil
+}
+
+func TestSESTransport(t *testing.T) {
+	stub := &sesStub{}
+	if err := (&SESTransport{stub}).Send(message); err != nil {
+		t.Errorf("cannot send message: %v", err)
+		t.FailNow()
+	}
+	in := stub.input
+	if *in.Source != DefaultFrom || len(in.Destinations) != 1 || *in.Destinations[0] != email || string(in.RawMessage.Data) != string(messageBytes(t, message)) {
+		t.Errorf("incorrect raw email, got %v", in)
+	}
+	if NewSESTransport("eu-west-1").svc == nil {
+		t.Errorf("SES client cannot be nil")
+	}
+}
+
+func TestFileTransport(t *testing.T) {
+	d := filepath.Join(t.TempDir(), "maildir")
+	tr, err := NewFileTransport(d)
+	if err != nil {
+		t.Errorf("cannot create maildir: %v", err)
+		t.FailNow()
+	}
+	for i := 0; i < 2; i++ {
+		if err := tr.Send(message); err != nil {
+			t.Errorf("cannot send message: %v", err)
+			t.FailNow()
+		}
+	}
+	es, _ := os.ReadDir(filepath.Join(d, "new"))
+	if len(es) != 2 {
+		t.Errorf("incorrect messages, got %d, want 2", len(es))
+		t.FailNow()
+	}
+	if b, _ := os.ReadFile(filepath.Join(d, "new", es[0].Name())); string(b) != string(messageBytes(t, message)) {
+		t.Errorf("incorrect message, got %q", b)
+	}
+	if es, _ := os.ReadDir(filepath.Join(d, "tmp")); len(es) != 0 {
+		t.Errorf("tmp should be empty, got %d files", len(es))
+	}
+
+	f := filepath.Join(t.TempDir(), "file")
+	os.WriteFile(f, nil, 0600)
+	if _, err := NewFileTransport(f); err == nil {
+		t.Errorf("incorrect error, should not be nil")
+	}
+}
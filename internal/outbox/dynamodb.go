@@ -0,0 +1,179 @@
+package outbox
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+)
+
+// DynamoDBStore keeps messages in a DynamoDB table (partition key "id"), it can be shared between dynos.
+// The table needs the stateIndex global secondary index, and a TTL on expires_at to delete the expired dead letters.
+type DynamoDBStore struct {
+	tn string
+}
+
+func NewDynamoDBStore(tn string) (*DynamoDBStore, error) {
+	if tn == "" {
+		return nil, ErrNoTableName
+	}
+	return &DynamoDBStore{tn}, nil
+}
+
+func key(id string) map[string]*dynamodb.AttributeValue {
+	return map[string]*dynamodb.AttributeValue{
+		"id": {S: aws.String(id)},
+	}
+}
+
+func (s *DynamoDBStore) Put(m *Message) error {
+	sess := session.Must(session.NewSession())
+	svc := dynamodb.New(sess)
+	av, err := dynamodbattribute.MarshalMap(*m)
+	if err != nil {
+		return err
+	}
+	_, err = svc.PutItem(&dynamodb.PutItemInput{
+		Item:      av,
+		TableName: aws.String(s.tn),
+	})
+	return err
+}
+
+func (s *DynamoDBStore) Get(id string) (*Message, error) {
+	sess := session.Must(session.NewSession())
+	svc := dynamodb.New(sess)
+	r, err := svc.GetItem(&dynamodb.GetItemInput{
+		TableName:      aws.String(s.tn),
+		Key:            key(id),
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if r.Item == nil {
+		return nil, ErrNotFound
+	}
+	m := &Message{}
+	if err := dynamodbattribute.UnmarshalMap(r.Item, m); err != nil {
+		return nil, fmt.Errorf("cannot read message: %w", err)
+	}
+	return m, nil
+}
+
+func (s *DynamoDBStore) Delete(id string) error {
+	sess := session.Must(session.NewSession())
+	svc := dynamodb.New(sess)
+	_, err := svc.DeleteItem(&dynamodb.DeleteItemInput{
+		TableName: aws.String(s.tn),
+		Key:       key(id),
+	})
+	return err
+}
+
+// stateIndex is the global secondary index of the table on state (partition key) and next_attempt (sort key)
+const stateIndex = "state_next_attempt"
+
+// query calls f with the pages of the messages of the state index matching the key condition, until f returns false
+func (s *DynamoDBStore) query(condition string, values map[string]*dynamodb.AttributeValue, f func([]*Message) (bool, error)) error {
+	sess := session.Must(session.NewSession())
+	svc := dynamodb.New(sess)
+
+	input := &dynamodb.QueryInput{
+		TableName:                 aws.String(s.tn),
+		IndexName:                 aws.String(stateIndex),
+		KeyConditionExpression:    aws.String(condition),
+		ExpressionAttributeNames:  map[string]*string{"#s": aws.String("state")},
+		ExpressionAttributeValues: values,
+	}
+	for {
+		result, err := svc.Query(input)
+		if err != nil {
+			return err
+		}
+		ms := make([]*Message, 0, len(result.Items))
+		for _, i := range result.Items {
+			m := &Message{}
+			if err := dynamodbattribute.UnmarshalMap(i, m); err != nil {
+				return fmt.Errorf("cannot read message: %w", err)
+			}
+			ms = append(ms, m)
+		}
+		more, err := f(ms)
+		if err != nil || !more {
+			return err
+		}
+		// pagination
+		input.ExclusiveStartKey = result.LastEvaluatedKey
+		if result.LastEvaluatedKey == nil {
+			return nil
+		}
+	}
+}
+
+// Claim queries the due messages, the oldest attempts first, and leases them with a conditional update:
+// a message claimed by another dyno is skipped
+func (s *DynamoDBStore) Claim(t time.Time, lease time.Duration, n int) ([]*Message, error) {
+	sess := session.Must(session.NewSession())
+	svc := dynamodb.New(sess)
+	next := t.Add(lease).UnixMilli()
+	ms := []*Message{}
+	err := s.query("#s = :state AND next_attempt <= :now", map[string]*dynamodb.AttributeValue{
+		":state": {S: aws.String(Pending)},
+		":now":   {N: aws.String(strconv.FormatInt(t.UnixMilli(), 10))},
+	}, func(due []*Message) (bool, error) {
+		for _, m := range due {
+			if len(ms) == n {
+				return false, nil
+			}
+			_, err := svc.UpdateItem(&dynamodb.UpdateItemInput{
+				TableName:           aws.String(s.tn),
+				Key:                 key(m.ID),
+				UpdateExpression:    aws.String("SET next_attempt = :next"),
+				ConditionExpression: aws.String("next_attempt = :prev AND #s = :state"),
+				ExpressionAttributeNames: map[string]*string{
+					"#s": aws.String("state"),
+				},
+				ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+					":next":  {N: aws.String(strconv.FormatInt(next, 10))},
+					":prev":  {N: aws.String(strconv.FormatInt(m.NextAttempt, 10))},
+					":state": {S: aws.String(Pending)},
+				},
+			})
+			var aerr awserr.Error
+			if errors.As(err, &aerr) && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+				continue // claimed by another dyno
+			}
+			if err != nil {
+				return false, err
+			}
+			m.NextAttempt = next
+			ms = append(ms, m)
+		}
+		return len(ms) < n, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ms, nil
+}
+
+func (s *DynamoDBStore) List(state string) ([]*Message, error) {
+	ms := []*Message{}
+	err := s.query("#s = :state", map[string]*dynamodb.AttributeValue{
+		":state": {S: aws.String(state)},
+	}, func(page []*Message) (bool, error) {
+		ms = append(ms, page...)
+		return true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return sortByCreation(ms), nil
+}
@@ -0,0 +1,142 @@
+package outbox
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FileStore keeps each message in a JSON file of a local directory.
+// It survives restarts but must not be shared between processes.
+type FileStore struct {
+	dir string
+	sync.Mutex
+}
+
+func NewFileStore(dir string) (*FileStore, error) {
+	if dir == "" {
+		return nil, ErrNoDirectory
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &FileStore{dir: dir}, nil
+}
+
+func (s *FileStore) path(id string) string {
+	return filepath.Join(s.dir, filepath.Base(id)+".json")
+}
+
+// write replaces the file of the message atomically, s must be locked
+func (s *FileStore) write(m *Message) error {
+	b, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	tmp := s.path(m.ID) + ".tmp"
+	if err := os.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path(m.ID))
+}
+
+// read returns the message of the file, s must be locked
+func (s *FileStore) read(path string) (*Message, error) {
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	m := &Message{}
+	if err := json.Unmarshal(b, m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// all returns all the messages, oldest first, s must be locked
+func (s *FileStore) all() ([]*Message, error) {
+	es, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	ms := []*Message{}
+	for _, e := range es {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), ".json") {
+			continue
+		}
+		m, err := s.read(filepath.Join(s.dir, e.Name()))
+		if err != nil {
+			return nil, err
+		}
+		ms = append(ms, m)
+	}
+	return sortByCreation(ms), nil
+}
+
+func (s *FileStore) Put(m *Message) error {
+	s.Lock()
+	defer s.Unlock()
+	return s.write(m)
+}
+
+func (s *FileStore) Get(id string) (*Message, error) {
+	s.Lock()
+	defer s.Unlock()
+	return s.read(s.path(id))
+}
+
+func (s *FileStore) Delete(id string) error {
+	s.Lock()
+	defer s.Unlock()
+	if err := os.Remove(s.path(id)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+func (s *FileStore) Claim(t time.Time, lease time.Duration, n int) ([]*Message, error) {
+	s.Lock()
+	defer s.Unlock()
+	all, err := s.all()
+	if err != nil {
+		return nil, err
+	}
+	ms := []*Message{}
+	for _, m := range all {
+		if len(ms) == n {
+			break
+		}
+		if m.State != Pending || m.NextAttempt > t.UnixMilli() {
+			continue
+		}
+		m.NextAttempt = t.Add(lease).UnixMilli()
+		if err := s.write(m); err != nil {
+			return nil, err
+		}
+		ms = append(ms, m)
+	}
+	return ms, nil
+}
+
+func (s *FileStore) List(state string) ([]*Message, error) {
+	s.Lock()
+	defer s.Unlock()
+	all, err := s.all()
+	if err != nil {
+		return nil, err
+	}
+	ms := []*Message{}
+	for _, m := range all {
+		if m.State == state {
+			ms = append(ms, m)
+		}
+	}
+	return ms, nil
+}
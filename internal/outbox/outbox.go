@@ -0,0 +1,459 @@
+package outbox
+
+import (
+	"errors"
+	"expvar"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/fairhive-labs/preregister/internal/crypto"
+	"github.com/fairhive-labs/preregister/internal/crypto/cipher"
+	"github.com/fairhive-labs/preregister/internal/data"
+	"github.com/fairhive-labs/preregister/internal/mailer"
+	"github.com/google/uuid"
+)
+
+// outbox metrics, published with expvar
+var (
+	outboxMessages = expvar.NewMap("outbox")
+)
+
+// Kinds of messages
+const (
+	Activation   = "activation"
+	Confirmation = "confirmation"
+	Reminder     = "reminder"
+)
+
+// States of a message
+const (
+	Pending = "pending"
+	Dead    = "dead" // too many failed attempts, waiting for a replay
+)
+
+var (
+	ErrNotFound     = errors.New("message not found")
+	ErrNotDead      = errors.New("message is not a dead letter")
+	ErrLinkExpired  = errors.New("activation link expired, the user must ask for a new one")
+	ErrUnknownKind  = errors.New("unknown message kind")
+	ErrNoTableName  = errors.New("cannot create DynamoDB outbox: no table name")
+	ErrNoDirectory  = errors.New("cannot create file outbox: no directory")
+	errNotDelivered = errors.New("message not delivered")
+)
+
+// Message is an email waiting to be sent.
+// In the stores, the recipient and the url (whose token holds the email) are encrypted with the message ID as additional data.
+type Message struct {
+	ID          string `json:"id"`
+	Kind        string `json:"kind"`
+	To          string `json:"to"`
+	URL         string `json:"url,omitempty"`
+	Hash        string `json:"hash,omitempty"`
+	Locale      string `json:"locale,omitempty"`
+	State       string `json:"state"`
+	Attempts    int    `json:"attempts"`
+	NextAttempt int64  `json:"next_attempt"` // milliseconds
+	LastError   string `json:"last_error,omitempty"`
+	CreatedAt   int64  `json:"created_at"`           // milliseconds
+	ExpiresAt   int64  `json:"expires_at,omitempty"` // seconds, dead letters are deleted after it (DynamoDB TTL)
+}
+
+func NewMessage(kind, to, url, hash, locale string, t time.Time) *Message {
+	return &Message{
+		ID:          uuid.New().String(),
+		Kind:        kind,
+		To:          to,
+		URL:         url,
+		Hash:        hash,
+		Locale:      locale,
+		State:       Pending,
+		NextAttempt: t.UnixMilli(),
+		CreatedAt:   t.UnixMilli(),
+	}
+}
+
+// Store persists the messages until they are sent
+type Store interface {
+	Put(m *Message) error
+	Get(id string) (*Message, error)
+	Delete(id string) error
+	// Claim returns at most n pending messages due at t, and delays their next attempt by lease
+	// so they are not claimed again while they are sent
+	Claim(t time.Time, lease time.Duration, n int) ([]*Message, error)
+	// List returns the messages in the state, oldest first
+	List(state string) ([]*Message, error)
+}
+
+// sortByCreation sorts messages, oldest first
+func sortByCreation(ms []*Message) []*Message {
+	sort.SliceStable(ms, func(i, j int) bool {
+		return ms[i].CreatedAt < ms[j].CreatedAt
+	})
+	return ms
+}
+
+// Outbox is a Mailer queuing the emails in a Store, they are sent by Run with the underlying Mailer.
+// Failed emails are retried with an exponential backoff, then kept as dead letters until replayed.
+type Outbox struct {
+	s           Store
+	m           mailer.Mailer
+	ek          string
+	maxAttempts int
+	backoff     time.Duration
+	maxBackoff  time.Duration
+	lease       time.Duration
+	retention   time.Duration // of the dead letters
+	wake        chan struct{}
+	now         func() time.Time
+}
+
+// New returns an Outbox storing the messages in s, encrypted with the data key ek, and sending them with m.
+// Dead letters are kept for a week.
+func New(s Store, m mailer.Mailer, ek string, maxAttempts int, backoff, maxBackoff time.Duration) *Outbox {
+	return &Outbox{
+		s:           s,
+		m:           m,
+		ek:          ek,
+		maxAttempts: maxAttempts,
+		backoff:     backoff,
+		maxBackoff:  maxBackoff,
+		lease:       time.Minute,
+		retention:   7 * 24 * time.Hour,
+		wake:        make(chan struct{}, 1),
+		now:         time.Now,
+	}
+}
+
+// KeepDeadLetters sets how long the dead letters are kept before they are deleted
+func (o *Outbox) KeepDeadLetters(d time.Duration) {
+	o.retention = d
+}
+
+// seal encrypts the recipient and the url of the message
+func (o *Outbox) seal(m *Message) (err error) {
+	if m.To, err = cipher.EncryptWithAD(m.To, o.ek, m.ID); err != nil {
+		return err
+	}
+	if m.URL != "" {
+		m.URL, err = cipher.EncryptWithAD(m.URL, o.ek, m.ID)
+	}
+	return err
+}
+
+// open returns a copy of the sealed message, with its recipient and url decrypted
+func (o *Outbox) open(m *Message) (*Message, error) {
+	c := *m
+	var err error
+	if c.To, err = cipher.DecryptWithAD(m.To, o.ek, m.ID); err != nil {
+		return nil, err
+	}
+	if m.URL != "" {
+		if c.URL, err = cipher.DecryptWithAD(m.URL, o.ek, m.ID); err != nil {
+			return nil, err
+		}
+	}
+	return &c, nil
+}
+
+// recipient returns the masked recipient of the sealed message, for the logs
+func (o *Outbox) recipient(m *Message) string {
+	to, err := cipher.DecryptWithAD(m.To, o.ek, m.ID)
+	if err != nil {
+		return "?"
+	}
+	return data.MaskEmail(to)
+}
+
+// queue seals and enqueues a new message
+func (o *Outbox) queue(kind, e, u, h, l string) error {
+	m := NewMessage(kind, e, u, h, l, o.now())
+	if err := o.seal(m); err != nil {
+		log.Printf("⚠️ Cannot encrypt %s email to %q: %v\n", kind, data.MaskEmail(e), err)
+		return err
+	}
+	return o.enqueue(m)
+}
+
+// enqueue stores the sealed message and wakes up the workers
+func (o *Outbox) enqueue(m *Message) error {
+	if err := o.s.Put(m); err != nil {
+		log.Printf("⚠️ Cannot queue %s email to %q: %v\n", m.Kind, o.recipient(m), err)
+		return err
+	}
+	outboxMessages.Add("queued", 1)
+	select {
+	case o.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+func (o *Outbox) SendActivationEmail(e, u, h, l string) error {
+	return o.queue(Activation, e, u, h, l)
+}
+
+func (o *Outbox) SendConfirmationEmail(e, l string) error {
+	return o.queue(Confirmation, e, "", "", l)
+}
+
+func (o *Outbox) SendReminderEmail(e, u, h, l string) error {
+	return o.queue(Reminder, e, u, h, l)
+}
+
+// linkExpired tells if the token of the activation link of the message is expired, it is issued when the message is queued
+func (o *Outbox) linkExpired(m *Message) bool {
+	var ttl time.Duration
+	switch m.Kind {
+	case Activation:
+		ttl = crypto.ActivationTTL
+	case Reminder:
+		ttl = crypto.ReminderTTL
+	default:
+		return false
+	}
+	return o.now().Sub(time.UnixMilli(m.CreatedAt)) >= ttl
+}
+
+// delay returns the backoff before the next attempt
+func (o *Outbox) delay(attempts int) time.Duration {
+	d := o.backoff
+	for i := 1; i < attempts && d < o.maxBackoff; i++ {
+		d *= 2
+	}
+	if d > o.maxBackoff {
+		d = o.maxBackoff
+	}
+	return d
+}
+
+// send opens the sealed message and sends it
+func (o *Outbox) send(sealed *Message) (err error) {
+	defer func() { // a panicking mailer must not stop the workers
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%w: %v", errNotDelivered, r)
+		}
+	}()
+	m, err := o.open(sealed)
+	if err != nil {
+		return fmt.Errorf("cannot decrypt message: %w", err)
+	}
+	switch m.Kind {
+	case Activation:
+		return o.m.SendActivationEmail(m.To, m.URL, m.Hash, m.Locale)
+	case Confirmation:
+		return o.m.SendConfirmationEmail(m.To, m.Locale)
+	case Reminder:
+		return o.m.SendReminderEmail(m.To, m.URL, m.Hash, m.Locale)
+	}
+	return ErrUnknownKind
+}
+
+// process sends the message, then deletes it or schedules its next attempt.
+// Messages whose activation link is expired become dead letters, they would only deliver a broken link.
+func (o *Outbox) process(m *Message) {
+	err := ErrLinkExpired
+	if !o.linkExpired(m) {
+		err = o.send(m)
+	}
+	if err == nil {
+		if err := o.s.Delete(m.ID); err != nil {
+			log.Printf("⚠️ Cannot delete sent message %s: %v\n", m.ID, err)
+		}
+		outboxMessages.Add("sent", 1)
+		return
+	}
+
+	m.Attempts++
+	m.LastError = err.Error()
+	if m.Attempts >= o.maxAttempts || errors.Is(err, ErrUnknownKind) || errors.Is(err, ErrLinkExpired) {
+		m.State = Dead
+		m.ExpiresAt = o.now().Add(o.retention).Unix()
+		outboxMessages.Add("dead", 1)
+		log.Printf("☠️ %s email to %q is a dead letter after %d attempts: %v\n", m.Kind, o.recipient(m), m.Attempts, err)
+	} else {
+		m.NextAttempt = o.now().Add(o.delay(m.Attempts)).UnixMilli()
+		outboxMessages.Add("retried", 1)
+	}
+	if err := o.s.Put(m); err != nil {
+		log.Printf("⚠️ Cannot update message %s: %v\n", m.ID, err)
+	}
+}
+
+// Drain sends the due messages with workers goroutines, and returns the number of messages processed
+func (o *Outbox) Drain(workers int) (int, error) {
+	n := 0
+	for {
+		ms, err := o.s.Claim(o.now(), o.lease, workers)
+		if err != nil || len(ms) == 0 {
+			return n, err
+		}
+		var wg sync.WaitGroup
+		for _, m := range ms {
+			wg.Add(1)
+			go func(m *Message) {
+				defer wg.Done()
+				o.process(m)
+			}(m)
+		}
+		wg.Wait()
+		n += len(ms)
+	}
+}
+
+// Run drains the outbox every interval, or as soon as a message is queued, until stop is closed
+func (o *Outbox) Run(workers int, interval time.Duration, stop <-chan struct{}) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		if _, err := o.Drain(workers); err != nil {
+			log.Printf("⚠️ Cannot drain outbox: %v\n", err)
+		}
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+		case <-o.wake:
+		}
+	}
+}
+
+// DeadLetters returns the messages which could not be sent and are not expired, oldest first, decrypted
+func (o *Outbox) DeadLetters() ([]*Message, error) {
+	ms, err := o.s.List(Dead)
+	if err != nil {
+		return nil, err
+	}
+	now := o.now().Unix()
+	dl := make([]*Message, 0, len(ms))
+	for _, m := range ms {
+		if m.ExpiresAt != 0 && m.ExpiresAt <= now {
+			continue
+		}
+		c, err := o.open(m)
+		if err != nil {
+			return nil, err
+		}
+		dl = append(dl, c)
+	}
+	return dl, nil
+}
+
+// Purge deletes the expired dead letters and returns how many have been deleted.
+// The DynamoDB store expires them itself with a TTL on expires_at.
+func (o *Outbox) Purge() (int, error) {
+	ms, err := o.s.List(Dead)
+	if err != nil {
+		return 0, err
+	}
+	n, now := 0, o.now().Unix()
+	for _, m := range ms {
+		if m.ExpiresAt == 0 || m.ExpiresAt > now {
+			continue
+		}
+		if err := o.s.Delete(m.ID); err != nil {
+			return n, err
+		}
+		n++
+	}
+	outboxMessages.Add("expired", int64(n))
+	return n, nil
+}
+
+// Replay queues a dead letter again, unless its activation link is expired
+func (o *Outbox) Replay(id string) (*Message, error) {
+	m, err := o.s.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	if m.State != Dead {
+		return nil, ErrNotDead
+	}
+	if m.ExpiresAt != 0 && m.ExpiresAt <= o.now().Unix() {
+		return nil, ErrNotFound
+	}
+	if o.linkExpired(m) {
+		return nil, ErrLinkExpired
+	}
+	m.State = Pending
+	m.Attempts = 0
+	m.NextAttempt = o.now().UnixMilli()
+	m.ExpiresAt = 0
+	if err := o.enqueue(m); err != nil {
+		return nil, err
+	}
+	outboxMessages.Add("replayed", 1)
+	return m, nil
+}
+
+// MemoryStore keeps messages in memory, for development and tests
+type MemoryStore struct {
+	messages map[string]*Message
+	sync.Mutex
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{messages: map[string]*Message{}}
+}
+
+func (s *MemoryStore) Put(m *Message) error {
+	s.Lock()
+	defer s.Unlock()
+	c := *m
+	s.messages[m.ID] = &c
+	return nil
+}
+
+func (s *MemoryStore) Get(id string) (*Message, error) {
+	s.Lock()
+	defer s.Unlock()
+	m, ok := s.messages[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	c := *m
+	return &c, nil
+}
+
+func (s *MemoryStore) Delete(id string) error {
+	s.Lock()
+	defer s.Unlock()
+	delete(s.messages, id)
+	return nil
+}
+
+func (s *MemoryStore) Claim(t time.Time, lease time.Duration, n int) ([]*Message, error) {
+	s.Lock()
+	defer s.Unlock()
+	ms := []*Message{}
+	for _, m := range s.messages {
+		if m.State == Pending && m.NextAttempt <= t.UnixMilli() {
+			ms = append(ms, m)
+		}
+	}
+	ms = sortByCreation(ms)
+	if len(ms) > n {
+		ms = ms[:n]
+	}
+	for i, m := range ms {
+		m.NextAttempt = t.Add(lease).UnixMilli()
+		c := *m
+		ms[i] = &c
+	}
+	return ms, nil
+}
+
+func (s *MemoryStore) List(state string) ([]*Message, error) {
+	s.Lock()
+	defer s.Unlock()
+	ms := []*Message{}
+	for _, m := range s.messages {
+		if m.State == state {
+			c := *m
+			ms = append(ms, &c)
+		}
+	}
+	return sortByCreation(ms), nil
+}
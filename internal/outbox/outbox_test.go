@@ -0,0 +1,332 @@
+package outbox
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fairhive-labs/preregister/internal/crypto"
+	"github.com/fairhive-labs/preregister/internal/crypto/cipher"
+)
+
+const (
+	email = "john.doe@domain.com"
+	url   = "http://poln.org/activate/T0k3n"
+	hash  = "hA5h"
+)
+
+var ek, _ = cipher.GenerateKey(32)
+
+// flakyMailer fails the first emails, then records the emails sent
+type flakyMailer struct {
+	failures int
+	sent     []string
+	sync.Mutex
+}
+
+func (m *flakyMailer) send(s string) error {
+	m.Lock()
+	defer m.Unlock()
+	if m.failures > 0 {
+		m.failures--
+		return errors.New("smtp is down")
+	}
+	m.sent = append(m.sent, s)
+	return nil
+}
+
+func (m *flakyMailer) SendActivationEmail(e, u, h, l string) error {
+	return m.send("activation:" + e + ":" + u + ":" + h + ":" + l)
+}
+
+func (m *flakyMailer) SendConfirmationEmail(e, l string) error {
+	return m.send("confirmation:" + e + ":" + l)
+}
+
+func (m *flakyMailer) SendReminderEmail(e, u, h, l string) error {
+	return m.send("reminder:" + e + ":" + u + ":" + h + ":" + l)
+}
+
+func newStores(t *testing.T) map[string]Store {
+	fs, err := NewFileStore(filepath.Join(t.TempDir(), "outbox"))
+	if err != nil {
+		t.Fatalf("cannot create file store: %v", err)
+	}
+	return map[string]Store{
+		"memory": NewMemoryStore(),
+		"file":   fs,
+	}
+}
+
+func TestStores(t *testing.T) {
+	now := time.UnixMilli(1647952128425)
+	for n, s := range newStores(t) {
+		t.Run(n, func(t *testing.T) {
+			m1 := NewMessage(Activation, email, url, hash, "en", now)
+			m2 := NewMessage(Confirmation, email, "", "", "en", now.Add(time.Millisecond))
+			m2.NextAttempt = now.UnixMilli()
+			m3 := NewMessage(Activation, email, url, hash, "en", now.Add(2*time.Millisecond))
+			m3.NextAttempt = now.Add(time.Hour).UnixMilli()
+			for _, m := range []*Message{m1, m2, m3} {
+				if err := s.Put(m); err != nil {
+					t.Errorf("cannot put message: %v", err)
+					t.FailNow()
+				}
+			}
+
+			ms, err := s.Claim(now, time.Minute, 1)
+			if err != nil || len(ms) != 1 || ms[0].ID != m1.ID {
+				t.Errorf("incorrect claim, got %v (%v), want %s", ms, err, m1.ID)
+				t.FailNow()
+			}
+			ms, _ = s.Claim(now, time.Minute, 10)
+			if len(ms) != 1 || ms[0].ID != m2.ID {
+				t.Errorf("claimed and future messages should be skipped, got %v", ms)
+				t.FailNow()
+			}
+			if ms, _ = s.Claim(now.Add(time.Minute), time.Minute, 10); len(ms) != 2 {
+				t.Errorf("expired leases should be claimed again, got %d messages", len(ms))
+				t.FailNow()
+			}
+
+			m1.State = Dead
+			s.Put(m1)
+			if ms, _ := s.List(Dead); len(ms) != 1 || ms[0].ID != m1.ID {
+				t.Errorf("incorrect dead letters, got %v", ms)
+				t.FailNow()
+			}
+			if ms, _ := s.List(Pending); len(ms) != 2 || ms[0].ID != m2.ID {
+				t.Errorf("incorrect pending messages, got %v", ms)
+				t.FailNow()
+			}
+
+			if err := s.Delete(m1.ID); err != nil {
+				t.Errorf("cannot delete message: %v", err)
+				t.FailNow()
+			}
+			if _, err := s.Get(m1.ID); !errors.Is(err, ErrNotFound) {
+				t.Errorf("incorrect error, got %v, want %v", err, ErrNotFound)
+				t.FailNow()
+			}
+			if err := s.Delete(m1.ID); err != nil {
+				t.Errorf("deleting a missing message should not fail, got %v", err)
+				t.FailNow()
+			}
+			if m, err := s.Get(m2.ID); err != nil || m.Kind != Confirmation || m.To != email {
+				t.Errorf("incorrect message, got %v (%v)", m, err)
+			}
+		})
+	}
+}
+
+func TestOutbox(t *testing.T) {
+	for n, s := range newStores(t) {
+		t.Run(n, func(t *testing.T) {
+			now := time.UnixMilli(1647952128425)
+			m := &flakyMailer{failures: 2}
+			o := New(s, m, ek, 3, time.Minute, 4*time.Minute)
+			o.now = func() time.Time { return now }
+
+			if err := o.SendActivationEmail(email, url, hash, "fr"); err != nil {
+				t.Errorf("cannot queue email: %v", err)
+				t.FailNow()
+			}
+			drain := func(want int) {
+				if n, err := o.Drain(2); err != nil || n != want {
+					t.Errorf("incorrect drain, got %d messages (%v), want %d", n, err, want)
+					t.FailNow()
+				}
+			}
+			if ms, _ := s.List(Pending); len(ms) != 1 || ms[0].To == email || ms[0].URL == url {
+				t.Errorf("recipient and url should be encrypted in the store, got %v", ms)
+				t.FailNow()
+			}
+			drain(1) // fails
+			drain(0) // backoff
+			now = now.Add(time.Minute)
+			drain(1) // fails again
+			now = now.Add(time.Minute)
+			drain(0) // backoff doubled
+			now = now.Add(time.Minute)
+			drain(1)
+			if len(m.sent) != 1 || m.sent[0] != "activation:"+email+":"+url+":"+hash+":fr" {
+				t.Errorf("incorrect emails sent, got %v", m.sent)
+				t.FailNow()
+			}
+			if ms, _ := s.List(Pending); len(ms) != 0 {
+				t.Errorf("sent messages should be deleted, got %d", len(ms))
+				t.FailNow()
+			}
+
+			t.Run("dead letter", func(t *testing.T) {
+				m.failures = 3
+				o.SendConfirmationEmail(email, "fr")
+				for i := 0; i < 3; i++ {
+					drain(1)
+					now = now.Add(4 * time.Minute)
+				}
+				drain(0)
+				dl, _ := o.DeadLetters()
+				if len(dl) != 1 || dl[0].Attempts != 3 || dl[0].LastError != "smtp is down" || dl[0].To != email {
+					t.Errorf("incorrect dead letters, got %v", dl)
+					t.FailNow()
+				}
+
+				if _, err := o.Replay(dl[0].ID); err != nil {
+					t.Errorf("cannot replay message: %v", err)
+					t.FailNow()
+				}
+				drain(1)
+				if len(m.sent) != 2 || m.sent[1] != "confirmation:"+email+":fr" {
+					t.Errorf("incorrect emails sent, got %v", m.sent)
+					t.FailNow()
+				}
+				if dl, _ := o.DeadLetters(); len(dl) != 0 {
+					t.Errorf("replayed message should be sent, got %v", dl)
+					t.FailNow()
+				}
+				if _, err := o.Replay(dl[0].ID); !errors.Is(err, ErrNotFound) {
+					t.Errorf("incorrect error, got %v, want %v", err, ErrNotFound)
+				}
+			})
+			t.Run("expired dead letter", func(t *testing.T) {
+				m.failures = 3
+				o.SendConfirmationEmail(email, "fr")
+				for i := 0; i < 3; i++ {
+					drain(1)
+					now = now.Add(4 * time.Minute)
+				}
+				dl, _ := o.DeadLetters()
+				if len(dl) != 1 || dl[0].ExpiresAt != now.Add(-4*time.Minute).Add(7*24*time.Hour).Unix() {
+					t.Errorf("incorrect dead letters, got %v", dl)
+					t.FailNow()
+				}
+				if n, err := o.Purge(); err != nil || n != 0 {
+					t.Errorf("dead letters should be kept a week, got %d (%v)", n, err)
+					t.FailNow()
+				}
+				now = now.Add(7 * 24 * time.Hour)
+				if dl, _ := o.DeadLetters(); len(dl) != 0 {
+					t.Errorf("expired dead letters should not be listed, got %v", dl)
+					t.FailNow()
+				}
+				if _, err := o.Replay(dl[0].ID); !errors.Is(err, ErrNotFound) {
+					t.Errorf("incorrect error, got %v, want %v", err, ErrNotFound)
+				}
+				if n, err := o.Purge(); err != nil || n != 1 {
+					t.Errorf("incorrect purge, got %d (%v), want 1", n, err)
+				}
+			})
+			t.Run("not dead", func(t *testing.T) {
+				msg := NewMessage(Confirmation, email, "", "", "en", now.Add(time.Hour))
+				s.Put(msg)
+				if _, err := o.Replay(msg.ID); !errors.Is(err, ErrNotDead) {
+					t.Errorf("incorrect error, got %v, want %v", err, ErrNotDead)
+				}
+			})
+		})
+	}
+}
+
+func TestRun(t *testing.T) {
+	m := &flakyMailer{}
+	o := New(NewMemoryStore(), m, ek, 3, time.Minute, time.Hour)
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		o.Run(2, time.Hour, stop)
+		close(done)
+	}()
+	o.SendActivationEmail(email, url, hash, "fr")
+	for i := 0; i < 100; i++ {
+		m.Lock()
+		n := len(m.sent)
+		m.Unlock()
+		if n == 1 {
+			close(stop)
+			<-done
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Errorf("queued messages should be sent as soon as possible")
+}
+
+func TestDelay(t *testing.T) {
+	o := New(NewMemoryStore(), &flakyMailer{}, ek, 10, 30*time.Second, 5*time.Minute)
+	for attempts, d := range map[int]time.Duration{1: 30 * time.Second, 2: time.Minute, 3: 2 * time.Minute, 5: 5 * time.Minute, 50: 5 * time.Minute} {
+		if got := o.delay(attempts); got != d {
+			t.Errorf("incorrect delay after %d attempts, got %v, want %v", attempts, got, d)
+		}
+	}
+}
+
+func TestUndecryptable(t *testing.T) {
+	s := NewMemoryStore()
+	m := &flakyMailer{}
+	o := New(s, m, ek, 1, time.Minute, time.Hour)
+	o.SendActivationEmail(email, url, hash, "fr")
+	other, _ := cipher.GenerateKey(32)
+	o.ek = other // rotated without migration
+	o.Drain(1)
+	if ms, _ := s.List(Dead); len(m.sent) != 0 || len(ms) != 1 || ms[0].LastError == "" {
+		t.Errorf("undecryptable messages should not be sent, got %v %v", m.sent, ms)
+	}
+}
+
+func TestNewStores(t *testing.T) {
+	if _, err := NewDynamoDBStore(""); err != ErrNoTableName {
+		t.Errorf("incorrect error, got %v, want %v", err, ErrNoTableName)
+	}
+	if _, err := NewDynamoDBStore("Outbox"); err != nil {
+		t.Errorf("incorrect error, got %v, want nil", err)
+	}
+	if _, err := NewFileStore(""); err != ErrNoDirectory {
+		t.Errorf("incorrect error, got %v, want %v", err, ErrNoDirectory)
+	}
+	f := filepath.Join(t.TempDir(), "file")
+	os.WriteFile(f, nil, 0600)
+	if _, err := NewFileStore(f); err == nil {
+		t.Errorf("incorrect error, should not be nil")
+	}
+}
+
+func TestReminder(t *testing.T) {
+	m := &flakyMailer{}
+	o := New(NewMemoryStore(), m, ek, 3, time.Minute, time.Hour)
+	o.SendReminderEmail(email, url, hash, "fr")
+	if n, err := o.Drain(1); err != nil || n != 1 || len(m.sent) != 1 || m.sent[0] != "reminder:"+email+":"+url+":"+hash+":fr" {
+		t.Errorf("incorrect reminder, got %v (%v)", m.sent, err)
+	}
+}
+
+func TestExpiredLink(t *testing.T) {
+	now := time.UnixMilli(1647952128425)
+	s := NewMemoryStore()
+	m := &flakyMailer{failures: 8}
+	o := New(s, m, ek, 8, 30*time.Second, time.Hour)
+	o.now = func() time.Time { return now }
+
+	o.SendActivationEmail(email, url, hash, "fr")
+	o.Drain(1) // fails
+	now = now.Add(crypto.ActivationTTL)
+	o.Drain(1)
+	dl, _ := o.DeadLetters()
+	if len(dl) != 1 || dl[0].Attempts != 2 || dl[0].LastError != ErrLinkExpired.Error() || len(m.sent) != 0 || m.failures != 7 {
+		t.Errorf("expired activation links should not be sent, got %v %v", dl, m.sent)
+		t.FailNow()
+	}
+	if _, err := o.Replay(dl[0].ID); !errors.Is(err, ErrLinkExpired) {
+		t.Errorf("incorrect error, got %v, want %v", err, ErrLinkExpired)
+	}
+
+	m.failures = 0
+	o.SendReminderEmail(email, url, hash, "fr")
+	now = now.Add(crypto.ReminderTTL - time.Minute)
+	if n, _ := o.Drain(1); n != 1 || len(m.sent) != 1 {
+		t.Errorf("reminder links should be valid longer, got %v", m.sent)
+	}
+}
@@ -0,0 +1,209 @@
+package pending
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+)
+
+// DynamoDBStore keeps registrations in a DynamoDB table (partition key "address"), it can be shared between dynos.
+// The table needs the dueIndex, monthIndex and emailIndex global secondary indexes, and a TTL on expires_at to delete the expired registrations.
+type DynamoDBStore struct {
+	tn string
+}
+
+func NewDynamoDBStore(tn string) (*DynamoDBStore, error) {
+	if tn == "" {
+		return nil, ErrNoTableName
+	}
+	return &DynamoDBStore{tn}, nil
+}
+
+func key(address string) map[string]*dynamodb.AttributeValue {
+	return map[string]*dynamodb.AttributeValue{
+		"address": {S: aws.String(address)},
+	}
+}
+
+func (s *DynamoDBStore) Put(r *Registration) error {
+	sess := session.Must(session.NewSession())
+	svc := dynamodb.New(sess)
+	av, err := dynamodbattribute.MarshalMap(*r)
+	if err != nil {
+		return err
+	}
+	_, err = svc.PutItem(&dynamodb.PutItemInput{
+		Item:                av,
+		TableName:           aws.String(s.tn),
+		ConditionExpression: aws.String("attribute_not_exists(activated_at)"),
+	})
+	var aerr awserr.Error
+	if errors.As(err, &aerr) && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+		return ErrActivated
+	}
+	return err
+}
+
+func (s *DynamoDBStore) Get(address string) (*Registration, error) {
+	sess := session.Must(session.NewSession())
+	svc := dynamodb.New(sess)
+	r, err := svc.GetItem(&dynamodb.GetItemInput{
+		TableName:      aws.String(s.tn),
+		Key:            key(address),
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if r.Item == nil {
+		return nil, ErrNotFound
+	}
+	reg := &Registration{}
+	if err := dynamodbattribute.UnmarshalMap(r.Item, reg); err != nil {
+		return nil, fmt.Errorf("cannot read registration: %w", err)
+	}
+	return reg, nil
+}
+
+func (s *DynamoDBStore) Delete(address string) error {
+	sess := session.Must(session.NewSession())
+	svc := dynamodb.New(sess)
+	_, err := svc.DeleteItem(&dynamodb.DeleteItemInput{
+		TableName: aws.String(s.tn),
+		Key:       key(address),
+	})
+	return err
+}
+
+// global secondary indexes of the table, on created_at (sort key)
+const (
+	dueIndex   = "due_created_at"   // partition key "due", only the registrations neither reminded nor activated
+	monthIndex = "month_created_at" // partition key "month"
+	emailIndex = "email_index"      // partition key "email_index"
+)
+
+// query returns the registrations of the index matching the key condition, the partition key is named #p
+func (s *DynamoDBStore) query(index, partition, condition string, values map[string]*dynamodb.AttributeValue) ([]*Registration, error) {
+	sess := session.Must(session.NewSession())
+	svc := dynamodb.New(sess)
+
+	input := &dynamodb.QueryInput{
+		TableName:                 aws.String(s.tn),
+		IndexName:                 aws.String(index),
+		KeyConditionExpression:    aws.String(condition),
+		ExpressionAttributeNames:  map[string]*string{"#p": aws.String(partition)},
+		ExpressionAttributeValues: values,
+	}
+	rs := []*Registration{}
+	for {
+		result, err := svc.Query(input)
+		if err != nil {
+			return nil, err
+		}
+		for _, i := range result.Items {
+			r := &Registration{}
+			if err := dynamodbattribute.UnmarshalMap(i, r); err != nil {
+				return nil, fmt.Errorf("cannot read registration: %w", err)
+			}
+			rs = append(rs, r)
+		}
+		// pagination
+		input.ExclusiveStartKey = result.LastEvaluatedKey
+		if result.LastEvaluatedKey == nil {
+			return rs, nil
+		}
+	}
+}
+
+func millis(t int64) *dynamodb.AttributeValue {
+	return &dynamodb.AttributeValue{N: aws.String(strconv.FormatInt(t, 10))}
+}
+
+func (s *DynamoDBStore) Due(before int64) ([]*Registration, error) {
+	return s.query(dueIndex, "due", "#p = :due AND created_at <= :before", map[string]*dynamodb.AttributeValue{
+		":due":    {S: aws.String(due)},
+		":before": millis(before),
+	})
+}
+
+func (s *DynamoDBStore) FindEmail(index string) ([]*Registration, error) {
+	rs, err := s.query(emailIndex, "email_index", "#p = :ei", map[string]*dynamodb.AttributeValue{
+		":ei": {S: aws.String(index)},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return sortByCreation(rs), nil
+}
+
+// months returns the UTC months between since and until, see monthLayout
+func months(since, until time.Time) []string {
+	ms := []string{}
+	since, until = since.UTC(), until.UTC()
+	for m := time.Date(since.Year(), since.Month(), 1, 0, 0, 0, 0, time.UTC); !m.After(until); m = m.AddDate(0, 1, 0) {
+		ms = append(ms, m.Format(monthLayout))
+	}
+	return ms
+}
+
+// Created queries the registrations month by month
+func (s *DynamoDBStore) Created(since, until time.Time) ([]*Registration, error) {
+	rs := []*Registration{}
+	for _, m := range months(since, until) {
+		mrs, err := s.query(monthIndex, "month", "#p = :month AND created_at BETWEEN :since AND :until", map[string]*dynamodb.AttributeValue{
+			":month": {S: aws.String(m)},
+			":since": millis(since.UnixMilli()),
+			":until": millis(until.UnixMilli()),
+		})
+		if err != nil {
+			return nil, err
+		}
+		rs = append(rs, mrs...)
+	}
+	return rs, nil
+}
+
+// Expire deletes nothing, DynamoDB deletes the expired registrations with the TTL on expires_at
+func (s *DynamoDBStore) Expire(t time.Time) (int, error) {
+	return 0, nil
+}
+
+// update sets the attribute to t and removes due if the condition holds, a failed condition is reported as ErrClaimed
+func (s *DynamoDBStore) update(address, attribute, condition string, t time.Time) error {
+	sess := session.Must(session.NewSession())
+	svc := dynamodb.New(sess)
+	_, err := svc.UpdateItem(&dynamodb.UpdateItemInput{
+		TableName:                aws.String(s.tn),
+		Key:                      key(address),
+		UpdateExpression:         aws.String("SET " + attribute + " = :t REMOVE #d"),
+		ConditionExpression:      aws.String(condition),
+		ExpressionAttributeNames: map[string]*string{"#d": aws.String("due")},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":t": millis(t.UnixMilli()),
+		},
+	})
+	var aerr awserr.Error
+	if errors.As(err, &aerr) && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+		return ErrClaimed
+	}
+	return err
+}
+
+// Remind is a conditional update, a registration reminded by another dyno is not reminded again
+func (s *DynamoDBStore) Remind(address string, t time.Time) error {
+	return s.update(address, "reminded_at", "attribute_exists(address) AND attribute_not_exists(reminded_at) AND attribute_not_exists(activated_at)", t)
+}
+
+func (s *DynamoDBStore) Activate(address string, t time.Time) error {
+	if err := s.update(address, "activated_at", "attribute_exists(address)", t); err != ErrClaimed {
+		return err
+	}
+	return ErrNotFound
+}
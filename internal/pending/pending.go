@@ -0,0 +1,379 @@
+package pending
+
+import (
+	"errors"
+	"expvar"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/fairhive-labs/preregister/internal/crypto/cipher"
+	"github.com/fairhive-labs/preregister/internal/data"
+)
+
+// pending registrations metrics, published with expvar
+var (
+	pendingRegistrations = expvar.NewMap("pending")
+)
+
+var (
+	ErrNotFound    = errors.New("registration not found")
+	ErrClaimed     = errors.New("registration already reminded or activated")
+	ErrActivated   = errors.New("registration already activated")
+	ErrNoTableName = errors.New("cannot create DynamoDB pending registrations: no table name")
+)
+
+// due marks the registrations neither reminded nor activated, it is removed once they are
+const due = "1"
+
+// monthLayout is the creation month of the registrations, to query them by creation time
+const monthLayout = "2006-01"
+
+// Registration is a registration waiting for its activation, its email is encrypted with the address as additional data
+// and found by its blind index
+type Registration struct {
+	Address     string `json:"address"`
+	Email       string `json:"email"`
+	EmailIndex  string `json:"email_index"`
+	Type        string `json:"type"`
+	Sponsor     string `json:"sponsor"`
+	Locale      string `json:"locale,omitempty"`
+	CreatedAt   int64  `json:"created_at"`             // milliseconds
+	RemindedAt  int64  `json:"reminded_at,omitempty"`  // milliseconds
+	ActivatedAt int64  `json:"activated_at,omitempty"` // milliseconds
+	Due         string `json:"due,omitempty"`          // set until reminded or activated
+	Month       string `json:"month"`                  // UTC creation month, see monthLayout
+	ExpiresAt   int64  `json:"expires_at,omitempty"`   // seconds, deleted after it (DynamoDB TTL)
+}
+
+// expired tells if the registration is expired at t, but not deleted yet
+func (r *Registration) expired(t time.Time) bool {
+	return r.ExpiresAt != 0 && r.ExpiresAt <= t.Unix()
+}
+
+// Store persists the registrations, by address
+type Store interface {
+	// Put replaces the registration of the address, it fails with ErrActivated if the registration is activated
+	Put(r *Registration) error
+	Get(address string) (*Registration, error)
+	Delete(address string) error
+	// FindEmail returns the registrations of the blind index of an email
+	FindEmail(index string) ([]*Registration, error)
+	// Due returns the registrations neither reminded nor activated, created before the time in milliseconds
+	Due(before int64) ([]*Registration, error)
+	// Created returns the registrations created between since and until
+	Created(since, until time.Time) ([]*Registration, error)
+	// Expire deletes the registrations expired at t and returns how many have been deleted
+	Expire(t time.Time) (int, error)
+	// Remind marks the registration as reminded at t, it fails with ErrClaimed if it is already reminded or activated
+	Remind(address string, t time.Time) error
+	// Activate marks the registration as activated at t
+	Activate(address string, t time.Time) error
+}
+
+// Funnel is the conversion of the registrations into activations
+type Funnel struct {
+	Registered             int     `json:"registered"`
+	Reminded               int     `json:"reminded"`
+	Activated              int     `json:"activated"`
+	ActivatedAfterReminder int     `json:"activated_after_reminder"`
+	Pending                int     `json:"pending"`
+	ConversionRate         float64 `json:"conversion_rate"`          // activated / registered
+	ReminderConversionRate float64 `json:"reminder_conversion_rate"` // activated after reminder / reminded
+}
+
+// Tracker follows the registrations until their activation
+type Tracker struct {
+	s         Store
+	ek        string
+	delay     time.Duration // before the reminder
+	retention time.Duration
+	now       func() time.Time
+}
+
+func New(s Store, ek string, delay, retention time.Duration) *Tracker {
+	return &Tracker{
+		s:         s,
+		ek:        ek,
+		delay:     delay,
+		retention: retention,
+		now:       time.Now,
+	}
+}
+
+// Register stores the registration of u, replacing the previous registration of its address unless it is activated
+func (t *Tracker) Register(u *data.User) error {
+	e, err := cipher.EncryptWithAD(u.Email, t.ek, u.Address)
+	if err != nil {
+		return err
+	}
+	ei, err := cipher.BlindIndex(data.NormalizeEmail(u.Email), t.ek)
+	if err != nil {
+		return err
+	}
+	now := t.now()
+	err = t.s.Put(&Registration{
+		Address:    u.Address,
+		Email:      e,
+		EmailIndex: ei,
+		Type:       u.Type,
+		Sponsor:    u.Sponsor,
+		Locale:     u.Locale,
+		CreatedAt:  now.UnixMilli(),
+		Due:        due,
+		Month:      now.UTC().Format(monthLayout),
+		ExpiresAt:  now.Add(t.retention).Unix(),
+	})
+	if err == nil {
+		pendingRegistrations.Add("registered", 1)
+	}
+	return err
+}
+
+// Activate marks the registration of the address as activated, registrations which are not tracked are ignored
+func (t *Tracker) Activate(address string) error {
+	err := t.s.Activate(address, t.now())
+	if errors.Is(err, ErrNotFound) {
+		return nil
+	}
+	if err == nil {
+		pendingRegistrations.Add("activated", 1)
+	}
+	return err
+}
+
+// Due claims the registrations which are not activated after the delay and returns their users, to be reminded once
+func (t *Tracker) Due() ([]*data.User, error) {
+	now := t.now()
+	rs, err := t.s.Due(now.Add(-t.delay).UnixMilli())
+	if err != nil {
+		return nil, err
+	}
+	us := []*data.User{}
+	for _, r := range rs {
+		if r.expired(now) {
+			continue
+		}
+		err := t.s.Remind(r.Address, now)
+		if errors.Is(err, ErrClaimed) || errors.Is(err, ErrNotFound) {
+			continue // claimed by another dyno
+		}
+		if err != nil {
+			return us, err
+		}
+		e, err := cipher.DecryptWithAD(r.Email, t.ek, r.Address)
+		if err != nil {
+			return us, err
+		}
+		u := data.NewUser(r.Address, e, r.Type, r.Sponsor)
+		u.Locale = r.Locale
+		us = append(us, u)
+		pendingRegistrations.Add("reminded", 1)
+	}
+	return us, nil
+}
+
+// Find returns the user of the registration not activated yet, by address if any, else by email.
+// When both are set, the email must match the registration of the address.
+func (t *Tracker) Find(address, email string) (*data.User, error) {
+	var rs []*Registration
+	if address != "" {
+		r, err := t.s.Get(address)
+		if err != nil {
+			return nil, err
+		}
+		rs = []*Registration{r}
+	} else {
+		ei, err := cipher.BlindIndex(data.NormalizeEmail(email), t.ek)
+		if err != nil {
+			return nil, err
+		}
+		if rs, err = t.s.FindEmail(ei); err != nil {
+			return nil, err
+		}
+	}
+	for _, r := range rs {
+		if r.ActivatedAt != 0 {
+			continue
+		}
+		e, err := cipher.DecryptWithAD(r.Email, t.ek, r.Address)
+		if err != nil {
+			return nil, err
+		}
+		if email != "" && data.NormalizeEmail(e) != data.NormalizeEmail(email) {
+			continue
+		}
+		u := data.NewUser(r.Address, e, r.Type, r.Sponsor)
+		u.Locale = r.Locale
+		return u, nil
+	}
+	return nil, ErrNotFound
+}
+
+// Purge deletes the registrations older than the retention and returns how many have been deleted
+func (t *Tracker) Purge() (int, error) {
+	n, err := t.s.Expire(t.now())
+	pendingRegistrations.Add("purged", int64(n))
+	return n, err
+}
+
+// Funnel returns the conversion of the registrations created since t, within the retention
+func (t *Tracker) Funnel(since time.Time) (*Funnel, error) {
+	now := t.now()
+	if oldest := now.Add(-t.retention); since.Before(oldest) {
+		since = oldest
+	}
+	rs, err := t.s.Created(since, now)
+	if err != nil {
+		return nil, err
+	}
+	f := &Funnel{}
+	for _, r := range rs {
+		if r.expired(now) {
+			continue
+		}
+		f.Registered++
+		if r.RemindedAt != 0 {
+			f.Reminded++
+		}
+		switch {
+		case r.ActivatedAt == 0:
+			f.Pending++
+		case r.RemindedAt != 0 && r.ActivatedAt >= r.RemindedAt:
+			f.ActivatedAfterReminder++
+			fallthrough
+		default:
+			f.Activated++
+		}
+	}
+	if f.Registered > 0 {
+		f.ConversionRate = float64(f.Activated) / float64(f.Registered)
+	}
+	if f.Reminded > 0 {
+		f.ReminderConversionRate = float64(f.ActivatedAfterReminder) / float64(f.Reminded)
+	}
+	return f, nil
+}
+
+func sortByCreation(rs []*Registration) []*Registration {
+	sort.Slice(rs, func(i, j int) bool {
+		return rs[i].CreatedAt < rs[j].CreatedAt
+	})
+	return rs
+}
+
+// MemoryStore keeps registrations in memory, for development and tests
+type MemoryStore struct {
+	registrations map[string]*Registration
+	sync.Mutex
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{registrations: map[string]*Registration{}}
+}
+
+func (s *MemoryStore) Put(r *Registration) error {
+	s.Lock()
+	defer s.Unlock()
+	if p, ok := s.registrations[r.Address]; ok && p.ActivatedAt != 0 {
+		return ErrActivated
+	}
+	c := *r
+	s.registrations[r.Address] = &c
+	return nil
+}
+
+func (s *MemoryStore) Get(address string) (*Registration, error) {
+	s.Lock()
+	defer s.Unlock()
+	r, ok := s.registrations[address]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	c := *r
+	return &c, nil
+}
+
+func (s *MemoryStore) Delete(address string) error {
+	s.Lock()
+	defer s.Unlock()
+	delete(s.registrations, address)
+	return nil
+}
+
+func (s *MemoryStore) FindEmail(index string) ([]*Registration, error) {
+	s.Lock()
+	defer s.Unlock()
+	rs := []*Registration{}
+	for _, r := range s.registrations {
+		if r.EmailIndex == index {
+			c := *r
+			rs = append(rs, &c)
+		}
+	}
+	return sortByCreation(rs), nil
+}
+
+func (s *MemoryStore) Due(before int64) ([]*Registration, error) {
+	s.Lock()
+	defer s.Unlock()
+	rs := []*Registration{}
+	for _, r := range s.registrations {
+		if r.Due != "" && r.CreatedAt <= before {
+			c := *r
+			rs = append(rs, &c)
+		}
+	}
+	return sortByCreation(rs), nil
+}
+
+func (s *MemoryStore) Created(since, until time.Time) ([]*Registration, error) {
+	s.Lock()
+	defer s.Unlock()
+	rs := []*Registration{}
+	for _, r := range s.registrations {
+		if r.CreatedAt >= since.UnixMilli() && r.CreatedAt <= until.UnixMilli() {
+			c := *r
+			rs = append(rs, &c)
+		}
+	}
+	return sortByCreation(rs), nil
+}
+
+func (s *MemoryStore) Expire(t time.Time) (int, error) {
+	s.Lock()
+	defer s.Unlock()
+	n := 0
+	for a, r := range s.registrations {
+		if r.expired(t) {
+			delete(s.registrations, a)
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (s *MemoryStore) Remind(address string, t time.Time) error {
+	s.Lock()
+	defer s.Unlock()
+	r, ok := s.registrations[address]
+	if !ok {
+		return ErrNotFound
+	}
+	if r.RemindedAt != 0 || r.ActivatedAt != 0 {
+		return ErrClaimed
+	}
+	r.RemindedAt, r.Due = t.UnixMilli(), ""
+	return nil
+}
+
+func (s *MemoryStore) Activate(address string, t time.Time) error {
+	s.Lock()
+	defer s.Unlock()
+	r, ok := s.registrations[address]
+	if !ok {
+		return ErrNotFound
+	}
+	r.ActivatedAt, r.Due = t.UnixMilli(), ""
+	return nil
+}
@@ -0,0 +1,194 @@
+package pending
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/fairhive-labs/preregister/internal/crypto/cipher"
+	"github.com/fairhive-labs/preregister/internal/data"
+)
+
+const (
+	address = "0x8ba1f109551bD432803012645Ac136ddd64DBA72"
+	sponsor = "0xD01efFE216E16a85Fc529db66c26aBeCf4D885f8"
+	email   = "john.doe@domain.com"
+)
+
+func TestMemoryStore(t *testing.T) {
+	s := NewMemoryStore()
+	now := time.UnixMilli(1647952128425)
+	s.Put(&Registration{Address: address, Email: "3ncrypt3d", CreatedAt: now.UnixMilli()})
+	s.Put(&Registration{Address: sponsor, Email: "3ncrypt3d", CreatedAt: now.Add(-time.Hour).UnixMilli()})
+
+	if rs, _ := s.Created(now.Add(-2*time.Hour), now); len(rs) != 2 || rs[0].Address != sponsor {
+		t.Errorf("incorrect registrations, got %v", rs)
+		t.FailNow()
+	}
+	if err := s.Remind(address, now); err != nil {
+		t.Errorf("cannot remind: %v", err)
+		t.FailNow()
+	}
+	if err := s.Remind(address, now); !errors.Is(err, ErrClaimed) {
+		t.Errorf("incorrect error, got %v, want %v", err, ErrClaimed)
+	}
+	s.Activate(sponsor, now)
+	if err := s.Remind(sponsor, now); !errors.Is(err, ErrClaimed) {
+		t.Errorf("activated registrations cannot be reminded, got %v", err)
+	}
+	if err := s.Put(&Registration{Address: sponsor, Email: "0th3r", CreatedAt: now.UnixMilli()}); !errors.Is(err, ErrActivated) {
+		t.Errorf("activated registrations cannot be replaced, got %v", err)
+	}
+	if r, _ := s.Get(sponsor); r.ActivatedAt != now.UnixMilli() || r.Email != "3ncrypt3d" {
+		t.Errorf("incorrect registration, got %v", r)
+	}
+	for _, err := range []error{s.Remind("0x0", now), s.Activate("0x0", now)} {
+		if !errors.Is(err, ErrNotFound) {
+			t.Errorf("incorrect error, got %v, want %v", err, ErrNotFound)
+		}
+	}
+	if r, err := s.Get(address); err != nil || r.RemindedAt != now.UnixMilli() {
+		t.Errorf("incorrect registration, got %v (%v)", r, err)
+	}
+	s.Delete(address)
+	if _, err := s.Get(address); !errors.Is(err, ErrNotFound) {
+		t.Errorf("incorrect error, got %v, want %v", err, ErrNotFound)
+	}
+}
+
+func TestTracker(t *testing.T) {
+	k, _ := cipher.GenerateKey(32)
+	s := NewMemoryStore()
+	tr := New(s, k, 24*time.Hour, 30*24*time.Hour)
+	now := time.UnixMilli(1647952128425)
+	tr.now = func() time.Time { return now }
+
+	u := data.NewUser(address, email, "mentor", sponsor)
+	u.Locale = "fr"
+	if err := tr.Register(u); err != nil {
+		t.Errorf("cannot register: %v", err)
+		t.FailNow()
+	}
+	if r, _ := s.Get(address); r == nil || r.Email == email || r.Locale != "fr" {
+		t.Errorf("email should be encrypted, got %v", r)
+		t.FailNow()
+	}
+	if r, _ := s.Get(address); r.Due != due || r.Month != "2022-03" || r.EmailIndex == "" || r.EmailIndex == email || r.ExpiresAt != now.Add(30*24*time.Hour).Unix() {
+		t.Errorf("incorrect keys, got %+v", r)
+		t.FailNow()
+	}
+	s2 := data.NewUser(sponsor, "jane.doe@domain.com", "agent", address)
+	tr.Register(s2)
+
+	if us, _ := tr.Due(); len(us) != 0 {
+		t.Errorf("registrations should not be reminded before the delay, got %v", us)
+		t.FailNow()
+	}
+	now = now.Add(12 * time.Hour)
+	tr.Activate(sponsor)
+	if err := tr.Activate("0x0"); err != nil {
+		t.Errorf("untracked registrations should be ignored, got %v", err)
+	}
+
+	now = now.Add(12 * time.Hour)
+	us, err := tr.Due()
+	if err != nil || len(us) != 1 || us[0].Address != address || us[0].Email != email || us[0].Locale != "fr" || us[0].Sponsor != sponsor {
+		t.Errorf("incorrect reminders, got %v (%v)", us, err)
+		t.FailNow()
+	}
+	if us, _ := tr.Due(); len(us) != 0 {
+		t.Errorf("registrations should be reminded once, got %v", us)
+		t.FailNow()
+	}
+	if rs, _ := s.Due(now.UnixMilli()); len(rs) != 0 {
+		t.Errorf("reminded and activated registrations should not be due, got %v", rs)
+		t.FailNow()
+	}
+
+	f, _ := tr.Funnel(time.Time{})
+	want := Funnel{Registered: 2, Reminded: 1, Activated: 1, Pending: 1, ConversionRate: 0.5}
+	if *f != want {
+		t.Errorf("incorrect funnel, got %+v, want %+v", *f, want)
+	}
+	now = now.Add(time.Hour)
+	tr.Activate(address)
+	f, _ = tr.Funnel(time.Time{})
+	want = Funnel{Registered: 2, Reminded: 1, Activated: 2, ActivatedAfterReminder: 1, ConversionRate: 1, ReminderConversionRate: 1}
+	if *f != want {
+		t.Errorf("incorrect funnel, got %+v, want %+v", *f, want)
+	}
+	if f, _ = tr.Funnel(now); f.Registered != 0 || f.ConversionRate != 0 {
+		t.Errorf("incorrect funnel since now, got %+v", *f)
+	}
+
+	now = now.Add(30 * 24 * time.Hour)
+	if f, _ = tr.Funnel(time.Time{}); f.Registered != 0 {
+		t.Errorf("expired registrations should not be counted, got %+v", *f)
+	}
+	if n, err := tr.Purge(); err != nil || n != 2 {
+		t.Errorf("incorrect purge, got %d (%v), want 2", n, err)
+	}
+}
+
+func TestFind(t *testing.T) {
+	k, _ := cipher.GenerateKey(32)
+	s := NewMemoryStore()
+	tr := New(s, k, 24*time.Hour, 30*24*time.Hour)
+	u := data.NewUser(address, email, "mentor", sponsor)
+	u.Locale = "fr"
+	tr.Register(u)
+	tr.Register(data.NewUser(sponsor, "jane.doe@domain.com", "agent", address))
+
+	tt := []struct {
+		name, address, email, want string
+	}{
+		{"address", address, "", address},
+		{"email", "", "John.Doe@Domain.com", address},
+		{"address and email", sponsor, "jane.doe@domain.com", sponsor},
+		{"email mismatch", address, "jane.doe@domain.com", ""},
+		{"unknown address", "0x0", "", ""},
+		{"unknown email", "", "joe@domain.com", ""},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			u, err := tr.Find(tc.address, tc.email)
+			if tc.want == "" {
+				if !errors.Is(err, ErrNotFound) {
+					t.Errorf("incorrect error, got %v, want %v", err, ErrNotFound)
+				}
+				return
+			}
+			if err != nil || u.Address != tc.want {
+				t.Errorf("incorrect user, got %v (%v), want %s", u, err, tc.want)
+			}
+		})
+	}
+
+	if u, _ := tr.Find(address, ""); u.Email != email || u.Locale != "fr" || u.Type != "mentor" {
+		t.Errorf("incorrect user, got %+v", u)
+	}
+	tr.Activate(address)
+	if _, err := tr.Find("", email); !errors.Is(err, ErrNotFound) {
+		t.Errorf("activated registrations should not be found, got %v", err)
+	}
+}
+
+func TestMonths(t *testing.T) {
+	since := time.Date(2022, 11, 30, 23, 0, 0, 0, time.FixedZone("", -2*3600)) // December in UTC
+	if ms := months(since, since.Add(62*24*time.Hour)); fmt.Sprint(ms) != "[2022-12 2023-01 2023-02]" {
+		t.Errorf("incorrect months, got %v", ms)
+	}
+	if ms := months(since, since); fmt.Sprint(ms) != "[2022-12]" {
+		t.Errorf("incorrect months, got %v", ms)
+	}
+}
+
+func TestNewDynamoDBStore(t *testing.T) {
+	if _, err := NewDynamoDBStore(""); err != ErrNoTableName {
+		t.Errorf("incorrect error, got %v, want %v", err, ErrNoTableName)
+	}
+	if _, err := NewDynamoDBStore("Pending"); err != nil {
+		t.Errorf("incorrect error, got %v, want nil", err)
+	}
+}